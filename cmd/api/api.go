@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"go-stripe/internal/cards"
 	"go-stripe/internal/driver"
 	"go-stripe/internal/models"
 	"log"
@@ -22,8 +24,10 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret        string
+		key           string
+		gateway       string
+		webhookSecret string
 	}
 	smtp struct {
 		host     string
@@ -31,8 +35,12 @@ type config struct {
 		username string
 		password string
 	}
+	dunning struct {
+		schedule models.DunningSchedule
+	}
 	secretKey string
 	frontend  string
+	invoice   string
 }
 
 type application struct {
@@ -40,6 +48,7 @@ type application struct {
 	logger  *zap.SugaredLogger
 	version string
 	DB      models.DBModel
+	gateway cards.PaymentGateway
 }
 
 // serve application
@@ -82,6 +91,8 @@ func main() {
 	cfg.db.dsn = os.Getenv("DSN")
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.gateway = os.Getenv("PAYMENT_GATEWAY")
+	cfg.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
 
 	cfg.smtp.host = os.Getenv("SMTP_HOST")
 	smtpPort, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
@@ -92,9 +103,23 @@ func main() {
 	cfg.smtp.username = os.Getenv("SMTP_USERNAME")
 	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
 
+	schedule, err := models.ParseDunningSchedule(os.Getenv("DUNNING_SCHEDULE"))
+	if err != nil {
+		logger.Fatal("unable to get dunning schedule from env vars: ", err)
+	}
+	cfg.dunning.schedule = schedule
+
 	cfg.secretKey = os.Getenv("SECRET_KEY")
 	cfg.frontend = os.Getenv("FRONTEND_URL") + ":" + os.Getenv("FRONTEND_PORT")
 
+	// invoice microservice, the flag overrides INVOICE_URL and INVOICE_PORT
+	invoiceURL := "http://localhost:4002"
+	if os.Getenv("INVOICE_URL") != "" {
+		invoiceURL = os.Getenv("INVOICE_URL") + ":" + os.Getenv("INVOICE_PORT")
+	}
+	flag.StringVar(&cfg.invoice, "invoice", invoiceURL, "url of the invoice microservice")
+	flag.Parse()
+
 	// establish database connection
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
@@ -102,14 +127,44 @@ func main() {
 	}
 	defer conn.Close()
 
+	// initialize payment gateway, the fake keeps its objects in the database so the api and the
+	// website see the same ones
+	gateway, err := cards.NewGateway(cfg.stripe.gateway, cfg.stripe.secret, &models.DBModel{DB: conn})
+	if err != nil {
+		logger.Fatal("unable to initialize payment gateway: ", err)
+	}
+
 	// initialize application
 	app := &application{
 		config:  cfg,
 		logger:  logger,
 		version: version,
 		DB:      models.DBModel{DB: conn},
+		gateway: gateway,
 	}
 
+	// the fake gateway needs plan prices to prorate plan changes
+	if fake, ok := gateway.(*cards.SharedFakeGateway); ok {
+		plans, err := app.DB.GetPlans()
+		if err != nil {
+			logger.Fatal("unable to load plans: ", err)
+		}
+		for _, p := range plans {
+			if err = fake.SetPrice(p.PlanID, p.Price.Amount()); err != nil {
+				logger.Fatal("unable to set plan prices: ", err)
+			}
+			for _, price := range p.Prices {
+				if err = fake.SetCurrencyPrice(p.PlanID, price.Currency(), price.Amount()); err != nil {
+					logger.Fatal("unable to set plan prices: ", err)
+				}
+			}
+		}
+	}
+
+	go app.expireReservations(time.Minute)
+	go app.reconcileSubscriptions(time.Hour)
+	go app.runDunning(15 * time.Minute)
+
 	// serve application
 	if err := app.serve(); err != nil {
 		logger.Fatal("unable to start the application ", err)
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// returns application on a mocked database and the fake payment gateway
+func newTestApp(t *testing.T) (*application, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	app := &application{
+		logger:  zap.NewNop().Sugar(),
+		DB:      models.DBModel{DB: db},
+		gateway: cards.NewFakeGateway(),
+	}
+	app.config.stripe.webhookSecret = testWebhookSecret
+
+	return app, mock
+}
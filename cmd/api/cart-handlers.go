@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"go-stripe/internal/models"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+type cartItemPayload struct {
+	WidgetID int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+}
+
+// creates a new empty cart
+func (app *application) CreateCart(w http.ResponseWriter, r *http.Request) {
+	cart, err := app.DB.CreateCart()
+	if err != nil {
+		app.logger.Error("failed to create cart: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.writeJson(w, http.StatusCreated, cart); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns cart with items and totals in the currency of the currency query parameter
+func (app *application) GetCart(w http.ResponseWriter, r *http.Request) {
+	code, err := checkoutCurrency(r.URL.Query().Get("currency"))
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	cart, err := app.DB.GetCartByToken(chi.URLParam(r, "token"), code)
+	if err != nil {
+		app.logger.Error("failed to get cart: ", zap.Error(err))
+		if err = app.badRequest(w, r, errors.New("cart not found")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.writeJson(w, http.StatusOK, cart); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns open cart from url token priced in currency, the default currency when it's empty
+func (app *application) openCart(r *http.Request, code string) (models.Cart, error) {
+	code, err := checkoutCurrency(code)
+	if err != nil {
+		return models.Cart{}, err
+	}
+
+	cart, err := app.DB.GetCartByToken(chi.URLParam(r, "token"), code)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return cart, errors.New("cart not found")
+		}
+		return cart, err
+	}
+
+	if cart.Status != models.CartStatusOpen {
+		return cart, models.ErrCartClosed
+	}
+
+	return cart, nil
+}
+
+// adds widget to cart
+func (app *application) AddCartItem(w http.ResponseWriter, r *http.Request) {
+	var payload cartItemPayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if payload.Quantity <= 0 {
+		if err = app.badRequest(w, r, errors.New("quantity must be positive")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	cart, err := app.openCart(r, r.URL.Query().Get("currency"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	widget, err := app.DB.GetWidget(payload.WidgetID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, errors.New("widget not found")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if widget.IsRecurring {
+		if err = app.badRequest(w, r, errors.New("plans cannot be added to cart")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if _, err = widget.PriceIn(cart.Currency); err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.AddCartItem(cart.ID, widget.ID, payload.Quantity); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	app.writeCart(w, r, cart.Token, cart.Currency)
+}
+
+// sets quantity of cart line
+func (app *application) UpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	var payload cartItemPayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	widgetID, err := strconv.Atoi(chi.URLParam(r, "widgetID"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	cart, err := app.openCart(r, r.URL.Query().Get("currency"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.UpdateCartItem(cart.ID, widgetID, payload.Quantity); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	app.writeCart(w, r, cart.Token, cart.Currency)
+}
+
+// removes line from cart
+func (app *application) RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	widgetID, err := strconv.Atoi(chi.URLParam(r, "widgetID"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	cart, err := app.openCart(r, r.URL.Query().Get("currency"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.RemoveCartItem(cart.ID, widgetID); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	app.writeCart(w, r, cart.Token, cart.Currency)
+}
+
+// writes current state of cart in the currency it was opened in
+func (app *application) writeCart(w http.ResponseWriter, r *http.Request, token, code string) {
+	cart, err := app.DB.GetCartByToken(token, code)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.writeJson(w, http.StatusOK, cart); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// creates one payment intent for the cart total
+func (app *application) CartPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	cart, err := app.openCart(r, payload.Currency)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if len(cart.Items) == 0 {
+		if err = app.badRequest(w, r, errors.New("cart is empty")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	payload.Cart = cart.Token
+	app.checkoutPaymentIntent(w, r, payload)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/currency"
+	"go-stripe/internal/models"
+	"go-stripe/internal/money"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v73"
+	"go.uber.org/zap"
+)
+
+// returns supported currency code the customer chose, the default currency when none is given
+func checkoutCurrency(code string) (string, error) {
+	if strings.TrimSpace(code) == "" {
+		return currency.Default, nil
+	}
+
+	c, err := currency.Get(code)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Code, nil
+}
+
+// creates payment intent for widgets priced on the server from a cart, item list or single product
+func (app *application) checkoutPaymentIntent(w http.ResponseWriter, r *http.Request, payload stripePayload) {
+	code, err := checkoutCurrency(payload.Currency)
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	payload.Currency = code
+
+	billing := payload.billingDetails()
+	if err = billing.Validate(); err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	// a payment method sent with the checkout is a card the logged in customer saved
+	var customer models.Customer
+	if payload.PaymentMethod != "" {
+		customer, err = app.customerFromToken(payload.CustomerToken)
+		if err != nil || customer.StripeCustomerID == "" {
+			app.logger.Error("rejected saved card payment: ", err)
+			if err = app.badRequest(w, r, errInvalidCustomerToken); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+	}
+
+	// order details let the webhook record the order if the browser never posts back
+	metadata := map[string]string{
+		"email":      payload.Email,
+		"first_name": payload.FirstName,
+		"last_name":  payload.LastName,
+		// amounts on the invoice are written the way the customer's browser asks for
+		"locale": currency.NegotiateLocale(r.Header.Get("Accept-Language")),
+	}
+	billing.SetMetadata(metadata)
+
+	billingAddress, shippingAddress, err := payload.addresses()
+	if err != nil {
+		if err = app.badRequest(w, r, addressError(err)); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	for _, a := range []*models.Address{billingAddress, shippingAddress} {
+		if a != nil {
+			a.SetMetadata(metadata)
+		}
+	}
+
+	quantities, err := app.checkoutQuantities(payload, metadata)
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	order, err := app.DB.PriceOrder(quantities, payload.Currency)
+	if err != nil {
+		app.logger.Error("failed to price order: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	for _, item := range order.Items {
+		if item.Widget.IsRecurring {
+			if err = app.badRequest(w, r, errors.New("plans must be bought as a subscription")); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+	}
+
+	// coupon is checked now and applied again from metadata when the order is recorded
+	if payload.Coupon != "" {
+		if payload.Cart != "" {
+			if err = app.badRequest(w, r, errors.New("coupons can't be applied to a cart")); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		coupon, err := app.DB.ValidateCoupon(payload.Coupon, payload.Email, payload.Currency)
+		if err != nil {
+			app.logger.Error("coupon rejected: ", zap.Error(err))
+			if err = app.badRequest(w, r, couponError(err)); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		if err = order.ApplyCoupon(coupon); err != nil {
+			app.logger.Error("failed to apply coupon: ", zap.Error(err))
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+		if !order.Amount.IsPositive() {
+			if err = app.badRequest(w, r, errors.New("coupon can't make the order free")); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+		metadata["coupon"] = coupon.Code
+	}
+
+	// tax is worked out after the discount, the rates are looked up again when the order is recorded
+	if err = app.DB.TaxOrder(&order, billing); err != nil {
+		app.logger.Error("failed to tax order: ", zap.Error(err))
+		if err = app.badRequest(w, r, billingError(err)); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	// hold stock until the payment is confirmed
+	reference, err := app.DB.ReserveInventory(quantities, reservationTTL)
+	if err != nil {
+		app.logger.Error("failed to reserve stock: ", zap.Error(err))
+		resp := jsonResponse{
+			OK:      false,
+			Message: stockErrorMessage(err),
+		}
+		if err = app.writeJson(w, http.StatusOK, resp); err != nil {
+			app.logger.Error("error writing response: ", zap.Error(err))
+		}
+		return
+	}
+
+	card := cards.Card{
+		Secret:         app.config.stripe.secret,
+		Key:            app.config.stripe.key,
+		Currency:       payload.Currency,
+		Gateway:        app.gateway,
+		Metadata:       metadata,
+		Shipping:       cardAddress(shippingAddress),
+		IdempotencyKey: idempotencyKeyFromContext(r.Context()),
+	}
+
+	var pi *stripe.PaymentIntent
+	var msg string
+	if customer.StripeCustomerID != "" {
+		// the customer is at checkout, the browser confirms the payment if the bank asks for it
+		pi, msg, err = card.ChargeSavedCard(customer.StripeCustomerID, payload.PaymentMethod, order.Amount, false)
+		if errors.Is(err, cards.ErrPaymentMethodNotSaved) {
+			msg = "This card is no longer saved, please choose another one"
+		}
+	} else {
+		pi, msg, err = card.Charge(order.Amount)
+	}
+	app.assignReservation(reference, pi, err)
+	if err != nil {
+		app.logger.Error("failed process payment: ", zap.Error(err))
+		resp := jsonResponse{
+			OK:      false,
+			Message: msg,
+		}
+		if err = app.writeJson(w, http.StatusOK, resp); err != nil {
+			app.logger.Error("error writing response: ", zap.Error(err))
+		}
+		return
+	}
+
+	if err = app.writeJson(w, http.StatusOK, pi); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns widget quantities of the cart, item list or single product being checked out
+// and records where they came from in metadata
+func (app *application) checkoutQuantities(payload stripePayload, metadata map[string]string) (map[int]int, error) {
+	quantities := make(map[int]int)
+
+	switch {
+	case payload.Cart != "":
+		cart, err := app.DB.GetCartByToken(payload.Cart, payload.Currency)
+		if err != nil {
+			app.logger.Error("failed to get cart: ", zap.Error(err))
+			return nil, errors.New("cart not found")
+		}
+
+		if cart.Status != models.CartStatusOpen {
+			return nil, models.ErrCartClosed
+		}
+
+		for _, item := range cart.Items {
+			quantities[item.WidgetID] += item.Quantity
+		}
+		metadata["cart"] = cart.Token
+
+	case len(payload.Items) > 0:
+		for _, item := range payload.Items {
+			quantities[item.WidgetID] += item.Quantity
+		}
+		metadata["items"] = models.EncodeQuantities(quantities)
+
+	default:
+		productID, err := strconv.Atoi(payload.ProductID)
+		if err != nil {
+			app.logger.Error("failed to convert product id: ", zap.Error(err))
+			return nil, errors.New("invalid product")
+		}
+		quantities[productID] = 1
+		metadata["items"] = models.EncodeQuantities(quantities)
+	}
+
+	return quantities, nil
+}
+
+// returns billing details sent with the payload
+func (p stripePayload) billingDetails() models.BillingDetails {
+	return models.BillingDetails{
+		Country: p.BillingCountry,
+		Region:  p.BillingRegion,
+		VATID:   p.VATID,
+	}
+}
+
+// returns error shown to customer for billing details that can't be taxed, database errors are not exposed
+func billingError(err error) error {
+	for _, e := range []error{models.ErrBillingCountry, models.ErrInvalidVATID} {
+		if errors.Is(err, e) {
+			return e
+		}
+	}
+
+	return errors.New("tax could not be worked out, please try again")
+}
+
+// returns validated postal addresses entered at checkout, nil for the ones not given
+func (p stripePayload) addresses() (billing, shipping *models.Address, err error) {
+	if p.BillingAddress != nil {
+		billing = p.BillingAddress
+		billing.Kind = models.AddressBilling
+		// the billing address is where the customer is taxed, it can't say otherwise
+		billing.Country = p.BillingCountry
+		billing.Region = p.BillingRegion
+		if strings.TrimSpace(billing.Name) == "" {
+			billing.Name = p.FirstName + " " + p.LastName
+		}
+		if err = billing.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if p.ShippingAddress != nil {
+		shipping = p.ShippingAddress
+		shipping.Kind = models.AddressShipping
+		if err = shipping.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return billing, shipping, nil
+}
+
+// returns error shown to customer for addresses that can't be used
+func addressError(err error) error {
+	if errors.Is(err, models.ErrInvalidAddress) || errors.Is(err, models.ErrBillingCountry) {
+		return err
+	}
+
+	return errors.New("address could not be saved, please try again")
+}
+
+// returns address in the form cards sends to stripe, nil for nil
+func cardAddress(a *models.Address) *cards.Address {
+	if a == nil {
+		return nil
+	}
+
+	return &cards.Address{
+		Name:       a.Name,
+		Line1:      a.Line1,
+		Line2:      a.Line2,
+		City:       a.City,
+		State:      a.Region,
+		PostalCode: a.PostalCode,
+		Country:    a.Country,
+	}
+}
+
+// returns address lines for the invoice, none for orders placed without the address
+func addressLines(a *models.Address) []string {
+	if a == nil {
+		return nil
+	}
+
+	return a.Lines()
+}
+
+// prices cart, item list or product for the billing details entered at checkout, so customers see
+// the tax before they pay
+func (app *application) CheckoutQuote(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if payload.Currency, err = checkoutCurrency(payload.Currency); err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	quantities, err := app.checkoutQuantities(payload, make(map[string]string))
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	order, err := app.DB.PriceOrder(quantities, payload.Currency)
+	if err != nil {
+		app.logger.Error("failed to price order: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if payload.Coupon != "" {
+		if payload.Cart != "" {
+			if err = app.badRequest(w, r, errors.New("coupons can't be applied to a cart")); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		coupon, err := app.DB.ValidateCoupon(payload.Coupon, payload.Email, payload.Currency)
+		if err == nil {
+			err = order.ApplyCoupon(coupon)
+		}
+		if err != nil {
+			if err = app.badRequest(w, r, couponError(err)); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+	}
+
+	if err = app.DB.TaxOrder(&order, payload.billingDetails()); err != nil {
+		app.logger.Error("failed to tax order: ", zap.Error(err))
+		if err = app.badRequest(w, r, billingError(err)); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	lines, err := order.TaxLines()
+	if err != nil {
+		app.logger.Error("failed to sum tax lines: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error         bool             `json:"error"`
+		Subtotal      money.Money      `json:"subtotal"`
+		Discount      money.Money      `json:"discount"`
+		Tax           money.Money      `json:"tax"`
+		Amount        money.Money      `json:"amount"`
+		TaxIncluded   bool             `json:"tax_included"`
+		ReverseCharge bool             `json:"reverse_charge"`
+		TaxLines      []models.TaxLine `json:"tax_lines"`
+	}
+
+	resp.Subtotal = order.Subtotal
+	resp.Discount = order.Discount
+	resp.Tax = order.Tax
+	resp.Amount = order.Amount
+	resp.TaxIncluded = models.PricesIncludeTax(payload.Currency)
+	resp.ReverseCharge = order.ReverseCharge
+	resp.TaxLines = lines
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"go-stripe/internal/models"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckoutQuantitiesItems(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	metadata := make(map[string]string)
+	quantities, err := app.checkoutQuantities(stripePayload{
+		Items: []cartItemPayload{{WidgetID: 2, Quantity: 1}, {WidgetID: 1, Quantity: 3}, {WidgetID: 2, Quantity: 1}},
+	}, metadata)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]int{1: 3, 2: 2}, quantities)
+
+	// the webhook and the website build the order from what the intent records
+	recorded, err := models.QuantitiesFromMetadata(metadata)
+	assert.Nil(t, err)
+	assert.Equal(t, quantities, recorded)
+}
+
+func Test_CheckoutQuantitiesProduct(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	metadata := make(map[string]string)
+	quantities, err := app.checkoutQuantities(stripePayload{ProductID: "4"}, metadata)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]int{4: 1}, quantities)
+	assert.Equal(t, "4:1", metadata["items"])
+
+	_, err = app.checkoutQuantities(stripePayload{ProductID: "four"}, make(map[string]string))
+	assert.EqualError(t, err, "invalid product")
+}
+
+func Test_CheckoutQuantitiesCart(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	cartColumns := []string{"id", "token", "status", "created_at", "updated_at"}
+	itemColumns := []string{
+		"id", "cart_id", "widget_id", "quantity", "created_at", "updated_at",
+		"id", "name", "description", "inventory_level", "price", "image", "is_recurring", "plan_id", "tax_category",
+	}
+
+	mock.ExpectQuery("select id, token, status, created_at, updated_at from carts").
+		WithArgs("open-cart").
+		WillReturnRows(sqlmock.NewRows(cartColumns).AddRow(1, "open-cart", models.CartStatusOpen, time.Now(), time.Now()))
+	mock.ExpectQuery("from\\s+cart_items").
+		WillReturnRows(sqlmock.NewRows(itemColumns).
+			AddRow(1, 1, 5, 2, time.Now(), time.Now(), 5, "Widget", "", 10, 1000, "", false, "", "standard"))
+	mock.ExpectQuery("select widget_id, currency, amount").
+		WillReturnRows(sqlmock.NewRows([]string{"widget_id", "currency", "amount"}))
+
+	metadata := make(map[string]string)
+	quantities, err := app.checkoutQuantities(stripePayload{Cart: "open-cart", Currency: "eur"}, metadata)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]int{5: 2}, quantities)
+	assert.Equal(t, "open-cart", metadata["cart"])
+
+	// a checked out cart can't be paid for again
+	mock.ExpectQuery("select id, token, status, created_at, updated_at from carts").
+		WillReturnRows(sqlmock.NewRows(cartColumns).AddRow(2, "paid-cart", models.CartStatusCheckedOut, time.Now(), time.Now()))
+	mock.ExpectQuery("from\\s+cart_items").WillReturnRows(sqlmock.NewRows(itemColumns))
+
+	_, err = app.checkoutQuantities(stripePayload{Cart: "paid-cart", Currency: "eur"}, make(map[string]string))
+	assert.ErrorIs(t, err, models.ErrCartClosed)
+
+	mock.ExpectQuery("select id, token, status, created_at, updated_at from carts").WillReturnError(sql.ErrNoRows)
+
+	_, err = app.checkoutQuantities(stripePayload{Cart: "missing", Currency: "eur"}, make(map[string]string))
+	assert.EqualError(t, err, "cart not found")
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
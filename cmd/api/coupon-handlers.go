@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"go-stripe/internal/money"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v73"
+	"go.uber.org/zap"
+)
+
+// returns error shown to customer for rejected coupon, database errors are not exposed
+func couponError(err error) error {
+	for _, e := range []error{
+		models.ErrCouponNotFound,
+		models.ErrCouponExpired,
+		models.ErrCouponRedeemed,
+		models.ErrCouponCustomerLimit,
+		models.ErrCouponCurrency,
+	} {
+		if errors.Is(err, e) {
+			return e
+		}
+	}
+
+	return errors.New("coupon code could not be checked, please try again")
+}
+
+// checks coupon code entered at checkout and returns the discounted price of the widget
+func (app *application) CheckCoupon(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code      string `json:"code"`
+		Email     string `json:"email"`
+		Currency  string `json:"currency"`
+		ProductID int    `json:"product_id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if payload.Currency, err = checkoutCurrency(payload.Currency); err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	coupon, err := app.DB.ValidateCoupon(payload.Code, payload.Email, payload.Currency)
+	if err != nil {
+		if err = app.badRequest(w, r, couponError(err)); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	order, err := app.DB.PriceOrder(map[int]int{payload.ProductID: 1}, payload.Currency)
+	if err != nil {
+		app.logger.Error("failed to price order: ", zap.Error(err))
+		if !errors.Is(err, models.ErrNoPrice) {
+			err = errors.New("invalid product")
+		}
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	if err = order.ApplyCoupon(coupon); err != nil {
+		app.logger.Error("failed to apply coupon: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error     bool        `json:"error"`
+		Message   string      `json:"message"`
+		Code      string      `json:"code"`
+		Discount  money.Money `json:"discount"`
+		Amount    money.Money `json:"amount"`
+		TrialDays int         `json:"trial_days"`
+	}
+
+	resp.Error = false
+	resp.Message = coupon.Description
+	resp.Code = coupon.Code
+	resp.Discount = order.Discount
+	resp.Amount = order.Amount
+	resp.TrialDays = coupon.TrialDays
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns page of coupons
+func (app *application) AllCoupons(w http.ResponseWriter, r *http.Request) {
+	var userInput struct {
+		PageSize    int `json:"page_size"`
+		CurrentPage int `json:"page"`
+	}
+
+	err := app.readJSON(w, r, &userInput)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	coupons, lastPage, totalRecords, err := app.DB.GetAllCoupons(userInput.PageSize, userInput.CurrentPage)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		CurrentPage  int              `json:"current_page"`
+		PageSize     int              `json:"page_size"`
+		LastPage     int              `json:"last_page"`
+		TotalRecords int              `json:"total_records"`
+		Coupons      []*models.Coupon `json:"coupons"`
+	}
+
+	resp.CurrentPage = userInput.CurrentPage
+	resp.PageSize = userInput.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Coupons = coupons
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns coupon with its redemptions
+func (app *application) OneCoupon(w http.ResponseWriter, r *http.Request) {
+	couponID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	coupon, err := app.DB.GetCoupon(couponID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	redemptions, err := app.DB.GetCouponRedemptions(couponID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		models.Coupon
+		RedemptionList []*models.CouponRedemption `json:"redemption_list"`
+	}
+
+	resp.Coupon = coupon
+	resp.RedemptionList = redemptions
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// creates coupon when id is 0, otherwise updates its limits
+func (app *application) EditCoupon(w http.ResponseWriter, r *http.Request) {
+	couponID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var coupon models.Coupon
+
+	err = app.readJSON(w, r, &coupon)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		ID      int    `json:"id"`
+	}
+
+	if couponID > 0 {
+		existing, err := app.DB.GetCoupon(couponID)
+		if err != nil {
+			app.logger.Error(err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		// code and discount are fixed, customers may already have used them
+		existing.Description = coupon.Description
+		existing.TrialDays = coupon.TrialDays
+		existing.MaxRedemptions = coupon.MaxRedemptions
+		existing.MaxPerCustomer = coupon.MaxPerCustomer
+		existing.ExpiresAt = coupon.ExpiresAt
+		existing.Active = coupon.Active
+
+		if err = existing.Validate(); err != nil {
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		if err = app.DB.UpdateCoupon(existing); err != nil {
+			app.logger.Error(err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		resp.ID = existing.ID
+		resp.Message = "Coupon updated successfully"
+	} else {
+		if err = coupon.Validate(); err != nil {
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		card := cards.Card{
+			Secret:         app.config.stripe.secret,
+			Key:            app.config.stripe.key,
+			Currency:       coupon.Currency,
+			Gateway:        app.gateway,
+			IdempotencyKey: idempotencyKeyFromContext(r.Context()),
+		}
+
+		// trial only coupons have nothing to discount on stripe
+		if coupon.PercentOff > 0 || coupon.AmountOff > 0 {
+			var amountOff money.Money
+			if coupon.AmountOff > 0 {
+				amountOff, err = money.New(int64(coupon.AmountOff), coupon.Currency)
+			}
+			var sc *stripe.Coupon
+			if err == nil {
+				sc, err = card.CreateCoupon(coupon.Code, coupon.PercentOff, amountOff, coupon.Duration, coupon.DurationInMonths)
+			}
+			if err != nil {
+				app.logger.Error("failed to create stripe coupon: ", zap.Error(err))
+				if err = app.badRequest(w, r, err); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+			coupon.StripeCouponID = sc.ID
+		}
+
+		id, err := app.DB.InsertCoupon(coupon)
+		if err != nil {
+			app.logger.Error(err)
+			if coupon.StripeCouponID != "" {
+				if err := card.DeleteCoupon(coupon.StripeCouponID); err != nil {
+					app.logger.Error("failed to delete stripe coupon: ", zap.Error(err))
+				}
+			}
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		resp.ID = id
+		resp.Message = "New coupon added successfully"
+	}
+
+	resp.Error = false
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// deletes coupon that was never redeemed, along with its stripe coupon
+func (app *application) DeleteCoupon(w http.ResponseWriter, r *http.Request) {
+	couponID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	coupon, err := app.DB.GetCoupon(couponID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logger.Error(err)
+		}
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.DeleteCoupon(couponID); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if coupon.StripeCouponID != "" {
+		card := cards.Card{
+			Secret:  app.config.stripe.secret,
+			Key:     app.config.stripe.key,
+			Gateway: app.gateway,
+		}
+
+		if err = card.DeleteCoupon(coupon.StripeCouponID); err != nil {
+			app.logger.Error("coupon was deleted, but the stripe coupon could not be: ", zap.Error(err))
+		}
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Coupon deleted successfully"
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
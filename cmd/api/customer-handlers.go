@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/models"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// returns customers sharing an email with the suggested survivor of each group
+func (app *application) DuplicateCustomers(w http.ResponseWriter, r *http.Request) {
+	groups, err := app.DB.GetDuplicateCustomers()
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err := app.writeJson(w, http.StatusOK, groups); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// merges duplicate customers into the survivor picked by the admin
+func (app *application) MergeCustomers(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		SurvivorID  int   `json:"survivor_id"`
+		CustomerIDs []int `json:"customer_ids"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if payload.SurvivorID <= 0 || len(payload.CustomerIDs) == 0 {
+		if err = app.badRequest(w, r, errors.New("survivor and customers to merge are required")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	user, _, err := app.authenticateToken(r)
+	if err != nil {
+		if err = app.invalidCredentials(w); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	merges, err := app.DB.MergeCustomers(payload.SurvivorID, payload.CustomerIDs, user.ID, models.MergeSourceAdmin)
+	if err != nil {
+		app.logger.Error("failed to merge customers: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool                    `json:"error"`
+		Message string                  `json:"message"`
+		Merges  []*models.CustomerMerge `json:"merges"`
+	}
+
+	resp.Error = false
+	resp.Message = "Customers merged"
+	resp.Merges = merges
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns page of customer merge audit log
+func (app *application) CustomerMerges(w http.ResponseWriter, r *http.Request) {
+	var userInput struct {
+		PageSize    int `json:"page_size"`
+		CurrentPage int `json:"page"`
+	}
+
+	err := app.readJSON(w, r, &userInput)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	merges, lastPage, totalRecords, err := app.DB.GetCustomerMerges(userInput.PageSize, userInput.CurrentPage)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		CurrentPage  int                     `json:"current_page"`
+		PageSize     int                     `json:"page_size"`
+		LastPage     int                     `json:"last_page"`
+		TotalRecords int                     `json:"total_records"`
+		Merges       []*models.CustomerMerge `json:"merges"`
+	}
+
+	resp.CurrentPage = userInput.CurrentPage
+	resp.PageSize = userInput.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Merges = merges
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
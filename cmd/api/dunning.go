@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"go-stripe/internal/money"
+	"go-stripe/internal/urlsigner"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v73"
+	"go.uber.org/zap"
+)
+
+// number of dunning cases retried per run
+const dunningBatchSize = 50
+
+// data for dunning email templates
+type dunningEmail struct {
+	Name        string
+	Amount      string
+	Link        string
+	Attempt     int
+	NextAttempt string
+	FinalNotice bool
+}
+
+// opens dunning case for failed renewal and tells the customer, failed first invoices are left to checkout
+func (app *application) startDunning(inv *stripe.Invoice, failedAt time.Time) error {
+	if inv.Subscription == nil || inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate {
+		return nil
+	}
+
+	next, _ := app.config.dunning.schedule.NextAttempt(0, failedAt)
+
+	amountDue, err := money.New(inv.AmountDue, string(inv.Currency))
+	if err != nil {
+		return err
+	}
+
+	dc, created, err := app.DB.OpenDunningCase(inv.Subscription.ID, inv.ID, amountDue, next)
+	if errors.Is(err, sql.ErrNoRows) {
+		// not a subscription sold here, or not synced yet, reconciliation catches up on its status
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if created {
+		app.sendDunningEmail(dc, false)
+	}
+
+	return nil
+}
+
+// periodically retries payment of failed renewals that are due
+func (app *application) runDunning(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cases, err := app.DB.GetDueDunningCases(time.Now(), dunningBatchSize)
+		if err != nil {
+			app.logger.Error("failed to get due dunning cases: ", zap.Error(err))
+			continue
+		}
+
+		for _, dc := range cases {
+			app.retryDunningCase(dc)
+		}
+	}
+}
+
+// retries invoice of dunning case, schedules the next retry or cancels the subscription after the last one
+func (app *application) retryDunningCase(dc *models.DunningCase) {
+	card := cards.Card{
+		Secret:   app.config.stripe.secret,
+		Key:      app.config.stripe.key,
+		Currency: dc.AmountDue.Currency(),
+		Gateway:  app.gateway,
+		// one charge per attempt, even if two back ends pick up the same case
+		IdempotencyKey: fmt.Sprintf("dunning-%d-%d", dc.ID, dc.Attempts),
+	}
+
+	inv, msg, err := card.RetryInvoice(dc.Invoice)
+	if err == nil && inv.Paid {
+		if err = app.DB.ResolveDunningCase(dc.StripeSubscriptionID, models.DunningStatusRecovered); err != nil {
+			app.logger.Error("failed to resolve dunning case ", dc.ID, ": ", zap.Error(err))
+		}
+		app.logger.Info("recovered payment of subscription ", dc.StripeSubscriptionID)
+		return
+	}
+
+	if err != nil && msg == "" {
+		// not a decline, e.g. stripe is unreachable or the invoice was paid meanwhile, try again next run
+		app.logger.Error("failed to retry invoice ", dc.Invoice, ": ", zap.Error(err))
+		return
+	}
+
+	if msg == "" {
+		msg = "payment is still pending"
+	}
+
+	dc.Attempts++
+	next, ok := app.config.dunning.schedule.NextAttempt(dc.Attempts, time.Now())
+	if !ok {
+		app.cancelDunningSubscription(dc, &card)
+		return
+	}
+
+	if err = app.DB.RecordDunningAttempt(dc.ID, msg, next); err != nil {
+		app.logger.Error("failed to record dunning attempt ", dc.ID, ": ", zap.Error(err))
+		return
+	}
+
+	dc.NextAttemptAt = &next
+	app.sendDunningEmail(*dc, false)
+}
+
+// cancels subscription whose last payment retry failed
+func (app *application) cancelDunningSubscription(dc *models.DunningCase, card *cards.Card) {
+	sub, err := card.CancelSubscriptionNow(dc.StripeSubscriptionID)
+	if err != nil {
+		app.logger.Error("failed to cancel subscription ", dc.StripeSubscriptionID, ": ", zap.Error(err))
+		return
+	}
+
+	if err = app.DB.SyncSubscription(subscriptionFromStripe(sub), time.Now()); err != nil {
+		app.logger.Error("failed to sync subscription ", sub.ID, ": ", zap.Error(err))
+	}
+
+	if err = app.DB.ResolveDunningCase(dc.StripeSubscriptionID, models.DunningStatusCancelled); err != nil {
+		app.logger.Error("failed to resolve dunning case ", dc.ID, ": ", zap.Error(err))
+	}
+
+	app.logger.Info("cancelled subscription ", sub.ID, " after ", dc.Attempts, " failed payment retries")
+
+	app.sendDunningEmail(*dc, true)
+}
+
+// emails customer about failed payment with a link to update the card, or about the cancellation
+func (app *application) sendDunningEmail(dc models.DunningCase, cancelled bool) {
+	if dc.Customer.Email == "" {
+		return
+	}
+
+	data := dunningEmail{
+		Name:    strings.TrimSpace(dc.Customer.FirstName + " " + dc.Customer.LastName),
+		Amount:  dc.AmountDue.Format(dc.Customer.Locale),
+		Attempt: dc.Attempts,
+	}
+
+	if cancelled {
+		err := app.SendMail("info@widgets.com", dc.Customer.Email, "Your subscription has been cancelled", "subscription-cancelled", data)
+		if err != nil {
+			app.logger.Error("failed to send cancellation email: ", zap.Error(err))
+		}
+		return
+	}
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+	data.Link = sign.GenerateTokenFromString(fmt.Sprintf("%s/update-card?order=%d", app.config.frontend, dc.OrderID))
+
+	if dc.NextAttemptAt != nil {
+		data.NextAttempt = dc.NextAttemptAt.Format("January 2, 2006")
+	}
+	_, hasMore := app.config.dunning.schedule.NextAttempt(dc.Attempts+1, time.Now())
+	data.FinalNotice = !hasMore
+
+	err := app.SendMail("info@widgets.com", dc.Customer.Email, "Your payment failed", "payment-failed", data)
+	if err != nil {
+		app.logger.Error("failed to send payment failed email: ", zap.Error(err))
+	}
+}
+
+// returns page of subscriptions with failed renewals still being retried
+func (app *application) AtRiskSubscriptions(w http.ResponseWriter, r *http.Request) {
+	var userInput struct {
+		PageSize    int `json:"page_size"`
+		CurrentPage int `json:"page"`
+	}
+
+	err := app.readJSON(w, r, &userInput)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	cases, lastPage, totalRecords, err := app.DB.GetAtRiskSubscriptions(userInput.PageSize, userInput.CurrentPage)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		CurrentPage  int                   `json:"current_page"`
+		PageSize     int                   `json:"page_size"`
+		LastPage     int                   `json:"last_page"`
+		TotalRecords int                   `json:"total_records"`
+		Retries      int                   `json:"retries"`
+		Cases        []*models.DunningCase `json:"cases"`
+	}
+
+	resp.CurrentPage = userInput.CurrentPage
+	resp.PageSize = userInput.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Retries = len(app.config.dunning.schedule)
+	resp.Cases = cases
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"go-stripe/internal/cards"
+	"go-stripe/internal/currency"
 	"go-stripe/internal/encryption"
 	"go-stripe/internal/models"
+	"go-stripe/internal/money"
 	"go-stripe/internal/urlsigner"
 	"net/http"
 	"strconv"
@@ -15,24 +17,50 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v73"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type stripePayload struct {
-	Currency      string `json:"currency"`
-	Amount        string `json:"amount"`
-	PaymentMethod string `json:"payment_method"`
-	PaymentIntent string `json:"payment_intent"`
-	Email         string `json:"email"`
-	CardBrand     string `json:"card_brand"`
-	ExpiryMonth   int    `json:"exp_month"`
-	ExpiryYear    int    `json:"exp_year"`
-	LastFour      string `json:"last_four"`
-	Plan          string `json:"plan"`
-	ProductID     string `json:"product_id"`
-	FirstName     string `json:"first_name"`
-	LastName      string `json:"last_name"`
+	Currency string `json:"currency"`
+	// charged by the virtual terminal, widgets are priced on the server
+	Amount        money.Money       `json:"amount"`
+	PaymentMethod string            `json:"payment_method"`
+	PaymentIntent string            `json:"payment_intent"`
+	Email         string            `json:"email"`
+	CardBrand     string            `json:"card_brand"`
+	ExpiryMonth   int               `json:"exp_month"`
+	ExpiryYear    int               `json:"exp_year"`
+	LastFour      string            `json:"last_four"`
+	Plan          string            `json:"plan"`
+	Coupon        string            `json:"coupon"`
+	ProductID     string            `json:"product_id"`
+	Items         []cartItemPayload `json:"items"`
+	Cart          string            `json:"cart"`
+	FirstName     string            `json:"first_name"`
+	LastName      string            `json:"last_name"`
+	// where the customer is billed, decides the tax
+	BillingCountry string `json:"billing_country"`
+	BillingRegion  string `json:"billing_region"`
+	VATID          string `json:"vat_id"`
+	// postal addresses, country and region of the billing one are the billing details
+	BillingAddress  *models.Address `json:"billing_address"`
+	ShippingAddress *models.Address `json:"shipping_address"`
+	// set when subscribing again after the browser confirmed the first payment
+	SubscriptionID string `json:"subscription_id"`
+	// identifies logged in customer, whose saved cards can be charged
+	CustomerToken string `json:"customer_token"`
+}
+
+// response to subscribe, requires_action asks the browser to confirm the first payment
+// with client_secret and to send the request again with subscription_id
+type subscribeResponse struct {
+	Error          bool   `json:"error"`
+	Message        string `json:"message"`
+	RequiresAction bool   `json:"requires_action,omitempty"`
+	ClientSecret   string `json:"client_secret,omitempty"`
+	SubscriptionID string `json:"subscription_id,omitempty"`
 }
 
 type jsonResponse struct {
@@ -43,14 +71,35 @@ type jsonResponse struct {
 }
 
 type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int           `json:"id"`
+	Items     []InvoiceItem `json:"items"`
+	Quantity  int           `json:"quantity"`
+	Subtotal  money.Money   `json:"subtotal"`
+	Discount  money.Money   `json:"discount"`
+	Tax       money.Money   `json:"tax"`
+	Amount    money.Money   `json:"amount"`
+	Locale    string        `json:"locale"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Email     string        `json:"email"`
+	CreatedAt time.Time     `json:"created_at"`
+	// tax summed by rate, none when the customer is reverse charged
+	TaxLines      []models.TaxLine      `json:"tax_lines"`
+	TaxIncluded   bool                  `json:"tax_included"`
+	Billing       models.BillingDetails `json:"billing"`
+	ReverseCharge bool                  `json:"reverse_charge"`
+	// address lines as printed, empty for orders placed without them
+	BillingAddress  []string `json:"billing_address"`
+	ShippingAddress []string `json:"shipping_address"`
+}
+
+type InvoiceItem struct {
+	Product   string      `json:"product"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+	Discount  money.Money `json:"discount"`
+	Tax       money.Money `json:"tax"`
+	Amount    money.Money `json:"amount"`
 }
 
 // get payment intent from stripe
@@ -64,21 +113,30 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	amount, err := strconv.Atoi(payload.Amount)
-	if err != nil {
-		app.logger.Error("failed to convert amount: ", zap.Error(err))
+	// widgets are priced on the server, a bare amount is only charged by the virtual terminal
+	if payload.Cart != "" || len(payload.Items) > 0 || payload.ProductID != "" {
+		app.checkoutPaymentIntent(w, r, payload)
+		return
+	}
+
+	if !payload.Amount.IsPositive() {
+		if err = app.badRequest(w, r, errors.New("amount must be positive")); err != nil {
+			app.logger.Error(err)
+		}
 		return
 	}
 
 	// initialize card
 	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+		Secret:         app.config.stripe.secret,
+		Key:            app.config.stripe.key,
+		Currency:       payload.Amount.Currency(),
+		Gateway:        app.gateway,
+		IdempotencyKey: idempotencyKeyFromContext(r.Context()),
 	}
 
 	ok := true
-	pi, msg, err := card.Charge(payload.Currency, amount)
+	pi, msg, err := card.Charge(payload.Amount)
 	if err != nil {
 		app.logger.Error("failed process payment: ", zap.Error(err))
 		ok = false
@@ -160,41 +218,177 @@ func (app *application) CreateCustomerSubscribe(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if data.Currency, err = checkoutCurrency(data.Currency); err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error("failed to write response: ", err)
+		}
+		return
+	}
+
+	billing := data.billingDetails()
+	if err = billing.Validate(); err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error("failed to write response: ", err)
+		}
+		return
+	}
+
+	// plans are not shipped, only the billing address is kept
+	data.ShippingAddress = nil
+	billingAddress, _, err := data.addresses()
+	if err != nil {
+		if err = app.badRequest(w, r, addressError(err)); err != nil {
+			app.logger.Error("failed to write response: ", err)
+		}
+		return
+	}
+
 	// initialize card
 	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: data.Currency,
+		Secret:         app.config.stripe.secret,
+		Key:            app.config.stripe.key,
+		Currency:       data.Currency,
+		Gateway:        app.gateway,
+		BillingAddress: cardAddress(billingAddress),
+		IdempotencyKey: idempotencyKeyFromContext(r.Context()),
 	}
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
+	productID, err := strconv.Atoi(data.ProductID)
 	if err != nil {
-		app.logger.Error("failed to create customer: ", err)
-		if err = app.badRequest(w, r, errors.New(msg)); err != nil {
+		app.logger.Error("failed to convert product id: ", err)
+		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error("failed to write response: ", err)
 		}
 		return
 	}
 
-	subscription, err := card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
+	// subscribe to the plan of the widget, not whatever plan the browser sent
+	plan, err := app.DB.GetPlan(productID)
+	if err == nil {
+		_, err = plan.PriceIn(data.Currency)
+	}
 	if err != nil {
-		app.logger.Error("failed to subscribe to plan: ", err)
+		app.logger.Error("failed to get plan: ", err)
 		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error("failed to write response: ", err)
 		}
 		return
 	}
 
-	productID, err := strconv.Atoi(data.ProductID)
+	var coupon models.Coupon
+	if data.Coupon != "" {
+		coupon, err = app.DB.ValidateCoupon(data.Coupon, data.Email, data.Currency)
+		if err != nil {
+			app.logger.Error("coupon rejected: ", err)
+			if err = app.badRequest(w, r, couponError(err)); err != nil {
+				app.logger.Error("failed to write response: ", err)
+			}
+			return
+		}
+	}
+
+	// the longer of the plan and coupon trials applies
+	card.Coupon = coupon.StripeCouponID
+	card.TrialDays = plan.TrialDays
+	if coupon.TrialDays > card.TrialDays {
+		card.TrialDays = coupon.TrialDays
+	}
+
+	// stripe taxes the subscription's invoices at the rate the order is taxed at
+	taxRate, err := app.stripeTaxRate(&card, plan.TaxCategory, billing)
 	if err != nil {
-		app.logger.Error("failed to convert product id: ", err)
-		if err = app.badRequest(w, r, err); err != nil {
+		app.logger.Error("failed to get stripe tax rate: ", err)
+		if err = app.badRequest(w, r, billingError(err)); err != nil {
 			app.logger.Error("failed to write response: ", err)
 		}
 		return
 	}
+	if taxRate != "" {
+		card.TaxRates = []string{taxRate}
+	}
+
+	var subscription *stripe.Subscription
+	if data.SubscriptionID != "" {
+		subscription, err = app.confirmedSubscription(&card, data, plan)
+		if err != nil {
+			app.logger.Error("failed to get confirmed subscription: ", err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error("failed to write response: ", err)
+			}
+			return
+		}
+
+		// the browser may resend the confirmation
+		if _, err = app.DB.GetTransactionByPaymentIntent(subscription.ID); err == nil {
+			app.writeSubscribeResponse(w, subscribeResponse{Message: "Transaction Successful"})
+			return
+		}
+	} else {
+		reference, err := app.DB.ReserveInventory(map[int]int{productID: 1}, reservationTTL)
+		if err != nil {
+			app.logger.Error("failed to reserve stock: ", err)
+			if err = app.badRequest(w, r, errors.New(stockErrorMessage(err))); err != nil {
+				app.logger.Error("failed to write response: ", err)
+			}
+			return
+		}
+
+		stripeCustomer, msg, err := app.subscriptionCustomer(&card, data)
+		if err != nil {
+			app.logger.Error("failed to create customer: ", err)
+			app.assignReservation(reference, nil, err)
+			if err = app.badRequest(w, r, errors.New(msg)); err != nil {
+				app.logger.Error("failed to write response: ", err)
+			}
+			return
+		}
+
+		subscription, err = card.SubscribeToPlan(stripeCustomer, plan.PlanID, data.Email, data.LastFour, "")
+		if err != nil {
+			app.logger.Error("failed to subscribe to plan: ", err)
+			app.assignReservation(reference, nil, err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error("failed to write response: ", err)
+			}
+			return
+		}
 
-	customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
+		if err = app.DB.UpdateReservationReference(reference, subscription.ID); err != nil {
+			app.logger.Error("failed to assign reservation to subscription: ", err)
+		}
+	}
+
+	// the order is only recorded once the first invoice is paid
+	payment := cards.FirstPayment(subscription)
+	switch payment.Status {
+	case cards.PaymentRequiresAction:
+		// stock stays reserved while the customer authenticates
+		app.writeSubscribeResponse(w, subscribeResponse{
+			Message:        "Payment requires confirmation",
+			RequiresAction: true,
+			ClientSecret:   payment.ClientSecret,
+			SubscriptionID: subscription.ID,
+		})
+		return
+	case cards.PaymentFailed:
+		app.logger.Error("first payment of subscription ", subscription.ID, " failed: ", payment.Message)
+		if _, err = card.CancelSubscriptionNow(subscription.ID); err != nil {
+			app.logger.Error("failed to cancel incomplete subscription: ", err)
+		}
+		if err = app.DB.ReleaseReservation(subscription.ID); err != nil {
+			app.logger.Error("failed to release reservation: ", err)
+		}
+		if err = app.badRequest(w, r, errors.New(payment.Message)); err != nil {
+			app.logger.Error("failed to write response: ", err)
+		}
+		return
+	}
+
+	if err = app.DB.CommitReservation(subscription.ID); err != nil {
+		app.logger.Error("failed to commit reservation: ", err)
+	}
+
+	customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email, currency.NegotiateLocale(r.Header.Get("Accept-Language")))
 	if err != nil {
 		app.logger.Error("failed to save customer: ", err)
 		if err = app.badRequest(w, r, err); err != nil {
@@ -203,18 +397,38 @@ func (app *application) CreateCustomerSubscribe(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	amount, err := strconv.Atoi(data.Amount)
+	// plan is charged at its catalog price whatever the browser sent
+	priced, err := app.DB.PriceOrder(map[int]int{productID: 1}, data.Currency)
 	if err != nil {
-		app.logger.Error("failed to convert amount: ", err)
+		app.logger.Error("failed to price plan: ", err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error("failed to write response: ", err)
+		}
+		return
+	}
+	if err = priced.ApplyCoupon(coupon); err != nil {
+		app.logger.Error("failed to apply coupon: ", err)
 		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error("failed to write response: ", err)
 		}
 		return
 	}
+	if err = app.DB.TaxOrder(&priced, billing); err != nil {
+		app.logger.Error("failed to tax plan: ", err)
+		if err = app.badRequest(w, r, billingError(err)); err != nil {
+			app.logger.Error("failed to write response: ", err)
+		}
+		return
+	}
+
+	// nothing is charged until the trial ends
+	amount := priced.Amount
+	if card.TrialDays > 0 {
+		amount = amount.Mul(0)
+	}
 
 	tx := models.Transaction{
 		Amount:              amount,
-		Currency:            data.Currency,
 		LastFour:            data.LastFour,
 		ExpiryMonth:         data.ExpiryMonth,
 		ExpiryYear:          data.ExpiryYear,
@@ -223,27 +437,18 @@ func (app *application) CreateCustomerSubscribe(w http.ResponseWriter, r *http.R
 		PaymentIntent:       subscription.ID,
 	}
 
-	txID, err := app.SaveTransaction(tx)
-	if err != nil {
-		app.logger.Error("failed to save transaction: ", err)
-		if err = app.badRequest(w, r, err); err != nil {
-			app.logger.Error("failed to write response: ", err)
-		}
-		return
-	}
-
 	order := models.Order{
-		WidgetID:      productID,
-		TransactionID: txID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        amount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+		CustomerID:     customerID,
+		StatusID:       1,
+		Items:          priced.Items,
+		Billing:        priced.Billing,
+		ReverseCharge:  priced.ReverseCharge,
+		BillingAddress: billingAddress,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
 	}
 
-	orderID, err := app.SaveOrder(order)
+	orderID, err := app.DB.InsertOrderWithTransaction(tx, order)
 	if err != nil {
 		app.logger.Error("failed to save order: ", err)
 		if err = app.badRequest(w, r, err); err != nil {
@@ -252,40 +457,99 @@ func (app *application) CreateCustomerSubscribe(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	inv := Invoice{
-		ID: orderID,
-		// TODO:
-		Amount: 2000,
-		// TODO: get from database
-		Product:   "Bronze Plan",
-		Quantity:  order.Quantity,
-		FirstName: data.FirstName,
-		LastName:  data.LastName,
-		Email:     data.Email,
-		CreatedAt: time.Now(),
+	if coupon.ID > 0 {
+		if err = app.DB.RedeemCoupon(coupon.ID, orderID, data.Email, priced.Discount); err != nil {
+			app.logger.Error("failed to record coupon redemption: ", err)
+		}
+	}
+
+	// the created event may have arrived before the order existed
+	if err = app.DB.SyncSubscription(subscriptionFromStripe(subscription), time.Unix(subscription.Created, 0)); err != nil {
+		app.logger.Error("failed to sync subscription: ", zap.Error(err))
 	}
 
-	err = app.callInvoiceMicro(inv)
+	inv, err := app.invoiceForOrder(orderID)
 	if err != nil {
+		app.logger.Error("failed to build invoice: ", zap.Error(err))
+	} else if err = app.callInvoiceMicro(inv); err != nil {
 		app.logger.Error("failed to call invoice microservice: ", zap.Error(err))
 	}
 
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+	app.writeSubscribeResponse(w, subscribeResponse{Message: "Transaction Successful: " + fmt.Sprint(inv)})
+}
+
+// gets subscription whose first payment the browser confirmed, it must be for the plan and email subscribed
+func (app *application) confirmedSubscription(card *cards.Card, data stripePayload, plan models.Widget) (*stripe.Subscription, error) {
+	sub, err := card.GetSubscription(data.SubscriptionID)
+	if err != nil {
+		return nil, err
 	}
 
-	resp.Error = false
-	resp.Message = "Transaction Successful: " + fmt.Sprint(inv)
+	item := ""
+	if sub.Items != nil && len(sub.Items.Data) == 1 && sub.Items.Data[0].Plan != nil {
+		item = sub.Items.Data[0].Plan.ID
+	}
+
+	if item != plan.PlanID || !strings.EqualFold(sub.Metadata["email"], data.Email) {
+		return nil, errors.New("subscription does not match the plan")
+	}
+
+	return sub, nil
+}
 
-	if err = app.writeJson(w, http.StatusOK, resp); err != nil {
+func (app *application) writeSubscribeResponse(w http.ResponseWriter, resp subscribeResponse) {
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
 		app.logger.Error("failed to write response: ", err)
 	}
 }
 
+// builds invoice with order lines from saved order
+func (app *application) invoiceForOrder(orderID int) (Invoice, error) {
+	order, err := app.DB.GetOrderByID(orderID)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	inv := Invoice{
+		ID:        order.ID,
+		Quantity:  order.Quantity,
+		Subtotal:  order.Subtotal,
+		Discount:  order.Discount,
+		Tax:       order.Tax,
+		Amount:    order.Amount,
+		Locale:    order.Customer.Locale,
+		FirstName: order.Customer.FirstName,
+		LastName:  order.Customer.LastName,
+		Email:     order.Customer.Email,
+		CreatedAt: order.CreatedAt,
+		// orders placed before billing details were collected were not taxed
+		Billing:         order.Billing,
+		ReverseCharge:   order.ReverseCharge,
+		BillingAddress:  addressLines(order.BillingAddress),
+		ShippingAddress: addressLines(order.ShippingAddress),
+	}
+
+	if inv.TaxLines, err = order.TaxLines(); err != nil {
+		return Invoice{}, err
+	}
+
+	for _, item := range order.Items {
+		inv.TaxIncluded = inv.TaxIncluded || item.TaxIncluded
+		inv.Items = append(inv.Items, InvoiceItem{
+			Product:   item.Widget.Name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Discount:  item.Discount,
+			Tax:       item.Tax,
+			Amount:    item.Amount,
+		})
+	}
+
+	return inv, nil
+}
+
 func (app *application) callInvoiceMicro(inv Invoice) error {
-	// TODO: add to env vars
-	url := "http://localhost:4002/v1/invoice/create-and-send"
+	url := app.config.invoice + "/v1/invoice/create-and-send"
 
 	out, err := json.Marshal(inv)
 	if err != nil {
@@ -308,15 +572,16 @@ func (app *application) callInvoiceMicro(inv Invoice) error {
 	return nil
 }
 
-// create a new customer
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
+// create a new customer, locale is kept when empty
+func (app *application) SaveCustomer(firstName, lastName, email, locale string) (int, error) {
 	customer := models.Customer{
 		FirstName: firstName,
 		LastName:  lastName,
 		Email:     email,
+		Locale:    locale,
 	}
 
-	id, err := app.DB.InsertCustomer(customer)
+	id, err := app.DB.UpsertCustomer(customer)
 	if err != nil {
 		return 0, err
 	}
@@ -334,16 +599,6 @@ func (app *application) SaveTransaction(tx models.Transaction) (int, error) {
 	return id, nil
 }
 
-// saves an order and returns its ID
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
 // handler for /auth route
 func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
 	var userInput struct {
@@ -360,8 +615,15 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	keys := []models.ThrottleKey{models.AccountKey(userInput.Email), models.IPKey(clientIP(r))}
+	if app.throttled(w, models.ThrottleLogin, keys...) {
+		return
+	}
+
 	user, err := app.DB.GetUserByEmail(userInput.Email)
 	if err != nil {
+		models.SpendPasswordCheck(userInput.Password)
+		app.recordFailure(models.ThrottleLogin, keys...)
 		if err = app.invalidCredentials(w); err != nil {
 			app.logger.Error(err)
 		}
@@ -370,21 +632,75 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 
 	validPassword, err := app.passwordMatches(user.Password, userInput.Password)
 	if err != nil || !validPassword {
+		app.recordFailure(models.ThrottleLogin, keys...)
 		if err = app.invalidCredentials(w); err != nil {
 			app.logger.Error(err)
 		}
 		return
 	}
+	app.clearFailures(models.ThrottleLogin, keys[0])
+
+	twoFactor, err := app.DB.GetTwoFactor(user.ID)
+	if err != nil {
+		app.logger.Error("failed to get two-factor authentication: ", zap.Error(err))
+		if err = app.serverError(w); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	// users with two-factor authentication get tokens once they send a code with the challenge
+	if twoFactor.Enabled {
+		challenge, err := app.DB.CreateLoginChallenge(user.ID)
+		if err != nil {
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		var payload struct {
+			Error             bool   `json:"error"`
+			Message           string `json:"message"`
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			Challenge         string `json:"challenge"`
+		}
 
-	token, err := models.GenerateToken(user.ID, 24*time.Hour, models.ScopeAuthentication)
+		payload.Message = "enter the code of your authenticator app"
+		payload.TwoFactorRequired = true
+		payload.Challenge = challenge
+
+		if err = app.writeJson(w, http.StatusOK, payload); err != nil {
+			app.logger.Error("error writing response: ", zap.Error(err))
+		}
+		return
+	}
+
+	app.sendLoginTokens(w, r, user)
+}
+
+// issues access and refresh token of a new login of user and sends them
+func (app *application) sendLoginTokens(w http.ResponseWriter, r *http.Request, user models.User) {
+	// the access token is short lived, the refresh token gets the login new ones
+	token, err := models.GenerateToken(user.ID, models.AccessTokenTTL, models.ScopeAuthentication)
 	if err != nil {
 		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error(err)
 		}
 		return
 	}
+	// the browser tells the user which of their logins a token is
+	token.Name = loginTokenName(r.UserAgent())
 
-	err = app.DB.InsertToken(token, user)
+	refreshToken, err := models.GenerateRefreshToken(user.ID, "")
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	err = app.DB.InsertLoginTokens(token, refreshToken, user)
 	if err != nil {
 		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error(err)
@@ -393,47 +709,47 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	}
 
 	var payload struct {
-		Error   bool          `json:"error"`
-		Message string        `json:"message"`
-		Token   *models.Token `json:"auth_token"`
+		Error        bool                 `json:"error"`
+		Message      string               `json:"message"`
+		Token        *models.Token        `json:"auth_token"`
+		RefreshToken *models.RefreshToken `json:"refresh_token"`
 	}
 
 	payload.Error = false
-	payload.Message = fmt.Sprintf("token for %s created", userInput.Email)
+	payload.Message = fmt.Sprintf("token for %s created", user.Email)
 	payload.Token = token
+	payload.RefreshToken = refreshToken
 
 	if err = app.writeJson(w, http.StatusOK, payload); err != nil {
 		app.logger.Error("error writing response: ", zap.Error(err))
 	}
-
 }
 
-func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
+func (app *application) authenticateToken(r *http.Request) (*models.User, *models.Token, error) {
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header received")
+		return nil, nil, errors.New("no authorization header received")
 	}
 
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no authorization header received")
+		return nil, nil, errors.New("no authorization header received")
 	}
 
-	token := headerParts[1]
-	if len(token) != 26 {
-		return nil, errors.New("invalid authentication token")
+	user, t, err := app.DB.GetUserForToken(headerParts[1])
+	if err != nil {
+		return nil, nil, errors.New("invalid authentication token")
 	}
 
-	user, err := app.DB.GetUserForToken(token)
-	if err != nil {
-		return nil, errors.New("invalid authentication token")
+	if err = app.DB.TouchToken(t.ID); err != nil {
+		app.logger.Error("failed to record token use: ", zap.Error(err))
 	}
 
-	return user, nil
+	return user, t, nil
 }
 
 func (app *application) CheckAuth(w http.ResponseWriter, r *http.Request) {
-	user, err := app.authenticateToken(r)
+	user, _, err := app.authenticateToken(r)
 	if err != nil {
 		if err = app.invalidCredentials(w); err != nil {
 			app.logger.Error(err)
@@ -456,17 +772,16 @@ func (app *application) CheckAuth(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
 	var txData struct {
-		PaymentAmount   int    `json:"amount"`
-		PaymentCurrency string `json:"currency"`
-		FirstName       string `json:"first_name"`
-		LastName        string `json:"last_name"`
-		Email           string `json:"email"`
-		PaymentIntent   string `json:"payment_intent"`
-		PaymentMethod   string `json:"payment_method"`
-		BankReturnCode  string `json:"bank_return_code"`
-		ExpiryMonth     int    `json:"expiry_month"`
-		ExpiryYear      int    `json:"expiry_year"`
-		LastFour        string `json:"last_four"`
+		PaymentAmount  money.Money `json:"amount"`
+		FirstName      string      `json:"first_name"`
+		LastName       string      `json:"last_name"`
+		Email          string      `json:"email"`
+		PaymentIntent  string      `json:"payment_intent"`
+		PaymentMethod  string      `json:"payment_method"`
+		BankReturnCode string      `json:"bank_return_code"`
+		ExpiryMonth    int         `json:"expiry_month"`
+		ExpiryYear     int         `json:"expiry_year"`
+		LastFour       string      `json:"last_four"`
 	}
 
 	err := app.readJSON(w, r, &txData)
@@ -478,8 +793,9 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 	}
 
 	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
 	}
 
 	pi, err := card.RetrievePaymentIntent(txData.PaymentIntent)
@@ -490,31 +806,16 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
-	pm, err := card.GetPaymentMethod(txData.PaymentMethod)
-	if err != nil {
+	// only record payments stripe has taken, e.g. not ones still waiting for 3-D Secure
+	if err = cards.CheckSucceeded(pi); err != nil {
+		app.logger.Error(err)
 		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error(err)
 		}
 		return
 	}
 
-	txData.LastFour = pm.Card.Last4
-	txData.ExpiryMonth = int(pm.Card.ExpMonth)
-	txData.ExpiryYear = int(pm.Card.ExpYear)
-
-	tx := models.Transaction{
-		Amount:              txData.PaymentAmount,
-		Currency:            txData.PaymentCurrency,
-		LastFour:            txData.LastFour,
-		ExpiryMonth:         txData.ExpiryMonth,
-		ExpiryYear:          txData.ExpiryYear,
-		BankReturnCode:      pi.Charges.Data[0].ID,
-		TransactionStatusID: 2,
-		PaymentIntent:       txData.PaymentIntent,
-		PaymentMethod:       txData.PaymentMethod,
-	}
-
-	_, err = app.SaveTransaction(tx)
+	tx, err := app.saveTerminalTransaction(&card, pi, txData.PaymentMethod)
 	if err != nil {
 		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error(err)
@@ -527,6 +828,39 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 	}
 }
 
+// saves transaction of payment intent that succeeded at the virtual terminal, with the card it was paid with
+func (app *application) saveTerminalTransaction(card *cards.Card, pi *stripe.PaymentIntent, paymentMethod string) (models.Transaction, error) {
+	pm, err := card.GetPaymentMethod(paymentMethod)
+	if err != nil {
+		return models.Transaction{}, err
+	}
+
+	// the amount charged, whatever the browser sent
+	amount, err := cards.PaymentAmount(pi)
+	if err != nil {
+		return models.Transaction{}, err
+	}
+
+	tx := models.Transaction{
+		Amount:              amount,
+		LastFour:            pm.Card.Last4,
+		ExpiryMonth:         int(pm.Card.ExpMonth),
+		ExpiryYear:          int(pm.Card.ExpYear),
+		BankReturnCode:      cards.ChargeID(pi),
+		TransactionStatusID: 2,
+		PaymentIntent:       pi.ID,
+		PaymentMethod:       paymentMethod,
+	}
+
+	id, err := app.SaveTransaction(tx)
+	if err != nil {
+		return models.Transaction{}, err
+	}
+	tx.ID = id
+
+	return tx, nil
+}
+
 func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Request) {
 	var userInput struct {
 		Email string `json:"email"`
@@ -541,22 +875,35 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	keys := []models.ThrottleKey{models.AccountKey(userInput.Email), models.IPKey(clientIP(r))}
+	if app.throttled(w, models.ThrottlePasswordReset, keys...) {
+		return
+	}
+	// every email asked for counts, so nobody is sent a flood of them
+	app.recordFailure(models.ThrottlePasswordReset, keys...)
+
+	// the answer is the same whether a user has the email or not, and the email is sent in the
+	// background so the answer takes as long either way
+	if _, err = app.DB.GetUserByEmail(userInput.Email); err == nil {
+		go app.sendPasswordResetLink(userInput.Email)
+	}
+
 	var payload struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
 	}
 
-	_, err = app.DB.GetUserByEmail(userInput.Email)
-	if err != nil {
-		payload.Error = true
-		payload.Message = "User not found."
-		if err := app.writeJson(w, http.StatusAccepted, payload); err != nil {
-			app.logger.Error("error writing response: ", zap.Error(err))
-		}
-		return
+	payload.Error = false
+	payload.Message = "If there is an account with this email, a link to reset its password is on its way"
+
+	if err := app.writeJson(w, http.StatusAccepted, payload); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
 	}
+}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, userInput.Email)
+// emails link to reset password of user with email
+func (app *application) sendPasswordResetLink(email string) {
+	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, email)
 	sign := urlsigner.Signer{
 		Secret: []byte(app.config.secretKey),
 	}
@@ -569,20 +916,9 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 
 	data.Link = signedLink
 
-	err = app.SendMail("info@widgets.com", userInput.Email, "Password Reset Request", "password-reset", data)
+	err := app.SendMail("info@widgets.com", email, "Password Reset Request", "password-reset", data)
 	if err != nil {
-		app.logger.Error(err)
-		if err = app.badRequest(w, r, err); err != nil {
-			app.logger.Error(err)
-		}
-		return
-	}
-
-	payload.Error = false
-	payload.Message = "Password reset email sent!"
-
-	if err := app.writeJson(w, http.StatusCreated, payload); err != nil {
-		app.logger.Error("error writing response: ", zap.Error(err))
+		app.logger.Error("failed to send password reset email: ", zap.Error(err))
 	}
 }
 
@@ -768,10 +1104,10 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	var chargeToRefund struct {
-		ID            int    `json:"id"`
-		PaymentIntent string `json:"payment_intent"`
-		Amount        int    `json:"amount"`
-		Currency      string `json:"currency"`
+		ID            int         `json:"id"`
+		PaymentIntent string      `json:"payment_intent"`
+		Amount        money.Money `json:"amount"`
+		Reason        string      `json:"reason"`
 	}
 
 	err := app.readJSON(w, r, &chargeToRefund)
@@ -783,6 +1119,14 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user, _, err := app.authenticateToken(r)
+	if err != nil {
+		if err = app.invalidCredentials(w); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
 	order, err := app.DB.GetOrderByID(chargeToRefund.ID)
 	if err != nil {
 		app.logger.Error(err)
@@ -792,8 +1136,22 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if order.Amount != chargeToRefund.Amount {
-		if err = app.badRequest(w, r, errors.New("amounts do not match")); err != nil {
+	// refunds are limited to what was captured and not refunded yet, in the currency it was captured in
+	remaining, err := order.Transaction.Amount.Sub(order.Refunded)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	more, err := chargeToRefund.Amount.Cmp(remaining)
+	if err == nil && (!chargeToRefund.Amount.IsPositive() || more > 0) {
+		err = fmt.Errorf("refund amount must be more than zero and at most %s", remaining)
+	}
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
 			app.logger.Error(err)
 		}
 		return
@@ -802,10 +1160,17 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	card := cards.Card{
 		Secret:   app.config.stripe.secret,
 		Key:      app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
+		Currency: remaining.Currency(),
+		Gateway:  app.gateway,
+		Metadata: map[string]string{
+			"order_id": strconv.Itoa(order.ID),
+			"user_id":  strconv.Itoa(user.ID),
+			"reason":   chargeToRefund.Reason,
+		},
+		IdempotencyKey: idempotencyKeyFromContext(r.Context()),
 	}
 
-	err = card.Refund(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+	refund, err := card.Refund(order.Transaction.PaymentIntent, chargeToRefund.Amount)
 	if err != nil {
 		app.logger.Error("error refunding payment: ", err)
 		if err = app.badRequest(w, r, err); err != nil {
@@ -814,9 +1179,20 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = app.DB.UpdateOrderStatus(chargeToRefund.ID, 2); err != nil {
+	refunded, err := money.New(refund.Amount, string(refund.Currency))
+	if err == nil {
+		err = app.DB.InsertRefund(models.Refund{
+			OrderID:        order.ID,
+			TransactionID:  order.TransactionID,
+			UserID:         user.ID,
+			StripeRefundID: refund.ID,
+			Amount:         refunded,
+			Reason:         chargeToRefund.Reason,
+		})
+	}
+	if err != nil {
 		errResp := errors.New("the charge was refunded, but the database could not be updated")
-		app.logger.Error(errResp)
+		app.logger.Error(errResp, ": ", err)
 		if err = app.badRequest(w, r, errResp); err != nil {
 			app.logger.Error(err)
 		}
@@ -830,6 +1206,9 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 
 	resp.Error = false
 	resp.Message = "Charge refunded"
+	if more < 0 {
+		resp.Message = "Charge partially refunded"
+	}
 
 	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
 		app.logger.Error("error writing response: ", zap.Error(err))
@@ -853,9 +1232,11 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 	}
 
 	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: subToCancel.Currency,
+		Secret:         app.config.stripe.secret,
+		Key:            app.config.stripe.key,
+		Currency:       subToCancel.Currency,
+		Gateway:        app.gateway,
+		IdempotencyKey: idempotencyKeyFromContext(r.Context()),
 	}
 
 	if err = card.CancelSubscription(subToCancel.PaymentIntent); err != nil {
@@ -866,7 +1247,8 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err = app.DB.UpdateOrderStatus(subToCancel.ID, 3); err != nil {
+	// the order stays active until stripe ends the subscription at the end of the period
+	if err = app.DB.MarkSubscriptionCancelling(subToCancel.PaymentIntent); err != nil {
 		errResp := errors.New("the subscription was cancelled, but the database could not be updated")
 		app.logger.Error(errResp)
 		if err = app.badRequest(w, r, errResp); err != nil {
@@ -881,7 +1263,7 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 	}
 
 	resp.Error = false
-	resp.Message = "Subscription cancelled"
+	resp.Message = "Subscription will be cancelled at the end of the billing period"
 
 	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
 		app.logger.Error("error writing response: ", zap.Error(err))
@@ -998,7 +1380,7 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err = app.DB.AddUser(user, string(newHash)); err != nil {
+		if user.ID, err = app.DB.AddUser(user, string(newHash)); err != nil {
 			app.logger.Error(err)
 			if err = app.badRequest(w, r, err); err != nil {
 				app.logger.Error(err)
@@ -1009,6 +1391,17 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		resp.Message = "New user added successfully"
 	}
 
+	// roles are kept when the form doesn't send them
+	if user.Roles != nil {
+		if err = app.DB.SetUserRoles(user.ID, user.Roles); err != nil {
+			app.logger.Error(err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+	}
+
 	resp.Error = false
 
 	if err := app.writeJson(w, http.StatusOK, user); err != nil {
@@ -1049,3 +1442,43 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+// lets a user locked out by failed logins try again
+func (app *application) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.UnlockAccount(user.Email); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = "User unlocked"
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
@@ -92,6 +92,54 @@ func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	return nil
 }
 
+// sends json response for users whose roles don't allow what they asked for
+func (app *application) forbidden(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "you don't have permission to do this"
+
+	if err := app.writeJson(w, http.StatusForbidden, payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sends json response for server faults, such as the database being unavailable
+func (app *application) serverError(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "the server could not process the request"
+
+	if err := app.writeJson(w, http.StatusInternalServerError, payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sends json response for users whose role requires two-factor authentication they haven't set up
+func (app *application) twoFactorSetupRequired(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "set up two-factor authentication before doing this"
+
+	if err := app.writeJson(w, http.StatusForbidden, payload); err != nil {
+		return err
+	}
+	return nil
+}
+
 // validates password
 func (app *application) passwordMatches(hash, password string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-stripe/internal/models"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+	maxIdempotencyKey = 255
+)
+
+type contextKey string
+
+const stripeIdempotencyKey contextKey = "stripeIdempotencyKey"
+
+// captures status and body of a response so it can be replayed
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// replays stored responses for POST requests sent with an Idempotency-Key header
+// and rejects duplicates of requests still in progress. Responses are stored as they are,
+// so it only goes on routes whose responses hold no tokens
+func (app *application) Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			if err := app.badRequest(w, r, errors.New("idempotency key is too long")); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		// keys are scoped to the user so one user can't replay another's response
+		userID := 0
+		if r.Header.Get("Authorization") != "" {
+			user, _, err := app.authenticateToken(r)
+			if err != nil {
+				if err = app.invalidCredentials(w); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+			userID = user.ID
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		route := r.URL.Path
+
+		stored, err := app.DB.StartIdempotentRequest(userID, key, route, hex.EncodeToString(hash[:]))
+		if err != nil {
+			app.idempotencyError(w, err)
+			return
+		}
+
+		if stored != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(replayedHeader, "true")
+			w.WriteHeader(stored.StatusCode)
+			if _, err = w.Write([]byte(stored.ResponseBody)); err != nil {
+				app.logger.Error("error writing response: ", zap.Error(err))
+			}
+			return
+		}
+
+		// stripe keys are global to the account, so derive one unique to this user and route
+		stripeKey := sha256.Sum256([]byte(fmt.Sprintf("%d:%s:%s", userID, route, key)))
+		ctx := context.WithValue(r.Context(), stripeIdempotencyKey, hex.EncodeToString(stripeKey[:16]))
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		// server errors may be transient, let the client retry with the same key
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			if err = app.DB.DeleteIdempotentRequest(userID, key, route); err != nil {
+				app.logger.Error("failed to release idempotency key: ", zap.Error(err))
+			}
+			return
+		}
+
+		if err = app.DB.CompleteIdempotentRequest(userID, key, route, rec.status, rec.body.Bytes()); err != nil {
+			app.logger.Error("failed to store idempotent response: ", zap.Error(err))
+		}
+	})
+}
+
+// writes response for idempotency key that can't be used
+func (app *application) idempotencyError(w http.ResponseWriter, err error) {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = err.Error()
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, models.ErrIdempotencyInProgress):
+		status = http.StatusConflict
+	case errors.Is(err, models.ErrIdempotencyMismatch):
+		status = http.StatusUnprocessableEntity
+	default:
+		app.logger.Error("failed to start idempotent request: ", zap.Error(err))
+		payload.Message = "internal server error"
+	}
+
+	if err = app.writeJson(w, status, payload); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns idempotency key to forward to stripe, empty when the request had none
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(stripeIdempotencyKey).(string)
+	return key
+}
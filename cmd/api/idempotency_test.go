@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/money"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const idempotentBody = `{"amount": 1000}`
+
+var idempotencyColumns = []string{
+	"id", "user_id", "idempotency_key", "route", "request_hash", "completed",
+	"status_code", "response_body", "locked_at", "created_at", "updated_at",
+}
+
+// returns hash the middleware stores for body
+func requestHash(body string) string {
+	hash := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(hash[:])
+}
+
+// posts body with idempotency key through the middleware in front of next
+func postIdempotent(app *application, next http.Handler, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/payment-intent", strings.NewReader(body))
+	r.Header.Set(idempotencyHeader, key)
+
+	w := httptest.NewRecorder()
+	app.Idempotency(next).ServeHTTP(w, r)
+	return w
+}
+
+// handler charging the fake gateway with the key the middleware derived, returns it and the
+// payment intents it made
+func chargingHandler(app *application, status int) (http.Handler, *[]string) {
+	var intents []string
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		amount, _ := money.New(1000, "eur")
+		card := cards.Card{Gateway: app.gateway, IdempotencyKey: idempotencyKeyFromContext(r.Context())}
+
+		pi, _, err := card.Charge(amount)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		intents = append(intents, pi.ID)
+
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"id": "` + pi.ID + `"}`))
+	}), &intents
+}
+
+// expects the key to be claimed by this request
+func expectClaim(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("delete from idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert ignore into idempotency_keys").WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expects the key to be held by an earlier request stored as row
+func expectStored(mock sqlmock.Sqlmock, hash string, completed bool, status int, body string, lockedAt time.Time) {
+	mock.ExpectExec("delete from idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert ignore into idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("from\\s+idempotency_keys").WillReturnRows(sqlmock.NewRows(idempotencyColumns).
+		AddRow(1, 0, "key-1", "/api/payment-intent", hash, completed, status, body, lockedAt, lockedAt, lockedAt))
+}
+
+func Test_IdempotencyStoresResponse(t *testing.T) {
+	app, mock := newTestApp(t)
+	next, intents := chargingHandler(app, http.StatusOK)
+
+	expectClaim(mock)
+	mock.ExpectExec("update idempotency_keys\\s+set completed = 1").
+		WithArgs(http.StatusOK, sqlmock.AnyArg(), sqlmock.AnyArg(), 0, "key-1", "/api/payment-intent").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := postIdempotent(app, next, "key-1", idempotentBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, *intents, 1)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_IdempotencyReplay(t *testing.T) {
+	app, mock := newTestApp(t)
+	next, intents := chargingHandler(app, http.StatusOK)
+
+	expectStored(mock, requestHash(idempotentBody), true, http.StatusCreated, `{"id": "pi_stored"}`, time.Now())
+
+	w := postIdempotent(app, next, "key-1", idempotentBody)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, `{"id": "pi_stored"}`, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get(replayedHeader))
+	// the card isn't charged again
+	assert.Empty(t, *intents)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_IdempotencyInProgress(t *testing.T) {
+	app, mock := newTestApp(t)
+	next, intents := chargingHandler(app, http.StatusOK)
+
+	expectStored(mock, requestHash(idempotentBody), false, 0, "", time.Now())
+
+	w := postIdempotent(app, next, "key-1", idempotentBody)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, *intents)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_IdempotencyMismatch(t *testing.T) {
+	app, mock := newTestApp(t)
+	next, intents := chargingHandler(app, http.StatusOK)
+
+	expectStored(mock, requestHash(`{"amount": 5000}`), true, http.StatusOK, `{}`, time.Now())
+
+	w := postIdempotent(app, next, "key-1", idempotentBody)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Empty(t, *intents)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_IdempotencyRetryAfterServerError(t *testing.T) {
+	app, mock := newTestApp(t)
+	next, intents := chargingHandler(app, http.StatusInternalServerError)
+
+	// the key is released so the client can retry with it
+	expectClaim(mock)
+	mock.ExpectExec("delete from idempotency_keys where user_id").
+		WithArgs(0, "key-1", "/api/payment-intent").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	w := postIdempotent(app, next, "key-1", idempotentBody)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// the retry sends stripe the same key, so the card is charged once
+	expectClaim(mock)
+	mock.ExpectExec("delete from idempotency_keys where user_id").WillReturnResult(sqlmock.NewResult(0, 1))
+	postIdempotent(app, next, "key-1", idempotentBody)
+
+	assert.Len(t, *intents, 2)
+	assert.Equal(t, (*intents)[0], (*intents)[1])
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_IdempotencyWithoutKey(t *testing.T) {
+	app, mock := newTestApp(t)
+	next, intents := chargingHandler(app, http.StatusOK)
+
+	w := postIdempotent(app, next, "", idempotentBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, *intents, 1)
+
+	w = postIdempotent(app, next, strings.Repeat("k", maxIdempotencyKey+1), idempotentBody)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, *intents, 1)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/models"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v73"
+	"go.uber.org/zap"
+)
+
+// how long stock stays reserved for an unconfirmed payment
+const reservationTTL = 15 * time.Minute
+
+// returns message shown to customer when stock cannot be reserved
+func stockErrorMessage(err error) string {
+	if errors.Is(err, models.ErrOutOfStock) {
+		return "Sorry, this item is out of stock"
+	}
+
+	return "Unable to reserve stock"
+}
+
+// links reservation to created payment intent, releases it when the intent failed
+func (app *application) assignReservation(reference string, pi *stripe.PaymentIntent, err error) {
+	if reference == "" {
+		return
+	}
+
+	if err != nil || pi == nil {
+		if err = app.DB.ReleaseReservation(reference); err != nil {
+			app.logger.Error("failed to release reservation: ", zap.Error(err))
+		}
+		return
+	}
+
+	if err = app.DB.UpdateReservationReference(reference, pi.ID); err != nil {
+		app.logger.Error("failed to assign reservation to payment intent: ", zap.Error(err))
+	}
+}
+
+// periodically expires reservations whose payment never completed
+func (app *application) expireReservations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		app.expireDueReservations()
+	}
+}
+
+// expires reservations past their ttl once
+func (app *application) expireDueReservations() {
+	expired, err := app.DB.ExpireReservations()
+	if err != nil {
+		app.logger.Error("failed to expire reservations: ", zap.Error(err))
+		return
+	}
+
+	if expired > 0 {
+		app.logger.Info("expired ", expired, " inventory reservations")
+	}
+}
+
+// returns page of inventory ledger
+func (app *application) InventoryMovements(w http.ResponseWriter, r *http.Request) {
+	var userInput struct {
+		PageSize    int `json:"page_size"`
+		CurrentPage int `json:"page"`
+	}
+
+	err := app.readJSON(w, r, &userInput)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	movements, lastPage, totalRecords, err := app.DB.GetInventoryMovements(userInput.PageSize, userInput.CurrentPage)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		CurrentPage  int                         `json:"current_page"`
+		PageSize     int                         `json:"page_size"`
+		LastPage     int                         `json:"last_page"`
+		TotalRecords int                         `json:"total_records"`
+		Movements    []*models.InventoryMovement `json:"movements"`
+	}
+
+	resp.CurrentPage = userInput.CurrentPage
+	resp.PageSize = userInput.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Movements = movements
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
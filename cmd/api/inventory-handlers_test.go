@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/money"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AssignReservation(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	amount, _ := money.New(1000, "eur")
+	card := cards.Card{Gateway: app.gateway}
+	pi, _, err := card.Charge(amount)
+	assert.Nil(t, err)
+
+	// the reservation is renamed to the payment intent, webhooks find it by that
+	mock.ExpectExec("update inventory_reservations set reference").
+		WithArgs(pi.ID, sqlmock.AnyArg(), "res_1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	app.assignReservation("res_1", pi, nil)
+
+	// stock held for an intent that couldn't be created is given back at once
+	mock.ExpectExec("update inventory_reservations set status").
+		WithArgs("released", sqlmock.AnyArg(), "res_2", "pending").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	app.assignReservation("res_2", nil, errors.New("card declined"))
+
+	// nothing was reserved, nothing is released
+	app.assignReservation("", nil, errors.New("card declined"))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ExpireDueReservations(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectExec("update inventory_reservations set status").
+		WithArgs("expired", sqlmock.AnyArg(), "pending", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	app.expireDueReservations()
+
+	mock.ExpectExec("update inventory_reservations set status").WillReturnError(errors.New("connection lost"))
+	app.expireDueReservations()
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
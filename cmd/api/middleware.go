@@ -1,10 +1,19 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"go-stripe/internal/models"
+	"net/http"
+)
+
+const (
+	authenticatedUser  contextKey = "authenticatedUser"
+	authenticatedToken contextKey = "authenticatedToken"
+)
 
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
+		user, token, err := app.authenticateToken(r)
 		if err != nil {
 			if err = app.invalidCredentials(w); err != nil {
 				app.logger.Error(err)
@@ -12,6 +21,84 @@ func (app *application) Auth(next http.Handler) http.Handler {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), authenticatedUser, user)
+		ctx = context.WithValue(ctx, authenticatedToken, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// lets through users whose roles grant permission, Auth must run first
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value(authenticatedUser).(*models.User)
+			if !ok {
+				if err := app.invalidCredentials(w); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+
+			// roles that require two-factor authentication grant nothing until it is set up
+			if user.TwoFactorRequired && !user.TwoFactorEnabled {
+				if err := app.twoFactorSetupRequired(w); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+
+			permissions, err := app.DB.GetUserPermissions(user.ID)
+			if err != nil {
+				app.logger.Error("failed to get user permissions: ", err)
+				if err = app.serverError(w); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+			if !permissions.Has(permission) {
+				if err = app.forbidden(w); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// lets through tokens given scope, login tokens have every scope, Auth must run first
+func (app *application) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := r.Context().Value(authenticatedToken).(*models.Token)
+			if !ok {
+				if err := app.invalidCredentials(w); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+
+			if !token.Allows(scope) {
+				if err := app.forbidden(w); err != nil {
+					app.logger.Error(err)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// returns user the request was authenticated as, Auth must run first
+func userFromContext(ctx context.Context) *models.User {
+	user, _ := ctx.Value(authenticatedUser).(*models.User)
+	return user
+}
+
+// returns token the request was authenticated with, Auth must run first
+func tokenFromContext(ctx context.Context) *models.Token {
+	token, _ := ctx.Value(authenticatedToken).(*models.Token)
+	return token
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"go-stripe/internal/money"
+	"go-stripe/internal/urlsigner"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v73"
+	"go.uber.org/zap"
+)
+
+var errInvalidCustomerToken = errors.New("please log in again to pay with a saved card")
+
+// returns customer the front end signed token for, see models.CustomerTokenPath
+func (app *application) customerFromToken(token string) (models.Customer, error) {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+
+	if token == "" || !signer.VerityToken(token) || signer.Expired(token, models.CustomerTokenExpiry) {
+		return models.Customer{}, errInvalidCustomerToken
+	}
+
+	u, err := url.Parse(token)
+	if err != nil || !strings.HasSuffix(u.Path, models.CustomerTokenPath) {
+		return models.Customer{}, errInvalidCustomerToken
+	}
+
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return models.Customer{}, errInvalidCustomerToken
+	}
+
+	return app.DB.GetCustomerByID(id)
+}
+
+// returns stripe customer to subscribe, the logged in customer's own one so the card is saved with their others,
+// otherwise a new one, returns potentially error message
+func (app *application) subscriptionCustomer(card *cards.Card, data stripePayload) (*stripe.Customer, string, error) {
+	if data.CustomerToken == "" {
+		return card.CreateCustomer(data.PaymentMethod, data.Email)
+	}
+
+	customer, err := app.customerFromToken(data.CustomerToken)
+	if err != nil {
+		return nil, errInvalidCustomerToken.Error(), err
+	}
+
+	if customer.StripeCustomerID == "" {
+		stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
+		if err != nil {
+			return nil, msg, err
+		}
+
+		if _, err = app.DB.SetStripeCustomerID(customer.ID, stripeCustomer.ID); err != nil {
+			app.logger.Error("failed to save stripe customer id: ", zap.Error(err))
+		}
+
+		return stripeCustomer, "", nil
+	}
+
+	if _, msg, err := card.AttachPaymentMethod(customer.StripeCustomerID, data.PaymentMethod); err != nil {
+		return nil, msg, err
+	}
+
+	// the new card pays for the subscription, not the customer's default one
+	card.PaymentMethod = data.PaymentMethod
+
+	stripeCustomer, err := card.GetCustomer(customer.StripeCustomerID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return stripeCustomer, "", nil
+}
+
+// returns cards saved for customer with the email, for charging them from the virtual terminal
+func (app *application) SavedCardsForCustomer(w http.ResponseWriter, r *http.Request) {
+	var userInput struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &userInput)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	customer, err := app.DB.GetCustomerWithSavedCards(userInput.Email)
+	if err != nil {
+		if err = app.badRequest(w, r, errors.New("no saved cards for this email")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	card := cards.Card{
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
+	}
+
+	saved, err := card.SavedCards(customer.StripeCustomerID)
+	if err != nil {
+		app.logger.Error("failed to get saved cards: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error    bool              `json:"error"`
+		Message  string            `json:"message"`
+		Customer models.Customer   `json:"customer"`
+		Cards    []cards.SavedCard `json:"cards"`
+	}
+
+	resp.Customer = customer
+	resp.Cards = saved
+
+	if err = app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// charges saved card of customer from the virtual terminal, the customer isn't there to confirm it
+func (app *application) VirtualTerminalChargeSavedCard(w http.ResponseWriter, r *http.Request) {
+	var txData struct {
+		Amount        money.Money `json:"amount"`
+		Email         string      `json:"email"`
+		PaymentMethod string      `json:"payment_method"`
+	}
+
+	err := app.readJSON(w, r, &txData)
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if !txData.Amount.IsPositive() {
+		if err = app.badRequest(w, r, errors.New("amount must be positive")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	customer, err := app.DB.GetCustomerWithSavedCards(txData.Email)
+	if err != nil {
+		if err = app.badRequest(w, r, errors.New("no saved cards for this email")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	card := cards.Card{
+		Secret:         app.config.stripe.secret,
+		Key:            app.config.stripe.key,
+		Currency:       txData.Amount.Currency(),
+		Gateway:        app.gateway,
+		IdempotencyKey: idempotencyKeyFromContext(r.Context()),
+	}
+
+	pi, msg, err := card.ChargeSavedCard(customer.StripeCustomerID, txData.PaymentMethod, txData.Amount, true)
+	if err != nil {
+		app.logger.Error("failed to charge saved card: ", zap.Error(err))
+		if msg == "" {
+			msg = "The card could not be charged"
+		}
+		if err = app.badRequest(w, r, errors.New(msg)); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = cards.CheckSucceeded(pi); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, errors.New("The card could not be charged")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	tx, err := app.saveTerminalTransaction(&card, pi, txData.PaymentMethod)
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.writeJson(w, http.StatusOK, tx); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// returns catalog of subscription plans
+func (app *application) Plans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.DB.GetPlans()
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err := app.writeJson(w, http.StatusOK, plans); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns subscription order from url with its current plan and the plan it is switched to
+func (app *application) planChange(r *http.Request, widgetID int) (models.Order, models.Widget, models.Widget, error) {
+	var current, plan models.Widget
+
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return models.Order{}, current, plan, err
+	}
+
+	order, err := app.DB.GetOrderByID(orderID)
+	if err != nil {
+		return order, current, plan, err
+	}
+
+	if len(order.Items) != 1 || !order.Items[0].Widget.IsRecurring {
+		return order, current, plan, errors.New("order is not a subscription")
+	}
+
+	if order.StatusID == models.OrderStatusCancelled {
+		return order, current, plan, errors.New("subscription is cancelled")
+	}
+
+	if order.Subscription != nil && order.Subscription.CancelAtPeriodEnd {
+		return order, current, plan, errors.New("subscription ends at the end of the billing period")
+	}
+
+	current = order.Items[0].Widget
+
+	plan, err = app.DB.GetPlan(widgetID)
+	if err != nil {
+		return order, current, plan, err
+	}
+
+	if plan.ID == current.ID {
+		return order, current, plan, errors.New("subscription is already on this plan")
+	}
+
+	if _, err = plan.PriceIn(order.Transaction.Amount.Currency()); err != nil {
+		return order, current, plan, err
+	}
+
+	return order, current, plan, nil
+}
+
+// previews prorated charge of switching subscription to another plan
+func (app *application) PreviewPlanChange(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		WidgetID int `json:"widget_id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	order, current, plan, err := app.planChange(r, payload.WidgetID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	card := cards.Card{
+		Secret:   app.config.stripe.secret,
+		Key:      app.config.stripe.key,
+		Currency: order.Transaction.Amount.Currency(),
+		Gateway:  app.gateway,
+	}
+
+	preview, err := card.PreviewPlanChange(order.Transaction.PaymentIntent, plan.PlanID, time.Now().Unix())
+	if err != nil {
+		app.logger.Error("failed to preview plan change: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool                     `json:"error"`
+		Message string                   `json:"message"`
+		Upgrade bool                     `json:"upgrade"`
+		Preview *cards.PlanChangePreview `json:"preview"`
+	}
+
+	resp.Error = false
+	resp.Upgrade = plan.IsUpgradeFrom(current)
+	resp.Preview = preview
+	if resp.Upgrade {
+		resp.Message = "The prorated amount is charged right away"
+	} else {
+		resp.Message = "The prorated credit is applied to the next invoice"
+	}
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// switches subscription to another plan, upgrades are charged right away
+// and downgrades are credited on the next invoice
+func (app *application) ChangeSubscriptionPlan(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		WidgetID      int   `json:"widget_id"`
+		ProrationDate int64 `json:"proration_date"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	order, current, plan, err := app.planChange(r, payload.WidgetID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	// charge what was previewed, unless the preview is missing or stale
+	prorationDate := payload.ProrationDate
+	if prorationDate <= 0 || time.Since(time.Unix(prorationDate, 0)) > time.Hour {
+		prorationDate = time.Now().Unix()
+	}
+
+	card := cards.Card{
+		Secret:         app.config.stripe.secret,
+		Key:            app.config.stripe.key,
+		Currency:       order.Transaction.Amount.Currency(),
+		Gateway:        app.gateway,
+		IdempotencyKey: idempotencyKeyFromContext(r.Context()),
+	}
+
+	_, err = card.ChangePlan(order.Transaction.PaymentIntent, plan.PlanID, prorationDate, plan.IsUpgradeFrom(current))
+	if err != nil {
+		app.logger.Error("failed to change plan: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.ChangeOrderPlan(order.ID, plan, order.Transaction.Amount.Currency()); err != nil {
+		errResp := errors.New("the plan was changed, but the database could not be updated")
+		app.logger.Error(errResp, zap.Error(err))
+		if err = app.badRequest(w, r, errResp); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Plan changed to " + plan.Name
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
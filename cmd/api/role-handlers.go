@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// returns all roles with their permissions, for giving them to users
+func (app *application) AllRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err := app.writeJson(w, http.StatusOK, roles); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
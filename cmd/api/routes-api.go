@@ -1,6 +1,7 @@
 package main
 
 import (
+	"go-stripe/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -14,17 +15,36 @@ func (app *application) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", idempotencyHeader},
+		ExposedHeaders:   []string{replayedHeader},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
-	mux.Post("/v"+app.version[0:1]+"/api/payment-intent", app.GetPaymentIntent)
+	// only routes that charge, refund or make stripe objects store responses for idempotency keys,
+	// others such as logins would keep tokens in the database
+	mux.With(app.Idempotency).Post("/v"+app.version[0:1]+"/api/payment-intent", app.GetPaymentIntent)
 	mux.Get("/v"+app.version[0:1]+"/api/widget/{id}", app.GetWidgetByID)
+	mux.Get("/v"+app.version[0:1]+"/api/plans", app.Plans)
 
-	mux.Post("/v"+app.version[0:1]+"/api/create-customer-subscribe", app.CreateCustomerSubscribe)
+	mux.With(app.Idempotency).Post("/v"+app.version[0:1]+"/api/create-customer-subscribe", app.CreateCustomerSubscribe)
+	mux.Post("/v"+app.version[0:1]+"/api/coupons/check", app.CheckCoupon)
+	mux.Post("/v"+app.version[0:1]+"/api/checkout/quote", app.CheckoutQuote)
+
+	mux.Post("/v"+app.version[0:1]+"/api/webhooks/stripe", app.StripeWebhook)
+
+	mux.Route("/v"+app.version[0:1]+"/api/cart", func(mux chi.Router) {
+		mux.Post("/", app.CreateCart)
+		mux.Get("/{token}", app.GetCart)
+		mux.Post("/{token}/items", app.AddCartItem)
+		mux.Put("/{token}/items/{widgetID}", app.UpdateCartItem)
+		mux.Delete("/{token}/items/{widgetID}", app.RemoveCartItem)
+		mux.With(app.Idempotency).Post("/{token}/payment-intent", app.CartPaymentIntent)
+	})
 
 	mux.Post("/v"+app.version[0:1]+"/api/auth", app.CreateAuthToken)
+	mux.Post("/v"+app.version[0:1]+"/api/auth/refresh", app.RefreshAuthToken)
+	mux.Post("/v"+app.version[0:1]+"/api/auth/two-factor", app.VerifyTwoFactor)
 	mux.Post("/v"+app.version[0:1]+"/api/is-authenticated", app.CheckAuth)
 	mux.Post("/v"+app.version[0:1]+"/api/forgot-password", app.SendPasswordResetEmail)
 	mux.Post("/v"+app.version[0:1]+"/api/reset-password", app.ResetPassword)
@@ -32,19 +52,87 @@ func (app *application) routes() http.Handler {
 	mux.Route("/v"+app.version[0:1]+"/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
-		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
+		// what each route needs is granted by the user's roles, and the token must have its scope
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermVirtualTerminal), app.RequireScope(models.ScopeVirtualTerminal))
+
+			mux.With(app.Idempotency).Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
+			mux.With(app.Idempotency).Post("/virtual-terminal-charge-saved", app.VirtualTerminalChargeSavedCard)
+			mux.Post("/customers/saved-cards", app.SavedCardsForCustomer)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermViewSales), app.RequireScope(models.ScopeReadSales))
+
+			mux.Post("/all-sales", app.AllSales)
+			mux.Post("/all-subscriptions", app.AllSubscriptions)
+			mux.Post("/at-risk-subscriptions", app.AtRiskSubscriptions)
+			mux.Post("/get-sale/{id}", app.GetSale)
+		})
+
+		mux.With(app.RequirePermission(models.PermViewInventory), app.RequireScope(models.ScopeReadInventory)).Post("/inventory-movements", app.InventoryMovements)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermManageCustomers), app.RequireScope(models.ScopeManageCustomers))
+
+			mux.Post("/customers/duplicates", app.DuplicateCustomers)
+			mux.Post("/customers/merge", app.MergeCustomers)
+			mux.Post("/customers/merges", app.CustomerMerges)
+		})
+
+		mux.With(app.RequirePermission(models.PermRefund), app.RequireScope(models.ScopeRefund), app.Idempotency).Post("/refund", app.RefundCharge)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermManageSubscriptions), app.RequireScope(models.ScopeManageSubscriptions))
+
+			mux.With(app.Idempotency).Post("/cancel-subscription", app.CancelSubscription)
+			mux.Post("/subscriptions/{id}/preview-plan-change", app.PreviewPlanChange)
+			mux.With(app.Idempotency).Post("/subscriptions/{id}/change-plan", app.ChangeSubscriptionPlan)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermManageCoupons), app.RequireScope(models.ScopeManageCoupons))
+
+			mux.Post("/all-coupons", app.AllCoupons)
+			mux.Post("/all-coupons/{id}", app.OneCoupon)
+			mux.With(app.Idempotency).Post("/all-coupons/edit/{id}", app.EditCoupon)
+			mux.Post("/all-coupons/delete/{id}", app.DeleteCoupon)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermManageTaxRates), app.RequireScope(models.ScopeManageTaxRates))
+
+			mux.Post("/all-tax-rates", app.AllTaxRates)
+			mux.Post("/all-tax-rates/edit/{id}", app.EditTaxRate)
+			mux.Post("/all-tax-rates/delete/{id}", app.DeleteTaxRate)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermManageUsers), app.RequireScope(models.ScopeManageUsers))
+
+			mux.Post("/all-users", app.AllUsers)
+			mux.Post("/all-users/{id}", app.OneUser)
+			mux.Post("/all-users/edit/{id}", app.EditUser)
+			mux.Post("/all-users/delete/{id}", app.DeleteUser)
+			mux.Post("/all-users/reset-two-factor/{id}", app.ResetUserTwoFactor)
+			mux.Post("/all-users/unlock/{id}", app.UnlockUser)
+			mux.Post("/all-roles", app.AllRoles)
+			mux.Post("/all-tokens", app.AllTokens)
+			mux.Post("/all-tokens/revoke/{id}", app.RevokeAnyToken)
+		})
 
-		mux.Post("/get-sale/{id}", app.GetSale)
+		// users manage their own tokens from a login, named tokens can't make more of themselves
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequireScope(models.ScopeAuthentication))
 
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
+			mux.Post("/tokens", app.Tokens)
+			mux.Post("/tokens/create", app.CreateToken)
+			mux.Post("/tokens/revoke/{id}", app.RevokeToken)
+			mux.Post("/tokens/revoke-all", app.RevokeAllTokens)
+		})
 
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+		// logging out ends the login whatever its scopes
+		mux.Post("/tokens/revoke-current", app.RevokeCurrentToken)
 
 	})
 
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"time"
+
+	"github.com/stripe/stripe-go/v73"
+	"go.uber.org/zap"
+)
+
+// number of subscriptions fetched from stripe per reconciliation run
+const reconcileBatchSize = 100
+
+// builds stored subscription state from stripe subscription
+func subscriptionFromStripe(sub *stripe.Subscription) models.Subscription {
+	s := models.NewSubscription(
+		sub.ID,
+		string(sub.Status),
+		sub.CurrentPeriodStart,
+		sub.CurrentPeriodEnd,
+		sub.CancelAtPeriodEnd,
+		sub.CancelAt,
+		sub.CanceledAt,
+	)
+
+	// latest invoice is only an id unless it was expanded
+	if sub.LatestInvoice != nil {
+		s.LatestInvoice = sub.LatestInvoice.ID
+		s.LatestInvoiceStatus = string(sub.LatestInvoice.Status)
+	}
+
+	return s
+}
+
+// stores subscription state sent with subscription created, updated and deleted events
+func (app *application) handleSubscriptionChanged(event stripe.Event) error {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+		return err
+	}
+
+	s := subscriptionFromStripe(&sub)
+	if err := app.DB.SyncSubscription(s, time.Unix(event.Created, 0)); err != nil {
+		return err
+	}
+
+	// cancelled elsewhere, e.g. in the stripe dashboard, no point retrying its payment
+	if s.Ended() {
+		return app.DB.ResolveDunningCase(sub.ID, models.DunningStatusCancelled)
+	}
+
+	return nil
+}
+
+// periodically refreshes subscriptions from stripe, catching up on missed webhooks
+func (app *application) reconcileSubscriptions(interval time.Duration) {
+	app.reconcileSubscriptionsOnce(interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		app.reconcileSubscriptionsOnce(interval)
+	}
+}
+
+// syncs subscriptions not synced within maxAge
+func (app *application) reconcileSubscriptionsOnce(maxAge time.Duration) {
+	ids, err := app.DB.GetSubscriptionsToReconcile(time.Now().Add(-maxAge), reconcileBatchSize)
+	if err != nil {
+		app.logger.Error("failed to get subscriptions to reconcile: ", zap.Error(err))
+		return
+	}
+
+	card := cards.Card{
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
+	}
+
+	synced := 0
+	for _, id := range ids {
+		// the snapshot is at least as new as the time it was requested
+		at := time.Now()
+
+		sub, err := card.GetSubscription(id)
+		if err != nil {
+			app.logger.Error("failed to get subscription ", id, ": ", zap.Error(err))
+			continue
+		}
+
+		if err = app.DB.SyncSubscription(subscriptionFromStripe(sub), at); err != nil {
+			app.logger.Error("failed to sync subscription ", id, ": ", zap.Error(err))
+			continue
+		}
+		synced++
+	}
+
+	if synced > 0 {
+		app.logger.Info("reconciled ", synced, " subscriptions")
+	}
+}
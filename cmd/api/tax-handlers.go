@@ -0,0 +1,185 @@
+package main
+
+import (
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// returns id of stripe tax rate for widgets of category billed with billing, creating it the first
+// time it is needed, empty when the subscription is not taxed
+func (app *application) stripeTaxRate(card *cards.Card, category string, billing models.BillingDetails) (string, error) {
+	rate, err := app.DB.TaxRateFor(category, billing)
+	if err != nil || rate == nil {
+		return "", err
+	}
+
+	inclusive := models.PricesIncludeTax(card.Currency)
+
+	id := rate.StripeTaxRateID
+	if inclusive {
+		id = rate.StripeInclusiveTaxRateID
+	}
+	if id != "" {
+		return id, nil
+	}
+
+	str, err := card.CreateTaxRate(rate.Name, rate.Country, rate.Region, rate.Rate, inclusive)
+	if err != nil {
+		return "", err
+	}
+
+	// a rate created twice by concurrent subscriptions is harmless, the last one is kept
+	if err = app.DB.SetStripeTaxRateID(rate.ID, inclusive, str.ID); err != nil {
+		app.logger.Error("failed to save stripe tax rate: ", zap.Error(err))
+	}
+
+	return str.ID, nil
+}
+
+// returns all tax rates
+func (app *application) AllTaxRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := app.DB.GetTaxRates()
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		TaxRates  []*models.TaxRate `json:"tax_rates"`
+		Countries []models.Country  `json:"countries"`
+	}
+
+	resp.TaxRates = rates
+	resp.Countries = models.BillingCountries()
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// creates tax rate when id is 0, otherwise updates its name and rate
+func (app *application) EditTaxRate(w http.ResponseWriter, r *http.Request) {
+	rateID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var rate models.TaxRate
+
+	err = app.readJSON(w, r, &rate)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		ID      int    `json:"id"`
+	}
+
+	if rateID > 0 {
+		existing, err := app.DB.GetTaxRate(rateID)
+		if err != nil {
+			app.logger.Error(err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		// where the rate applies is fixed, a different place gets a rate of its own
+		existing.Name = rate.Name
+		existing.Rate = rate.Rate
+
+		if err = existing.Validate(); err != nil {
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		if err = app.DB.UpdateTaxRate(existing); err != nil {
+			app.logger.Error(err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		resp.ID = existing.ID
+		resp.Message = "Tax rate updated successfully"
+	} else {
+		if err = rate.Validate(); err != nil {
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		id, err := app.DB.InsertTaxRate(rate)
+		if err != nil {
+			app.logger.Error(err)
+			if err = app.badRequest(w, r, err); err != nil {
+				app.logger.Error(err)
+			}
+			return
+		}
+
+		resp.ID = id
+		resp.Message = "New tax rate added successfully"
+	}
+
+	resp.Error = false
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// deletes tax rate, orders already taxed keep their tax
+func (app *application) DeleteTaxRate(w http.ResponseWriter, r *http.Request) {
+	rateID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.DeleteTaxRate(rateID); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Tax rate deleted successfully"
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"go-stripe/internal/models"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// returns ip the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sends 429 and returns true while attempts of scope by keys have to wait. Keys of emails count
+// whether a user has the email or not, so the answer doesn't tell. Attempts that can't be
+// checked get 503, so a database outage doesn't lift the limit
+func (app *application) throttled(w http.ResponseWriter, scope string, keys ...models.ThrottleKey) bool {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	payload.Error = true
+
+	wait, err := app.DB.ThrottleWait(scope, keys...)
+	if err != nil {
+		app.logger.Error("failed to check attempts: ", zap.Error(err))
+		payload.Message = "service unavailable, try again later"
+		if err = app.writeJson(w, http.StatusServiceUnavailable, payload); err != nil {
+			app.logger.Error(err)
+		}
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+
+	payload.Message = fmt.Sprintf("too many attempts, try again in %d seconds", seconds)
+
+	headers := make(http.Header)
+	headers.Set("Retry-After", strconv.Itoa(seconds))
+
+	if err = app.writeJson(w, http.StatusTooManyRequests, payload, headers); err != nil {
+		app.logger.Error(err)
+	}
+	return true
+}
+
+// counts a failed attempt of scope against keys
+func (app *application) recordFailure(scope string, keys ...models.ThrottleKey) {
+	if err := app.DB.RecordFailure(scope, keys...); err != nil {
+		app.logger.Error("failed to record failed attempt: ", zap.Error(err))
+	}
+}
+
+// forgets failed attempts of scope by key once one succeeds
+func (app *application) clearFailures(scope string, key models.ThrottleKey) {
+	if err := app.DB.ClearFailures(scope, key); err != nil {
+		app.logger.Error("failed to clear failed attempts: ", zap.Error(err))
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-stripe/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// returns name of a login token from the browser it was made in
+func loginTokenName(userAgent string) string {
+	userAgent = strings.TrimSpace(userAgent)
+	if userAgent == "" {
+		return "Login"
+	}
+	if len(userAgent) > 200 {
+		userAgent = userAgent[:200]
+	}
+
+	return "Login from " + userAgent
+}
+
+// returns active tokens of the logged in user with the scopes new ones can be given
+func (app *application) Tokens(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+
+	tokens, err := app.DB.GetActiveTokens(user.ID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Tokens  []*models.Token     `json:"tokens"`
+		Scopes  []models.TokenScope `json:"scopes"`
+		Current int                 `json:"current"`
+	}
+
+	resp.Tokens = tokens
+	resp.Scopes = models.TokenScopes()
+	resp.Current = tokenFromContext(r.Context()).ID
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// creates named token with scopes for the logged in user, its plain text is only returned now
+func (app *application) CreateToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		Days   int      `json:"days"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	ttl := time.Duration(input.Days) * 24 * time.Hour
+
+	switch {
+	case input.Name == "" || len(input.Name) > 255:
+		err = errors.New("token name is required and must be at most 255 characters")
+	case ttl <= 0 || ttl > models.MaxTokenTTL:
+		err = fmt.Errorf("tokens last between 1 and %d days", models.MaxTokenTTL/(24*time.Hour))
+	default:
+		err = models.ValidateScopes(input.Scopes)
+	}
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	user := userFromContext(r.Context())
+
+	token, err := models.GenerateToken(user.ID, ttl, input.Scopes...)
+	if err != nil {
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	token.Name = input.Name
+
+	if err = app.DB.InsertToken(token, *user); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool          `json:"error"`
+		Message string        `json:"message"`
+		Token   *models.Token `json:"token"`
+	}
+
+	resp.Error = false
+	resp.Message = "Token created, copy it now, it won't be shown again"
+	resp.Token = token
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// revokes token of the logged in user
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	app.revokeToken(w, r, userFromContext(r.Context()).ID)
+}
+
+// revokes token of any user
+func (app *application) RevokeAnyToken(w http.ResponseWriter, r *http.Request) {
+	app.revokeToken(w, r, 0)
+}
+
+// revokes token with id from the url, it must be of user unless userID is 0
+func (app *application) revokeToken(w http.ResponseWriter, r *http.Request, userID int) {
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.RevokeToken(tokenID, userID); err != nil {
+		if !errors.Is(err, models.ErrTokenNotFound) {
+			app.logger.Error(err)
+		}
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Token revoked"
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// revokes all tokens of the logged in user but the one of this login, logging out their other devices
+func (app *application) RevokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+
+	n, err := app.DB.RevokeAllTokens(user.ID, tokenFromContext(r.Context()).ID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = fmt.Sprintf("%d tokens revoked", n)
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// revokes token the request was made with, when logging out
+func (app *application) RevokeCurrentToken(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromContext(r.Context())
+
+	if err := app.DB.RevokeToken(token.ID, int(token.UserID)); err != nil && !errors.Is(err, models.ErrTokenNotFound) {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Logged out"
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns active tokens of all users
+func (app *application) AllTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := app.DB.GetActiveTokens(0)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err := app.writeJson(w, http.StatusOK, tokens); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// swaps a login's refresh token for a new access token and refresh token. A refresh token used
+// twice logs the login out everywhere it was copied to
+func (app *application) RefreshAuthToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	token, refreshToken, err := app.DB.RotateRefreshToken(input.RefreshToken, loginTokenName(r.UserAgent()))
+	if errors.Is(err, models.ErrRefreshTokenInvalid) || errors.Is(err, models.ErrRefreshTokenReused) {
+		if errors.Is(err, models.ErrRefreshTokenReused) {
+			app.logger.Warn("refresh token reused, its login was revoked")
+		}
+		if err = app.invalidCredentials(w); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error        bool                 `json:"error"`
+		Message      string               `json:"message"`
+		Token        *models.Token        `json:"auth_token"`
+		RefreshToken *models.RefreshToken `json:"refresh_token"`
+	}
+
+	resp.Message = "token refreshed"
+	resp.Token = token
+	resp.RefreshToken = refreshToken
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
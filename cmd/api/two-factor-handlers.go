@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/encryption"
+	"go-stripe/internal/models"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// second step of a login with two-factor authentication, swaps the challenge from CreateAuthToken
+// and a code for the login's tokens. The website login then finishes with the same challenge
+func (app *application) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	challenge, err := app.DB.GetLoginChallenge(input.Challenge)
+	if errors.Is(err, models.ErrChallengeInvalid) {
+		if err = app.invalidCredentials(w); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	user, err := app.DB.GetUserByID(challenge.UserID)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	// wrong codes count as failed logins, new challenges don't give more tries
+	keys := []models.ThrottleKey{models.AccountKey(user.Email), models.IPKey(clientIP(r))}
+	if app.throttled(w, models.ThrottleLogin, keys...) {
+		return
+	}
+
+	twoFactor, err := app.DB.GetTwoFactor(challenge.UserID)
+	if err != nil {
+		app.logger.Error("failed to get two-factor authentication: ", zap.Error(err))
+		if err = app.serverError(w); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretKey),
+	}
+
+	secret, err := encryptor.Decrypt(twoFactor.Secret)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	valid, err := app.DB.CheckTwoFactorCode(challenge.UserID, secret, input.Code)
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	if !valid {
+		app.recordFailure(models.ThrottleLogin, keys...)
+		if err = app.DB.FailLoginChallenge(challenge.ID); err != nil {
+			app.logger.Error(err)
+		}
+		if err = app.invalidCredentials(w); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.VerifyLoginChallenge(challenge.ID); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+	app.clearFailures(models.ThrottleLogin, keys[0])
+
+	app.sendLoginTokens(w, r, user)
+}
+
+// turns off two-factor authentication of a user who lost their app and recovery codes
+func (app *application) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if err = app.DB.ResetTwoFactor(userID); err != nil {
+		app.logger.Error(err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = "Two-factor authentication reset"
+
+	if err := app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"go-stripe/internal/money"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v73"
+	"github.com/stripe/stripe-go/v73/webhook"
+	"go.uber.org/zap"
+)
+
+// handles single stripe event type
+type webhookHandler func(event stripe.Event) error
+
+// maps stripe event types to their handlers
+func (app *application) webhookHandlers() map[string]webhookHandler {
+	return map[string]webhookHandler{
+		"payment_intent.succeeded":      app.handlePaymentIntentSucceeded,
+		"payment_intent.payment_failed": app.handlePaymentIntentFailed,
+		"payment_intent.canceled":       app.handlePaymentIntentCanceled,
+		"charge.refunded":               app.handleChargeRefunded,
+		"invoice.paid":                  app.handleInvoicePaid,
+		"invoice.payment_failed":        app.handleInvoicePaymentFailed,
+		"customer.subscription.created": app.handleSubscriptionChanged,
+		"customer.subscription.updated": app.handleSubscriptionChanged,
+		"customer.subscription.deleted": app.handleSubscriptionChanged,
+	}
+}
+
+// receives stripe webhooks, verifies signature and dispatches event to its handler
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	maxBytes := 65536
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.logger.Error("failed to read webhook body: ", zap.Error(err))
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	event, err := webhook.ConstructEventWithOptions(payload, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	})
+	if err != nil {
+		app.logger.Error("failed to verify webhook signature: ", zap.Error(err))
+		if err = app.badRequest(w, r, errors.New("invalid signature")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	var resp jsonResponse
+	resp.OK = true
+
+	handler, ok := app.webhookHandlers()[event.Type]
+	if !ok {
+		resp.Message = fmt.Sprintf("event %s ignored", event.Type)
+		if err = app.writeJson(w, http.StatusOK, resp); err != nil {
+			app.logger.Error("error writing response: ", zap.Error(err))
+		}
+		return
+	}
+
+	// the event is only marked processed once its handler finished, a delivery that died midway
+	// leaves it claimed until the lease runs out and a redelivery takes it over
+	state, err := app.DB.ClaimWebhookEvent(event.ID, event.Type)
+	if err != nil {
+		app.logger.Error("failed to record webhook event: ", zap.Error(err))
+		app.webhookFailed(w)
+		return
+	}
+
+	switch state {
+	case models.WebhookEventProcessed:
+		resp.Message = fmt.Sprintf("event %s already processed", event.ID)
+		if err = app.writeJson(w, http.StatusOK, resp); err != nil {
+			app.logger.Error("error writing response: ", zap.Error(err))
+		}
+		return
+	case models.WebhookEventInProgress:
+		resp.OK = false
+		resp.Message = fmt.Sprintf("event %s is being processed", event.ID)
+		if err = app.writeJson(w, http.StatusConflict, resp); err != nil {
+			app.logger.Error("error writing response: ", zap.Error(err))
+		}
+		return
+	}
+
+	if err = handler(event); err != nil {
+		app.logger.Error("failed to handle webhook event ", event.Type, ": ", zap.Error(err))
+
+		// forget the event so stripe can redeliver it
+		if err = app.DB.DeleteWebhookEvent(event.ID); err != nil {
+			app.logger.Error("failed to delete webhook event: ", zap.Error(err))
+		}
+
+		app.webhookFailed(w)
+		return
+	}
+
+	if err = app.DB.MarkWebhookEventProcessed(event.ID); err != nil {
+		app.logger.Error("failed to mark webhook event processed: ", zap.Error(err))
+		app.webhookFailed(w)
+		return
+	}
+
+	resp.Message = fmt.Sprintf("event %s processed", event.ID)
+	if err = app.writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// returns server error so stripe retries the delivery
+func (app *application) webhookFailed(w http.ResponseWriter) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "event could not be processed",
+	}
+
+	if err := app.writeJson(w, http.StatusInternalServerError, resp); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// takes reserved stock, marks transaction cleared, records the order if the browser never posted back
+func (app *application) handlePaymentIntentSucceeded(event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+		return err
+	}
+
+	if err := app.DB.CommitReservation(pi.ID); err != nil {
+		return err
+	}
+
+	_, err := app.DB.GetTransactionByPaymentIntent(pi.ID)
+	if err == nil {
+		_, err = app.DB.UpdateTransactionStatusByPaymentIntent(pi.ID, 2)
+		return err
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if token := pi.Metadata["cart"]; token != "" {
+		return app.recoverCartOrder(&pi, token)
+	}
+
+	quantities, err := models.QuantitiesFromMetadata(pi.Metadata)
+	if errors.Is(err, models.ErrNoItems) {
+		// not created by checkout, nothing to recover
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return app.recoverOrder(&pi, quantities)
+}
+
+// builds cleared transaction from payment intent
+func transactionFromIntent(pi *stripe.PaymentIntent) (models.Transaction, error) {
+	amount, err := cards.PaymentAmount(pi)
+	if err != nil {
+		return models.Transaction{}, err
+	}
+
+	tx := models.Transaction{
+		Amount:              amount,
+		TransactionStatusID: 2,
+		PaymentIntent:       pi.ID,
+	}
+
+	if pi.PaymentMethod != nil {
+		tx.PaymentMethod = pi.PaymentMethod.ID
+	}
+
+	if pi.Charges != nil && len(pi.Charges.Data) > 0 {
+		charge := pi.Charges.Data[0]
+		tx.BankReturnCode = charge.ID
+		if charge.PaymentMethodDetails != nil && charge.PaymentMethodDetails.Card != nil {
+			tx.LastFour = charge.PaymentMethodDetails.Card.Last4
+			tx.ExpiryMonth = int(charge.PaymentMethodDetails.Card.ExpMonth)
+			tx.ExpiryYear = int(charge.PaymentMethodDetails.Card.ExpYear)
+		}
+	}
+
+	return tx, nil
+}
+
+// records customer, transaction and order from payment intent metadata
+func (app *application) recoverOrder(pi *stripe.PaymentIntent, quantities map[int]int) error {
+	tx, err := transactionFromIntent(pi)
+	if err != nil {
+		return err
+	}
+
+	billing := models.BillingDetailsFromMetadata(pi.Metadata)
+	priced, coupon, err := app.DB.PriceOrderWithCoupon(quantities, pi.Metadata["coupon"], string(pi.Currency), billing)
+	if err != nil {
+		return err
+	}
+
+	// a mismatch is not retried, it needs a look from an admin
+	if err = priced.CheckAmount(tx.Amount); err != nil {
+		app.logger.Error("not recording order for payment intent ", pi.ID, ": ", zap.Error(err))
+		return nil
+	}
+
+	customerID, err := app.SaveCustomer(pi.Metadata["first_name"], pi.Metadata["last_name"], pi.Metadata["email"], pi.Metadata["locale"])
+	if err != nil {
+		return err
+	}
+
+	order := models.Order{
+		CustomerID:    customerID,
+		StatusID:      1,
+		Items:         priced.Items,
+		Billing:       priced.Billing,
+		ReverseCharge: priced.ReverseCharge,
+		// addresses were validated when the payment was created
+		BillingAddress:  models.AddressFromMetadata(models.AddressBilling, pi.Metadata),
+		ShippingAddress: models.AddressFromMetadata(models.AddressShipping, pi.Metadata),
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	orderID, err := app.DB.InsertOrderWithTransaction(tx, order)
+	if errors.Is(err, models.ErrPaymentRecorded) {
+		// the browser posted back meanwhile
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if coupon.ID > 0 {
+		if err = app.DB.RedeemCoupon(coupon.ID, orderID, pi.Metadata["email"], priced.Discount); err != nil {
+			app.logger.Error("failed to record coupon redemption: ", zap.Error(err))
+		}
+	}
+
+	app.logger.Info("recovered order ", orderID, " from payment intent ", pi.ID)
+
+	return nil
+}
+
+// records order for cart paid by payment intent
+func (app *application) recoverCartOrder(pi *stripe.PaymentIntent, token string) error {
+	cart, err := app.DB.GetCartByToken(token, string(pi.Currency))
+	if err != nil {
+		return err
+	}
+
+	if cart.Status != models.CartStatusOpen {
+		return nil
+	}
+
+	tx, err := transactionFromIntent(pi)
+	if err != nil {
+		return err
+	}
+
+	order, err := cart.Order()
+	if err != nil {
+		return err
+	}
+
+	if err = app.DB.TaxOrder(&order, models.BillingDetailsFromMetadata(pi.Metadata)); err != nil {
+		return err
+	}
+
+	if err = order.CheckAmount(tx.Amount); err != nil {
+		app.logger.Error("not recording cart order for payment intent ", pi.ID, ": ", zap.Error(err))
+		return nil
+	}
+	order.BillingAddress = models.AddressFromMetadata(models.AddressBilling, pi.Metadata)
+	order.ShippingAddress = models.AddressFromMetadata(models.AddressShipping, pi.Metadata)
+
+	order.CustomerID, err = app.SaveCustomer(pi.Metadata["first_name"], pi.Metadata["last_name"], pi.Metadata["email"], pi.Metadata["locale"])
+	if err != nil {
+		return err
+	}
+
+	orderID, err := app.DB.InsertCartOrder(cart, order, tx)
+	if errors.Is(err, models.ErrCartClosed) || errors.Is(err, models.ErrPaymentRecorded) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	app.logger.Info("recovered cart order ", orderID, " from payment intent ", pi.ID)
+
+	return nil
+}
+
+// marks transaction declined and releases reserved stock
+func (app *application) handlePaymentIntentFailed(event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+		return err
+	}
+
+	if err := app.DB.ReleaseReservation(pi.ID); err != nil {
+		return err
+	}
+
+	_, err := app.DB.UpdateTransactionStatusByPaymentIntent(pi.ID, 3)
+	return err
+}
+
+// releases stock reserved for abandoned payment intent
+func (app *application) handlePaymentIntentCanceled(event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+		return err
+	}
+
+	return app.DB.ReleaseReservation(pi.ID)
+}
+
+// records refunds made outside the admin and marks order refunded or partially refunded
+func (app *application) handleChargeRefunded(event stripe.Event) error {
+	var charge stripe.Charge
+	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+		return err
+	}
+
+	if charge.PaymentIntent == nil {
+		return nil
+	}
+
+	txn, err := app.DB.GetTransactionByPaymentIntent(charge.PaymentIntent.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// newer api versions leave refunds out of the charge, the total below still applies
+	if charge.Refunds != nil {
+		for _, re := range charge.Refunds.Data {
+			if re.Status == stripe.RefundStatusFailed || re.Status == stripe.RefundStatusCanceled {
+				continue
+			}
+
+			userID, _ := strconv.Atoi(re.Metadata["user_id"])
+			reason := re.Metadata["reason"]
+			if reason == "" {
+				reason = string(re.Reason)
+			}
+
+			amount, err := money.New(re.Amount, string(re.Currency))
+			if err != nil {
+				return err
+			}
+
+			err = app.DB.InsertRefund(models.Refund{
+				TransactionID:  txn.ID,
+				UserID:         userID,
+				StripeRefundID: re.ID,
+				Amount:         amount,
+				Reason:         reason,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	refunded, err := money.New(charge.AmountRefunded, string(charge.Currency))
+	if err != nil {
+		return err
+	}
+
+	return app.DB.UpdateRefundStatusByPaymentIntent(charge.PaymentIntent.ID, refunded)
+}
+
+// marks the first charge of a subscription cleared and records the paid invoice
+func (app *application) handleInvoicePaid(event stripe.Event) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+		return err
+	}
+
+	if inv.Subscription == nil {
+		return nil
+	}
+
+	// the transaction is the first charge, renewals don't change it
+	if inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate {
+		if _, err := app.DB.UpdateTransactionStatusByPaymentIntent(inv.Subscription.ID, 2); err != nil {
+			return err
+		}
+	}
+
+	if err := app.DB.UpdateSubscriptionInvoice(inv.Subscription.ID, inv.ID, string(inv.Status)); err != nil {
+		return err
+	}
+
+	// paid after the customer updated the card, or by a retry
+	return app.DB.ResolveDunningCase(inv.Subscription.ID, models.DunningStatusRecovered)
+}
+
+// marks the first charge of a subscription declined, records the unpaid invoice and starts dunning for renewals
+func (app *application) handleInvoicePaymentFailed(event stripe.Event) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+		return err
+	}
+
+	if inv.Subscription == nil {
+		return nil
+	}
+
+	// a failed renewal leaves the paid first charge alone, it is tracked by the subscription's
+	// invoice status and its dunning case
+	if inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate {
+		if _, err := app.DB.UpdateTransactionStatusByPaymentIntent(inv.Subscription.ID, 3); err != nil {
+			return err
+		}
+	}
+
+	if err := app.DB.UpdateSubscriptionInvoice(inv.Subscription.ID, inv.ID, string(inv.Status)); err != nil {
+		return err
+	}
+
+	return app.startDunning(&inv, time.Unix(event.Created, 0))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v73/webhook"
+)
+
+// returns event of type for payment intent as stripe sends it
+func testEvent(eventType, paymentIntent string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"id": "evt_test",
+		"object": "event",
+		"type": %q,
+		"api_version": "2022-08-01",
+		"created": %d,
+		"data": {"object": {"id": %q, "object": "payment_intent"}}
+	}`, eventType, time.Now().Unix(), paymentIntent))
+}
+
+// posts payload to the webhook signed with secret, returns the response
+func postWebhook(app *application, payload []byte, secret string) *httptest.ResponseRecorder {
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", strings.NewReader(string(payload)))
+	r.Header.Set("Stripe-Signature", signed.Header)
+
+	w := httptest.NewRecorder()
+	app.StripeWebhook(w, r)
+	return w
+}
+
+func Test_StripeWebhookSignature(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	w := postWebhook(app, testEvent("payment_intent.canceled", "pi_1"), "whsec_other")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", strings.NewReader(string(testEvent("payment_intent.canceled", "pi_1"))))
+	w = httptest.NewRecorder()
+	app.StripeWebhook(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// nothing is recorded for events that fail verification
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_StripeWebhookIgnoredEvent(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	w := postWebhook(app, testEvent("customer.created", "pi_1"), testWebhookSecret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "ignored")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_StripeWebhookDispatch(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectExec("insert into webhook_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	// the canceled intent gives its reserved stock back
+	mock.ExpectExec("update inventory_reservations set status").
+		WithArgs("released", sqlmock.AnyArg(), "pi_1", "pending").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("update webhook_events set processed_at").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := postWebhook(app, testEvent("payment_intent.canceled", "pi_1"), testWebhookSecret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "processed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_StripeWebhookPaymentFailed(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectExec("insert into webhook_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("update inventory_reservations set status").
+		WithArgs("released", sqlmock.AnyArg(), "pi_2", "pending").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// declined
+	mock.ExpectExec("update transactions set transaction_status_id").
+		WithArgs(3, sqlmock.AnyArg(), "pi_2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update webhook_events set processed_at").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := postWebhook(app, testEvent("payment_intent.payment_failed", "pi_2"), testWebhookSecret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_StripeWebhookAlreadyProcessed(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectExec("insert into webhook_events").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select processed_at from webhook_events").
+		WillReturnRows(sqlmock.NewRows([]string{"processed_at"}).AddRow(time.Now()))
+
+	w := postWebhook(app, testEvent("payment_intent.canceled", "pi_1"), testWebhookSecret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "already processed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_StripeWebhookInProgress(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectExec("insert into webhook_events").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select processed_at from webhook_events").
+		WillReturnRows(sqlmock.NewRows([]string{"processed_at"}).AddRow(nil))
+
+	// stripe retries, by then the delivery holding the event finished or its claim ran out
+	w := postWebhook(app, testEvent("payment_intent.canceled", "pi_1"), testWebhookSecret)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_StripeWebhookHandlerFails(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectExec("insert into webhook_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("update inventory_reservations set status").WillReturnError(errors.New("connection lost"))
+	// the claim is dropped so the redelivery handles the event
+	mock.ExpectExec("delete from webhook_events").
+		WithArgs("evt_test").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := postWebhook(app, testEvent("payment_intent.canceled", "pi_1"), testWebhookSecret)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
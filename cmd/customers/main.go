@@ -0,0 +1,132 @@
+// Command customers finds customers sharing an email and merges them.
+//
+//	customers                          list duplicate groups and the suggested survivor
+//	customers -apply                   merge every group into its suggested survivor
+//	customers -survivor 3 -merge 7,9   merge customers 7 and 9 into customer 3
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go-stripe/internal/driver"
+	"go-stripe/internal/models"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func main() {
+	var (
+		dsn      string
+		apply    bool
+		survivor int
+		merge    string
+	)
+
+	flag.StringVar(&dsn, "dsn", os.Getenv("DSN"), "database connection string")
+	flag.BoolVar(&apply, "apply", false, "merge all duplicates into their suggested survivor")
+	flag.IntVar(&survivor, "survivor", 0, "customer to keep when merging by hand")
+	flag.StringVar(&merge, "merge", "", "comma separated customers to merge into survivor")
+	flag.Parse()
+
+	conn, err := driver.OpenDB(dsn)
+	if err != nil {
+		log.Fatal("unable to connect to database: ", err)
+	}
+	defer conn.Close()
+
+	db := models.DBModel{DB: conn}
+
+	if merge != "" {
+		ids, err := parseIDs(merge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if survivor <= 0 {
+			log.Fatal("-survivor is required with -merge")
+		}
+
+		if err = mergeInto(db, survivor, ids); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	groups, err := db.GetDuplicateCustomers()
+	if err != nil {
+		log.Fatal("failed to find duplicate customers: ", err)
+	}
+
+	if len(groups) == 0 {
+		fmt.Println("no duplicate customers")
+		return
+	}
+
+	printGroups(groups)
+
+	if !apply {
+		fmt.Printf("\n%d emails with duplicates, run with -apply to merge them into the suggested survivor\n", len(groups))
+		return
+	}
+
+	for _, g := range groups {
+		var ids []int
+		for _, c := range g.Customers {
+			ids = append(ids, c.ID)
+		}
+
+		if err = mergeInto(db, g.SurvivorID, ids); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// merges customers and prints the audit records
+func mergeInto(db models.DBModel, survivorID int, ids []int) error {
+	merges, err := db.MergeCustomers(survivorID, ids, 0, models.MergeSourceCLI)
+	if err != nil {
+		return fmt.Errorf("failed to merge into customer %d: %w", survivorID, err)
+	}
+
+	for _, m := range merges {
+		fmt.Printf("merged customer %d <%s> into %d, moved %d orders\n", m.MergedCustomerID, m.MergedEmail, m.SurvivorID, m.OrdersMoved)
+	}
+
+	return nil
+}
+
+// prints duplicate groups, the suggested survivor is marked with *
+func printGroups(groups []*models.DuplicateGroup) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tID\tNAME\tORDERS\tREGISTERED\t")
+
+	for _, g := range groups {
+		for _, c := range g.Customers {
+			id := strconv.Itoa(c.ID)
+			if c.ID == g.SurvivorID {
+				id += "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s %s\t%d\t%t\t\n", g.Email, id, c.FirstName, c.LastName, c.Orders, c.Registered)
+		}
+	}
+
+	w.Flush()
+}
+
+// parses comma separated customer ids
+func parseIDs(s string) ([]int, error) {
+	var ids []int
+
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			return nil, errors.New("invalid customer id: " + part)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
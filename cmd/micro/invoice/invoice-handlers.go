@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"go-stripe/internal/money"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/phpdave11/gofpdf"
@@ -12,14 +15,50 @@ import (
 
 // type for all orders
 type Order struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int         `json:"id"`
+	Items     []OrderItem `json:"items"`
+	Quantity  int         `json:"quantity"`
+	Subtotal  money.Money `json:"subtotal"`
+	Discount  money.Money `json:"discount"`
+	Tax       money.Money `json:"tax"`
+	Amount    money.Money `json:"amount"`
+	Locale    string      `json:"locale"`
+	FirstName string      `json:"first_name"`
+	LastName  string      `json:"last_name"`
+	Email     string      `json:"email"`
+	CreatedAt time.Time   `json:"created_at"`
+	// tax summed by rate, none when the customer is reverse charged
+	TaxLines      []TaxLine      `json:"tax_lines"`
+	TaxIncluded   bool           `json:"tax_included"`
+	Billing       BillingDetails `json:"billing"`
+	ReverseCharge bool           `json:"reverse_charge"`
+	// address lines as printed, empty for orders placed without them
+	BillingAddress  []string `json:"billing_address"`
+	ShippingAddress []string `json:"shipping_address"`
+}
+
+// type for tax of order lines at one rate, rate is in basis points
+type TaxLine struct {
+	Rate    int         `json:"rate"`
+	Taxable money.Money `json:"taxable"`
+	Tax     money.Money `json:"tax"`
+}
+
+// type for where the order is billed
+type BillingDetails struct {
+	Country string `json:"country"`
+	Region  string `json:"region"`
+	VATID   string `json:"vat_id"`
+}
+
+// type for invoice lines
+type OrderItem struct {
+	Product   string      `json:"product"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+	Discount  money.Money `json:"discount"`
+	Tax       money.Money `json:"tax"`
+	Amount    money.Money `json:"amount"`
 }
 
 func (app *application) CreateAndSend(w http.ResponseWriter, r *http.Request) {
@@ -34,6 +73,13 @@ func (app *application) CreateAndSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(order.Items) == 0 {
+		if err = app.badRequest(w, r, errors.New("invoice has no items")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
 	err = app.createInvoicePDF(order)
 	if err != nil {
 		app.logger.Error("error creating invoice: ", err)
@@ -47,7 +93,10 @@ func (app *application) CreateAndSend(w http.ResponseWriter, r *http.Request) {
 		fmt.Sprintf("./invoices/%d.pdf", order.ID),
 	}
 
-	err = app.SendMail("info@widgets.com", order.Email, "Your Invoice", "invoice", attachments, nil)
+	err = app.SendMail("info@widgets.com", order.Email, "Your Invoice", "invoice", attachments, map[string]any{
+		"Order": order,
+		"Total": order.formatAmount(order.Amount),
+	})
 	if err != nil {
 		app.logger.Error("error sending email", err)
 		if err = app.badRequest(w, r, err); err != nil {
@@ -71,11 +120,48 @@ func (app *application) CreateAndSend(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// creates invoice and sends the pdf back for download
+func (app *application) Download(w http.ResponseWriter, r *http.Request) {
+	var order Order
+
+	err := app.readJSON(w, r, &order)
+	if err != nil {
+		app.logger.Error("error reading json: ", err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	if len(order.Items) == 0 {
+		if err = app.badRequest(w, r, errors.New("invoice has no items")); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	err = app.createInvoicePDF(order)
+	if err != nil {
+		app.logger.Error("error creating invoice: ", err)
+		if err = app.badRequest(w, r, err); err != nil {
+			app.logger.Error(err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"invoice-%d.pdf\"", order.ID))
+	http.ServeFile(w, r, fmt.Sprintf("./invoices/%d.pdf", order.ID))
+}
+
 func (app *application) createInvoicePDF(order Order) error {
 	pdf := gofpdf.New("P", "mm", "Letter", "")
 	pdf.SetMargins(10, 13, 10)
 	pdf.SetAutoPageBreak(true, 0)
 
+	// core fonts are cp1252, which has the €, £ and ¥ symbols amounts are written with
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
 	importer := gofpdi.NewImporter()
 
 	t := importer.ImportPage(pdf, "./pdf-templates/invoice.pdf", 1, "/MediaBox")
@@ -87,22 +173,104 @@ func (app *application) createInvoicePDF(order Order) error {
 	pdf.SetX(10)
 	pdf.SetY(50)
 	pdf.SetFont("Times", "", 10)
-	pdf.CellFormat(97, 8, fmt.Sprintf("Attention: %s %s", order.FirstName, order.LastName), "", 0, "L", false, 0, "")
+	pdf.CellFormat(97, 8, tr(fmt.Sprintf("Attention: %s %s", order.FirstName, order.LastName)), "", 0, "L", false, 0, "")
 	pdf.Ln(5)
 	pdf.CellFormat(97, 8, order.Email, "", 0, "L", false, 0, "")
 	pdf.Ln(5)
 	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
+	if order.Billing.Country != "" {
+		billedIn := order.Billing.Country
+		if order.Billing.Region != "" {
+			billedIn += "-" + order.Billing.Region
+		}
+		pdf.Ln(5)
+		pdf.CellFormat(97, 8, "Billed in: "+billedIn, "", 0, "L", false, 0, "")
+	}
+	if order.Billing.VATID != "" {
+		pdf.Ln(5)
+		pdf.CellFormat(97, 8, tr("VAT ID: "+order.Billing.VATID), "", 0, "L", false, 0, "")
+	}
+
+	// addresses are printed next to the head, the shipping one only when it differs
+	printAddress(pdf, tr, 110, "Bill to:", order.BillingAddress)
+	printAddress(pdf, tr, 160, "Ship to:", order.ShippingAddress)
 
 	// invoice items
-	pdf.SetX(58)
 	pdf.SetY(93)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
+	for _, item := range order.Items {
+		pdf.SetX(10)
+		pdf.CellFormat(155, 8, tr(fmt.Sprintf("%s (%s each)", item.Product, order.formatAmount(item.UnitPrice))), "", 0, "L", false, 0, "")
 
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprint(order.Quantity), "", 0, "C", false, 0, "")
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, fmt.Sprint(item.Quantity), "", 0, "C", false, 0, "")
 
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%.2f EUR", float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, tr(order.formatAmount(item.Amount)), "", 0, "R", false, 0, "")
+		pdf.Ln(6)
+
+		if !item.Discount.IsZero() {
+			pdf.SetX(14)
+			pdf.CellFormat(151, 6, tr(fmt.Sprintf("Discount: -%s", order.formatAmount(item.Discount))), "", 0, "L", false, 0, "")
+			pdf.Ln(5)
+		}
+
+		if !item.Tax.IsZero() {
+			pdf.SetX(14)
+			pdf.CellFormat(151, 6, tr(fmt.Sprintf("Tax: %s", order.formatAmount(item.Tax))), "", 0, "L", false, 0, "")
+			pdf.Ln(5)
+		}
+	}
+
+	// invoice totals
+	pdf.Ln(4)
+	type total struct {
+		label  string
+		amount money.Money
+	}
+
+	// tax included in prices is shown after the total, tax added to them before it
+	var taxes []total
+	for _, line := range order.TaxLines {
+		taxes = append(taxes, total{
+			fmt.Sprintf("VAT %s of %s", taxRatePercent(line.Rate), order.formatAmount(line.Taxable)),
+			line.Tax,
+		})
+	}
+	if len(taxes) == 0 {
+		taxes = append(taxes, total{"Tax", order.Tax})
+	}
+
+	totals := []total{
+		{"Subtotal", order.Subtotal},
+		{"Discount", order.Discount.Neg()},
+	}
+	if order.TaxIncluded {
+		totals = append(totals, total{"Total", order.Amount})
+		for _, t := range taxes {
+			totals = append(totals, total{"incl. " + t.label, t.amount})
+		}
+	} else {
+		totals = append(totals, taxes...)
+		totals = append(totals, total{"Total", order.Amount})
+	}
+
+	for _, t := range totals {
+		if t.amount.IsZero() && t.label != "Total" {
+			continue
+		}
+
+		pdf.SetX(100)
+		pdf.CellFormat(85, 6, tr(t.label), "", 0, "R", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 6, tr(order.formatAmount(t.amount)), "", 0, "R", false, 0, "")
+		pdf.Ln(5)
+	}
+
+	if order.ReverseCharge {
+		pdf.Ln(4)
+		pdf.SetX(10)
+		pdf.MultiCell(195, 5, "Reverse charge: no VAT is charged, the customer accounts for it (Article 196 of Council Directive 2006/112/EC).", "", "L", false)
+	}
 
 	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
 
@@ -113,3 +281,31 @@ func (app *application) createInvoicePDF(order Order) error {
 
 	return nil
 }
+
+// prints address lines in a column of the invoice head starting at x, nothing when there are none
+func printAddress(pdf *gofpdf.Fpdf, tr func(string) string, x float64, title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+
+	pdf.SetY(50)
+	pdf.SetX(x)
+	pdf.SetFont("Times", "B", 10)
+	pdf.CellFormat(45, 8, title, "", 0, "L", false, 0, "")
+	pdf.SetFont("Times", "", 10)
+	for _, line := range lines {
+		pdf.Ln(5)
+		pdf.SetX(x)
+		pdf.CellFormat(45, 8, tr(line), "", 0, "L", false, 0, "")
+	}
+}
+
+// formats tax rate in basis points as a percentage, e.g. "20%" or "5.5%"
+func taxRatePercent(rate int) string {
+	return strconv.FormatFloat(float64(rate)/100, 'f', -1, 64) + "%"
+}
+
+// formats amount of the order the way the customer's locale writes it
+func (o Order) formatAmount(amount money.Money) string {
+	return amount.Format(o.Locale)
+}
@@ -20,6 +20,7 @@ func (app *application) routes() http.Handler {
 	}))
 
 	mux.Post("/v"+app.version[0:1]+"/invoice/create-and-send", app.CreateAndSend)
+	mux.Post("/v"+app.version[0:1]+"/invoice/download", app.Download)
 
 	return mux
 }
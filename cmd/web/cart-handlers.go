@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/currency"
+	"go-stripe/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// returns open cart stored in session priced in the customer's currency, or in the default currency
+// when a widget in it isn't sold in theirs, creates a new one when missing or checked out
+func (app *application) currentCart(r *http.Request) (models.Cart, error) {
+	if token := app.Session.GetString(r.Context(), "cartToken"); token != "" {
+		cart, err := app.DB.GetCartByToken(token, app.currency(r))
+		if errors.Is(err, models.ErrNoPrice) {
+			cart, err = app.DB.GetCartByToken(token, currency.Default)
+		}
+		if err == nil && cart.Status == models.CartStatusOpen {
+			return cart, nil
+		}
+	}
+
+	cart, err := app.DB.CreateCart()
+	if err != nil {
+		return cart, err
+	}
+	cart.Currency = app.currency(r)
+
+	app.Session.Put(r.Context(), "cartToken", cart.Token)
+
+	return cart, nil
+}
+
+// handler for cart page
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	cart, err := app.currentCart(r)
+	if err != nil {
+		app.logger.Error("failed to get cart: ", zap.Error(err))
+		return
+	}
+
+	data := map[string]any{
+		"cart": cart,
+	}
+	app.addCustomerAddresses(r, data, models.AddressBilling, models.AddressShipping)
+
+	if err := app.renderTemplate(w, r, "cart", app.cartTemplateData(r, cart, data)); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+// returns template data showing cart in the currency it is priced in
+func (app *application) cartTemplateData(r *http.Request, cart models.Cart, data map[string]any) *templateData {
+	td := &templateData{Data: data, Currency: cart.Currency}
+	if code := app.currency(r); cart.Currency != code {
+		td.Warning = fmt.Sprintf("Some widgets in your cart are not sold in %s, prices are shown in %s",
+			strings.ToUpper(code), strings.ToUpper(cart.Currency))
+	}
+
+	return td
+}
+
+// reads widget id and quantity from cart form
+func (app *application) cartForm(r *http.Request) (int, int, error) {
+	if err := r.ParseForm(); err != nil {
+		return 0, 0, err
+	}
+
+	widgetID, err := strconv.Atoi(r.Form.Get("widget_id"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	quantity := 1
+	if q := r.Form.Get("quantity"); q != "" {
+		quantity, err = strconv.Atoi(q)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return widgetID, quantity, nil
+}
+
+// adds widget to cart
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := app.cartForm(r)
+	if err != nil {
+		app.logger.Error("failed to parse cart form: ", zap.Error(err))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		app.logger.Error("failed to get widget from database: ", zap.Error(err))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	if widget.IsRecurring || quantity <= 0 {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart, err := app.currentCart(r)
+	if err != nil {
+		app.logger.Error("failed to get cart: ", zap.Error(err))
+		return
+	}
+
+	if err = app.DB.AddCartItem(cart.ID, widget.ID, quantity); err != nil {
+		app.logger.Error("failed to add cart item: ", zap.Error(err))
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// sets quantity of cart line
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := app.cartForm(r)
+	if err != nil {
+		app.logger.Error("failed to parse cart form: ", zap.Error(err))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart, err := app.currentCart(r)
+	if err != nil {
+		app.logger.Error("failed to get cart: ", zap.Error(err))
+		return
+	}
+
+	if err = app.DB.UpdateCartItem(cart.ID, widgetID, quantity); err != nil {
+		app.logger.Error("failed to update cart item: ", zap.Error(err))
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// removes line from cart
+func (app *application) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, _, err := app.cartForm(r)
+	if err != nil {
+		app.logger.Error("failed to parse cart form: ", zap.Error(err))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart, err := app.currentCart(r)
+	if err != nil {
+		app.logger.Error("failed to get cart: ", zap.Error(err))
+		return
+	}
+
+	if err = app.DB.RemoveCartItem(cart.ID, widgetID); err != nil {
+		app.logger.Error("failed to remove cart item: ", zap.Error(err))
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// handler for cart checkout page
+func (app *application) CartCheckout(w http.ResponseWriter, r *http.Request) {
+	cart, err := app.currentCart(r)
+	if err != nil {
+		app.logger.Error("failed to get cart: ", zap.Error(err))
+		return
+	}
+
+	if len(cart.Items) == 0 {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	data := map[string]any{
+		"cart": cart,
+	}
+
+	if err := app.renderTemplate(w, r, "cart-checkout", app.cartTemplateData(r, cart, data), "stripe-js", "format-currency", "billing"); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+// handler for cart payment succeeded, saves one order with all cart lines
+func (app *application) CartPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
+	token := app.Session.GetString(r.Context(), "cartToken")
+	if token == "" {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	txData, err := app.GetTransactionData(r)
+	if errors.Is(err, cards.ErrPaymentIncomplete) {
+		app.logger.Error("not recording order: ", zap.Error(err))
+		app.Session.Put(r.Context(), "error", paymentIncompleteMessage)
+		http.Redirect(w, r, "/cart/checkout", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.logger.Error("failed to get transaction data: ", zap.Error(err))
+		return
+	}
+
+	// the cart is priced in the currency it was paid in
+	cart, err := app.DB.GetCartByToken(token, txData.PaymentAmount.Currency())
+	if err != nil {
+		app.logger.Error("failed to get cart: ", zap.Error(err))
+		return
+	}
+
+	app.Session.Remove(r.Context(), "cartToken")
+	app.Session.Put(r.Context(), "receipt", txData)
+
+	if err = app.DB.CommitReservation(txData.PaymentIntentID); err != nil {
+		app.logger.Error("failed to commit reservation: ", zap.Error(err))
+	}
+
+	// the stripe webhook may have recorded the order already
+	if _, err = app.DB.GetTransactionByPaymentIntent(txData.PaymentIntentID); err == nil {
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	}
+
+	order, err := cart.Order()
+	if err == nil {
+		err = app.DB.TaxOrder(&order, txData.Billing)
+	}
+	if err != nil {
+		app.logger.Error("failed to price cart order: ", zap.Error(err))
+		return
+	}
+
+	if err = order.CheckAmount(txData.PaymentAmount); err != nil {
+		app.logger.Error("not recording cart order for payment intent ", txData.PaymentIntentID, ": ", zap.Error(err))
+		http.Error(w, "Payment amount does not match order", http.StatusBadRequest)
+		return
+	}
+	order.BillingAddress = txData.BillingAddress
+	order.ShippingAddress = txData.ShippingAddress
+
+	order.CustomerID, err = app.SaveCustomer(txData.FirstName, txData.LastName, txData.Email, app.locale(r))
+	if err != nil {
+		app.logger.Error("failed to insert a new customer: ", zap.Error(err))
+		return
+	}
+
+	tx := models.Transaction{
+		Amount:              txData.PaymentAmount,
+		LastFour:            txData.LastFour,
+		ExpiryMonth:         txData.ExpiryMonth,
+		ExpiryYear:          txData.ExpiryYear,
+		BankReturnCode:      txData.BankReturnCode,
+		TransactionStatusID: 2,
+		PaymentIntent:       txData.PaymentIntentID,
+		PaymentMethod:       txData.PaymentMethodID,
+	}
+
+	orderID, err := app.DB.InsertCartOrder(cart, order, tx)
+	if errors.Is(err, models.ErrCartClosed) || errors.Is(err, models.ErrPaymentRecorded) {
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.logger.Error("failed to save order: ", zap.Error(err))
+		return
+	}
+
+	// create and send invoice
+	inv, err := app.invoiceForOrder(orderID)
+	if err != nil {
+		app.logger.Error("failed to build invoice: ", zap.Error(err))
+	} else if err = app.callInvoiceMicro(inv); err != nil {
+		app.logger.Error("failed to call invoice microservice: ", zap.Error(err))
+	}
+
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-stripe/internal/currency"
+	"go-stripe/internal/models"
+	"go-stripe/internal/money"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// returns currency the customer chose to pay in, the default currency until they choose one
+func (app *application) currency(r *http.Request) string {
+	if c, err := currency.Get(app.Session.GetString(r.Context(), "currency")); err == nil {
+		return c.Code
+	}
+
+	return currency.Default
+}
+
+// returns locale amounts are written in for the customer's browser
+func (app *application) locale(r *http.Request) string {
+	return currency.NegotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+// returns price of widget in the currency the customer chose, widgets not sold in it
+// are priced in the default currency and td gets a warning saying so
+func (app *application) widgetPrice(r *http.Request, widget models.Widget, td *templateData) (money.Money, error) {
+	code := app.currency(r)
+
+	price, err := widget.PriceIn(code)
+	if errors.Is(err, models.ErrNoPrice) && code != currency.Default {
+		td.Warning = fmt.Sprintf("%s is not sold in %s, prices are shown in %s",
+			widget.Name, strings.ToUpper(code), strings.ToUpper(currency.Default))
+		code = currency.Default
+		price, err = widget.PriceIn(code)
+	}
+	td.Currency = code
+
+	return price, err
+}
+
+// stores currency chosen in the navigation bar and goes back to the page it was chosen on
+func (app *application) SetCurrency(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	c, err := currency.Get(r.Form.Get("currency"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "This currency is not supported")
+	} else {
+		app.Session.Put(r.Context(), "currency", c.Code)
+	}
+
+	// only paths on this site are followed back
+	back := "/"
+	if u, err := url.Parse(r.Form.Get("return_to")); err == nil && u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//") {
+		back = u.RequestURI()
+	}
+
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"go-stripe/internal/urlsigner"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const customerOrdersPageSize = 10
+
+// subscription as shown to the customer, billing details come from stripe
+type customerSubscription struct {
+	Order             *models.Order
+	Status            string
+	NextBilling       time.Time
+	CancelAtPeriodEnd bool
+}
+
+// displays customer registration page
+func (app *application) CustomerRegisterPage(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "customer-register", &templateData{}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+	}
+}
+
+// registers customer and logs them in
+func (app *application) PostCustomerRegister(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		return
+	}
+
+	customer := models.Customer{
+		FirstName: strings.TrimSpace(r.Form.Get("first_name")),
+		LastName:  strings.TrimSpace(r.Form.Get("last_name")),
+		Email:     strings.TrimSpace(r.Form.Get("email")),
+	}
+	password := r.Form.Get("password")
+
+	var formErr string
+	switch {
+	case customer.FirstName == "" || customer.LastName == "" || !strings.Contains(customer.Email, "@"):
+		formErr = "Please enter your name and a valid email"
+	case len(password) < 8:
+		formErr = "Password must be at least 8 characters long"
+	case password != r.Form.Get("verify_password"):
+		formErr = "Passwords do not match"
+	}
+
+	if formErr != "" {
+		app.Session.Put(r.Context(), "error", formErr)
+		http.Redirect(w, r, "/account/register", http.StatusSeeOther)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		app.logger.Error("failed to hash password: ", zap.Error(err))
+		return
+	}
+
+	id, err := app.DB.RegisterCustomer(customer, string(hash))
+	if err != nil {
+		if errors.Is(err, models.ErrCustomerExists) {
+			app.Session.Put(r.Context(), "error", "An account with this email already exists, please log in")
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
+		app.logger.Error("failed to register customer: ", zap.Error(err))
+		return
+	}
+
+	if err = app.Session.RenewToken(r.Context()); err != nil {
+		app.logger.Error("failed to renew token: ", zap.Error(err))
+		return
+	}
+
+	app.Session.Put(r.Context(), "customerID", id)
+	app.Session.Put(r.Context(), "flash", "Welcome, your account has been created")
+	http.Redirect(w, r, "/account/orders", http.StatusSeeOther)
+}
+
+// displays customer login page
+func (app *application) CustomerLoginPage(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "customer-login", &templateData{}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+	}
+}
+
+// logs customer in
+func (app *application) PostCustomerLogin(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		return
+	}
+
+	email := r.Form.Get("email")
+
+	// counted with the logins of admin users, the keys are the same
+	keys := []models.ThrottleKey{models.AccountKey(email), models.IPKey(clientIP(r))}
+	if app.loginThrottled(w, r, "/account/login", keys...) {
+		return
+	}
+
+	id, err := app.DB.AuthenticateCustomer(email, r.Form.Get("password"))
+	if err != nil {
+		app.recordFailure(models.ThrottleLogin, keys...)
+		app.Session.Put(r.Context(), "error", "Invalid email or password")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+	app.clearFailures(models.ThrottleLogin, keys[0])
+
+	if err = app.Session.RenewToken(r.Context()); err != nil {
+		app.logger.Error("failed to renew token: ", zap.Error(err))
+		return
+	}
+
+	app.Session.Put(r.Context(), "customerID", id)
+	http.Redirect(w, r, "/account/orders", http.StatusSeeOther)
+}
+
+// logs customer out, keeps the rest of the session such as the cart
+func (app *application) CustomerLogout(w http.ResponseWriter, r *http.Request) {
+	app.Session.Remove(r.Context(), "customerID")
+	if err := app.Session.RenewToken(r.Context()); err != nil {
+		app.logger.Error("failed to renew token: ", zap.Error(err))
+		return
+	}
+
+	http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+}
+
+// displays orders of logged in customer
+func (app *application) CustomerOrders(w http.ResponseWriter, r *http.Request) {
+	customerID := app.Session.GetInt(r.Context(), "customerID")
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	customer, err := app.DB.GetCustomerByID(customerID)
+	if err != nil {
+		app.logger.Error("failed to get customer: ", zap.Error(err))
+		return
+	}
+
+	orders, _, totalRecords, err := app.DB.GetOrdersForCustomer(customerID, customerOrdersPageSize, page)
+	if err != nil {
+		app.logger.Error("failed to get orders for customer: ", zap.Error(err))
+		return
+	}
+
+	data := map[string]any{
+		"customer": customer,
+		"orders":   orders,
+	}
+
+	intMap := map[string]int{
+		"page":      page,
+		"prev-page": page - 1,
+		"next-page": 0,
+	}
+	if page*customerOrdersPageSize < totalRecords {
+		intMap["next-page"] = page + 1
+	}
+
+	if err := app.renderTemplate(w, r, "customer-orders", &templateData{Data: data, IntMap: intMap}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+	}
+}
+
+// returns order of logged in customer from url, writes not found when it isn't theirs
+func (app *application) customerOrder(w http.ResponseWriter, r *http.Request) (models.Order, bool) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return models.Order{}, false
+	}
+
+	order, err := app.DB.GetOrderForCustomer(app.Session.GetInt(r.Context(), "customerID"), orderID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logger.Error("failed to get order: ", zap.Error(err))
+		}
+		http.NotFound(w, r)
+		return models.Order{}, false
+	}
+
+	return order, true
+}
+
+// sends invoice pdf of customer order
+func (app *application) CustomerInvoice(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.customerOrder(w, r)
+	if !ok {
+		return
+	}
+
+	inv, err := app.invoiceForOrder(order.ID)
+	if err != nil {
+		app.logger.Error("failed to build invoice: ", zap.Error(err))
+		http.Error(w, "Invoice is not available", http.StatusInternalServerError)
+		return
+	}
+
+	url := app.config.invoice + "/v1/invoice/download"
+
+	out, err := json.Marshal(inv)
+	if err != nil {
+		app.logger.Error("failed to encode invoice: ", zap.Error(err))
+		http.Error(w, "Invoice is not available", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(out))
+	if err != nil {
+		app.logger.Error("failed to call invoice microservice: ", zap.Error(err))
+		http.Error(w, "Invoice is not available", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		app.logger.Error("invoice microservice returned ", resp.Status)
+		http.Error(w, "Invoice is not available", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"invoice-%d.pdf\"", order.ID))
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// displays subscriptions of logged in customer with their billing state as synced from stripe
+func (app *application) CustomerSubscriptions(w http.ResponseWriter, r *http.Request) {
+	orders, err := app.DB.GetSubscriptionsForCustomer(app.Session.GetInt(r.Context(), "customerID"))
+	if err != nil {
+		app.logger.Error("failed to get subscriptions for customer: ", zap.Error(err))
+		return
+	}
+
+	card := cards.Card{
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
+	}
+
+	var subscriptions []customerSubscription
+	for _, o := range orders {
+		s := customerSubscription{Order: o}
+
+		if o.Subscription != nil && o.Subscription.CurrentPeriodEnd != nil {
+			s.Status = o.Subscription.Status
+			s.NextBilling = *o.Subscription.CurrentPeriodEnd
+			s.CancelAtPeriodEnd = o.Subscription.CancelAtPeriodEnd
+			subscriptions = append(subscriptions, s)
+			continue
+		}
+
+		// not synced yet, ask stripe
+		sub, err := card.GetSubscription(o.Transaction.PaymentIntent)
+		if err != nil {
+			app.logger.Error("failed to get subscription ", o.Transaction.PaymentIntent, ": ", zap.Error(err))
+		} else {
+			s.Status = string(sub.Status)
+			s.NextBilling = time.Unix(sub.CurrentPeriodEnd, 0)
+			s.CancelAtPeriodEnd = sub.CancelAtPeriodEnd
+		}
+
+		subscriptions = append(subscriptions, s)
+	}
+
+	data := map[string]any{
+		"subscriptions": subscriptions,
+	}
+
+	if err := app.renderTemplate(w, r, "customer-subscriptions", &templateData{Data: data}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+	}
+}
+
+// cancels customer subscription at the end of the billing period
+func (app *application) CustomerCancelSubscription(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.customerOrder(w, r)
+	if !ok {
+		return
+	}
+
+	if order.StatusID == models.OrderStatusCancelled || (order.Subscription != nil && order.Subscription.CancelAtPeriodEnd) {
+		http.Redirect(w, r, "/account/subscriptions", http.StatusSeeOther)
+		return
+	}
+
+	card := cards.Card{
+		Secret:   app.config.stripe.secret,
+		Key:      app.config.stripe.key,
+		Currency: order.Transaction.Amount.Currency(),
+		Gateway:  app.gateway,
+	}
+
+	if err := card.CancelSubscription(order.Transaction.PaymentIntent); err != nil {
+		app.logger.Error("error cancelling subscription: ", zap.Error(err))
+		app.Session.Put(r.Context(), "error", "The subscription could not be cancelled, please try again")
+		http.Redirect(w, r, "/account/subscriptions", http.StatusSeeOther)
+		return
+	}
+
+	// the order stays active until stripe ends the subscription
+	if err := app.DB.MarkSubscriptionCancelling(order.Transaction.PaymentIntent); err != nil {
+		app.logger.Error("the subscription was cancelled, but the database could not be updated: ", zap.Error(err))
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your subscription will end at the end of the billing period")
+	http.Redirect(w, r, "/account/subscriptions", http.StatusSeeOther)
+}
+
+// charges future invoices of customer subscription to a new card
+func (app *application) CustomerUpdateCard(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.customerOrder(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		return
+	}
+
+	msg, err := app.updateSubscriptionCard(order, r.Form.Get("payment_method"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", msg)
+	} else {
+		app.Session.Put(r.Context(), "flash", msg)
+	}
+
+	http.Redirect(w, r, "/account/subscriptions", http.StatusSeeOther)
+}
+
+// charges future invoices of subscription to a new card and pays its failed renewal with it,
+// returns message for the customer
+func (app *application) updateSubscriptionCard(order models.Order, paymentMethod string) (string, error) {
+	card := cards.Card{
+		Secret:   app.config.stripe.secret,
+		Key:      app.config.stripe.key,
+		Currency: order.Transaction.Amount.Currency(),
+		Gateway:  app.gateway,
+	}
+
+	pm, msg, err := card.UpdateSubscriptionPaymentMethod(order.Transaction.PaymentIntent, paymentMethod)
+	if err != nil {
+		app.logger.Error("failed to update subscription card: ", zap.Error(err))
+		if msg == "" {
+			msg = "The card could not be updated, please try again"
+		}
+		return msg, err
+	}
+
+	tx := models.Transaction{
+		PaymentMethod: pm.ID,
+	}
+	if pm.Card != nil {
+		tx.LastFour = pm.Card.Last4
+		tx.ExpiryMonth = int(pm.Card.ExpMonth)
+		tx.ExpiryYear = int(pm.Card.ExpYear)
+	}
+
+	if err = app.DB.UpdateTransactionPaymentMethod(order.Transaction.PaymentIntent, tx); err != nil {
+		app.logger.Error("the card was updated, but the database could not be updated: ", zap.Error(err))
+	}
+
+	dc, err := app.DB.GetOpenDunningCase(order.Transaction.PaymentIntent)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logger.Error("failed to get dunning case: ", zap.Error(err))
+		}
+		return "Your card has been updated", nil
+	}
+
+	if _, msg, err = card.RetryInvoice(dc.Invoice); err != nil {
+		app.logger.Error("failed to pay invoice ", dc.Invoice, " with updated card: ", zap.Error(err))
+		if msg == "" {
+			msg = "please try again later"
+		}
+		return "Your card has been updated, but the overdue payment failed: " + msg, err
+	}
+
+	if err = app.DB.ResolveDunningCase(order.Transaction.PaymentIntent, models.DunningStatusRecovered); err != nil {
+		app.logger.Error("failed to resolve dunning case: ", zap.Error(err))
+	}
+
+	return "Your card has been updated and the overdue payment was made", nil
+}
+
+// verifies signed card update link sent with dunning emails, returns its subscription order
+func (app *application) updateCardOrder(w http.ResponseWriter, r *http.Request) (models.Order, bool) {
+	testURL := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+
+	if !signer.VerityToken(testURL) || signer.Expired(testURL, models.UpdateCardLinkExpiry) {
+		app.logger.Error("invalid or expired card update link")
+		app.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return models.Order{}, false
+	}
+
+	orderID, err := strconv.Atoi(r.URL.Query().Get("order"))
+	if err != nil {
+		http.NotFound(w, r)
+		return models.Order{}, false
+	}
+
+	order, err := app.DB.GetOrderByID(orderID)
+	if err != nil || order.Subscription == nil || order.Subscription.Ended() {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.logger.Error("failed to get order: ", zap.Error(err))
+		}
+		app.Session.Put(r.Context(), "error", "This subscription can no longer be updated")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return models.Order{}, false
+	}
+
+	return order, true
+}
+
+// displays card update form linked from dunning emails, no sign in needed
+func (app *application) ShowUpdateCard(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.updateCardOrder(w, r)
+	if !ok {
+		return
+	}
+
+	data := map[string]any{
+		"order":  order,
+		"action": r.RequestURI,
+	}
+
+	if dc, err := app.DB.GetOpenDunningCase(order.Transaction.PaymentIntent); err == nil {
+		data["dunning"] = dc
+	}
+
+	if err := app.renderTemplate(w, r, "update-card", &templateData{Data: data}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+	}
+}
+
+// charges subscription from card update link to the new card
+func (app *application) PostUpdateCard(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.updateCardOrder(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		return
+	}
+
+	msg, err := app.updateSubscriptionCard(order, r.Form.Get("payment_method"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", msg)
+	} else {
+		app.Session.Put(r.Context(), "flash", msg)
+	}
+
+	http.Redirect(w, r, r.RequestURI, http.StatusSeeOther)
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go-stripe/internal/cards"
 	"go-stripe/internal/encryption"
 	"go-stripe/internal/models"
+	"go-stripe/internal/money"
 	"go-stripe/internal/urlsigner"
 	"net/http"
 	"strconv"
@@ -16,29 +19,60 @@ import (
 	"go.uber.org/zap"
 )
 
+// shown when the order form is posted before the payment went through
+const paymentIncompleteMessage = "Your payment was not completed, please try again"
+
 type TransactionData struct {
 	FirstName       string
 	LastName        string
 	Email           string
 	PaymentIntentID string
 	PaymentMethodID string
-	PaymentAmount   int
-	PaymentCurrency string
+	PaymentAmount   money.Money
 	LastFour        string
 	ExpiryMonth     int
 	ExpiryYear      int
 	BankReturnCode  string
+	Coupon          string
+	// where the customer is billed, the order is taxed for it
+	Billing models.BillingDetails
+	// addresses entered at checkout, nil when none was given
+	BillingAddress  *models.Address
+	ShippingAddress *models.Address
+	// widget quantities the payment intent was priced for, nil for carts which keep their own
+	Quantities map[int]int
 }
 
 type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int           `json:"id"`
+	Items     []InvoiceItem `json:"items"`
+	Quantity  int           `json:"quantity"`
+	Subtotal  money.Money   `json:"subtotal"`
+	Discount  money.Money   `json:"discount"`
+	Tax       money.Money   `json:"tax"`
+	Amount    money.Money   `json:"amount"`
+	Locale    string        `json:"locale"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Email     string        `json:"email"`
+	CreatedAt time.Time     `json:"created_at"`
+	// tax summed by rate, none when the customer is reverse charged
+	TaxLines      []models.TaxLine      `json:"tax_lines"`
+	TaxIncluded   bool                  `json:"tax_included"`
+	Billing       models.BillingDetails `json:"billing"`
+	ReverseCharge bool                  `json:"reverse_charge"`
+	// address lines as printed, empty for orders placed without them
+	BillingAddress  []string `json:"billing_address"`
+	ShippingAddress []string `json:"shipping_address"`
+}
+
+type InvoiceItem struct {
+	Product   string      `json:"product"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+	Discount  money.Money `json:"discount"`
+	Tax       money.Money `json:"tax"`
+	Amount    money.Money `json:"amount"`
 }
 
 // handler for homepage
@@ -68,14 +102,14 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	firstName := r.Form.Get("first_name")
 	lastName := r.Form.Get("last_name")
 	email := r.Form.Get("cardholder_email")
-	currency := r.Form.Get("payment_currency")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
 
 	// initialize card and get payment data
 	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
 	}
 
 	pi, err := card.RetrievePaymentIntent(paymentIntent)
@@ -84,19 +118,28 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 		return txData, err
 	}
 
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	// the form may be posted before 3-D Secure was completed
+	if err = cards.CheckSucceeded(pi); err != nil {
+		return txData, err
+	}
+
+	amount, err := cards.PaymentAmount(pi)
 	if err != nil {
-		app.logger.Error("failed to get payment method: ", zap.Error(err))
 		return txData, err
 	}
 
-	// create a new transaction
-	amount, err := strconv.Atoi(r.Form.Get("payment_amount"))
+	quantities, err := models.QuantitiesFromMetadata(pi.Metadata)
+	if err != nil && !errors.Is(err, models.ErrNoItems) {
+		return txData, err
+	}
+
+	pm, err := card.GetPaymentMethod(paymentMethod)
 	if err != nil {
-		app.logger.Error("failed to parse payment amount: ", zap.Error(err))
+		app.logger.Error("failed to get payment method: ", zap.Error(err))
 		return txData, err
 	}
 
+	// amount and currency come from stripe, form fields can be tampered with
 	txData = TransactionData{
 		FirstName:       firstName,
 		LastName:        lastName,
@@ -104,11 +147,15 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
 		PaymentAmount:   amount,
-		PaymentCurrency: currency,
 		LastFour:        pm.Card.Last4,
 		ExpiryMonth:     int(pm.Card.ExpMonth),
 		ExpiryYear:      int(pm.Card.ExpYear),
-		BankReturnCode:  pi.Charges.Data[0].ID,
+		BankReturnCode:  cards.ChargeID(pi),
+		Coupon:          pi.Metadata["coupon"],
+		Billing:         models.BillingDetailsFromMetadata(pi.Metadata),
+		BillingAddress:  models.AddressFromMetadata(models.AddressBilling, pi.Metadata),
+		ShippingAddress: models.AddressFromMetadata(models.AddressShipping, pi.Metadata),
+		Quantities:      quantities,
 	}
 
 	return txData, nil
@@ -131,13 +178,49 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	}
 
 	txData, err := app.GetTransactionData(r)
-	if err != nil {
+	if errors.Is(err, cards.ErrPaymentIncomplete) {
+		app.logger.Error("not recording order: ", zap.Error(err))
+		app.Session.Put(r.Context(), "error", paymentIncompleteMessage)
+		http.Redirect(w, r, fmt.Sprintf("/widget/%d", widgetID), http.StatusSeeOther)
+		return
+	} else if err != nil {
 		app.logger.Error("failed to get transaction data: ", zap.Error(err))
 		return
 	}
 
+	// the order is made of what the intent was priced for, the form only names the product page
+	if txData.Quantities[widgetID] == 0 {
+		app.logger.Error("not recording order for payment intent ", txData.PaymentIntentID, ": widget ", widgetID, " was not paid for")
+		http.Error(w, "Payment does not match order", http.StatusBadRequest)
+		return
+	}
+
+	if err = app.DB.CommitReservation(txData.PaymentIntentID); err != nil {
+		app.logger.Error("failed to commit reservation: ", zap.Error(err))
+	}
+
+	// the stripe webhook may have recorded the order already
+	if _, err = app.DB.GetTransactionByPaymentIntent(txData.PaymentIntentID); err == nil {
+		app.Session.Put(r.Context(), "receipt", txData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	}
+
+	// coupon comes from the payment intent, it was checked when the intent was created
+	priced, coupon, err := app.DB.PriceOrderWithCoupon(txData.Quantities, txData.Coupon, txData.PaymentAmount.Currency(), txData.Billing)
+	if err != nil {
+		app.logger.Error("failed to price order: ", zap.Error(err))
+		return
+	}
+
+	if err = priced.CheckAmount(txData.PaymentAmount); err != nil {
+		app.logger.Error("not recording order for payment intent ", txData.PaymentIntentID, ": ", zap.Error(err))
+		http.Error(w, "Payment amount does not match order", http.StatusBadRequest)
+		return
+	}
+
 	// create a new customer
-	customerID, err := app.SaveCustomer(txData.FirstName, txData.LastName, txData.Email)
+	customerID, err := app.SaveCustomer(txData.FirstName, txData.LastName, txData.Email, app.locale(r))
 	if err != nil {
 		app.logger.Error("failed to insert a new customer: ", zap.Error(err))
 		return
@@ -145,7 +228,6 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 
 	tx := models.Transaction{
 		Amount:              txData.PaymentAmount,
-		Currency:            txData.PaymentCurrency,
 		LastFour:            txData.LastFour,
 		ExpiryMonth:         txData.ExpiryMonth,
 		ExpiryYear:          txData.ExpiryYear,
@@ -155,44 +237,40 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		PaymentMethod:       txData.PaymentMethodID,
 	}
 
-	txID, err := app.SaveTransaction(tx)
-	if err != nil {
-		app.logger.Error("failed to insert a new transaction: ", zap.Error(err))
-		return
-	}
-
 	order := models.Order{
-		WidgetID:      widgetID,
-		TransactionID: txID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        txData.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
-	}
-
-	orderID, err := app.SaveOrder(order)
-	if err != nil {
+		CustomerID:      customerID,
+		StatusID:        1,
+		Items:           priced.Items,
+		Billing:         priced.Billing,
+		ReverseCharge:   priced.ReverseCharge,
+		BillingAddress:  txData.BillingAddress,
+		ShippingAddress: txData.ShippingAddress,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	orderID, err := app.DB.InsertOrderWithTransaction(tx, order)
+	if errors.Is(err, models.ErrPaymentRecorded) {
+		// the stripe webhook got there first
+		app.Session.Put(r.Context(), "receipt", txData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	} else if err != nil {
 		app.logger.Error("failed to save order: ", zap.Error(err))
 		return
 	}
 
-	// create and send invoice
-	inv := Invoice{
-		ID:     orderID,
-		Amount: order.Amount,
-		// TODO: get from database
-		Product:   "Widget",
-		Quantity:  order.Quantity,
-		FirstName: txData.FirstName,
-		LastName:  txData.LastName,
-		Email:     txData.Email,
-		CreatedAt: time.Now(),
+	if coupon.ID > 0 {
+		if err = app.DB.RedeemCoupon(coupon.ID, orderID, txData.Email, priced.Discount); err != nil {
+			app.logger.Error("failed to record coupon redemption: ", zap.Error(err))
+		}
 	}
 
-	err = app.callInvoiceMicro(inv)
+	// create and send invoice
+	inv, err := app.invoiceForOrder(orderID)
 	if err != nil {
+		app.logger.Error("failed to build invoice: ", zap.Error(err))
+	} else if err = app.callInvoiceMicro(inv); err != nil {
 		app.logger.Error("failed to call invoice microservice: ", zap.Error(err))
 	}
 
@@ -201,9 +279,62 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
 }
 
+// returns address lines for the invoice, none for orders placed without the address
+func addressLines(a *models.Address) []string {
+	if a == nil {
+		return nil
+	}
+
+	return a.Lines()
+}
+
+// builds invoice with order lines from saved order
+func (app *application) invoiceForOrder(orderID int) (Invoice, error) {
+	order, err := app.DB.GetOrderByID(orderID)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	inv := Invoice{
+		ID:        order.ID,
+		Quantity:  order.Quantity,
+		Subtotal:  order.Subtotal,
+		Discount:  order.Discount,
+		Tax:       order.Tax,
+		Amount:    order.Amount,
+		Locale:    order.Customer.Locale,
+		FirstName: order.Customer.FirstName,
+		LastName:  order.Customer.LastName,
+		Email:     order.Customer.Email,
+		CreatedAt: order.CreatedAt,
+		// orders placed before billing details were collected were not taxed
+		Billing:         order.Billing,
+		ReverseCharge:   order.ReverseCharge,
+		BillingAddress:  addressLines(order.BillingAddress),
+		ShippingAddress: addressLines(order.ShippingAddress),
+	}
+
+	if inv.TaxLines, err = order.TaxLines(); err != nil {
+		return Invoice{}, err
+	}
+
+	for _, item := range order.Items {
+		inv.TaxIncluded = inv.TaxIncluded || item.TaxIncluded
+		inv.Items = append(inv.Items, InvoiceItem{
+			Product:   item.Widget.Name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Discount:  item.Discount,
+			Tax:       item.Tax,
+			Amount:    item.Amount,
+		})
+	}
+
+	return inv, nil
+}
+
 func (app *application) callInvoiceMicro(inv Invoice) error {
-	// TODO: add to env vars
-	url := "http://localhost:4002/v1/invoice/create-and-send"
+	url := app.config.invoice + "/v1/invoice/create-and-send"
 
 	out, err := json.Marshal(inv)
 	if err != nil {
@@ -247,35 +378,16 @@ func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// saves a customer and returns its ID
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
+// saves a customer and returns its ID, locale is kept when empty
+func (app *application) SaveCustomer(firstName, lastName, email, locale string) (int, error) {
 	customer := models.Customer{
 		FirstName: firstName,
 		LastName:  lastName,
 		Email:     email,
+		Locale:    locale,
 	}
 
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
-// saves a transaction and returns its ID
-func (app *application) SaveTransaction(tx models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(tx)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
-// saves an order and returns its ID
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+	id, err := app.DB.UpsertCustomer(customer)
 	if err != nil {
 		return 0, err
 	}
@@ -300,37 +412,118 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := map[string]any{
+	td := &templateData{}
+	price, err := app.widgetPrice(r, widget, td)
+	if err != nil {
+		app.logger.Error("failed to price widget: ", zap.Error(err))
+		http.NotFound(w, r)
+		return
+	}
+
+	td.Data = map[string]any{
 		"widget": widget,
+		"price":  price,
 	}
+	app.addSavedCards(r, td.Data)
+	app.addCustomerAddresses(r, td.Data, models.AddressBilling, models.AddressShipping)
 
-	if err := app.renderTemplate(w, r, "charge-once", &templateData{Data: data}, "stripe-js"); err != nil {
+	if err := app.renderTemplate(w, r, "charge-once", td, "stripe-js", "coupon", "format-currency", "billing"); err != nil {
 		app.logger.Error("unable to render template: ", zap.Error(err))
 		return
 	}
 }
 
-// handler for bronze plan
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-	// get only 1 plan at the moment
-	widget, err := app.DB.GetWidget(2)
+// adds addresses of kinds the logged in customer last used to checkout page data, so they are filled in
+func (app *application) addCustomerAddresses(r *http.Request, data map[string]any, kinds ...string) {
+	customerID := app.Session.GetInt(r.Context(), "customerID")
+	if customerID == 0 {
+		return
+	}
+
+	for _, kind := range kinds {
+		address, err := app.DB.GetCustomerAddress(customerID, kind)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				app.logger.Error("failed to get customer address: ", zap.Error(err))
+			}
+			continue
+		}
+		data[kind+"_address"] = address
+	}
+}
+
+// displays catalog of subscription plans
+func (app *application) Plans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.DB.GetPlans()
 	if err != nil {
-		app.logger.Error("failed to get widget from database: ", zap.Error(err))
+		app.logger.Error("failed to get plans from database: ", zap.Error(err))
 		return
 	}
 
+	// plans are listed at their price in the customer's currency, plans not sold in it aren't offered
+	code := app.currency(r)
+	prices := make(map[int]money.Money)
+	for _, p := range plans {
+		if price, err := p.PriceIn(code); err == nil {
+			prices[p.ID] = price
+		}
+	}
+
 	data := map[string]any{
+		"plans":  plans,
+		"prices": prices,
+	}
+
+	if err := app.renderTemplate(w, r, "plans", &templateData{Data: data}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+// displays subscription form of plan
+func (app *application) ShowPlan(w http.ResponseWriter, r *http.Request) {
+	widgetID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	widget, err := app.DB.GetPlan(widgetID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, models.ErrNotAPlan) {
+			app.logger.Error("failed to get plan from database: ", zap.Error(err))
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	td := &templateData{}
+	price, err := app.widgetPrice(r, widget, td)
+	if err != nil {
+		app.logger.Error("failed to price plan: ", zap.Error(err))
+		http.NotFound(w, r)
+		return
+	}
+
+	td.Data = map[string]any{
 		"widget": widget,
+		"price":  price,
+	}
+
+	// the card of a logged in customer is saved with their others
+	if customerID := app.Session.GetInt(r.Context(), "customerID"); customerID > 0 {
+		td.Data["customer_token"] = app.customerToken(customerID)
 	}
+	app.addCustomerAddresses(r, td.Data, models.AddressBilling)
 
-	if err := app.renderTemplate(w, r, "bronze-plan", &templateData{Data: data}); err != nil {
+	if err := app.renderTemplate(w, r, "plan", td, "coupon", "format-currency", "billing"); err != nil {
 		app.logger.Error("unable to render template: ", zap.Error(err))
 		return
 	}
 }
 
-// handler for bronze plan receipt
-func (app *application) BronzePlanReceipt(w http.ResponseWriter, r *http.Request) {
+// handler for plan receipt
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "receipt-plan", &templateData{}); err != nil {
 		app.logger.Error("unable to render template: ", zap.Error(err))
 		return
@@ -360,11 +553,36 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
+	// failed logins here count with those of the api, they share the database
+	keys := []models.ThrottleKey{models.AccountKey(email), models.IPKey(clientIP(r))}
+	if app.loginThrottled(w, r, "/login", keys...) {
+		return
+	}
+
 	id, err := app.DB.Authenticate(email, password)
 	if err != nil {
+		app.recordFailure(models.ThrottleLogin, keys...)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	app.clearFailures(models.ThrottleLogin, keys[0])
+
+	// with two-factor authentication the password isn't enough, the login page passes on the
+	// challenge the api verified the code of
+	twoFactor, err := app.DB.GetTwoFactor(id)
+	if err != nil {
+		app.logger.Error("failed to get two-factor authentication: ", zap.Error(err))
+		app.Session.Put(r.Context(), "error", "Login is unavailable, try again later")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if twoFactor.Enabled {
+		if err = app.DB.ConsumeLoginChallenge(id, r.Form.Get("challenge")); err != nil {
+			app.Session.Put(r.Context(), "error", "Enter the code of your authenticator app to log in")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+	}
 
 	app.Session.Put(r.Context(), "userID", id)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -452,14 +670,32 @@ func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// handler for subscriptions whose renewal payment failed
+func (app *application) AtRiskSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "at-risk-subscriptions", &templateData{}, "format-currency"); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+// handler for inventory ledger page
+func (app *application) InventoryMovements(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "inventory", &templateData{}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
 func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap := map[string]string{
-		"title":        "Sale",
-		"cancel":       "/admin/all-sales",
-		"refund-url":   "/v1/api/admin/refund",
-		"refund-btn":   "Refund Order",
-		"alert-text":   "Refunded",
-		"message-text": "Charge refunded",
+		"title":           "Sale",
+		"cancel":          "/admin/all-sales",
+		"refund-url":      "/v1/api/admin/refund",
+		"refund-btn":      "Refund Order",
+		"alert-text":      "Refunded",
+		"message-text":    "Charge refunded",
+		"partial-refunds": "true",
+		"permission":      models.PermRefund,
 	}
 
 	if err := app.renderTemplate(w, r, "sale", &templateData{StringMap: stringMap}, "format-currency"); err != nil {
@@ -476,6 +712,7 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 		"refund-btn":   "Cancel Subscription",
 		"alert-text":   "Cancelled",
 		"message-text": "Subscription cancelled",
+		"permission":   models.PermManageSubscriptions,
 	}
 
 	if err := app.renderTemplate(w, r, "sale", &templateData{StringMap: stringMap}, "format-currency"); err != nil {
@@ -497,3 +734,33 @@ func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// shows api tokens of the logged in user, and of all users to those who manage users
+func (app *application) Tokens(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "tokens", &templateData{}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+func (app *application) AllCoupons(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-coupons", &templateData{}, "format-currency"); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+// shows tax rates, the country list comes with the default template data
+func (app *application) AllTaxRates(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-tax-rates", &templateData{}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+func (app *application) OneCoupon(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-coupon", &templateData{}, "format-currency"); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/gob"
+	"flag"
 	"fmt"
+	"go-stripe/internal/cards"
 	"go-stripe/internal/driver"
 	"go-stripe/internal/models"
 	"html/template"
@@ -31,11 +33,13 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret  string
+		key     string
+		gateway string
 	}
 	secretKey string
 	frontend  string
+	invoice   string
 }
 
 type application struct {
@@ -45,6 +49,7 @@ type application struct {
 	version       string
 	DB            models.DBModel
 	Session       *scs.SessionManager
+	gateway       cards.PaymentGateway
 }
 
 // serve application
@@ -96,10 +101,19 @@ func main() {
 	cfg.db.dsn = os.Getenv("DSN")
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.gateway = os.Getenv("PAYMENT_GATEWAY")
 
 	cfg.secretKey = os.Getenv("SECRET_KEY")
 	cfg.frontend = os.Getenv("FRONTEND_URL") + ":" + os.Getenv("FRONTEND_PORT")
 
+	// invoice microservice, the flag overrides INVOICE_URL and INVOICE_PORT
+	invoiceURL := "http://localhost:4002"
+	if os.Getenv("INVOICE_URL") != "" {
+		invoiceURL = os.Getenv("INVOICE_URL") + ":" + os.Getenv("INVOICE_PORT")
+	}
+	flag.StringVar(&cfg.invoice, "invoice", invoiceURL, "url of the invoice microservice")
+	flag.Parse()
+
 	// setup template data
 	tc := make(map[string]*template.Template)
 
@@ -110,6 +124,13 @@ func main() {
 	}
 	defer conn.Close()
 
+	// initialize payment gateway, the fake keeps its objects in the database so the api and the
+	// website see the same ones
+	gateway, err := cards.NewGateway(cfg.stripe.gateway, cfg.stripe.secret, &models.DBModel{DB: conn})
+	if err != nil {
+		logger.Fatal("unable to initialize payment gateway: ", err)
+	}
+
 	session.Store = mysqlstore.New(conn)
 
 	// initialize application
@@ -120,6 +141,25 @@ func main() {
 		version:       version,
 		DB:            models.DBModel{DB: conn},
 		Session:       session,
+		gateway:       gateway,
+	}
+
+	// the fake gateway needs plan prices to prorate plan changes
+	if fake, ok := gateway.(*cards.SharedFakeGateway); ok {
+		plans, err := app.DB.GetPlans()
+		if err != nil {
+			logger.Fatal("unable to load plans: ", err)
+		}
+		for _, p := range plans {
+			if err = fake.SetPrice(p.PlanID, p.Price.Amount()); err != nil {
+				logger.Fatal("unable to set plan prices: ", err)
+			}
+			for _, price := range p.Prices {
+				if err = fake.SetCurrencyPrice(p.PlanID, price.Currency(), price.Amount()); err != nil {
+					logger.Fatal("unable to set plan prices: ", err)
+				}
+			}
+		}
 	}
 
 	go app.ListenToWsChannel()
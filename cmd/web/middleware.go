@@ -1,6 +1,12 @@
 package main
 
-import "net/http"
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
 
 // session middleware
 func SessionLoad(next http.Handler) http.Handler {
@@ -14,6 +20,61 @@ func (app *application) Auth(next http.Handler) http.Handler {
 			return
 		}
 
+		// users whose role requires two-factor authentication set it up before anything else
+		if !strings.HasPrefix(r.URL.Path, "/admin/two-factor") {
+			twoFactor, err := app.DB.GetTwoFactor(app.Session.GetInt(r.Context(), "userID"))
+			if err != nil {
+				app.logger.Error("failed to get two-factor authentication: ", zap.Error(err))
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if twoFactor.SetupRequired() {
+				http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lets through admin users whose roles grant permission, Auth must run first
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			permissions, err := app.DB.GetUserPermissions(app.Session.GetInt(r.Context(), "userID"))
+			if err != nil {
+				app.logger.Error("failed to get user permissions: ", zap.Error(err))
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !permissions.Has(permission) {
+				http.Error(w, "You don't have permission to view this page", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// redirects customers who are not logged in to customer login
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "customerID") {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// returns ip the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/models"
+	"go-stripe/internal/urlsigner"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v73"
+	"go.uber.org/zap"
+)
+
+// returns signed token the api knows the logged in customer by, e.g. to charge their saved card
+func (app *application) customerToken(customerID int) string {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretKey),
+	}
+
+	return signer.GenerateTokenFromString(fmt.Sprintf("%s%s?id=%d", app.config.frontend, models.CustomerTokenPath, customerID))
+}
+
+// adds token and saved cards of logged in customer to checkout page data
+func (app *application) addSavedCards(r *http.Request, data map[string]any) {
+	customerID := app.Session.GetInt(r.Context(), "customerID")
+	if customerID == 0 {
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByID(customerID)
+	if err != nil {
+		app.logger.Error("failed to get customer: ", zap.Error(err))
+		return
+	}
+
+	data["customer"] = customer
+	data["customer_token"] = app.customerToken(customerID)
+
+	if customer.StripeCustomerID == "" {
+		return
+	}
+
+	card := cards.Card{
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
+	}
+
+	saved, err := card.SavedCards(customer.StripeCustomerID)
+	if err != nil {
+		app.logger.Error("failed to get saved cards: ", zap.Error(err))
+		return
+	}
+
+	data["saved_cards"] = saved
+}
+
+// returns logged in customer with the stripe customer their cards are saved for, creating it on first use
+func (app *application) savedCardsCustomer(r *http.Request, card *cards.Card) (models.Customer, error) {
+	customer, err := app.DB.GetCustomerByID(app.Session.GetInt(r.Context(), "customerID"))
+	if err != nil || customer.StripeCustomerID != "" {
+		return customer, err
+	}
+
+	stripeCustomer, _, err := card.CreateCustomer("", customer.Email)
+	if err != nil {
+		return customer, err
+	}
+
+	customer.StripeCustomerID, err = app.DB.SetStripeCustomerID(customer.ID, stripeCustomer.ID)
+
+	return customer, err
+}
+
+// displays cards saved by logged in customer and a form saving another one
+func (app *application) CustomerPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	card := cards.Card{
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
+	}
+
+	customer, err := app.savedCardsCustomer(r, &card)
+	if err != nil {
+		app.logger.Error("failed to get stripe customer: ", zap.Error(err))
+		return
+	}
+
+	saved, err := card.SavedCards(customer.StripeCustomerID)
+	if err != nil {
+		app.logger.Error("failed to get saved cards: ", zap.Error(err))
+		return
+	}
+
+	// the browser confirms it with the new card
+	si, err := card.CreateSetupIntent(customer.StripeCustomerID)
+	if err != nil {
+		app.logger.Error("failed to create setup intent: ", zap.Error(err))
+		return
+	}
+
+	data := map[string]any{
+		"cards":         saved,
+		"client_secret": si.ClientSecret,
+		"setup_intent":  si.ID,
+	}
+
+	if err := app.renderTemplate(w, r, "customer-payment-methods", &templateData{Data: data}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+	}
+}
+
+// saves card confirmed with setup intent, the first card saved becomes the default one
+func (app *application) CustomerSaveCard(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		return
+	}
+
+	card := cards.Card{
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
+	}
+
+	customer, err := app.DB.GetCustomerByID(app.Session.GetInt(r.Context(), "customerID"))
+	if err != nil {
+		app.logger.Error("failed to get customer: ", zap.Error(err))
+		return
+	}
+
+	si, err := card.GetSetupIntent(r.Form.Get("setup_intent"))
+	if err != nil || si.Status != stripe.SetupIntentStatusSucceeded || si.Customer == nil || si.Customer.ID != customer.StripeCustomerID {
+		if err != nil {
+			app.logger.Error("failed to get setup intent: ", zap.Error(err))
+		}
+		app.Session.Put(r.Context(), "error", "The card could not be saved, please try again")
+		http.Redirect(w, r, "/account/payment-methods", http.StatusSeeOther)
+		return
+	}
+
+	saved, err := card.SavedCards(customer.StripeCustomerID)
+	if err != nil {
+		app.logger.Error("failed to get saved cards: ", zap.Error(err))
+	}
+
+	hasDefault := false
+	for _, c := range saved {
+		hasDefault = hasDefault || c.Default
+	}
+
+	if !hasDefault {
+		if err = card.SetDefaultPaymentMethod(customer.StripeCustomerID, si.PaymentMethod.ID); err != nil {
+			app.logger.Error("failed to set default card: ", zap.Error(err))
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your card has been saved")
+	http.Redirect(w, r, "/account/payment-methods", http.StatusSeeOther)
+}
+
+// makes saved card the one logged in customer's invoices are charged to
+func (app *application) CustomerDefaultCard(w http.ResponseWriter, r *http.Request) {
+	app.updateSavedCard(w, r, func(card *cards.Card, customerID, pm string) (string, error) {
+		return "Your default card has been changed", card.SetDefaultPaymentMethod(customerID, pm)
+	})
+}
+
+// removes saved card of logged in customer
+func (app *application) CustomerRemoveCard(w http.ResponseWriter, r *http.Request) {
+	app.updateSavedCard(w, r, func(card *cards.Card, customerID, pm string) (string, error) {
+		return "Your card has been removed", card.DetachPaymentMethod(customerID, pm)
+	})
+}
+
+// applies update to saved card in the url of logged in customer, update returns the message shown when it succeeds
+func (app *application) updateSavedCard(w http.ResponseWriter, r *http.Request, update func(card *cards.Card, customerID, pm string) (string, error)) {
+	customer, err := app.DB.GetCustomerByID(app.Session.GetInt(r.Context(), "customerID"))
+	if err != nil {
+		app.logger.Error("failed to get customer: ", zap.Error(err))
+		return
+	}
+
+	card := cards.Card{
+		Secret:  app.config.stripe.secret,
+		Key:     app.config.stripe.key,
+		Gateway: app.gateway,
+	}
+
+	msg, err := update(&card, customer.StripeCustomerID, chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, cards.ErrPaymentMethodNotSaved):
+		app.Session.Put(r.Context(), "error", "This card is not saved")
+	case err != nil:
+		app.logger.Error("failed to update saved card: ", zap.Error(err))
+		app.Session.Put(r.Context(), "error", "The card could not be updated, please try again")
+	default:
+		app.Session.Put(r.Context(), "flash", msg)
+	}
+
+	http.Redirect(w, r, "/account/payment-methods", http.StatusSeeOther)
+}
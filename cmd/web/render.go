@@ -3,6 +3,9 @@ package main
 import (
 	"embed"
 	"fmt"
+	"go-stripe/internal/cards"
+	"go-stripe/internal/currency"
+	"go-stripe/internal/models"
 	"html/template"
 	"net/http"
 	"strings"
@@ -21,20 +24,32 @@ type templateData struct {
 	Error                string
 	IsAuthenticated      int
 	UserID               int
+	CustomerID           int
 	API                  string
 	CSSVersion           string
 	StripeSecretKey      string
 	StripePublishableKey string
+	// payments go through the fake gateway, pages don't load stripe.js
+	FakeGateway bool
+	// currency prices are shown and charged in, locale they are written in
+	Currency   string
+	Locale     string
+	Currencies []currency.Currency
+	// prices in the currency include tax, otherwise it is added at checkout
+	PricesIncludeTax bool
+	BillingCountries []models.Country
+	// what the roles of the logged in admin user allow
+	Permissions models.Permissions
 }
 
-var functions = template.FuncMap{
-	"formatCurrency": formatCurrency,
+// reports whether the logged in admin user may do what permission allows, e.g. {{if .Can "sales.refund"}}
+func (td *templateData) Can(permission string) bool {
+	return td.Permissions.Has(permission)
 }
 
-// format currency to user friendly format
-func formatCurrency(n int) string {
-	f := float32(n) / float32(100)
-	return fmt.Sprintf("%.2f €", f)
+// amounts are money and format themselves, e.g. {{.Amount.Format .Locale}}
+var functions = template.FuncMap{
+	"upper": strings.ToUpper,
 }
 
 //go:embed templates
@@ -45,15 +60,41 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.API = app.config.api
 	td.StripePublishableKey = app.config.stripe.key
 	td.StripeSecretKey = app.config.stripe.secret
+	td.FakeGateway = app.config.stripe.gateway == cards.GatewayFake
 
 	if app.Session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+
+		permissions, err := app.DB.GetUserPermissions(td.UserID)
+		if err != nil {
+			app.logger.Error("failed to get user permissions: ", zap.Error(err))
+		}
+		td.Permissions = permissions
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
 	}
 
+	td.CustomerID = app.Session.GetInt(r.Context(), "customerID")
+
+	if td.Currency == "" {
+		td.Currency = app.currency(r)
+	}
+	if td.Locale == "" {
+		td.Locale = app.locale(r)
+	}
+	td.Currencies = currency.Supported()
+	td.PricesIncludeTax = models.PricesIncludeTax(td.Currency)
+	td.BillingCountries = models.BillingCountries()
+
+	if td.Flash == "" {
+		td.Flash = app.Session.PopString(r.Context(), "flash")
+	}
+	if td.Error == "" {
+		td.Error = app.Session.PopString(r.Context(), "error")
+	}
+
 	return td
 }
 
@@ -94,7 +135,9 @@ func (app *application) parseTemplate(partials []string, page, templateToRender
 		for i, x := range partials {
 			partials[i] = fmt.Sprintf("templates/%s.partial.gohtml", x)
 		}
-		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, "templates/base.layout.gohtml", strings.Join(partials, ","), templateToRender)
+		patterns := append([]string{"templates/base.layout.gohtml"}, partials...)
+		patterns = append(patterns, templateToRender)
+		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, patterns...)
 	} else {
 		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, "templates/base.layout.gohtml", templateToRender)
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"go-stripe/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -17,24 +18,65 @@ func (app *application) routes() http.Handler {
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
+		// pages need the permission of the api routes they call
+		mux.With(app.RequirePermission(models.PermVirtualTerminal)).Get("/virtual-terminal", app.VirtualTerminal)
 
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subscription/{id}", app.ShowSubscription)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermViewSales))
 
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+			mux.Get("/all-sales", app.AllSales)
+			mux.Get("/all-subscriptions", app.AllSubscriptions)
+			mux.Get("/at-risk-subscriptions", app.AtRiskSubscriptions)
+			mux.Get("/sales/{id}", app.ShowSale)
+			mux.Get("/subscription/{id}", app.ShowSubscription)
+		})
+
+		mux.With(app.RequirePermission(models.PermViewInventory)).Get("/inventory", app.InventoryMovements)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermManageUsers))
+
+			mux.Get("/all-users", app.AllUsers)
+			mux.Get("/all-users/{id}", app.OneUser)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermManageCoupons))
+
+			mux.Get("/all-coupons", app.AllCoupons)
+			mux.Get("/all-coupons/{id}", app.OneCoupon)
+		})
+
+		mux.With(app.RequirePermission(models.PermManageTaxRates)).Get("/all-tax-rates", app.AllTaxRates)
+
+		// every user manages their own tokens
+		mux.Get("/tokens", app.Tokens)
+
+		// and their own two-factor authentication
+		mux.Get("/two-factor", app.TwoFactor)
+		mux.Get("/two-factor/qr.png", app.TwoFactorQRCode)
+		mux.Post("/two-factor/enable", app.EnableTwoFactor)
+		mux.Post("/two-factor/recovery-codes", app.RegenerateRecoveryCodes)
+		mux.Post("/two-factor/disable", app.DisableTwoFactor)
 
 	})
 
+	mux.Post("/currency", app.SetCurrency)
+
 	mux.Get("/receipt", app.Receipt)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/widget/{id}", app.ChargeOnce)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/cart/remove", app.RemoveFromCart)
+	mux.Get("/cart/checkout", app.CartCheckout)
+	mux.Post("/cart/payment-succeeded", app.CartPaymentSucceeded)
+
+	mux.Get("/plans", app.Plans)
+	mux.Get("/plans/{id}", app.ShowPlan)
+	mux.Get("/receipt/plan", app.PlanReceipt)
 
 	mux.Get("/login", app.LoginPage)
 	mux.Post("/login", app.PostLoginPage)
@@ -43,6 +85,31 @@ func (app *application) routes() http.Handler {
 
 	mux.Get("/reset-password", app.ShowResetPassword)
 
+	mux.Get("/update-card", app.ShowUpdateCard)
+	mux.Post("/update-card", app.PostUpdateCard)
+
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Get("/register", app.CustomerRegisterPage)
+		mux.Post("/register", app.PostCustomerRegister)
+		mux.Get("/login", app.CustomerLoginPage)
+		mux.Post("/login", app.PostCustomerLogin)
+		mux.Get("/logout", app.CustomerLogout)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.CustomerAuth)
+
+			mux.Get("/orders", app.CustomerOrders)
+			mux.Get("/orders/{id}/invoice", app.CustomerInvoice)
+			mux.Get("/subscriptions", app.CustomerSubscriptions)
+			mux.Post("/subscriptions/{id}/cancel", app.CustomerCancelSubscription)
+			mux.Post("/subscriptions/{id}/card", app.CustomerUpdateCard)
+			mux.Get("/payment-methods", app.CustomerPaymentMethods)
+			mux.Post("/payment-methods", app.CustomerSaveCard)
+			mux.Post("/payment-methods/{id}/default", app.CustomerDefaultCard)
+			mux.Post("/payment-methods/{id}/remove", app.CustomerRemoveCard)
+		})
+	})
+
 	fileServer := http.FileServer(http.Dir("./static"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"go-stripe/internal/models"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// redirects back to the login page at path and returns true while logins by keys have to wait.
+// Logins that can't be checked get 503, so a database outage doesn't lift the limit
+func (app *application) loginThrottled(w http.ResponseWriter, r *http.Request, path string, keys ...models.ThrottleKey) bool {
+	wait, err := app.DB.ThrottleWait(models.ThrottleLogin, keys...)
+	if err != nil {
+		app.logger.Error("failed to check attempts: ", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	app.Session.Put(r.Context(), "error", "Too many failed logins, try again later")
+	http.Redirect(w, r, path, http.StatusSeeOther)
+	return true
+}
+
+// counts a failed attempt of scope against keys
+func (app *application) recordFailure(scope string, keys ...models.ThrottleKey) {
+	if err := app.DB.RecordFailure(scope, keys...); err != nil {
+		app.logger.Error("failed to record failed attempt: ", zap.Error(err))
+	}
+}
+
+// forgets failed attempts of scope by key once one succeeds
+func (app *application) clearFailures(scope string, key models.ThrottleKey) {
+	if err := app.DB.ClearFailures(scope, key); err != nil {
+		app.logger.Error("failed to clear failed attempts: ", zap.Error(err))
+	}
+}
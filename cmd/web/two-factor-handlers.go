@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"go-stripe/internal/encryption"
+	"go-stripe/internal/models"
+	"go-stripe/internal/totp"
+	"net/http"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"go.uber.org/zap"
+)
+
+// name authenticator apps show next to the user's email
+const twoFactorIssuer = "Widgets"
+
+// shows two-factor authentication of the logged in user, with a new secret to scan when it is off
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	twoFactor, err := app.DB.GetTwoFactor(userID)
+	if err != nil {
+		app.logger.Error("failed to get two-factor authentication: ", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]any{
+		"two_factor": twoFactor,
+	}
+
+	if !twoFactor.Enabled {
+		secret, err := app.pendingTwoFactorSecret(r)
+		if err != nil {
+			app.logger.Error("failed to make two-factor secret: ", zap.Error(err))
+			return
+		}
+		data["secret"] = secret
+	}
+
+	td := &templateData{Data: data}
+	if twoFactor.SetupRequired() {
+		td.Warning = "Your role requires two-factor authentication, set it up to carry on"
+	}
+
+	if err := app.renderTemplate(w, r, "two-factor", td); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
+
+// returns secret the user is setting up, kept encrypted in the session until a code of it is entered
+func (app *application) pendingTwoFactorSecret(r *http.Request) (string, error) {
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretKey),
+	}
+
+	if encrypted := app.Session.GetString(r.Context(), "totpSecret"); encrypted != "" {
+		return encryptor.Decrypt(encrypted)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := encryptor.Encrypt(secret)
+	if err != nil {
+		return "", err
+	}
+	app.Session.Put(r.Context(), "totpSecret", encrypted)
+
+	return secret, nil
+}
+
+// serves qr code of the secret being set up, for authenticator apps to scan
+func (app *application) TwoFactorQRCode(w http.ResponseWriter, r *http.Request) {
+	if app.Session.GetString(r.Context(), "totpSecret") == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	secret, err := app.pendingTwoFactorSecret(r)
+	if err != nil {
+		app.logger.Error("failed to get two-factor secret: ", zap.Error(err))
+		return
+	}
+
+	user, err := app.DB.GetUserByID(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.logger.Error("failed to get user: ", zap.Error(err))
+		return
+	}
+
+	// each module 6 pixels wide, the image grows with the url
+	png, err := qrcode.Encode(totp.URL(twoFactorIssuer, user.Email, secret), qrcode.Medium, -6)
+	if err != nil {
+		app.logger.Error("failed to make qr code: ", zap.Error(err))
+		return
+	}
+
+	// the code is as secret as the secret
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err = w.Write(png); err != nil {
+		app.logger.Error("error writing response: ", zap.Error(err))
+	}
+}
+
+// turns on two-factor authentication once a code of the secret being set up is entered, and shows
+// the recovery codes
+func (app *application) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+	encrypted := app.Session.GetString(r.Context(), "totpSecret")
+	if encrypted == "" {
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := app.pendingTwoFactorSecret(r)
+	if err != nil {
+		app.logger.Error("failed to get two-factor secret: ", zap.Error(err))
+		return
+	}
+
+	step, ok := totp.Validate(secret, r.Form.Get("code"), time.Now())
+	if !ok {
+		app.Session.Put(r.Context(), "error", "The code is not right, check the time of your device and try again")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	codes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.logger.Error("failed to make recovery codes: ", zap.Error(err))
+		return
+	}
+
+	if err = app.DB.EnableTwoFactor(userID, encrypted, step, codes); err != nil {
+		app.logger.Error("failed to enable two-factor authentication: ", zap.Error(err))
+		return
+	}
+	app.Session.Remove(r.Context(), "totpSecret")
+
+	app.renderRecoveryCodes(w, r, "Two-factor authentication is on", codes)
+}
+
+// replaces recovery codes of the logged in user, a code is needed to do so
+func (app *application) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if !app.checkTwoFactorForm(w, r) {
+		return
+	}
+
+	codes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.logger.Error("failed to make recovery codes: ", zap.Error(err))
+		return
+	}
+
+	if err = app.DB.ReplaceRecoveryCodes(app.Session.GetInt(r.Context(), "userID"), codes); err != nil {
+		app.logger.Error("failed to replace recovery codes: ", zap.Error(err))
+		return
+	}
+
+	app.renderRecoveryCodes(w, r, "Your old recovery codes no longer work", codes)
+}
+
+// turns off two-factor authentication of the logged in user unless their role requires it
+func (app *application) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !app.checkTwoFactorForm(w, r) {
+		return
+	}
+
+	err := app.DB.DisableTwoFactor(app.Session.GetInt(r.Context(), "userID"))
+	if errors.Is(err, models.ErrTwoFactorRequired) {
+		app.Session.Put(r.Context(), "error", "Your role requires two-factor authentication")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.logger.Error("failed to disable two-factor authentication: ", zap.Error(err))
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is off")
+	http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+}
+
+// checks code posted by the logged in user, redirects back with an error and returns false when
+// it is wrong
+func (app *application) checkTwoFactorForm(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		app.logger.Error("failed to parse form: ", zap.Error(err))
+		return false
+	}
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	twoFactor, err := app.DB.GetTwoFactor(userID)
+	if err != nil {
+		app.logger.Error("failed to get two-factor authentication: ", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if !twoFactor.Enabled {
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return false
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretKey),
+	}
+
+	secret, err := encryptor.Decrypt(twoFactor.Secret)
+	if err != nil {
+		app.logger.Error("failed to decrypt two-factor secret: ", zap.Error(err))
+		return false
+	}
+
+	valid, err := app.DB.CheckTwoFactorCode(userID, secret, r.Form.Get("code"))
+	if err != nil {
+		app.logger.Error("failed to check two-factor code: ", zap.Error(err))
+		return false
+	}
+	if !valid {
+		app.Session.Put(r.Context(), "error", "The code is not right")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return false
+	}
+
+	return true
+}
+
+// shows recovery codes, the only time they are shown
+func (app *application) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, flash string, codes []string) {
+	twoFactor, err := app.DB.GetTwoFactor(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.logger.Error("failed to get two-factor authentication: ", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]any{
+		"two_factor":     twoFactor,
+		"recovery_codes": codes,
+	}
+
+	if err := app.renderTemplate(w, r, "two-factor", &templateData{Data: data, Flash: flash}); err != nil {
+		app.logger.Error("unable to render template: ", zap.Error(err))
+		return
+	}
+}
@@ -1,44 +1,108 @@
 package cards
 
 import (
+	"errors"
 	"fmt"
+	"go-stripe/internal/money"
 
 	"github.com/stripe/stripe-go/v73"
-	"github.com/stripe/stripe-go/v73/customer"
-	"github.com/stripe/stripe-go/v73/paymentintent"
-	"github.com/stripe/stripe-go/v73/paymentmethod"
-	"github.com/stripe/stripe-go/v73/refund"
-	"github.com/stripe/stripe-go/v73/subscription"
 )
 
 type Card struct {
 	Secret   string
 	Key      string
 	Currency string
+	Gateway  PaymentGateway
+	Metadata map[string]string
+	// forwarded to stripe so retried requests don't create duplicate objects
+	IdempotencyKey string
+	// stripe coupon and free trial applied by SubscribeToPlan
+	Coupon    string
+	TrialDays int
+	// saved card SubscribeToPlan charges instead of the customer's default one
+	PaymentMethod string
+	// stripe tax rates SubscribeToPlan applies to the subscription's invoices
+	TaxRates []string
+	// billing address saved on customers CreateCustomer creates, shipping address of payments
+	BillingAddress *Address
+	Shipping       *Address
+}
+
+// type for postal addresses passed to stripe, state is the region of the country
+type Address struct {
+	Name       string
+	Line1      string
+	Line2      string
+	City       string
+	State      string
+	PostalCode string
+	Country    string
+}
+
+func (a *Address) params() *stripe.AddressParams {
+	return &stripe.AddressParams{
+		Line1:      stripe.String(a.Line1),
+		Line2:      stripe.String(a.Line2),
+		City:       stripe.String(a.City),
+		State:      stripe.String(a.State),
+		PostalCode: stripe.String(a.PostalCode),
+		Country:    stripe.String(a.Country),
+	}
+}
+
+func (a *Address) shippingParams() *stripe.ShippingDetailsParams {
+	return &stripe.ShippingDetailsParams{
+		Name:    stripe.String(a.Name),
+		Address: a.params(),
+	}
 }
 
 type Transaction struct {
 	TransactionStatusID int
-	Amount              int
-	Currency            string
+	Amount              money.Money
 	LastFour            string
 	BankReturnCode      string
 }
 
-func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+// returns configured payment gateway, defaults to stripe
+func (c *Card) gateway() PaymentGateway {
+	if c.Gateway == nil {
+		c.Gateway = NewStripeGateway(c.Secret)
+	}
+
+	return c.Gateway
 }
 
-// returns payment intent
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	stripe.Key = c.Secret
+// returns idempotency key for a single stripe call, nil when none was set
+func (c *Card) idempotencyKey(op string) *string {
+	if c.IdempotencyKey == "" {
+		return nil
+	}
+
+	return stripe.String(c.IdempotencyKey + "-" + op)
+}
+
+func (c *Card) Charge(amount money.Money) (*stripe.PaymentIntent, string, error) {
+	return c.CreatePaymentIntent(amount)
+}
 
+// returns payment intent
+func (c *Card) CreatePaymentIntent(amount money.Money) (*stripe.PaymentIntent, string, error) {
 	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(int64(amount)),
-		Currency: stripe.String(currency),
+		Amount:   stripe.Int64(amount.Amount()),
+		Currency: stripe.String(amount.Currency()),
 	}
+	if c.Shipping != nil {
+		params.Shipping = c.Shipping.shippingParams()
+	}
+
+	params.IdempotencyKey = c.idempotencyKey("payment-intent")
 
-	pi, err := paymentintent.New(params)
+	for k, v := range c.Metadata {
+		params.AddMetadata(k, v)
+	}
+
+	pi, err := c.gateway().NewPaymentIntent(params)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -51,11 +115,14 @@ func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Payment
 	return pi, "", nil
 }
 
+// returns amount of payment intent
+func PaymentAmount(pi *stripe.PaymentIntent) (money.Money, error) {
+	return money.New(pi.Amount, string(pi.Currency))
+}
+
 // gets the payment method by payment intent id
 func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
-	stripe.Key = c.Secret
-
-	pm, err := paymentmethod.Get(s, nil)
+	pm, err := c.gateway().GetPaymentMethod(s, nil)
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
@@ -66,9 +133,7 @@ func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
 
 // gets an existing payment intent by id
 func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
-	stripe.Key = c.Secret
-
-	pi, err := paymentintent.Get(id, nil)
+	pi, err := c.gateway().GetPaymentIntent(id, nil)
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
@@ -77,6 +142,72 @@ func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
 	return pi, nil
 }
 
+// outcome of a payment, e.g. the first invoice of a new subscription
+const (
+	PaymentSucceeded      = "succeeded"
+	PaymentRequiresAction = "requires_action"
+	PaymentFailed         = "failed"
+)
+
+var (
+	ErrPaymentIncomplete     = errors.New("payment has not succeeded")
+	ErrPaymentMethodNotSaved = errors.New("payment method is not saved for this customer")
+)
+
+// returns ErrPaymentIncomplete unless payment intent has succeeded, e.g. when 3-D Secure wasn't completed
+func CheckSucceeded(pi *stripe.PaymentIntent) error {
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return fmt.Errorf("%w: payment intent %s is %s", ErrPaymentIncomplete, pi.ID, pi.Status)
+	}
+
+	return nil
+}
+
+// reports whether customer has to confirm payment intent in the browser, e.g. with 3-D Secure
+func RequiresAction(pi *stripe.PaymentIntent) bool {
+	return pi.Status == stripe.PaymentIntentStatusRequiresAction || pi.Status == stripe.PaymentIntentStatusRequiresConfirmation
+}
+
+// returns id of the charge that paid payment intent, empty until it's charged
+func ChargeID(pi *stripe.PaymentIntent) string {
+	if pi.Charges == nil || len(pi.Charges.Data) == 0 {
+		return ""
+	}
+
+	return pi.Charges.Data[0].ID
+}
+
+// state of the first payment of a new subscription
+type SubscriptionPayment struct {
+	Status string
+	// confirms the payment of the first invoice in the browser when it requires action
+	ClientSecret string
+	Message      string
+}
+
+// returns state of first payment of subscription created with latest_invoice.payment_intent expanded
+func FirstPayment(sub *stripe.Subscription) SubscriptionPayment {
+	if sub.Status == stripe.SubscriptionStatusActive || sub.Status == stripe.SubscriptionStatusTrialing {
+		return SubscriptionPayment{Status: PaymentSucceeded}
+	}
+
+	var pi *stripe.PaymentIntent
+	if sub.LatestInvoice != nil {
+		pi = sub.LatestInvoice.PaymentIntent
+	}
+
+	if pi != nil && RequiresAction(pi) {
+		return SubscriptionPayment{Status: PaymentRequiresAction, ClientSecret: pi.ClientSecret}
+	}
+
+	msg := "Your card has been declined"
+	if pi != nil && pi.LastPaymentError != nil {
+		msg = cardErrorMessage(pi.LastPaymentError.Code)
+	}
+
+	return SubscriptionPayment{Status: PaymentFailed, Message: msg}
+}
+
 // returns human readable versions of card error messages
 func cardErrorMessage(code stripe.ErrorCode) string {
 	var msg string
@@ -98,6 +229,8 @@ func cardErrorMessage(code stripe.ErrorCode) string {
 		msg = "Insufficient balance"
 	case stripe.ErrorCodePostalCodeInvalid:
 		msg = "Incorrect postal code"
+	case stripe.ErrorCodeAuthenticationRequired, stripe.ErrorCodeInvoicePamentIntentRequiresAction:
+		msg = "Your bank requires you to confirm the payment"
 	default:
 		msg = "Your card has been declined"
 	}
@@ -117,10 +250,32 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 		Items:    items,
 	}
 
+	if c.Coupon != "" {
+		params.Coupon = stripe.String(c.Coupon)
+	}
+	if c.TrialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(c.TrialDays))
+	}
+	if c.PaymentMethod != "" {
+		params.DefaultPaymentMethod = stripe.String(c.PaymentMethod)
+	}
+	if len(c.TaxRates) > 0 {
+		params.DefaultTaxRates = stripe.StringSlice(c.TaxRates)
+	}
+	// the plan's price needs currency options for currencies other than its own
+	if c.Currency != "" {
+		params.Currency = stripe.String(c.Currency)
+	}
+
+	// a first payment needing 3-D secure leaves the subscription incomplete until the customer confirms it
+	params.PaymentBehavior = stripe.String("allow_incomplete")
+
+	params.AddMetadata("email", email)
 	params.AddMetadata("last_four", last4)
 	params.AddMetadata("card_type", cardType)
 	params.AddExpand("latest_invoice.payment_intent")
-	subscription, err := subscription.New(params)
+	params.IdempotencyKey = c.idempotencyKey("subscription")
+	subscription, err := c.gateway().NewSubscription(params)
 	if err != nil {
 		return nil, err
 	}
@@ -128,18 +283,24 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 	return subscription, nil
 }
 
-// returns newly created customer and potentially error message
+// returns newly created customer and potentially error message, pm may be empty when cards are saved later
 func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
-	stripe.Key = c.Secret
 	customerParams := &stripe.CustomerParams{
-		PaymentMethod: stripe.String(pm),
-		Email:         stripe.String(email),
-		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+		Email: stripe.String(email),
+	}
+	if c.BillingAddress != nil {
+		customerParams.Name = stripe.String(c.BillingAddress.Name)
+		customerParams.Address = c.BillingAddress.params()
+	}
+	if pm != "" {
+		customerParams.PaymentMethod = stripe.String(pm)
+		customerParams.InvoiceSettings = &stripe.CustomerInvoiceSettingsParams{
 			DefaultPaymentMethod: stripe.String(pm),
-		},
+		}
 	}
+	customerParams.IdempotencyKey = c.idempotencyKey("customer")
 
-	cust, err := customer.New(customerParams)
+	cust, err := c.gateway().NewCustomer(customerParams)
 	if err != nil {
 		msg := ""
 
@@ -153,36 +314,442 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 	return cust, "", nil
 }
 
-// refunds payment
-func (c *Card) Refund(pi string, amount int) error {
-	stripe.Key = c.Secret
-	amountToRefund := int64(amount)
+// gets stripe customer, the default card is in its invoice settings
+func (c *Card) GetCustomer(customerID string) (*stripe.Customer, error) {
+	return c.gateway().GetCustomer(customerID, nil)
+}
+
+// attaches card entered at checkout to customer so it's saved for later purchases,
+// returns potentially error message
+func (c *Card) AttachPaymentMethod(customerID, pm string) (*stripe.PaymentMethod, string, error) {
+	params := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	}
+
+	paymentMethod, err := c.gateway().AttachPaymentMethod(pm, params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+
+		return nil, msg, err
+	}
+
+	return paymentMethod, "", nil
+}
+
+// creates setup intent saving a card for off-session payments, the browser confirms it with stripe.confirmCardSetup
+func (c *Card) CreateSetupIntent(customerID string) (*stripe.SetupIntent, error) {
+	params := &stripe.SetupIntentParams{
+		Customer:           stripe.String(customerID),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+	}
+	params.IdempotencyKey = c.idempotencyKey("setup-intent")
+
+	return c.gateway().NewSetupIntent(params)
+}
+
+// gets setup intent, its payment method is saved once it has succeeded
+func (c *Card) GetSetupIntent(id string) (*stripe.SetupIntent, error) {
+	return c.gateway().GetSetupIntent(id, nil)
+}
+
+// returns cards saved for customer
+func (c *Card) ListPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error) {
+	params := &stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	}
+
+	return c.gateway().ListPaymentMethods(params)
+}
+
+// card saved for a customer as shown to customers and admins
+type SavedCard struct {
+	ID       string `json:"id"`
+	Brand    string `json:"brand"`
+	LastFour string `json:"last_four"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+	Default  bool   `json:"default"`
+}
+
+// returns cards saved for customer, the default one marked
+func (c *Card) SavedCards(customerID string) ([]SavedCard, error) {
+	cust, err := c.GetCustomer(customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	pms, err := c.ListPaymentMethods(customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultID := ""
+	if cust.InvoiceSettings != nil && cust.InvoiceSettings.DefaultPaymentMethod != nil {
+		defaultID = cust.InvoiceSettings.DefaultPaymentMethod.ID
+	}
+
+	saved := make([]SavedCard, 0, len(pms))
+	for _, pm := range pms {
+		if pm.Card == nil {
+			continue
+		}
+		saved = append(saved, SavedCard{
+			ID:       pm.ID,
+			Brand:    string(pm.Card.Brand),
+			LastFour: pm.Card.Last4,
+			ExpMonth: int(pm.Card.ExpMonth),
+			ExpYear:  int(pm.Card.ExpYear),
+			Default:  pm.ID == defaultID,
+		})
+	}
+
+	return saved, nil
+}
+
+// returns saved card of customer, ErrPaymentMethodNotSaved when pm isn't one of theirs
+func (c *Card) savedPaymentMethod(customerID, pm string) (*stripe.PaymentMethod, error) {
+	pms, err := c.ListPaymentMethods(customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pms {
+		if p.ID == pm {
+			return p, nil
+		}
+	}
+
+	return nil, ErrPaymentMethodNotSaved
+}
+
+// makes saved card the one customer's invoices are charged to
+func (c *Card) SetDefaultPaymentMethod(customerID, pm string) error {
+	if _, err := c.savedPaymentMethod(customerID, pm); err != nil {
+		return err
+	}
+
+	params := &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm),
+		},
+	}
+
+	_, err := c.gateway().UpdateCustomer(customerID, params)
+	return err
+}
+
+// removes saved card from customer
+func (c *Card) DetachPaymentMethod(customerID, pm string) error {
+	if _, err := c.savedPaymentMethod(customerID, pm); err != nil {
+		return err
+	}
+
+	_, err := c.gateway().DetachPaymentMethod(pm, nil)
+	return err
+}
+
+// charges saved card of customer, returns payment intent and potentially error message. A customer
+// at checkout may have to confirm the payment in the browser, off-session charges fail instead
+func (c *Card) ChargeSavedCard(customerID, pm string, amount money.Money, offSession bool) (*stripe.PaymentIntent, string, error) {
+	if _, err := c.savedPaymentMethod(customerID, pm); err != nil {
+		return nil, "", err
+	}
+
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(amount.Amount()),
+		Currency:      stripe.String(amount.Currency()),
+		Customer:      stripe.String(customerID),
+		PaymentMethod: stripe.String(pm),
+		Confirm:       stripe.Bool(true),
+	}
+	if offSession {
+		params.OffSession = stripe.Bool(true)
+	}
+	if c.Shipping != nil {
+		params.Shipping = c.Shipping.shippingParams()
+	}
+
+	params.IdempotencyKey = c.idempotencyKey("payment-intent")
+
+	for k, v := range c.Metadata {
+		params.AddMetadata(k, v)
+	}
+
+	pi, err := c.gateway().NewPaymentIntent(params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+
+		return nil, msg, err
+	}
+
+	return pi, "", nil
+}
+
+// refunds all or part of payment, card metadata is attached to the refund
+func (c *Card) Refund(pi string, amount money.Money) (*stripe.Refund, error) {
+	amountToRefund := amount.Amount()
 
 	refundParams := &stripe.RefundParams{
 		Amount:        &amountToRefund,
 		PaymentIntent: &pi,
 	}
+	refundParams.IdempotencyKey = c.idempotencyKey("refund")
+
+	for k, v := range c.Metadata {
+		refundParams.AddMetadata(k, v)
+	}
 
-	_, err := refund.New(refundParams)
+	refund, err := c.gateway().NewRefund(refundParams)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return refund, nil
 }
 
 // cancels subscription
 func (c *Card) CancelSubscription(subID string) error {
-	stripe.Key = c.Secret
-
 	params := &stripe.SubscriptionParams{
 		CancelAtPeriodEnd: stripe.Bool(true),
 	}
+	params.IdempotencyKey = c.idempotencyKey("cancel-subscription")
 
-	_, err := subscription.Update(subID, params)
+	_, err := c.gateway().UpdateSubscription(subID, params)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// cancels subscription right away, e.g. after its last renewal payment failed
+func (c *Card) CancelSubscriptionNow(subID string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionCancelParams{}
+	params.IdempotencyKey = c.idempotencyKey("cancel-subscription-now")
+
+	return c.gateway().CancelSubscription(subID, params)
+}
+
+// charges open invoice to the payment method on file, returns invoice and potentially error message
+func (c *Card) RetryInvoice(invoiceID string) (*stripe.Invoice, string, error) {
+	params := &stripe.InvoicePayParams{}
+	params.IdempotencyKey = c.idempotencyKey("pay-invoice")
+
+	inv, err := c.gateway().PayInvoice(invoiceID, params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Type == stripe.ErrorTypeCard {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+
+		return nil, msg, err
+	}
+
+	return inv, "", nil
+}
+
+// creates stripe coupon applied to subscriptions
+func (c *Card) CreateCoupon(name string, percentOff int, amountOff money.Money, duration string, durationInMonths int) (*stripe.Coupon, error) {
+	params := &stripe.CouponParams{
+		Name:     stripe.String(name),
+		Duration: stripe.String(duration),
+	}
+
+	if percentOff > 0 {
+		params.PercentOff = stripe.Float64(float64(percentOff))
+	} else {
+		params.AmountOff = stripe.Int64(amountOff.Amount())
+		params.Currency = stripe.String(amountOff.Currency())
+	}
+
+	if durationInMonths > 0 {
+		params.DurationInMonths = stripe.Int64(int64(durationInMonths))
+	}
+
+	params.IdempotencyKey = c.idempotencyKey("coupon")
+
+	return c.gateway().NewCoupon(params)
+}
+
+// deletes stripe coupon, subscriptions already discounted keep their discount
+func (c *Card) DeleteCoupon(id string) error {
+	_, err := c.gateway().DeleteCoupon(id, nil)
+	return err
+}
+
+// creates stripe tax rate, rate is in basis points, inclusive rates are a part of the plan's price
+func (c *Card) CreateTaxRate(name, country, region string, rate int, inclusive bool) (*stripe.TaxRate, error) {
+	params := &stripe.TaxRateParams{
+		DisplayName: stripe.String(name),
+		Country:     stripe.String(country),
+		Percentage:  stripe.Float64(float64(rate) / 100),
+		Inclusive:   stripe.Bool(inclusive),
+	}
+
+	jurisdiction := country
+	if region != "" {
+		params.State = stripe.String(region)
+		jurisdiction += "-" + region
+	}
+	params.Jurisdiction = stripe.String(jurisdiction)
+	params.IdempotencyKey = c.idempotencyKey("tax-rate")
+
+	return c.gateway().NewTaxRate(params)
+}
+
+// gets subscription by id with its latest invoice and the invoice's payment intent
+func (c *Card) GetSubscription(subID string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice.payment_intent")
+
+	sub, err := c.gateway().GetSubscription(subID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// attaches payment method to the subscription's customer and charges future invoices to it,
+// returns payment method and potentially error message
+func (c *Card) UpdateSubscriptionPaymentMethod(subID, pm string) (*stripe.PaymentMethod, string, error) {
+	sub, err := c.GetSubscription(subID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	attachParams := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(sub.Customer.ID),
+	}
+	attachParams.IdempotencyKey = c.idempotencyKey("attach-payment-method")
+
+	method, err := c.gateway().AttachPaymentMethod(pm, attachParams)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+
+		return nil, msg, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		DefaultPaymentMethod: stripe.String(pm),
+	}
+	params.IdempotencyKey = c.idempotencyKey("update-subscription")
+
+	if _, err = c.gateway().UpdateSubscription(subID, params); err != nil {
+		return nil, "", err
+	}
+
+	return method, "", nil
+}
+
+// prorated cost of switching a subscription to another plan
+type PlanChangePreview struct {
+	// timestamp the proration is calculated for, pass it to ChangePlan to charge the previewed amount
+	ProrationDate int64
+	// charged (or credited when negative) for the rest of the current period
+	ProrationAmount money.Money
+	// total of the next invoice including the proration
+	NextInvoiceAmount money.Money
+}
+
+// returns the only item of a subscription, plans are subscribed one per subscription
+func subscriptionItem(sub *stripe.Subscription) (*stripe.SubscriptionItem, error) {
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return nil, fmt.Errorf("subscription %s has no items", sub.ID)
+	}
+
+	return sub.Items.Data[0], nil
+}
+
+// previews prorated charge of switching subscription to plan at proration date
+func (c *Card) PreviewPlanChange(subID, plan string, prorationDate int64) (*PlanChangePreview, error) {
+	sub, err := c.GetSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := subscriptionItem(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.InvoiceUpcomingParams{
+		Customer:     stripe.String(sub.Customer.ID),
+		Subscription: stripe.String(subID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Plan: stripe.String(plan)},
+		},
+		SubscriptionProrationDate: stripe.Int64(prorationDate),
+	}
+
+	invoice, err := c.gateway().GetUpcomingInvoice(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var proration int64
+	if invoice.Lines != nil {
+		for _, line := range invoice.Lines.Data {
+			if line.Proration {
+				proration += line.Amount
+			}
+		}
+	}
+
+	preview := &PlanChangePreview{ProrationDate: prorationDate}
+
+	if preview.ProrationAmount, err = money.New(proration, string(invoice.Currency)); err != nil {
+		return nil, err
+	}
+	if preview.NextInvoiceAmount, err = money.New(invoice.AmountDue, string(invoice.Currency)); err != nil {
+		return nil, err
+	}
+
+	return preview, nil
+}
+
+// switches subscription to plan with proration at proration date,
+// chargeNow invoices the prorated amount right away instead of adding it to the next invoice
+func (c *Card) ChangePlan(subID, plan string, prorationDate int64, chargeNow bool) (*stripe.Subscription, error) {
+	sub, err := c.GetSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := subscriptionItem(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	behavior := "create_prorations"
+	if chargeNow {
+		behavior = "always_invoice"
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Plan: stripe.String(plan)},
+		},
+		ProrationBehavior: stripe.String(behavior),
+		ProrationDate:     stripe.Int64(prorationDate),
+	}
+	params.IdempotencyKey = c.idempotencyKey("change-plan")
+
+	updated, err := c.gateway().UpdateSubscription(subID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
@@ -10,18 +10,57 @@ import (
 func Test_CardErrorMessage(t *testing.T) {
 	// table-driven testing
 	testCases := map[stripe.ErrorCode]string{
-		stripe.ErrorCodeCardDeclined:        "Your card has been declined",
-		stripe.ErrorCodeExpiredCard:         "Your card is expired",
-		stripe.ErrorCodeIncorrectCVC:        "Incorrect CVC code",
-		stripe.ErrorCodeIncorrectZip:        "Incorrect ZIP/postal code",
-		stripe.ErrorCodeAmountTooLarge:      "The amount is too large to charge to your card",
-		stripe.ErrorCodeAmountTooSmall:      "The amount is too small to charge to your card",
-		stripe.ErrorCodeBalanceInsufficient: "Insufficient balance",
-		stripe.ErrorCodePostalCodeInvalid:   "Incorrect postal code",
-		stripe.ErrorCodeAPIKeyExpired:       "Your card has been declined",
+		stripe.ErrorCodeCardDeclined:           "Your card has been declined",
+		stripe.ErrorCodeExpiredCard:            "Your card is expired",
+		stripe.ErrorCodeIncorrectCVC:           "Incorrect CVC code",
+		stripe.ErrorCodeIncorrectZip:           "Incorrect ZIP/postal code",
+		stripe.ErrorCodeAmountTooLarge:         "The amount is too large to charge to your card",
+		stripe.ErrorCodeAmountTooSmall:         "The amount is too small to charge to your card",
+		stripe.ErrorCodeBalanceInsufficient:    "Insufficient balance",
+		stripe.ErrorCodePostalCodeInvalid:      "Incorrect postal code",
+		stripe.ErrorCodeAuthenticationRequired: "Your bank requires you to confirm the payment",
+		stripe.ErrorCodeAPIKeyExpired:          "Your card has been declined",
 	}
 
 	for k, v := range testCases {
 		assert.Equal(t, cardErrorMessage(k), v)
 	}
 }
+
+func Test_CheckSucceeded(t *testing.T) {
+	assert.Nil(t, CheckSucceeded(&stripe.PaymentIntent{Status: stripe.PaymentIntentStatusSucceeded}))
+
+	err := CheckSucceeded(&stripe.PaymentIntent{ID: "pi_1", Status: stripe.PaymentIntentStatusRequiresAction})
+	assert.ErrorIs(t, err, ErrPaymentIncomplete)
+
+	assert.Equal(t, "", ChargeID(&stripe.PaymentIntent{}))
+	assert.Equal(t, "", ChargeID(&stripe.PaymentIntent{Charges: &stripe.ChargeList{}}))
+	assert.Equal(t, "ch_1", ChargeID(&stripe.PaymentIntent{Charges: &stripe.ChargeList{Data: []*stripe.Charge{{ID: "ch_1"}}}}))
+}
+
+func Test_FirstPayment(t *testing.T) {
+	active := &stripe.Subscription{Status: stripe.SubscriptionStatusActive}
+	assert.Equal(t, PaymentSucceeded, FirstPayment(active).Status)
+
+	needsAuth := &stripe.Subscription{
+		Status: stripe.SubscriptionStatusIncomplete,
+		LatestInvoice: &stripe.Invoice{PaymentIntent: &stripe.PaymentIntent{
+			Status:       stripe.PaymentIntentStatusRequiresAction,
+			ClientSecret: "pi_1_secret",
+		}},
+	}
+	payment := FirstPayment(needsAuth)
+	assert.Equal(t, PaymentRequiresAction, payment.Status)
+	assert.Equal(t, "pi_1_secret", payment.ClientSecret)
+
+	declined := &stripe.Subscription{
+		Status: stripe.SubscriptionStatusIncomplete,
+		LatestInvoice: &stripe.Invoice{PaymentIntent: &stripe.PaymentIntent{
+			Status:           stripe.PaymentIntentStatusRequiresPaymentMethod,
+			LastPaymentError: &stripe.Error{Code: stripe.ErrorCodeExpiredCard},
+		}},
+	}
+	payment = FirstPayment(declined)
+	assert.Equal(t, PaymentFailed, payment.Status)
+	assert.Equal(t, "Your card is expired", payment.Message)
+}
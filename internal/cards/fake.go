@@ -0,0 +1,1217 @@
+package cards
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v73"
+)
+
+// payment methods understood by the fake gateway, modelled after stripe test tokens
+const (
+	FakeCardVisa              = "pm_card_visa"
+	FakeCardMastercard        = "pm_card_mastercard"
+	FakeCardDeclined          = "pm_card_chargeDeclined"
+	FakeCardInsufficientFunds = "pm_card_chargeDeclinedInsufficientFunds"
+	FakeCardExpired           = "pm_card_chargeDeclinedExpiredCard"
+	// always asks for 3-D Secure, payments wait for ConfirmPaymentIntent
+	FakeCardAuthenticationRequired = "pm_card_authenticationRequired"
+)
+
+// deterministic in-memory payment gateway for local development and tests,
+// payment intents are settled immediately so flows complete without stripe.js
+type FakeGateway struct {
+	mu            sync.Mutex
+	now           func() time.Time
+	counters      map[string]int
+	intents       map[string]*stripe.PaymentIntent
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	refunds       map[string]*stripe.Refund
+	coupons       map[string]*stripe.Coupon
+	taxRates      map[string]*stripe.TaxRate
+	invoices      map[string]*stripe.Invoice
+	setupIntents  map[string]*stripe.SetupIntent
+	// payment methods attached to each customer, in the order they were attached
+	paymentMethods map[string][]string
+	// objects created with an idempotency key, returned again on retries
+	idempotent map[string]interface{}
+	// plan prices used for prorations keyed by plan and currency, unknown plans are free
+	prices map[string]int64
+}
+
+// returns empty fake gateway
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		now:            time.Now,
+		counters:       make(map[string]int),
+		intents:        make(map[string]*stripe.PaymentIntent),
+		customers:      make(map[string]*stripe.Customer),
+		subscriptions:  make(map[string]*stripe.Subscription),
+		refunds:        make(map[string]*stripe.Refund),
+		coupons:        make(map[string]*stripe.Coupon),
+		taxRates:       make(map[string]*stripe.TaxRate),
+		invoices:       make(map[string]*stripe.Invoice),
+		setupIntents:   make(map[string]*stripe.SetupIntent),
+		paymentMethods: make(map[string][]string),
+		idempotent:     make(map[string]interface{}),
+		prices:         make(map[string]int64),
+	}
+}
+
+// sets price per period of plan, so prorations can be previewed, it applies
+// to currencies the plan has no price in
+func (g *FakeGateway) SetPrice(plan string, amount int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prices[plan] = amount
+}
+
+// sets price per period of plan in currency, like currency options of a stripe price
+func (g *FakeGateway) SetCurrencyPrice(plan, currency string, amount int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prices[plan+"/"+strings.ToLower(currency)] = amount
+}
+
+// returns plan with its price in currency
+func (g *FakeGateway) plan(id string, currency stripe.Currency) *stripe.Plan {
+	amount, ok := g.prices[id+"/"+string(currency)]
+	if !ok {
+		amount = g.prices[id]
+	}
+
+	return &stripe.Plan{ID: id, Amount: amount, Currency: currency}
+}
+
+// returns next sequential id for prefix, e.g. pi_fake_1
+func (g *FakeGateway) nextID(prefix string) string {
+	g.counters[prefix]++
+	return fmt.Sprintf("%s_fake_%d", prefix, g.counters[prefix])
+}
+
+// returns object previously created with idempotency key
+func (g *FakeGateway) replay(key *string) (interface{}, bool) {
+	if key == nil {
+		return nil, false
+	}
+
+	obj, ok := g.idempotent[*key]
+	return obj, ok
+}
+
+// stores created object under idempotency key
+func (g *FakeGateway) remember(key *string, obj interface{}) {
+	if key != nil {
+		g.idempotent[*key] = obj
+	}
+}
+
+// returns card error for declining test payment methods
+func fakeCardError(pm string) error {
+	var code stripe.ErrorCode
+
+	switch pm {
+	case FakeCardDeclined:
+		code = stripe.ErrorCodeCardDeclined
+	case FakeCardInsufficientFunds:
+		code = stripe.ErrorCodeBalanceInsufficient
+	case FakeCardExpired:
+		code = stripe.ErrorCodeExpiredCard
+	default:
+		return nil
+	}
+
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeCard,
+		Code:           code,
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Msg:            cardErrorMessage(code),
+	}
+}
+
+// returns error stripe gives for off-session payments the bank wants authenticated
+func fakeAuthenticationRequired() error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeCard,
+		Code:           stripe.ErrorCodeAuthenticationRequired,
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Msg:            cardErrorMessage(stripe.ErrorCodeAuthenticationRequired),
+	}
+}
+
+// returns invalid request error in the same shape stripe does
+func fakeInvalidRequest(msg string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		HTTPStatusCode: http.StatusBadRequest,
+		Msg:            msg,
+	}
+}
+
+// reports whether payment method is attached to customer
+func (g *FakeGateway) attached(pm, customerID string) bool {
+	for _, id := range g.paymentMethods[customerID] {
+		if id == pm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attaches payment method to customer, test payment methods can be attached to any number of customers
+func (g *FakeGateway) attach(pm, customerID string) {
+	if !g.attached(pm, customerID) {
+		g.paymentMethods[customerID] = append(g.paymentMethods[customerID], pm)
+	}
+}
+
+// returns not found error in the same shape stripe does
+func fakeNotFound(kind, id string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", kind, id),
+	}
+}
+
+func (g *FakeGateway) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if obj, ok := g.replay(params.IdempotencyKey); ok {
+		return obj.(*stripe.PaymentIntent), nil
+	}
+
+	pm := FakeCardVisa
+	if params.PaymentMethod != nil {
+		pm = *params.PaymentMethod
+	}
+
+	if err := fakeCardError(pm); err != nil {
+		return nil, err
+	}
+
+	// saved cards are charged for the customer they belong to
+	if params.Customer != nil && params.PaymentMethod != nil && !g.attached(pm, *params.Customer) {
+		return nil, fakeInvalidRequest(fmt.Sprintf("The payment method %s does not belong to customer %s", pm, *params.Customer))
+	}
+
+	// the customer isn't there to authenticate
+	if pm == FakeCardAuthenticationRequired && params.OffSession != nil && *params.OffSession {
+		return nil, fakeAuthenticationRequired()
+	}
+
+	var amount int64
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+
+	var currency string
+	if params.Currency != nil {
+		currency = *params.Currency
+	}
+
+	if pm == FakeCardAuthenticationRequired {
+		pi := g.newIntentRequiringAction(amount, currency)
+		pi.PaymentMethod = &stripe.PaymentMethod{ID: pm}
+		pi.Metadata = params.Metadata
+		if params.Customer != nil {
+			pi.Customer = &stripe.Customer{ID: *params.Customer}
+		}
+		g.remember(params.IdempotencyKey, pi)
+		return pi, nil
+	}
+
+	id := g.nextID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:             id,
+		Object:         "payment_intent",
+		Amount:         amount,
+		AmountReceived: amount,
+		Currency:       stripe.Currency(currency),
+		ClientSecret:   id + "_secret_fake",
+		Created:        g.now().Unix(),
+		Status:         stripe.PaymentIntentStatusSucceeded,
+		PaymentMethod:  &stripe.PaymentMethod{ID: pm},
+		Metadata:       params.Metadata,
+		Charges: &stripe.ChargeList{
+			Data: []*stripe.Charge{
+				{
+					ID:            g.nextID("ch"),
+					Amount:        amount,
+					Currency:      stripe.Currency(currency),
+					Paid:          true,
+					Captured:      true,
+					PaymentMethod: pm,
+					Status:        stripe.ChargeStatusSucceeded,
+				},
+			},
+		},
+	}
+
+	if params.Customer != nil {
+		pi.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+	if params.Shipping != nil {
+		pi.Shipping = fakeShipping(params.Shipping)
+	}
+
+	g.intents[id] = pi
+	g.remember(params.IdempotencyKey, pi)
+
+	return pi, nil
+}
+
+func fakeAddress(params *stripe.AddressParams) *stripe.Address {
+	a := &stripe.Address{}
+	if params.Line1 != nil {
+		a.Line1 = *params.Line1
+	}
+	if params.Line2 != nil {
+		a.Line2 = *params.Line2
+	}
+	if params.City != nil {
+		a.City = *params.City
+	}
+	if params.State != nil {
+		a.State = *params.State
+	}
+	if params.PostalCode != nil {
+		a.PostalCode = *params.PostalCode
+	}
+	if params.Country != nil {
+		a.Country = *params.Country
+	}
+
+	return a
+}
+
+func fakeShipping(params *stripe.ShippingDetailsParams) *stripe.ShippingDetails {
+	shipping := &stripe.ShippingDetails{}
+	if params.Name != nil {
+		shipping.Name = *params.Name
+	}
+	if params.Address != nil {
+		shipping.Address = fakeAddress(params.Address)
+	}
+
+	return shipping
+}
+
+// stores payment intent waiting for the customer to authenticate
+func (g *FakeGateway) newIntentRequiringAction(amount int64, currency string) *stripe.PaymentIntent {
+	id := g.nextID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Object:       "payment_intent",
+		Amount:       amount,
+		Currency:     stripe.Currency(currency),
+		ClientSecret: id + "_secret_fake",
+		Created:      g.now().Unix(),
+		Status:       stripe.PaymentIntentStatusRequiresAction,
+		NextAction: &stripe.PaymentIntentNextAction{
+			Type: stripe.PaymentIntentNextActionType("use_stripe_sdk"),
+		},
+		Charges: &stripe.ChargeList{},
+	}
+
+	g.intents[id] = pi
+
+	return pi
+}
+
+// completes payment intent waiting for authentication, as the browser does after 3-D Secure,
+// paying the invoice and activating the subscription it belongs to
+func (g *FakeGateway) ConfirmPaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pi, ok := g.intents[id]
+	if !ok {
+		return nil, fakeNotFound("payment_intent", id)
+	}
+
+	if pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		return pi, nil
+	}
+
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = pi.Amount
+	pi.NextAction = nil
+	pi.Charges.Data = append(pi.Charges.Data, &stripe.Charge{
+		ID:       g.nextID("ch"),
+		Amount:   pi.Amount,
+		Currency: pi.Currency,
+		Paid:     true,
+		Captured: true,
+		Status:   stripe.ChargeStatusSucceeded,
+	})
+
+	if inv := pi.Invoice; inv != nil {
+		inv.Paid = true
+		inv.Status = stripe.InvoiceStatusPaid
+		inv.AmountPaid = inv.AmountDue
+		inv.AmountRemaining = 0
+		if inv.Subscription != nil && inv.Subscription.Status == stripe.SubscriptionStatusIncomplete {
+			inv.Subscription.Status = stripe.SubscriptionStatusActive
+		}
+	}
+
+	return pi, nil
+}
+
+func (g *FakeGateway) GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pi, ok := g.intents[id]
+	if !ok {
+		return nil, fakeNotFound("payment_intent", id)
+	}
+
+	return pi, nil
+}
+
+func (g *FakeGateway) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pi, ok := g.intents[id]
+	if !ok {
+		return nil, fakeNotFound("payment_intent", id)
+	}
+
+	if pi.Status == stripe.PaymentIntentStatusSucceeded {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodePaymentIntentUnexpectedState,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            "payment intent has already succeeded",
+		}
+	}
+
+	pi.Status = stripe.PaymentIntentStatusCanceled
+	pi.CanceledAt = g.now().Unix()
+
+	return pi, nil
+}
+
+// returns test payment method, not attached to anyone
+func (g *FakeGateway) paymentMethod(id string) *stripe.PaymentMethod {
+	brand := stripe.PaymentMethodCardBrandVisa
+	last4 := "4242"
+
+	switch id {
+	case FakeCardMastercard:
+		brand = stripe.PaymentMethodCardBrandMastercard
+		last4 = "4444"
+	case FakeCardDeclined:
+		last4 = "0002"
+	case FakeCardInsufficientFunds:
+		last4 = "9995"
+	case FakeCardExpired:
+		last4 = "0069"
+	case FakeCardAuthenticationRequired:
+		last4 = "3184"
+	}
+
+	return &stripe.PaymentMethod{
+		ID:     id,
+		Object: "payment_method",
+		Type:   stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand:    brand,
+			Last4:    last4,
+			ExpMonth: 12,
+			ExpYear:  int64(g.now().Year() + 5),
+		},
+	}
+}
+
+func (g *FakeGateway) GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.paymentMethod(id), nil
+}
+
+func (g *FakeGateway) AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	if err := fakeCardError(id); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pm := g.paymentMethod(id)
+
+	if params.Customer != nil {
+		cust, ok := g.customers[*params.Customer]
+		if !ok {
+			return nil, fakeNotFound("customer", *params.Customer)
+		}
+		g.attach(id, cust.ID)
+		pm.Customer = cust
+	}
+
+	return pm, nil
+}
+
+// detaches payment method from the customers it's attached to, clearing their default when it was the default
+func (g *FakeGateway) DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	detached := false
+	for customerID, pms := range g.paymentMethods {
+		for i, pm := range pms {
+			if pm != id {
+				continue
+			}
+
+			g.paymentMethods[customerID] = append(pms[:i:i], pms[i+1:]...)
+			detached = true
+
+			if cust, ok := g.customers[customerID]; ok {
+				if def := cust.InvoiceSettings.DefaultPaymentMethod; def != nil && def.ID == id {
+					cust.InvoiceSettings.DefaultPaymentMethod = nil
+				}
+			}
+			break
+		}
+	}
+
+	if !detached {
+		return nil, fakeInvalidRequest(fmt.Sprintf("The payment method %s is not attached to a customer", id))
+	}
+
+	return g.paymentMethod(id), nil
+}
+
+// returns payment methods attached to customer in the order they were attached
+func (g *FakeGateway) ListPaymentMethods(params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var customerID string
+	if params.Customer != nil {
+		customerID = *params.Customer
+	}
+
+	cust, ok := g.customers[customerID]
+	if !ok {
+		return nil, fakeNotFound("customer", customerID)
+	}
+
+	var pms []*stripe.PaymentMethod
+	for _, id := range g.paymentMethods[customerID] {
+		pm := g.paymentMethod(id)
+		pm.Customer = cust
+		pms = append(pms, pm)
+	}
+
+	return pms, nil
+}
+
+// creates setup intent, confirming it right away when it's given a payment method and confirm
+func (g *FakeGateway) NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if obj, ok := g.replay(params.IdempotencyKey); ok {
+		return obj.(*stripe.SetupIntent), nil
+	}
+
+	id := g.nextID("seti")
+	si := &stripe.SetupIntent{
+		ID:           id,
+		Object:       "setup_intent",
+		ClientSecret: id + "_secret_fake",
+		Created:      g.now().Unix(),
+		Status:       stripe.SetupIntentStatusRequiresPaymentMethod,
+		Usage:        stripe.SetupIntentUsageOffSession,
+		Metadata:     params.Metadata,
+	}
+
+	if params.Customer != nil {
+		cust, ok := g.customers[*params.Customer]
+		if !ok {
+			return nil, fakeNotFound("customer", *params.Customer)
+		}
+		si.Customer = cust
+	}
+
+	if params.Usage != nil {
+		si.Usage = stripe.SetupIntentUsage(*params.Usage)
+	}
+
+	g.setupIntents[id] = si
+
+	if params.PaymentMethod != nil && params.Confirm != nil && *params.Confirm {
+		if err := g.confirmSetupIntent(si, *params.PaymentMethod); err != nil {
+			return nil, err
+		}
+	}
+
+	g.remember(params.IdempotencyKey, si)
+
+	return si, nil
+}
+
+// saves card with setup intent, as the browser does with stripe.confirmCardSetup
+func (g *FakeGateway) ConfirmSetupIntent(id, pm string) (*stripe.SetupIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	si, ok := g.setupIntents[id]
+	if !ok {
+		return nil, fakeNotFound("setup_intent", id)
+	}
+
+	if err := g.confirmSetupIntent(si, pm); err != nil {
+		return nil, err
+	}
+
+	return si, nil
+}
+
+// attaches payment method of setup intent to its customer, declining test cards fail
+func (g *FakeGateway) confirmSetupIntent(si *stripe.SetupIntent, pm string) error {
+	if si.Status == stripe.SetupIntentStatusSucceeded {
+		return fakeInvalidRequest("setup intent has already succeeded")
+	}
+
+	if err := fakeCardError(pm); err != nil {
+		si.LastSetupError = &stripe.Error{Type: stripe.ErrorTypeCard, Code: err.(*stripe.Error).Code}
+		return err
+	}
+
+	if si.Customer != nil {
+		g.attach(pm, si.Customer.ID)
+	}
+
+	si.PaymentMethod = g.paymentMethod(pm)
+	si.Status = stripe.SetupIntentStatusSucceeded
+	si.LastSetupError = nil
+
+	return nil
+}
+
+func (g *FakeGateway) GetSetupIntent(id string, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	si, ok := g.setupIntents[id]
+	if !ok {
+		return nil, fakeNotFound("setup_intent", id)
+	}
+
+	return si, nil
+}
+
+func (g *FakeGateway) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if obj, ok := g.replay(params.IdempotencyKey); ok {
+		return obj.(*stripe.Customer), nil
+	}
+
+	cust := &stripe.Customer{
+		ID:              g.nextID("cus"),
+		Object:          "customer",
+		Created:         g.now().Unix(),
+		Metadata:        params.Metadata,
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{},
+	}
+
+	if params.Email != nil {
+		cust.Email = *params.Email
+	}
+	if params.Name != nil {
+		cust.Name = *params.Name
+	}
+	if params.Address != nil {
+		cust.Address = fakeAddress(params.Address)
+	}
+
+	if params.PaymentMethod != nil {
+		if err := fakeCardError(*params.PaymentMethod); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.InvoiceSettings != nil && params.InvoiceSettings.DefaultPaymentMethod != nil {
+		pm := *params.InvoiceSettings.DefaultPaymentMethod
+		if err := fakeCardError(pm); err != nil {
+			return nil, err
+		}
+		cust.InvoiceSettings.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+	}
+
+	g.customers[cust.ID] = cust
+	if params.PaymentMethod != nil {
+		g.paymentMethods[cust.ID] = []string{*params.PaymentMethod}
+	}
+	g.remember(params.IdempotencyKey, cust)
+
+	return cust, nil
+}
+
+func (g *FakeGateway) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cust, ok := g.customers[id]
+	if !ok {
+		return nil, fakeNotFound("customer", id)
+	}
+
+	return cust, nil
+}
+
+// updates email and default payment method of customer, the default must be attached to it
+func (g *FakeGateway) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cust, ok := g.customers[id]
+	if !ok {
+		return nil, fakeNotFound("customer", id)
+	}
+
+	if params.InvoiceSettings != nil && params.InvoiceSettings.DefaultPaymentMethod != nil {
+		pm := *params.InvoiceSettings.DefaultPaymentMethod
+		if !g.attached(pm, id) {
+			return nil, fakeInvalidRequest(fmt.Sprintf("The payment method %s is not attached to customer %s", pm, id))
+		}
+		cust.InvoiceSettings.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+	}
+
+	if params.Email != nil {
+		cust.Email = *params.Email
+	}
+
+	return cust, nil
+}
+
+func (g *FakeGateway) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if obj, ok := g.replay(params.IdempotencyKey); ok {
+		return obj.(*stripe.Subscription), nil
+	}
+
+	var customerID string
+	if params.Customer != nil {
+		customerID = *params.Customer
+	}
+
+	cust, ok := g.customers[customerID]
+	if !ok {
+		return nil, fakeNotFound("customer", customerID)
+	}
+
+	var discount *stripe.Discount
+	if params.Coupon != nil {
+		coupon, ok := g.coupons[*params.Coupon]
+		if !ok {
+			return nil, fakeNotFound("coupon", *params.Coupon)
+		}
+		discount = &stripe.Discount{Coupon: coupon, Customer: cust}
+	}
+
+	var taxRates []*stripe.TaxRate
+	for _, id := range params.DefaultTaxRates {
+		rate, ok := g.taxRates[*id]
+		if !ok {
+			return nil, fakeNotFound("tax_rate", *id)
+		}
+		taxRates = append(taxRates, rate)
+	}
+
+	now := g.now()
+	id := g.nextID("sub")
+
+	currency := stripe.CurrencyEUR
+	if params.Currency != nil {
+		currency = stripe.Currency(strings.ToLower(*params.Currency))
+	}
+
+	items := &stripe.SubscriptionItemList{}
+	for _, item := range params.Items {
+		si := &stripe.SubscriptionItem{
+			ID:           g.nextID("si"),
+			Subscription: id,
+			Quantity:     1,
+		}
+		if item.Plan != nil {
+			si.Plan = g.plan(*item.Plan, currency)
+		}
+		if item.Price != nil {
+			si.Price = &stripe.Price{ID: *item.Price}
+		}
+		if item.Quantity != nil {
+			si.Quantity = *item.Quantity
+		}
+		items.Data = append(items.Data, si)
+	}
+
+	sub := &stripe.Subscription{
+		ID:                 id,
+		Object:             "subscription",
+		Customer:           cust,
+		Created:            now.Unix(),
+		Currency:           currency,
+		StartDate:          now.Unix(),
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Status:             stripe.SubscriptionStatusActive,
+		Items:              items,
+		Metadata:           params.Metadata,
+		Discount:           discount,
+		DefaultTaxRates:    taxRates,
+		LatestInvoice: &stripe.Invoice{
+			ID:            g.nextID("in"),
+			Currency:      currency,
+			Paid:          true,
+			Status:        stripe.InvoiceStatusPaid,
+			BillingReason: stripe.InvoiceBillingReasonSubscriptionCreate,
+		},
+	}
+
+	// trial replaces the first billing period, its invoice is free
+	trial := params.TrialPeriodDays != nil && *params.TrialPeriodDays > 0
+
+	pm := ""
+	if cust.InvoiceSettings != nil && cust.InvoiceSettings.DefaultPaymentMethod != nil {
+		pm = cust.InvoiceSettings.DefaultPaymentMethod.ID
+	}
+	if params.DefaultPaymentMethod != nil {
+		pm = *params.DefaultPaymentMethod
+		sub.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+	}
+
+	// the first invoice waits for the customer to authenticate
+	if !trial && pm == FakeCardAuthenticationRequired {
+		var amount int64
+		for _, si := range items.Data {
+			if si.Plan != nil {
+				amount += si.Plan.Amount * si.Quantity
+			}
+		}
+
+		pi := g.newIntentRequiringAction(amount, string(currency))
+		sub.Status = stripe.SubscriptionStatusIncomplete
+		sub.LatestInvoice.Paid = false
+		sub.LatestInvoice.Status = stripe.InvoiceStatusOpen
+		sub.LatestInvoice.AmountDue = amount
+		sub.LatestInvoice.AmountRemaining = amount
+		sub.LatestInvoice.PaymentIntent = pi
+		pi.Invoice = sub.LatestInvoice
+	}
+
+	if trial {
+		trialEnd := now.AddDate(0, 0, int(*params.TrialPeriodDays)).Unix()
+		sub.Status = stripe.SubscriptionStatusTrialing
+		sub.TrialStart = now.Unix()
+		sub.TrialEnd = trialEnd
+		sub.CurrentPeriodEnd = trialEnd
+	}
+
+	sub.LatestInvoice.Customer = cust
+	sub.LatestInvoice.Subscription = sub
+	g.invoices[sub.LatestInvoice.ID] = sub.LatestInvoice
+
+	g.subscriptions[id] = sub
+	g.remember(params.IdempotencyKey, sub)
+
+	return sub, nil
+}
+
+func (g *FakeGateway) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sub, ok := g.subscriptions[id]
+	if !ok {
+		return nil, fakeNotFound("subscription", id)
+	}
+
+	return sub, nil
+}
+
+func (g *FakeGateway) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sub, ok := g.subscriptions[id]
+	if !ok {
+		return nil, fakeNotFound("subscription", id)
+	}
+
+	if params.CancelAtPeriodEnd != nil {
+		sub.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+		if sub.CancelAtPeriodEnd {
+			sub.CancelAt = sub.CurrentPeriodEnd
+		} else {
+			sub.CancelAt = 0
+		}
+	}
+
+	for _, item := range params.Items {
+		if item.ID == nil || item.Plan == nil {
+			continue
+		}
+		for _, si := range sub.Items.Data {
+			if si.ID == *item.ID {
+				si.Plan = g.plan(*item.Plan, sub.Currency)
+			}
+		}
+	}
+
+	if params.DefaultPaymentMethod != nil {
+		sub.DefaultPaymentMethod = &stripe.PaymentMethod{ID: *params.DefaultPaymentMethod}
+	}
+
+	for k, v := range params.Metadata {
+		if sub.Metadata == nil {
+			sub.Metadata = make(map[string]string)
+		}
+		sub.Metadata[k] = v
+	}
+
+	return sub, nil
+}
+
+func (g *FakeGateway) CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sub, ok := g.subscriptions[id]
+	if !ok {
+		return nil, fakeNotFound("subscription", id)
+	}
+
+	now := g.now().Unix()
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = now
+	sub.EndedAt = now
+
+	return sub, nil
+}
+
+// returns next invoice of subscription, prorating changed plans by the time left in the period
+func (g *FakeGateway) GetUpcomingInvoice(params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var subID string
+	if params.Subscription != nil {
+		subID = *params.Subscription
+	}
+
+	sub, ok := g.subscriptions[subID]
+	if !ok {
+		return nil, fakeNotFound("subscription", subID)
+	}
+
+	prorationDate := g.now().Unix()
+	if params.SubscriptionProrationDate != nil {
+		prorationDate = *params.SubscriptionProrationDate
+	}
+
+	period := sub.CurrentPeriodEnd - sub.CurrentPeriodStart
+	left := sub.CurrentPeriodEnd - prorationDate
+	if left < 0 || period <= 0 {
+		left = 0
+	}
+
+	prorate := func(amount int64) int64 {
+		if period <= 0 {
+			return 0
+		}
+		return amount * left / period
+	}
+
+	invoice := &stripe.Invoice{
+		Object:       "invoice",
+		Customer:     sub.Customer,
+		Subscription: sub,
+		Currency:     sub.Currency,
+		Lines:        &stripe.InvoiceLineItemList{},
+	}
+
+	for _, si := range sub.Items.Data {
+		plan := si.Plan
+		for _, item := range params.SubscriptionItems {
+			if item.ID != nil && *item.ID == si.ID && item.Plan != nil && *item.Plan != si.Plan.ID {
+				plan = g.plan(*item.Plan, sub.Currency)
+				invoice.Lines.Data = append(invoice.Lines.Data,
+					&stripe.InvoiceLineItem{Amount: -prorate(si.Plan.Amount), Proration: true, Plan: si.Plan},
+					&stripe.InvoiceLineItem{Amount: prorate(plan.Amount), Proration: true, Plan: plan},
+				)
+			}
+		}
+		invoice.Lines.Data = append(invoice.Lines.Data, &stripe.InvoiceLineItem{Amount: plan.Amount, Plan: plan})
+	}
+
+	for _, line := range invoice.Lines.Data {
+		invoice.AmountDue += line.Amount
+	}
+
+	return invoice, nil
+}
+
+// starts next period of subscription with a renewal invoice whose payment failed, as stripe does
+// when the card on file is declined
+func (g *FakeGateway) FailRenewal(subID string) (*stripe.Invoice, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sub, ok := g.subscriptions[subID]
+	if !ok {
+		return nil, fakeNotFound("subscription", subID)
+	}
+
+	inv := &stripe.Invoice{
+		ID:            g.nextID("in"),
+		Object:        "invoice",
+		Customer:      sub.Customer,
+		Subscription:  sub,
+		Currency:      sub.Currency,
+		BillingReason: stripe.InvoiceBillingReasonSubscriptionCycle,
+		Status:        stripe.InvoiceStatusOpen,
+		AttemptCount:  1,
+		Attempted:     true,
+		Created:       g.now().Unix(),
+	}
+
+	for _, si := range sub.Items.Data {
+		if si.Plan != nil {
+			inv.AmountDue += si.Plan.Amount * si.Quantity
+		}
+	}
+	inv.AmountRemaining = inv.AmountDue
+
+	sub.CurrentPeriodStart = sub.CurrentPeriodEnd
+	sub.CurrentPeriodEnd = time.Unix(sub.CurrentPeriodEnd, 0).AddDate(0, 1, 0).Unix()
+	sub.Status = stripe.SubscriptionStatusPastDue
+	sub.LatestInvoice = inv
+
+	g.invoices[inv.ID] = inv
+
+	return inv, nil
+}
+
+// pays open invoice with the given payment method, or the subscription's or customer's default one
+func (g *FakeGateway) PayInvoice(id string, params *stripe.InvoicePayParams) (*stripe.Invoice, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	inv, ok := g.invoices[id]
+	if !ok {
+		return nil, fakeNotFound("invoice", id)
+	}
+
+	if inv.Paid {
+		return nil, fakeInvalidRequest("Invoice is already paid")
+	}
+
+	pm := FakeCardVisa
+	switch {
+	case params != nil && params.PaymentMethod != nil:
+		pm = *params.PaymentMethod
+	case inv.Subscription != nil && inv.Subscription.DefaultPaymentMethod != nil:
+		pm = inv.Subscription.DefaultPaymentMethod.ID
+	case inv.Customer != nil && inv.Customer.InvoiceSettings != nil && inv.Customer.InvoiceSettings.DefaultPaymentMethod != nil:
+		pm = inv.Customer.InvoiceSettings.DefaultPaymentMethod.ID
+	}
+
+	inv.AttemptCount++
+	if err := fakeCardError(pm); err != nil {
+		return nil, err
+	}
+
+	// off-session payments can't be authenticated
+	if pm == FakeCardAuthenticationRequired {
+		return nil, fakeAuthenticationRequired()
+	}
+
+	inv.Paid = true
+	inv.Status = stripe.InvoiceStatusPaid
+	inv.AmountPaid = inv.AmountDue
+	inv.AmountRemaining = 0
+
+	if inv.Subscription != nil && inv.Subscription.Status == stripe.SubscriptionStatusPastDue {
+		inv.Subscription.Status = stripe.SubscriptionStatusActive
+	}
+
+	return inv, nil
+}
+
+func (g *FakeGateway) NewCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if obj, ok := g.replay(params.IdempotencyKey); ok {
+		return obj.(*stripe.Coupon), nil
+	}
+
+	coupon := &stripe.Coupon{
+		ID:       g.nextID("coupon"),
+		Object:   "coupon",
+		Created:  g.now().Unix(),
+		Duration: stripe.CouponDurationOnce,
+		Valid:    true,
+	}
+	if params.ID != nil {
+		coupon.ID = *params.ID
+	}
+	if params.Name != nil {
+		coupon.Name = *params.Name
+	}
+	if params.PercentOff != nil {
+		coupon.PercentOff = *params.PercentOff
+	}
+	if params.AmountOff != nil {
+		coupon.AmountOff = *params.AmountOff
+	}
+	if params.Currency != nil {
+		coupon.Currency = stripe.Currency(*params.Currency)
+	}
+	if params.Duration != nil {
+		coupon.Duration = stripe.CouponDuration(*params.Duration)
+	}
+	if params.DurationInMonths != nil {
+		coupon.DurationInMonths = *params.DurationInMonths
+	}
+
+	g.coupons[coupon.ID] = coupon
+	g.remember(params.IdempotencyKey, coupon)
+
+	return coupon, nil
+}
+
+func (g *FakeGateway) DeleteCoupon(id string, params *stripe.CouponParams) (*stripe.Coupon, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	coupon, ok := g.coupons[id]
+	if !ok {
+		return nil, fakeNotFound("coupon", id)
+	}
+
+	delete(g.coupons, id)
+	coupon.Deleted = true
+
+	return coupon, nil
+}
+
+func (g *FakeGateway) NewTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if obj, ok := g.replay(params.IdempotencyKey); ok {
+		return obj.(*stripe.TaxRate), nil
+	}
+
+	rate := &stripe.TaxRate{
+		ID:      g.nextID("txr"),
+		Object:  "tax_rate",
+		Created: g.now().Unix(),
+		Active:  true,
+	}
+	if params.DisplayName != nil {
+		rate.DisplayName = *params.DisplayName
+	}
+	if params.Country != nil {
+		rate.Country = *params.Country
+	}
+	if params.State != nil {
+		rate.State = *params.State
+	}
+	if params.Jurisdiction != nil {
+		rate.Jurisdiction = *params.Jurisdiction
+	}
+	if params.Percentage != nil {
+		rate.Percentage = *params.Percentage
+	}
+	if params.Inclusive != nil {
+		rate.Inclusive = *params.Inclusive
+	}
+
+	g.taxRates[rate.ID] = rate
+	g.remember(params.IdempotencyKey, rate)
+
+	return rate, nil
+}
+
+func (g *FakeGateway) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if obj, ok := g.replay(params.IdempotencyKey); ok {
+		return obj.(*stripe.Refund), nil
+	}
+
+	var piID string
+	if params.PaymentIntent != nil {
+		piID = *params.PaymentIntent
+	}
+
+	pi, ok := g.intents[piID]
+	if !ok {
+		return nil, fakeNotFound("payment_intent", piID)
+	}
+
+	charge := pi.Charges.Data[0]
+	remaining := charge.Amount - charge.AmountRefunded
+
+	amount := remaining
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+
+	if amount <= 0 || amount > remaining {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeAmountTooLarge,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, remaining),
+		}
+	}
+
+	charge.AmountRefunded += amount
+	charge.Refunded = charge.AmountRefunded == charge.Amount
+
+	ref := &stripe.Refund{
+		ID:            g.nextID("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Currency:      pi.Currency,
+		Charge:        charge,
+		PaymentIntent: pi,
+		Created:       g.now().Unix(),
+		Metadata:      params.Metadata,
+		Status:        stripe.RefundStatusSucceeded,
+	}
+
+	if params.Reason != nil {
+		ref.Reason = stripe.RefundReason(*params.Reason)
+	}
+
+	g.refunds[ref.ID] = ref
+	g.remember(params.IdempotencyKey, ref)
+
+	return ref, nil
+}
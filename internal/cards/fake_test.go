@@ -0,0 +1,406 @@
+package cards
+
+import (
+	"go-stripe/internal/money"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v73"
+)
+
+// returns amount in euro cents
+func eur(amount int64) money.Money {
+	m, _ := money.New(amount, "eur")
+	return m
+}
+
+func Test_FakeGatewayCharge(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway()}
+
+	pi, msg, err := card.Charge(eur(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg)
+	assert.Equal(t, "pi_fake_1", pi.ID)
+	assert.Equal(t, stripe.PaymentIntentStatusSucceeded, pi.Status)
+
+	retrieved, err := card.RetrievePaymentIntent(pi.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), retrieved.Amount)
+	assert.Equal(t, "ch_fake_1", retrieved.Charges.Data[0].ID)
+
+	_, err = card.RetrievePaymentIntent("pi_missing")
+	assert.NotNil(t, err)
+}
+
+func Test_FakeGatewayDeclined(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway()}
+
+	_, msg, err := card.CreateCustomer(FakeCardDeclined, "jane@example.com")
+	assert.NotNil(t, err)
+	assert.Equal(t, "Your card has been declined", msg)
+}
+
+func Test_FakeGatewayRefund(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway()}
+
+	pi, _, err := card.Charge(eur(1000))
+	assert.Nil(t, err)
+
+	first, err := card.Refund(pi.ID, eur(400))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(400), first.Amount)
+
+	_, err = card.Refund(pi.ID, eur(600))
+	assert.Nil(t, err)
+
+	_, err = card.Refund(pi.ID, eur(1))
+	assert.NotNil(t, err)
+}
+
+func Test_FakeGatewaySubscription(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway()}
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusActive, sub.Status)
+	assert.Equal(t, "price_bronze", sub.Items.Data[0].Plan.ID)
+
+	assert.Nil(t, card.CancelSubscription(sub.ID))
+	assert.True(t, sub.CancelAtPeriodEnd)
+	assert.NotNil(t, card.CancelSubscription("sub_missing"))
+}
+
+func Test_NewGateway(t *testing.T) {
+	g, err := NewGateway("", "sk_test", nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &StripeGateway{}, g)
+
+	g, err = NewGateway(GatewayFake, "", nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &FakeGateway{}, g)
+
+	g, err = NewGateway(GatewayFake, "", &memoryFakeStore{})
+	assert.Nil(t, err)
+	assert.IsType(t, &SharedFakeGateway{}, g)
+
+	_, err = NewGateway("paypal", "", nil)
+	assert.NotNil(t, err)
+}
+
+func Test_FakeGatewayIdempotency(t *testing.T) {
+	gateway := NewFakeGateway()
+	card := Card{Gateway: gateway, IdempotencyKey: "retry"}
+
+	first, _, err := card.Charge(eur(1000))
+	assert.Nil(t, err)
+
+	second, _, err := card.Charge(eur(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID, second.ID)
+
+	refund, err := card.Refund(first.ID, eur(400))
+	assert.Nil(t, err)
+
+	retried, err := card.Refund(first.ID, eur(400))
+	assert.Nil(t, err)
+	assert.Equal(t, refund.ID, retried.ID)
+
+	other := Card{Gateway: gateway}
+	third, _, err := other.Charge(eur(1000))
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.ID, third.ID)
+}
+
+func Test_FakeGatewayUpdateSubscriptionCard(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway()}
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+
+	pm, msg, err := card.UpdateSubscriptionPaymentMethod(sub.ID, FakeCardMastercard)
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg)
+	assert.Equal(t, "4444", pm.Card.Last4)
+
+	updated, err := card.GetSubscription(sub.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, FakeCardMastercard, updated.DefaultPaymentMethod.ID)
+
+	_, msg, err = card.UpdateSubscriptionPaymentMethod(sub.ID, FakeCardDeclined)
+	assert.NotNil(t, err)
+	assert.Equal(t, "Your card has been declined", msg)
+}
+
+func Test_FakeGatewayChangePlan(t *testing.T) {
+	gateway := NewFakeGateway()
+	gateway.SetPrice("price_bronze", 2000)
+	gateway.SetPrice("price_silver", 3000)
+	card := Card{Gateway: gateway}
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+
+	// half way through the period
+	halfway := sub.CurrentPeriodStart + (sub.CurrentPeriodEnd-sub.CurrentPeriodStart)/2
+
+	preview, err := card.PreviewPlanChange(sub.ID, "price_silver", halfway)
+	assert.Nil(t, err)
+	assert.Equal(t, eur(500), preview.ProrationAmount)
+	assert.Equal(t, eur(3500), preview.NextInvoiceAmount)
+
+	updated, err := card.ChangePlan(sub.ID, "price_silver", halfway, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "price_silver", updated.Items.Data[0].Plan.ID)
+
+	_, err = card.PreviewPlanChange("sub_missing", "price_silver", halfway)
+	assert.NotNil(t, err)
+}
+
+func Test_FakeGatewayPlanCurrency(t *testing.T) {
+	gateway := NewFakeGateway()
+	gateway.SetPrice("price_bronze", 2000)
+	gateway.SetCurrencyPrice("price_bronze", "JPY", 3000)
+	card := Card{Gateway: gateway, Currency: "jpy"}
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.CurrencyJPY, sub.Currency)
+	assert.Equal(t, int64(3000), sub.Items.Data[0].Plan.Amount)
+
+	inv, err := gateway.FailRenewal(sub.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.CurrencyJPY, inv.Currency)
+	assert.Equal(t, int64(3000), inv.AmountDue)
+
+	card.Currency = "usd"
+	sub, err = card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2000), sub.Items.Data[0].Plan.Amount)
+}
+
+func Test_FakeGatewayCouponAndTrial(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway(), Currency: "eur"}
+
+	coupon, err := card.CreateCoupon("SPRING10", 10, money.Money{}, "once", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(10), coupon.PercentOff)
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+
+	card.Coupon = coupon.ID
+	card.TrialDays = 14
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusTrialing, sub.Status)
+	assert.Equal(t, coupon.ID, sub.Discount.Coupon.ID)
+	assert.Equal(t, sub.TrialEnd, sub.CurrentPeriodEnd)
+
+	assert.Nil(t, card.DeleteCoupon(coupon.ID))
+
+	_, err = card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.NotNil(t, err)
+}
+
+func Test_FakeGatewayAddresses(t *testing.T) {
+	address := &Address{Name: "Jane Doe", Line1: "1 Market St", City: "San Francisco", State: "CA", PostalCode: "94105", Country: "US"}
+	card := Card{Gateway: NewFakeGateway(), BillingAddress: address, Shipping: address}
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "Jane Doe", cust.Name)
+	assert.Equal(t, "94105", cust.Address.PostalCode)
+
+	pi, _, err := card.Charge(eur(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, "Jane Doe", pi.Shipping.Name)
+	assert.Equal(t, "CA", pi.Shipping.Address.State)
+}
+
+func Test_FakeGatewayTaxRates(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway(), Currency: "eur"}
+
+	rate, err := card.CreateTaxRate("VAT", "PT", "30", 2200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 22.0, rate.Percentage)
+	assert.Equal(t, "PT-30", rate.Jurisdiction)
+	assert.True(t, rate.Inclusive)
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+
+	card.TaxRates = []string{rate.ID}
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+	assert.Equal(t, rate.ID, sub.DefaultTaxRates[0].ID)
+
+	card.TaxRates = []string{"txr_missing"}
+	_, err = card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.NotNil(t, err)
+}
+
+func Test_FakeGatewayRetryInvoice(t *testing.T) {
+	gateway := NewFakeGateway()
+	gateway.SetPrice("price_bronze", 2000)
+	card := Card{Gateway: gateway}
+
+	cust, _, err := card.CreateCustomer(FakeCardVisa, "jane@example.com")
+	assert.Nil(t, err)
+
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa")
+	assert.Nil(t, err)
+
+	inv, err := gateway.FailRenewal(sub.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2000), inv.AmountDue)
+	assert.Equal(t, stripe.SubscriptionStatusPastDue, sub.Status)
+
+	_, err = gateway.PayInvoice(inv.ID, &stripe.InvoicePayParams{PaymentMethod: stripe.String(FakeCardDeclined)})
+	assert.NotNil(t, err)
+
+	paid, msg, err := card.RetryInvoice(inv.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg)
+	assert.True(t, paid.Paid)
+	assert.Equal(t, stripe.SubscriptionStatusActive, sub.Status)
+
+	_, _, err = card.RetryInvoice(inv.ID)
+	assert.NotNil(t, err)
+
+	canceled, err := card.CancelSubscriptionNow(sub.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusCanceled, canceled.Status)
+}
+
+func Test_FakeGatewayAuthenticationRequired(t *testing.T) {
+	gateway := NewFakeGateway()
+	gateway.SetPrice("price_bronze", 2000)
+	card := Card{Gateway: gateway}
+
+	pi, err := gateway.NewPaymentIntent(&stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(1000),
+		Currency:      stripe.String("eur"),
+		PaymentMethod: stripe.String(FakeCardAuthenticationRequired),
+	})
+	assert.Nil(t, err)
+	assert.True(t, RequiresAction(pi))
+	assert.ErrorIs(t, CheckSucceeded(pi), ErrPaymentIncomplete)
+	assert.Equal(t, "", ChargeID(pi))
+
+	pi, err = gateway.ConfirmPaymentIntent(pi.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, CheckSucceeded(pi))
+	assert.NotEqual(t, "", ChargeID(pi))
+
+	cust, _, err := card.CreateCustomer(FakeCardAuthenticationRequired, "jane@example.com")
+	assert.Nil(t, err)
+
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "3184", "visa")
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusIncomplete, sub.Status)
+
+	payment := FirstPayment(sub)
+	assert.Equal(t, PaymentRequiresAction, payment.Status)
+	assert.Equal(t, sub.LatestInvoice.PaymentIntent.ClientSecret, payment.ClientSecret)
+
+	_, err = gateway.ConfirmPaymentIntent(sub.LatestInvoice.PaymentIntent.ID)
+	assert.Nil(t, err)
+
+	confirmed, err := card.GetSubscription(sub.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, PaymentSucceeded, FirstPayment(confirmed).Status)
+	assert.True(t, confirmed.LatestInvoice.Paid)
+}
+
+func Test_FakeGatewaySavedCards(t *testing.T) {
+	gateway := NewFakeGateway()
+	card := Card{Gateway: gateway}
+
+	cust, _, err := card.CreateCustomer("", "jane@example.com")
+	assert.Nil(t, err)
+
+	pms, err := card.ListPaymentMethods(cust.ID)
+	assert.Nil(t, err)
+	assert.Len(t, pms, 0)
+
+	si, err := card.CreateSetupIntent(cust.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SetupIntentStatusRequiresPaymentMethod, si.Status)
+
+	_, err = gateway.ConfirmSetupIntent(si.ID, FakeCardDeclined)
+	assert.NotNil(t, err)
+
+	_, err = gateway.ConfirmSetupIntent(si.ID, FakeCardMastercard)
+	assert.Nil(t, err)
+
+	si, err = card.GetSetupIntent(si.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SetupIntentStatusSucceeded, si.Status)
+	assert.Equal(t, FakeCardMastercard, si.PaymentMethod.ID)
+
+	_, _, err = card.AttachPaymentMethod(cust.ID, FakeCardVisa)
+	assert.Nil(t, err)
+
+	pms, err = card.ListPaymentMethods(cust.ID)
+	assert.Nil(t, err)
+	assert.Len(t, pms, 2)
+	assert.Equal(t, "4444", pms[0].Card.Last4)
+
+	assert.Nil(t, card.SetDefaultPaymentMethod(cust.ID, FakeCardVisa))
+	saved, err := card.SavedCards(cust.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []SavedCard{
+		{ID: FakeCardMastercard, Brand: "mastercard", LastFour: "4444", ExpMonth: 12, ExpYear: saved[0].ExpYear},
+		{ID: FakeCardVisa, Brand: "visa", LastFour: "4242", ExpMonth: 12, ExpYear: saved[1].ExpYear, Default: true},
+	}, saved)
+
+	// cards of other customers can't be used
+	other, _, err := card.CreateCustomer("", "john@example.com")
+	assert.Nil(t, err)
+	assert.ErrorIs(t, card.SetDefaultPaymentMethod(other.ID, FakeCardVisa), ErrPaymentMethodNotSaved)
+	_, _, err = card.ChargeSavedCard(other.ID, FakeCardVisa, eur(1000), false)
+	assert.ErrorIs(t, err, ErrPaymentMethodNotSaved)
+
+	pi, _, err := card.ChargeSavedCard(cust.ID, FakeCardVisa, eur(1000), false)
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.PaymentIntentStatusSucceeded, pi.Status)
+	assert.Equal(t, cust.ID, pi.Customer.ID)
+
+	assert.Nil(t, card.DetachPaymentMethod(cust.ID, FakeCardVisa))
+	cust, err = card.GetCustomer(cust.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, cust.InvoiceSettings.DefaultPaymentMethod)
+
+	pms, err = card.ListPaymentMethods(cust.ID)
+	assert.Nil(t, err)
+	assert.Len(t, pms, 1)
+}
+
+func Test_FakeGatewaySavedCardAuthentication(t *testing.T) {
+	card := Card{Gateway: NewFakeGateway()}
+
+	cust, _, err := card.CreateCustomer(FakeCardAuthenticationRequired, "jane@example.com")
+	assert.Nil(t, err)
+
+	// the customer at checkout confirms the payment in the browser
+	pi, _, err := card.ChargeSavedCard(cust.ID, FakeCardAuthenticationRequired, eur(1000), false)
+	assert.Nil(t, err)
+	assert.True(t, RequiresAction(pi))
+
+	// nobody is there to confirm a virtual terminal charge
+	_, msg, err := card.ChargeSavedCard(cust.ID, FakeCardAuthenticationRequired, eur(1000), true)
+	assert.NotNil(t, err)
+	assert.Equal(t, "Your bank requires you to confirm the payment", msg)
+}
@@ -0,0 +1,71 @@
+package cards
+
+import (
+	"fmt"
+
+	"github.com/stripe/stripe-go/v73"
+)
+
+const (
+	GatewayStripe = "stripe"
+	GatewayFake   = "fake"
+)
+
+// interface for payment providers used by Card
+type PaymentGateway interface {
+	// payment intents
+	NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error)
+
+	// setup intents
+	NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error)
+	GetSetupIntent(id string, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error)
+
+	// payment methods
+	GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error)
+	AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error)
+	DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error)
+	ListPaymentMethods(params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error)
+
+	// customers
+	NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+
+	// subscriptions
+	NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error)
+
+	// invoices
+	GetUpcomingInvoice(params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error)
+	PayInvoice(id string, params *stripe.InvoicePayParams) (*stripe.Invoice, error)
+
+	// coupons
+	NewCoupon(params *stripe.CouponParams) (*stripe.Coupon, error)
+	DeleteCoupon(id string, params *stripe.CouponParams) (*stripe.Coupon, error)
+
+	// tax rates
+	NewTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error)
+
+	// refunds
+	NewRefund(params *stripe.RefundParams) (*stripe.Refund, error)
+}
+
+// returns payment gateway by name, empty name defaults to stripe. The fake keeps its objects in
+// store when there is one, so processes using the same store share them
+func NewGateway(name, secret string, store FakeStore) (PaymentGateway, error) {
+	switch name {
+	case "", GatewayStripe:
+		return NewStripeGateway(secret), nil
+	case GatewayFake:
+		if store != nil {
+			return NewSharedFakeGateway(store), nil
+		}
+		return NewFakeGateway(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway: %s", name)
+	}
+}
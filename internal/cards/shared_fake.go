@@ -0,0 +1,430 @@
+package cards
+
+import (
+	"encoding/json"
+
+	"github.com/stripe/stripe-go/v73"
+)
+
+// interface for where a shared fake gateway keeps its objects
+type FakeStore interface {
+	// runs update with the saved state, empty when there is none yet, and saves the state it
+	// returns. Updates of every process sharing the store run one at a time
+	UpdateFakeGatewayState(update func(state []byte) ([]byte, error)) error
+}
+
+// fake gateway whose objects are kept in a store, so the api and the website see the same
+// payment intents, customers and subscriptions
+type SharedFakeGateway struct {
+	store FakeStore
+}
+
+// returns fake gateway sharing its objects through store
+func NewSharedFakeGateway(store FakeStore) *SharedFakeGateway {
+	return &SharedFakeGateway{store: store}
+}
+
+// runs fn on the fake gateway as saved in the store and saves it again, also when fn fails since
+// declined payments change things too
+func shared[T any](s *SharedFakeGateway, fn func(g *FakeGateway) (T, error)) (T, error) {
+	var obj T
+	var result error
+
+	err := s.store.UpdateFakeGatewayState(func(state []byte) ([]byte, error) {
+		g := NewFakeGateway()
+		if err := g.load(state); err != nil {
+			return nil, err
+		}
+
+		obj, result = fn(g)
+
+		return g.dump()
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return obj, result
+}
+
+func (s *SharedFakeGateway) SetPrice(plan string, amount int64) error {
+	_, err := shared(s, func(g *FakeGateway) (any, error) {
+		g.SetPrice(plan, amount)
+		return nil, nil
+	})
+	return err
+}
+
+func (s *SharedFakeGateway) SetCurrencyPrice(plan, currency string, amount int64) error {
+	_, err := shared(s, func(g *FakeGateway) (any, error) {
+		g.SetCurrencyPrice(plan, currency, amount)
+		return nil, nil
+	})
+	return err
+}
+
+func (s *SharedFakeGateway) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.PaymentIntent, error) { return g.NewPaymentIntent(params) })
+}
+
+func (s *SharedFakeGateway) ConfirmPaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.PaymentIntent, error) { return g.ConfirmPaymentIntent(id) })
+}
+
+func (s *SharedFakeGateway) GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.PaymentIntent, error) { return g.GetPaymentIntent(id, params) })
+}
+
+func (s *SharedFakeGateway) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.PaymentIntent, error) { return g.CancelPaymentIntent(id, params) })
+}
+
+func (s *SharedFakeGateway) NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.SetupIntent, error) { return g.NewSetupIntent(params) })
+}
+
+func (s *SharedFakeGateway) ConfirmSetupIntent(id, pm string) (*stripe.SetupIntent, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.SetupIntent, error) { return g.ConfirmSetupIntent(id, pm) })
+}
+
+func (s *SharedFakeGateway) GetSetupIntent(id string, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.SetupIntent, error) { return g.GetSetupIntent(id, params) })
+}
+
+func (s *SharedFakeGateway) GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.PaymentMethod, error) { return g.GetPaymentMethod(id, params) })
+}
+
+func (s *SharedFakeGateway) AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.PaymentMethod, error) { return g.AttachPaymentMethod(id, params) })
+}
+
+func (s *SharedFakeGateway) DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.PaymentMethod, error) { return g.DetachPaymentMethod(id, params) })
+}
+
+func (s *SharedFakeGateway) ListPaymentMethods(params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error) {
+	return shared(s, func(g *FakeGateway) ([]*stripe.PaymentMethod, error) { return g.ListPaymentMethods(params) })
+}
+
+func (s *SharedFakeGateway) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Customer, error) { return g.NewCustomer(params) })
+}
+
+func (s *SharedFakeGateway) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Customer, error) { return g.GetCustomer(id, params) })
+}
+
+func (s *SharedFakeGateway) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Customer, error) { return g.UpdateCustomer(id, params) })
+}
+
+func (s *SharedFakeGateway) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Subscription, error) { return g.NewSubscription(params) })
+}
+
+func (s *SharedFakeGateway) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Subscription, error) { return g.GetSubscription(id, params) })
+}
+
+func (s *SharedFakeGateway) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Subscription, error) { return g.UpdateSubscription(id, params) })
+}
+
+func (s *SharedFakeGateway) CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Subscription, error) { return g.CancelSubscription(id, params) })
+}
+
+func (s *SharedFakeGateway) GetUpcomingInvoice(params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Invoice, error) { return g.GetUpcomingInvoice(params) })
+}
+
+func (s *SharedFakeGateway) FailRenewal(subID string) (*stripe.Invoice, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Invoice, error) { return g.FailRenewal(subID) })
+}
+
+func (s *SharedFakeGateway) PayInvoice(id string, params *stripe.InvoicePayParams) (*stripe.Invoice, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Invoice, error) { return g.PayInvoice(id, params) })
+}
+
+func (s *SharedFakeGateway) NewCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Coupon, error) { return g.NewCoupon(params) })
+}
+
+func (s *SharedFakeGateway) DeleteCoupon(id string, params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Coupon, error) { return g.DeleteCoupon(id, params) })
+}
+
+func (s *SharedFakeGateway) NewTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.TaxRate, error) { return g.NewTaxRate(params) })
+}
+
+func (s *SharedFakeGateway) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	return shared(s, func(g *FakeGateway) (*stripe.Refund, error) { return g.NewRefund(params) })
+}
+
+// objects of a fake gateway as they are saved. Objects point at each other, e.g. a subscription
+// at its latest invoice and the invoice back at it, so references are saved as ids and linked
+// again when the state is loaded
+type fakeState struct {
+	Counters       map[string]int                   `json:"counters"`
+	Intents        map[string]*stripe.PaymentIntent `json:"intents"`
+	Customers      map[string]*stripe.Customer      `json:"customers"`
+	Subscriptions  map[string]*stripe.Subscription  `json:"subscriptions"`
+	Refunds        map[string]*stripe.Refund        `json:"refunds"`
+	Coupons        map[string]*stripe.Coupon        `json:"coupons"`
+	TaxRates       map[string]*stripe.TaxRate       `json:"tax_rates"`
+	Invoices       map[string]*stripe.Invoice       `json:"invoices"`
+	SetupIntents   map[string]*stripe.SetupIntent   `json:"setup_intents"`
+	PaymentMethods map[string][]string              `json:"payment_methods"`
+	Idempotent     map[string]fakeRef               `json:"idempotent"`
+	Prices         map[string]int64                 `json:"prices"`
+}
+
+// type for an object saved under an idempotency key
+type fakeRef struct {
+	Object string `json:"object"`
+	ID     string `json:"id"`
+}
+
+// returns state of the gateway to save
+func (g *FakeGateway) dump() ([]byte, error) {
+	s := fakeState{
+		Counters:       g.counters,
+		Intents:        make(map[string]*stripe.PaymentIntent),
+		Customers:      g.customers,
+		Subscriptions:  make(map[string]*stripe.Subscription),
+		Refunds:        make(map[string]*stripe.Refund),
+		Coupons:        g.coupons,
+		TaxRates:       g.taxRates,
+		Invoices:       make(map[string]*stripe.Invoice),
+		SetupIntents:   make(map[string]*stripe.SetupIntent),
+		PaymentMethods: g.paymentMethods,
+		Idempotent:     make(map[string]fakeRef),
+		Prices:         g.prices,
+	}
+
+	for id, pi := range g.intents {
+		c := *pi
+		if pi.Invoice != nil {
+			c.Invoice = &stripe.Invoice{ID: pi.Invoice.ID}
+		}
+		s.Intents[id] = &c
+	}
+
+	for id, si := range g.setupIntents {
+		c := *si
+		if si.Customer != nil {
+			c.Customer = &stripe.Customer{ID: si.Customer.ID}
+		}
+		s.SetupIntents[id] = &c
+	}
+
+	for id, sub := range g.subscriptions {
+		c := *sub
+		if sub.Customer != nil {
+			c.Customer = &stripe.Customer{ID: sub.Customer.ID}
+		}
+		if sub.LatestInvoice != nil {
+			c.LatestInvoice = &stripe.Invoice{ID: sub.LatestInvoice.ID}
+		}
+		if sub.Discount != nil && sub.Discount.Customer != nil {
+			d := *sub.Discount
+			d.Customer = &stripe.Customer{ID: sub.Discount.Customer.ID}
+			c.Discount = &d
+		}
+		s.Subscriptions[id] = &c
+	}
+
+	for id, inv := range g.invoices {
+		c := *inv
+		if inv.Customer != nil {
+			c.Customer = &stripe.Customer{ID: inv.Customer.ID}
+		}
+		if inv.Subscription != nil {
+			c.Subscription = &stripe.Subscription{ID: inv.Subscription.ID}
+		}
+		if inv.PaymentIntent != nil {
+			c.PaymentIntent = &stripe.PaymentIntent{ID: inv.PaymentIntent.ID}
+		}
+		s.Invoices[id] = &c
+	}
+
+	for id, ref := range g.refunds {
+		c := *ref
+		if ref.Charge != nil {
+			c.Charge = &stripe.Charge{ID: ref.Charge.ID}
+		}
+		if ref.PaymentIntent != nil {
+			c.PaymentIntent = &stripe.PaymentIntent{ID: ref.PaymentIntent.ID}
+		}
+		s.Refunds[id] = &c
+	}
+
+	for key, obj := range g.idempotent {
+		switch o := obj.(type) {
+		case *stripe.PaymentIntent:
+			s.Idempotent[key] = fakeRef{Object: "payment_intent", ID: o.ID}
+		case *stripe.SetupIntent:
+			s.Idempotent[key] = fakeRef{Object: "setup_intent", ID: o.ID}
+		case *stripe.Customer:
+			s.Idempotent[key] = fakeRef{Object: "customer", ID: o.ID}
+		case *stripe.Subscription:
+			s.Idempotent[key] = fakeRef{Object: "subscription", ID: o.ID}
+		case *stripe.Coupon:
+			s.Idempotent[key] = fakeRef{Object: "coupon", ID: o.ID}
+		case *stripe.TaxRate:
+			s.Idempotent[key] = fakeRef{Object: "tax_rate", ID: o.ID}
+		case *stripe.Refund:
+			s.Idempotent[key] = fakeRef{Object: "refund", ID: o.ID}
+		}
+	}
+
+	return json.Marshal(s)
+}
+
+// replaces objects of the gateway with saved state, empty state leaves it empty
+func (g *FakeGateway) load(state []byte) error {
+	if len(state) == 0 {
+		return nil
+	}
+
+	var s fakeState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+
+	for k, v := range s.Counters {
+		g.counters[k] = v
+	}
+	for k, v := range s.Intents {
+		g.intents[k] = v
+	}
+	for k, v := range s.Customers {
+		g.customers[k] = v
+	}
+	for k, v := range s.Subscriptions {
+		g.subscriptions[k] = v
+	}
+	for k, v := range s.Refunds {
+		g.refunds[k] = v
+	}
+	for k, v := range s.Coupons {
+		g.coupons[k] = v
+	}
+	for k, v := range s.TaxRates {
+		g.taxRates[k] = v
+	}
+	for k, v := range s.Invoices {
+		g.invoices[k] = v
+	}
+	for k, v := range s.SetupIntents {
+		g.setupIntents[k] = v
+	}
+	for k, v := range s.PaymentMethods {
+		g.paymentMethods[k] = v
+	}
+	for k, v := range s.Prices {
+		g.prices[k] = v
+	}
+
+	for _, pi := range g.intents {
+		if pi.Invoice != nil {
+			if inv, ok := g.invoices[pi.Invoice.ID]; ok {
+				pi.Invoice = inv
+			}
+		}
+	}
+
+	for _, si := range g.setupIntents {
+		if si.Customer != nil {
+			if cust, ok := g.customers[si.Customer.ID]; ok {
+				si.Customer = cust
+			}
+		}
+	}
+
+	for _, sub := range g.subscriptions {
+		if sub.Customer != nil {
+			if cust, ok := g.customers[sub.Customer.ID]; ok {
+				sub.Customer = cust
+			}
+		}
+		if sub.LatestInvoice != nil {
+			if inv, ok := g.invoices[sub.LatestInvoice.ID]; ok {
+				sub.LatestInvoice = inv
+			}
+		}
+		if sub.Discount != nil && sub.Discount.Customer != nil {
+			if cust, ok := g.customers[sub.Discount.Customer.ID]; ok {
+				sub.Discount.Customer = cust
+			}
+		}
+	}
+
+	for _, inv := range g.invoices {
+		if inv.Customer != nil {
+			if cust, ok := g.customers[inv.Customer.ID]; ok {
+				inv.Customer = cust
+			}
+		}
+		if inv.Subscription != nil {
+			if sub, ok := g.subscriptions[inv.Subscription.ID]; ok {
+				inv.Subscription = sub
+			}
+		}
+		if inv.PaymentIntent != nil {
+			if pi, ok := g.intents[inv.PaymentIntent.ID]; ok {
+				inv.PaymentIntent = pi
+			}
+		}
+	}
+
+	for _, ref := range g.refunds {
+		if ref.PaymentIntent == nil {
+			continue
+		}
+		pi, ok := g.intents[ref.PaymentIntent.ID]
+		if !ok {
+			continue
+		}
+		ref.PaymentIntent = pi
+		if ref.Charge != nil && pi.Charges != nil {
+			for _, ch := range pi.Charges.Data {
+				if ch.ID == ref.Charge.ID {
+					ref.Charge = ch
+				}
+			}
+		}
+	}
+
+	for key, r := range s.Idempotent {
+		var obj interface{}
+		var ok bool
+
+		switch r.Object {
+		case "payment_intent":
+			obj, ok = g.intents[r.ID]
+		case "setup_intent":
+			obj, ok = g.setupIntents[r.ID]
+		case "customer":
+			obj, ok = g.customers[r.ID]
+		case "subscription":
+			obj, ok = g.subscriptions[r.ID]
+		case "coupon":
+			obj, ok = g.coupons[r.ID]
+		case "tax_rate":
+			obj, ok = g.taxRates[r.ID]
+		case "refund":
+			obj, ok = g.refunds[r.ID]
+		}
+
+		// deleted coupons are forgotten, as they are without a store
+		if ok {
+			g.idempotent[key] = obj
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package cards
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v73"
+)
+
+// store keeping the state in memory, as the database does for processes sharing it
+type memoryFakeStore struct {
+	state []byte
+}
+
+func (s *memoryFakeStore) UpdateFakeGatewayState(update func(state []byte) ([]byte, error)) error {
+	state, err := update(s.state)
+	if err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
+
+func Test_SharedFakeGatewayCharge(t *testing.T) {
+	store := &memoryFakeStore{}
+	api := Card{Gateway: NewSharedFakeGateway(store)}
+	web := Card{Gateway: NewSharedFakeGateway(store)}
+
+	pi, _, err := api.Charge(eur(1000))
+	assert.Nil(t, err)
+
+	// the payment intent made by the api is there for the website
+	retrieved, err := web.RetrievePaymentIntent(pi.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), retrieved.Amount)
+	assert.Equal(t, stripe.PaymentIntentStatusSucceeded, retrieved.Status)
+
+	_, err = web.Refund(pi.ID, eur(600))
+	assert.Nil(t, err)
+	_, err = api.Refund(pi.ID, eur(600))
+	assert.NotNil(t, err)
+
+	next, _, err := web.Charge(eur(1000))
+	assert.Nil(t, err)
+	assert.NotEqual(t, pi.ID, next.ID)
+}
+
+func Test_SharedFakeGatewayIdempotency(t *testing.T) {
+	store := &memoryFakeStore{}
+
+	api := Card{Gateway: NewSharedFakeGateway(store), IdempotencyKey: "retry"}
+	web := Card{Gateway: NewSharedFakeGateway(store), IdempotencyKey: "retry"}
+
+	first, _, err := api.Charge(eur(1000))
+	assert.Nil(t, err)
+
+	second, _, err := web.Charge(eur(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID, second.ID)
+}
+
+func Test_SharedFakeGatewaySubscription(t *testing.T) {
+	store := &memoryFakeStore{}
+	gateway := NewSharedFakeGateway(store)
+	assert.Nil(t, gateway.SetPrice("price_bronze", 2000))
+	card := Card{Gateway: gateway}
+
+	cust, _, err := card.CreateCustomer(FakeCardAuthenticationRequired, "jane@example.com")
+	assert.Nil(t, err)
+
+	sub, err := card.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "3184", "visa")
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusIncomplete, sub.Status)
+	assert.Equal(t, int64(2000), sub.LatestInvoice.AmountDue)
+
+	// confirming the payment pays the invoice and activates the subscription saved with it
+	_, err = NewSharedFakeGateway(store).ConfirmPaymentIntent(sub.LatestInvoice.PaymentIntent.ID)
+	assert.Nil(t, err)
+
+	confirmed, err := card.GetSubscription(sub.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusActive, confirmed.Status)
+	assert.True(t, confirmed.LatestInvoice.Paid)
+	assert.Equal(t, cust.ID, confirmed.LatestInvoice.Customer.ID)
+}
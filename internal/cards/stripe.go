@@ -0,0 +1,114 @@
+package cards
+
+import (
+	"github.com/stripe/stripe-go/v73"
+	"github.com/stripe/stripe-go/v73/client"
+)
+
+// payment gateway backed by stripe api
+type StripeGateway struct {
+	api *client.API
+}
+
+// returns stripe gateway with its own client, global stripe.Key is not used
+func NewStripeGateway(secret string) *StripeGateway {
+	return &StripeGateway{
+		api: client.New(secret, nil),
+	}
+}
+
+func (g *StripeGateway) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return g.api.PaymentIntents.New(params)
+}
+
+func (g *StripeGateway) GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return g.api.PaymentIntents.Get(id, params)
+}
+
+func (g *StripeGateway) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	return g.api.PaymentIntents.Cancel(id, params)
+}
+
+func (g *StripeGateway) NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	return g.api.SetupIntents.New(params)
+}
+
+func (g *StripeGateway) GetSetupIntent(id string, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	return g.api.SetupIntents.Get(id, params)
+}
+
+func (g *StripeGateway) GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return g.api.PaymentMethods.Get(id, params)
+}
+
+func (g *StripeGateway) AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	return g.api.PaymentMethods.Attach(id, params)
+}
+
+func (g *StripeGateway) DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	return g.api.PaymentMethods.Detach(id, params)
+}
+
+// returns all payment methods matching params, following stripe's pagination
+func (g *StripeGateway) ListPaymentMethods(params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error) {
+	var pms []*stripe.PaymentMethod
+
+	it := g.api.PaymentMethods.List(params)
+	for it.Next() {
+		pms = append(pms, it.PaymentMethod())
+	}
+
+	return pms, it.Err()
+}
+
+func (g *StripeGateway) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return g.api.Customers.New(params)
+}
+
+func (g *StripeGateway) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return g.api.Customers.Get(id, params)
+}
+
+func (g *StripeGateway) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return g.api.Customers.Update(id, params)
+}
+
+func (g *StripeGateway) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.New(params)
+}
+
+func (g *StripeGateway) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.Get(id, params)
+}
+
+func (g *StripeGateway) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.Update(id, params)
+}
+
+func (g *StripeGateway) CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	return g.api.Subscriptions.Cancel(id, params)
+}
+
+func (g *StripeGateway) GetUpcomingInvoice(params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error) {
+	return g.api.Invoices.Upcoming(params)
+}
+
+func (g *StripeGateway) PayInvoice(id string, params *stripe.InvoicePayParams) (*stripe.Invoice, error) {
+	return g.api.Invoices.Pay(id, params)
+}
+
+func (g *StripeGateway) NewCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return g.api.Coupons.New(params)
+}
+
+func (g *StripeGateway) DeleteCoupon(id string, params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return g.api.Coupons.Del(id, params)
+}
+
+func (g *StripeGateway) NewTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error) {
+	return g.api.TaxRates.New(params)
+}
+
+func (g *StripeGateway) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	return g.api.Refunds.New(params)
+}
@@ -0,0 +1,190 @@
+package currency
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// currency widgets are priced in when no other price is set
+const Default = "eur"
+
+// locale amounts are formatted in when the customer's one isn't known
+const DefaultLocale = "sk-SK"
+
+var ErrUnsupported = errors.New("currency is not supported")
+
+// type for currencies widgets are sold in, amounts are kept in minor units
+// and zero-decimal currencies like JPY have none
+type Currency struct {
+	Code   string `json:"code"`
+	Symbol string `json:"symbol"`
+	Digits int    `json:"digits"`
+}
+
+var currencies = map[string]Currency{
+	"eur": {Code: "eur", Symbol: "€", Digits: 2},
+	"usd": {Code: "usd", Symbol: "$", Digits: 2},
+	"gbp": {Code: "gbp", Symbol: "£", Digits: 2},
+	"jpy": {Code: "jpy", Symbol: "¥", Digits: 0},
+}
+
+// gets supported currency by its ISO code in any case
+func Get(code string) (Currency, error) {
+	c, ok := currencies[strings.ToLower(strings.TrimSpace(code))]
+	if !ok {
+		return Currency{}, fmt.Errorf("%w: %q", ErrUnsupported, code)
+	}
+
+	return c, nil
+}
+
+// returns supported currencies ordered by code
+func Supported() []Currency {
+	all := make([]Currency, 0, len(currencies))
+	for _, c := range currencies {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Code < all[j].Code })
+
+	return all
+}
+
+// type for how a locale writes amounts
+type locale struct {
+	decimal     string
+	group       string
+	symbolFirst bool
+	space       bool
+}
+
+var locales = map[string]locale{
+	"sk-SK": {decimal: ",", group: " ", space: true},
+	"de-DE": {decimal: ",", group: ".", space: true},
+	"fr-FR": {decimal: ",", group: " ", space: true},
+	"en-GB": {decimal: ".", group: ",", symbolFirst: true},
+	"en-US": {decimal: ".", group: ",", symbolFirst: true},
+	"ja-JP": {decimal: ".", group: ",", symbolFirst: true},
+}
+
+// picks the supported locale closest to an Accept-Language header, e.g. "de-AT,de;q=0.9,en;q=0.8"
+func NegotiateLocale(acceptLanguage string) string {
+	type tag struct {
+		name string
+		q    float64
+	}
+
+	var tags []tag
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		t := tag{name: strings.TrimSpace(fields[0]), q: 1}
+		if t.name == "" || t.name == "*" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if !strings.HasPrefix(f, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(f, "q="), 64); err == nil {
+				t.q = q
+			}
+		}
+		tags = append(tags, t)
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	for _, t := range tags {
+		if l, ok := matchLocale(t.name); ok {
+			return l
+		}
+	}
+
+	return DefaultLocale
+}
+
+// matches a language tag to a supported locale, first exactly then by language
+func matchLocale(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "_", "-")
+	for l := range locales {
+		if strings.EqualFold(l, name) {
+			return l, true
+		}
+	}
+
+	language := strings.ToLower(strings.Split(name, "-")[0])
+	var match string
+	for l := range locales {
+		if strings.HasPrefix(strings.ToLower(l), language+"-") && (match == "" || l < match) {
+			match = l
+		}
+	}
+
+	return match, match != ""
+}
+
+// formats amount in minor units of currency the way locale writes it, e.g. "1 234,50 €" or "¥1,235",
+// unknown locales are written like DefaultLocale
+func Format(amount int, code, localeName string) string {
+	c, err := Get(code)
+	if err != nil {
+		c = Currency{Code: code, Symbol: strings.ToUpper(code), Digits: 2}
+	}
+
+	l, ok := locales[localeName]
+	if !ok {
+		if name, found := matchLocale(localeName); found {
+			l = locales[name]
+		} else {
+			l = locales[DefaultLocale]
+		}
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	scale := 1
+	for i := 0; i < c.Digits; i++ {
+		scale *= 10
+	}
+
+	number := groupThousands(strconv.Itoa(amount/scale), l.group)
+	if c.Digits > 0 {
+		number += l.decimal + fmt.Sprintf("%0*d", c.Digits, amount%scale)
+	}
+
+	switch {
+	case l.symbolFirst:
+		return sign + c.Symbol + number
+	case l.space:
+		return sign + number + " " + c.Symbol
+	default:
+		return sign + number + c.Symbol
+	}
+}
+
+// inserts group separator every three digits from the right
+func groupThousands(digits, group string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+
+	var b strings.Builder
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteString(group)
+		}
+		b.WriteString(digits[i : i+3])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,37 @@
+package currency
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Get(t *testing.T) {
+	c, err := Get(" JPY ")
+	assert.NoError(t, err)
+	assert.Equal(t, "jpy", c.Code)
+	assert.Equal(t, 0, c.Digits)
+
+	_, err = Get("xyz")
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func Test_Format(t *testing.T) {
+	assert.Equal(t, "10,00 €", Format(1000, "eur", "sk-SK"))
+	assert.Equal(t, "1.234,56 €", Format(123456, "eur", "de-DE"))
+	assert.Equal(t, "$1,234,567.89", Format(123456789, "usd", "en-US"))
+	assert.Equal(t, "¥1,500", Format(1500, "jpy", "ja-JP"))
+	assert.Equal(t, "1 500 ¥", Format(1500, "JPY", "sk-SK"))
+	assert.Equal(t, "-£0.05", Format(-5, "gbp", "en-GB"))
+	assert.Equal(t, "£0.05", Format(5, "gbp", "en"))
+	assert.Equal(t, "12,00 CHF", Format(1200, "chf", "xx-XX"))
+}
+
+func Test_NegotiateLocale(t *testing.T) {
+	assert.Equal(t, "de-DE", NegotiateLocale("de-AT,de;q=0.9,en;q=0.8"))
+	assert.Equal(t, "en-US", NegotiateLocale("en-us"))
+	assert.Equal(t, "en-GB", NegotiateLocale("fr;q=0.5, en-GB"))
+	assert.Equal(t, "ja-JP", NegotiateLocale("ja"))
+	assert.Equal(t, DefaultLocale, NegotiateLocale("pt-BR,*"))
+	assert.Equal(t, DefaultLocale, NegotiateLocale(""))
+}
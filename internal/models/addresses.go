@@ -0,0 +1,315 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrInvalidAddress = errors.New("address is not valid")
+
+// kinds of addresses, customers keep the last one of each they used
+const (
+	AddressBilling  = "billing"
+	AddressShipping = "shipping"
+)
+
+// type for postal addresses of customers, orders keep a copy of the ones they were placed with
+type Address struct {
+	ID         int    `json:"id"`
+	CustomerID int    `json:"customer_id"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	// ISO 3166-2 subdivision code without the country, e.g. "CA" for California
+	Region     string    `json:"region"`
+	PostalCode string    `json:"postal_code"`
+	Country    string    `json:"country"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// type for how a country writes addresses
+type addressFormat struct {
+	// postal codes, nil when the country has none
+	postalCode *regexp.Regexp
+	// example shown when a postal code doesn't match
+	example string
+	// the region is a part of the address, e.g. US states
+	regionRequired bool
+	// city line is "City, REGION POSTAL" instead of "POSTAL City"
+	cityFirst bool
+	// postal code is written on its own line under the city
+	postalCodeLine bool
+}
+
+var addressFormats = map[string]addressFormat{
+	"AT": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "1010"},
+	"AU": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "2000", regionRequired: true, cityFirst: true},
+	"BE": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "1000"},
+	"BG": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "1000"},
+	"CA": {postalCode: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), example: "K1A 0B1", regionRequired: true, cityFirst: true},
+	"CH": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "8001"},
+	"CY": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "1010"},
+	"CZ": {postalCode: regexp.MustCompile(`^\d{3} ?\d{2}$`), example: "110 00"},
+	"DE": {postalCode: regexp.MustCompile(`^\d{5}$`), example: "10115"},
+	"DK": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "1050"},
+	"EE": {postalCode: regexp.MustCompile(`^\d{5}$`), example: "10111"},
+	"ES": {postalCode: regexp.MustCompile(`^\d{5}$`), example: "28001"},
+	"FI": {postalCode: regexp.MustCompile(`^\d{5}$`), example: "00100"},
+	"FR": {postalCode: regexp.MustCompile(`^\d{5}$`), example: "75001"},
+	"GB": {postalCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), example: "SW1A 1AA", postalCodeLine: true},
+	"GR": {postalCode: regexp.MustCompile(`^\d{3} ?\d{2}$`), example: "105 57"},
+	"HR": {postalCode: regexp.MustCompile(`^\d{5}$`), example: "10000"},
+	"HU": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "1011"},
+	// Eircodes are not on every address
+	"IE": {postalCode: regexp.MustCompile(`^([A-Z]\d[\dW] ?[A-Z\d]{4})?$`), example: "D02 X285", postalCodeLine: true},
+	"IT": {postalCode: regexp.MustCompile(`^\d{5}$`), example: "00118"},
+	"JP": {postalCode: regexp.MustCompile(`^\d{3}-?\d{4}$`), example: "100-0001"},
+	"LT": {postalCode: regexp.MustCompile(`^(LT-)?\d{5}$`), example: "LT-01100"},
+	"LU": {postalCode: regexp.MustCompile(`^(L-)?\d{4}$`), example: "L-1111"},
+	"LV": {postalCode: regexp.MustCompile(`^(LV-)?\d{4}$`), example: "LV-1050"},
+	"MT": {postalCode: regexp.MustCompile(`^[A-Z]{3} ?\d{4}$`), example: "VLT 1117"},
+	"NL": {postalCode: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), example: "1012 AB"},
+	"NO": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "0150"},
+	"PL": {postalCode: regexp.MustCompile(`^\d{2}-\d{3}$`), example: "00-001"},
+	"PT": {postalCode: regexp.MustCompile(`^\d{4}-\d{3}$`), example: "1000-001"},
+	"RO": {postalCode: regexp.MustCompile(`^\d{6}$`), example: "010011"},
+	"SE": {postalCode: regexp.MustCompile(`^\d{3} ?\d{2}$`), example: "111 20"},
+	"SI": {postalCode: regexp.MustCompile(`^\d{4}$`), example: "1000"},
+	"SK": {postalCode: regexp.MustCompile(`^\d{3} ?\d{2}$`), example: "811 01"},
+	"US": {postalCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`), example: "94103", regionRequired: true, cityFirst: true},
+}
+
+// normalizes address and checks it has what is needed to deliver to it in its country
+func (a *Address) Validate() error {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Line1 = strings.TrimSpace(a.Line1)
+	a.Line2 = strings.TrimSpace(a.Line2)
+	a.City = strings.TrimSpace(a.City)
+	a.Region = strings.ToUpper(strings.TrimSpace(a.Region))
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+
+	country, ok := countries[a.Country]
+	if !ok {
+		return ErrBillingCountry
+	}
+	format := addressFormats[a.Country]
+
+	switch {
+	case a.Kind != AddressBilling && a.Kind != AddressShipping:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidAddress, a.Kind)
+	case a.Name == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidAddress)
+	case a.Line1 == "":
+		return fmt.Errorf("%w: street address is required", ErrInvalidAddress)
+	case a.City == "":
+		return fmt.Errorf("%w: city is required", ErrInvalidAddress)
+	case format.regionRequired && a.Region == "":
+		return fmt.Errorf("%w: state or province is required in %s", ErrInvalidAddress, country.Name)
+	case len(a.Region) > 10:
+		return fmt.Errorf("%w: region must be at most 10 characters", ErrInvalidAddress)
+	case format.postalCode != nil && !format.postalCode.MatchString(a.PostalCode):
+		return fmt.Errorf("%w: postal code in %s looks like %s", ErrInvalidAddress, country.Name, format.example)
+	}
+
+	return nil
+}
+
+// returns address lines the way its country writes them, ending with the country's name
+func (a Address) Lines() []string {
+	format := addressFormats[a.Country]
+
+	lines := []string{a.Name, a.Line1}
+	if a.Line2 != "" {
+		lines = append(lines, a.Line2)
+	}
+
+	switch {
+	case format.cityFirst:
+		lines = append(lines, strings.TrimSpace(fmt.Sprintf("%s, %s %s", a.City, a.Region, a.PostalCode)))
+	case format.postalCodeLine:
+		lines = append(lines, a.City)
+		if a.PostalCode != "" {
+			lines = append(lines, a.PostalCode)
+		}
+	default:
+		lines = append(lines, strings.TrimSpace(a.PostalCode+" "+a.City))
+	}
+
+	return append(lines, countries[a.Country].Name)
+}
+
+// writes address to payment metadata under keys prefixed with its kind, e.g. "shipping_city"
+func (a Address) SetMetadata(metadata map[string]string) {
+	metadata[a.Kind+"_name"] = a.Name
+	metadata[a.Kind+"_line1"] = a.Line1
+	metadata[a.Kind+"_line2"] = a.Line2
+	metadata[a.Kind+"_city"] = a.City
+	metadata[a.Kind+"_region"] = a.Region
+	metadata[a.Kind+"_postal_code"] = a.PostalCode
+	metadata[a.Kind+"_country"] = a.Country
+}
+
+// reads address of kind written by SetMetadata, nil when the payment has none
+func AddressFromMetadata(kind string, metadata map[string]string) *Address {
+	if metadata[kind+"_line1"] == "" {
+		return nil
+	}
+
+	return &Address{
+		Kind:       kind,
+		Name:       metadata[kind+"_name"],
+		Line1:      metadata[kind+"_line1"],
+		Line2:      metadata[kind+"_line2"],
+		City:       metadata[kind+"_city"],
+		Region:     metadata[kind+"_region"],
+		PostalCode: metadata[kind+"_postal_code"],
+		Country:    metadata[kind+"_country"],
+	}
+}
+
+const addressColumns = `
+	id, customer_id, kind, name, line1, line2, city, region, postal_code, country, created_at, updated_at
+`
+
+// scans address selected with addressColumns
+func scanAddress(row interface{ Scan(...any) error }) (Address, error) {
+	var a Address
+	err := row.Scan(
+		&a.ID,
+		&a.CustomerID,
+		&a.Kind,
+		&a.Name,
+		&a.Line1,
+		&a.Line2,
+		&a.City,
+		&a.Region,
+		&a.PostalCode,
+		&a.Country,
+		&a.CreatedAt,
+		&a.UpdatedAt,
+	)
+
+	return a, err
+}
+
+// gets address of kind the customer last used, sql.ErrNoRows when they have none
+func (m *DBModel) GetCustomerAddress(customerID int, kind string) (Address, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `
+		select `+addressColumns+`
+		from addresses
+		where customer_id = ? and kind = ?
+	`, customerID, kind)
+
+	return scanAddress(row)
+}
+
+// saves order's addresses as the customer's and keeps a copy on the order within an open db transaction
+func insertOrderAddresses(ctx context.Context, tx *sql.Tx, orderID int, order Order) error {
+	for _, a := range []*Address{order.BillingAddress, order.ShippingAddress} {
+		if a == nil {
+			continue
+		}
+
+		_, err := tx.ExecContext(ctx, `
+			insert into addresses
+				(customer_id, kind, name, line1, line2, city, region, postal_code, country, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			on duplicate key update
+				name = values(name), line1 = values(line1), line2 = values(line2), city = values(city),
+				region = values(region), postal_code = values(postal_code), country = values(country),
+				updated_at = values(updated_at)
+		`,
+			order.CustomerID,
+			a.Kind,
+			a.Name,
+			a.Line1,
+			a.Line2,
+			a.City,
+			a.Region,
+			a.PostalCode,
+			a.Country,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into order_addresses
+				(order_id, kind, name, line1, line2, city, region, postal_code, country, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			orderID,
+			a.Kind,
+			a.Name,
+			a.Line1,
+			a.Line2,
+			a.City,
+			a.Region,
+			a.PostalCode,
+			a.Country,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loads addresses order was placed with, they don't change when the customer's do
+func (m *DBModel) loadOrderAddresses(ctx context.Context, o *Order) error {
+	rows, err := m.DB.QueryContext(ctx, `
+		select id, kind, name, line1, line2, city, region, postal_code, country, created_at, updated_at
+		from order_addresses
+		where order_id = ?
+	`, o.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := &Address{CustomerID: o.CustomerID}
+		err = rows.Scan(
+			&a.ID,
+			&a.Kind,
+			&a.Name,
+			&a.Line1,
+			&a.Line2,
+			&a.City,
+			&a.Region,
+			&a.PostalCode,
+			&a.Country,
+			&a.CreatedAt,
+			&a.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		switch a.Kind {
+		case AddressBilling:
+			o.BillingAddress = a
+		case AddressShipping:
+			o.ShippingAddress = a
+		}
+	}
+
+	return rows.Err()
+}
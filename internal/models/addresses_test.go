@@ -0,0 +1,69 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AddressValidate(t *testing.T) {
+	a := Address{
+		Kind:       AddressBilling,
+		Name:       " Jane Doe ",
+		Line1:      "Hlavná 1",
+		City:       "Košice",
+		PostalCode: "040 01",
+		Country:    "sk",
+	}
+	assert.NoError(t, a.Validate())
+	assert.Equal(t, "Jane Doe", a.Name)
+	assert.Equal(t, "SK", a.Country)
+
+	tests := []struct {
+		name    string
+		address Address
+		valid   bool
+	}{
+		{"german postal code", Address{PostalCode: "10115", Country: "DE"}, true},
+		{"short german postal code", Address{PostalCode: "1011", Country: "DE"}, false},
+		{"dutch postal code in lower case", Address{PostalCode: "1012 ab", Country: "NL"}, true},
+		{"british postcode", Address{PostalCode: "SW1A 1AA", Country: "GB"}, true},
+		{"irish address without eircode", Address{Country: "IE"}, true},
+		{"us zip+4", Address{PostalCode: "94103-1234", Region: "CA", Country: "US"}, true},
+		{"us address without state", Address{PostalCode: "94103", Country: "US"}, false},
+		{"canadian postal code", Address{PostalCode: "K1A 0B1", Region: "ON", Country: "CA"}, true},
+		{"polish postal code without dash", Address{PostalCode: "00001", Country: "PL"}, false},
+		{"country not sold to", Address{PostalCode: "12345", Country: "XX"}, false},
+	}
+
+	for _, tt := range tests {
+		a := tt.address
+		a.Kind, a.Name, a.Line1, a.City = AddressShipping, "Jane Doe", "1 Main St", "Town"
+		assert.Equal(t, tt.valid, a.Validate() == nil, tt.name)
+	}
+
+	assert.ErrorIs(t, (&Address{Kind: AddressBilling, Name: "Jane", City: "Berlin", PostalCode: "10115", Country: "DE"}).Validate(), ErrInvalidAddress)
+	assert.ErrorIs(t, (&Address{Kind: "home", Name: "Jane", Line1: "1", City: "Berlin", PostalCode: "10115", Country: "DE"}).Validate(), ErrInvalidAddress)
+}
+
+func Test_AddressLines(t *testing.T) {
+	de := Address{Name: "Jane Doe", Line1: "Unter den Linden 1", City: "Berlin", PostalCode: "10117", Country: "DE"}
+	assert.Equal(t, []string{"Jane Doe", "Unter den Linden 1", "10117 Berlin", "Germany"}, de.Lines())
+
+	us := Address{Name: "Jane Doe", Line1: "1 Market St", Line2: "Suite 300", City: "San Francisco", Region: "CA", PostalCode: "94105", Country: "US"}
+	assert.Equal(t, []string{"Jane Doe", "1 Market St", "Suite 300", "San Francisco, CA 94105", "United States"}, us.Lines())
+
+	gb := Address{Name: "Jane Doe", Line1: "10 Downing St", City: "London", PostalCode: "SW1A 2AA", Country: "GB"}
+	assert.Equal(t, []string{"Jane Doe", "10 Downing St", "London", "SW1A 2AA", "United Kingdom"}, gb.Lines())
+}
+
+func Test_AddressMetadata(t *testing.T) {
+	a := Address{Kind: AddressShipping, Name: "Jane Doe", Line1: "1 Market St", City: "San Francisco", Region: "CA", PostalCode: "94105", Country: "US"}
+
+	metadata := make(map[string]string)
+	a.SetMetadata(metadata)
+	assert.Equal(t, "San Francisco", metadata["shipping_city"])
+	assert.Equal(t, &a, AddressFromMetadata(AddressShipping, metadata))
+
+	assert.Nil(t, AddressFromMetadata(AddressBilling, metadata))
+}
@@ -0,0 +1,346 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"go-stripe/internal/currency"
+	"go-stripe/internal/money"
+	"strings"
+	"time"
+)
+
+const (
+	CartStatusOpen       = "open"
+	CartStatusCheckedOut = "checked_out"
+)
+
+var ErrCartClosed = errors.New("cart is already checked out")
+
+// type for shopping carts
+type Cart struct {
+	ID        int         `json:"id"`
+	Token     string      `json:"token"`
+	Status    string      `json:"status"`
+	Items     []*CartItem `json:"items"`
+	Quantity  int         `json:"quantity"`
+	Amount    money.Money `json:"amount"`
+	Currency  string      `json:"currency"`
+	CreatedAt time.Time   `json:"-"`
+	UpdatedAt time.Time   `json:"-"`
+}
+
+// type for cart lines
+type CartItem struct {
+	ID        int         `json:"id"`
+	CartID    int         `json:"cart_id"`
+	WidgetID  int         `json:"widget_id"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+	Amount    money.Money `json:"amount"`
+	Widget    Widget      `json:"widget"`
+	CreatedAt time.Time   `json:"-"`
+	UpdatedAt time.Time   `json:"-"`
+}
+
+// returns random base32 token for public references
+func randomToken() (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// creates an empty cart with random token
+func (m *DBModel) CreateCart() (Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cart Cart
+
+	token, err := randomToken()
+	if err != nil {
+		return cart, err
+	}
+
+	cart.Token = token
+	cart.Status = CartStatusOpen
+	cart.CreatedAt = time.Now()
+	cart.UpdatedAt = time.Now()
+
+	query := `insert into carts (token, status, created_at, updated_at) values (?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, query, cart.Token, cart.Status, cart.CreatedAt, cart.UpdatedAt)
+	if err != nil {
+		return cart, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return cart, err
+	}
+
+	cart.ID = int(id)
+
+	return cart, nil
+}
+
+// gets cart with its items and totals priced from widget prices in currency
+func (m *DBModel) GetCartByToken(token, code string) (Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	cart := Cart{Currency: strings.ToLower(code)}
+	// empty carts total zero in their currency
+	cart.Amount = cart.Amount.In(cart.Currency)
+
+	query := `select id, token, status, created_at, updated_at from carts where token = ?`
+
+	err := m.DB.QueryRowContext(ctx, query, token).Scan(
+		&cart.ID,
+		&cart.Token,
+		&cart.Status,
+		&cart.CreatedAt,
+		&cart.UpdatedAt,
+	)
+	if err != nil {
+		return cart, err
+	}
+
+	query = `
+		select
+			ci.id, ci.cart_id, ci.widget_id, ci.quantity, ci.created_at, ci.updated_at,
+			w.id, w.name, w.description, w.inventory_level, w.price, coalesce(w.image, ''),
+			w.is_recurring, w.plan_id, w.tax_category
+		from
+			cart_items ci
+			inner join widgets w on (ci.widget_id = w.id)
+		where
+			ci.cart_id = ?
+		order by
+			ci.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, cart.ID)
+	if err != nil {
+		return cart, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i CartItem
+		err = rows.Scan(
+			&i.ID,
+			&i.CartID,
+			&i.WidgetID,
+			&i.Quantity,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.ID,
+			&i.Widget.Name,
+			&i.Widget.Description,
+			&i.Widget.InventoryLevel,
+			&i.Widget.Price,
+			&i.Widget.Image,
+			&i.Widget.IsRecurring,
+			&i.Widget.PlanID,
+			&i.Widget.TaxCategory,
+		)
+		if err != nil {
+			return cart, err
+		}
+		i.Widget.Price = i.Widget.Price.In(currency.Default)
+
+		cart.Items = append(cart.Items, &i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return cart, err
+	}
+
+	ids := make([]int, len(cart.Items))
+	for n, i := range cart.Items {
+		ids[n] = i.WidgetID
+	}
+
+	prices, err := m.widgetPrices(ctx, ids...)
+	if err != nil {
+		return cart, err
+	}
+
+	for _, i := range cart.Items {
+		i.Widget.Prices = prices[i.WidgetID]
+		if i.UnitPrice, err = i.Widget.PriceIn(cart.Currency); err != nil {
+			return cart, err
+		}
+
+		i.Amount = i.UnitPrice.Mul(int64(i.Quantity))
+		cart.Quantity += i.Quantity
+		if cart.Amount, err = cart.Amount.Add(i.Amount); err != nil {
+			return cart, err
+		}
+	}
+
+	return cart, nil
+}
+
+// adds quantity of widget to cart, increasing existing line
+func (m *DBModel) AddCartItem(cartID, widgetID, quantity int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		insert into cart_items
+			(cart_id, widget_id, quantity, created_at, updated_at)
+		values (?, ?, ?, ?, ?)
+		on duplicate key update
+			quantity = quantity + values(quantity), updated_at = values(updated_at)
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, cartID, widgetID, quantity, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return m.touchCart(ctx, cartID)
+}
+
+// sets quantity of cart line, removes the line when quantity is not positive
+func (m *DBModel) UpdateCartItem(cartID, widgetID, quantity int) error {
+	if quantity <= 0 {
+		return m.RemoveCartItem(cartID, widgetID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update cart_items set quantity = ?, updated_at = ? where cart_id = ? and widget_id = ?`
+
+	_, err := m.DB.ExecContext(ctx, query, quantity, time.Now(), cartID, widgetID)
+	if err != nil {
+		return err
+	}
+
+	return m.touchCart(ctx, cartID)
+}
+
+// removes widget from cart
+func (m *DBModel) RemoveCartItem(cartID, widgetID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `delete from cart_items where cart_id = ? and widget_id = ?`
+
+	_, err := m.DB.ExecContext(ctx, query, cartID, widgetID)
+	if err != nil {
+		return err
+	}
+
+	return m.touchCart(ctx, cartID)
+}
+
+func (m *DBModel) touchCart(ctx context.Context, cartID int) error {
+	_, err := m.DB.ExecContext(ctx, `update carts set updated_at = ? where id = ?`, time.Now(), cartID)
+	return err
+}
+
+// returns order for cart lines priced like the cart, to be taxed before it is charged
+func (c Cart) Order() (Order, error) {
+	var order Order
+
+	for _, item := range c.Items {
+		line := &OrderItem{
+			WidgetID:  item.WidgetID,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Widget:    item.Widget,
+		}
+
+		var err error
+		if line.Amount, err = line.Total(); err != nil {
+			return order, err
+		}
+		order.Items = append(order.Items, line)
+	}
+
+	return order, order.calculateTotals()
+}
+
+// saves transaction, order and order items of cart order and closes the cart, returns order id
+func (m *DBModel) InsertCartOrder(cart Cart, order Order, txn Transaction) (int, error) {
+	if len(order.Items) == 0 {
+		return 0, errors.New("cart is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// closing the cart first guards against checking out the same cart twice
+	result, err := tx.ExecContext(ctx, `update carts set status = ?, updated_at = ? where id = ? and status = ?`,
+		CartStatusCheckedOut, time.Now(), cart.ID, CartStatusOpen)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, ErrCartClosed
+	}
+
+	txID, err := insertTransaction(ctx, tx, txn)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err = tx.ExecContext(ctx, `
+		insert into orders
+			(transaction_id, status_id, customer_id, billing_country, billing_region, vat_id, reverse_charge, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		txID,
+		1,
+		order.CustomerID,
+		order.Billing.Country,
+		order.Billing.Region,
+		order.Billing.VATID,
+		order.ReverseCharge,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	orderID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = insertOrderItems(ctx, tx, int(orderID), order.Items); err != nil {
+		return 0, err
+	}
+
+	if err = insertOrderAddresses(ctx, tx, int(orderID), order); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return int(orderID), nil
+}
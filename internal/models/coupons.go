@@ -0,0 +1,511 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"go-stripe/internal/money"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// how long a coupon discounts a subscription, same as stripe coupon durations
+const (
+	CouponDurationOnce      = "once"
+	CouponDurationRepeating = "repeating"
+	CouponDurationForever   = "forever"
+)
+
+var (
+	ErrCouponNotFound      = errors.New("coupon code is not valid")
+	ErrCouponExpired       = errors.New("coupon code has expired")
+	ErrCouponRedeemed      = errors.New("coupon code has been fully redeemed")
+	ErrCouponCustomerLimit = errors.New("coupon code has already been used")
+	ErrCouponCurrency      = errors.New("coupon code is not valid for this currency")
+	ErrCouponExists        = errors.New("a coupon with this code already exists")
+	ErrCouponInUse         = errors.New("coupon has been redeemed, deactivate it instead")
+)
+
+var couponCodeRegex = regexp.MustCompile(`^[A-Z0-9_-]{3,64}$`)
+
+// type for discount and trial codes entered at checkout,
+// a coupon takes either a percentage or a fixed amount off, or only grants a trial
+type Coupon struct {
+	ID               int        `json:"id"`
+	Code             string     `json:"code"`
+	Description      string     `json:"description"`
+	PercentOff       int        `json:"percent_off"`
+	AmountOff        int        `json:"amount_off"`
+	Currency         string     `json:"currency"`
+	Duration         string     `json:"duration"`
+	DurationInMonths int        `json:"duration_in_months"`
+	TrialDays        int        `json:"trial_days"`
+	MaxRedemptions   int        `json:"max_redemptions"`
+	MaxPerCustomer   int        `json:"max_per_customer"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	Active           bool       `json:"active"`
+	StripeCouponID   string     `json:"stripe_coupon_id"`
+	Redemptions      int        `json:"redemptions"`
+	CreatedAt        time.Time  `json:"-"`
+	UpdatedAt        time.Time  `json:"-"`
+}
+
+// type for coupon used on an order
+type CouponRedemption struct {
+	ID        int         `json:"id"`
+	CouponID  int         `json:"coupon_id"`
+	OrderID   int         `json:"order_id"`
+	Email     string      `json:"email"`
+	Discount  money.Money `json:"discount"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"-"`
+}
+
+// returns coupon code as stored, codes are case insensitive
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// checks coupon entered by an admin
+func (c *Coupon) Validate() error {
+	c.Code = NormalizeCouponCode(c.Code)
+	c.Currency = strings.ToLower(strings.TrimSpace(c.Currency))
+	if c.Duration == "" {
+		c.Duration = CouponDurationOnce
+	}
+
+	switch {
+	case !couponCodeRegex.MatchString(c.Code):
+		return errors.New("code must be 3 to 64 letters, digits, dashes or underscores")
+	case c.PercentOff < 0 || c.PercentOff > 100:
+		return errors.New("percent off must be between 0 and 100")
+	case c.AmountOff < 0 || c.TrialDays < 0 || c.MaxRedemptions < 0 || c.MaxPerCustomer < 0:
+		return errors.New("amounts and limits cannot be negative")
+	case c.PercentOff > 0 && c.AmountOff > 0:
+		return errors.New("coupon takes either a percentage or an amount off, not both")
+	case c.PercentOff == 0 && c.AmountOff == 0 && c.TrialDays == 0:
+		return errors.New("coupon must give a discount or a trial")
+	case c.AmountOff > 0 && len(c.Currency) != 3:
+		return errors.New("amount off requires a currency")
+	}
+
+	switch c.Duration {
+	case CouponDurationOnce, CouponDurationForever:
+		c.DurationInMonths = 0
+	case CouponDurationRepeating:
+		if c.DurationInMonths <= 0 {
+			return errors.New("repeating coupon requires a number of months")
+		}
+	default:
+		return errors.New("duration must be once, repeating or forever")
+	}
+
+	return nil
+}
+
+// returns discount of coupon on amount, never more than the amount
+func (c Coupon) Discount(amount money.Money) (money.Money, error) {
+	switch {
+	case c.PercentOff > 0:
+		return amount.Percent(int64(c.PercentOff)), nil
+	case c.AmountOff <= 0:
+		return money.Money{}, nil
+	}
+
+	discount, err := money.New(int64(c.AmountOff), c.Currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	more, err := discount.Cmp(amount)
+	if err != nil {
+		return money.Money{}, err
+	}
+	if more > 0 {
+		return amount, nil
+	}
+
+	return discount, nil
+}
+
+// checks whether coupon can still be redeemed by customer paying in currency
+func (c Coupon) redeemable(now time.Time, currency string, redemptions, customerRedemptions int) error {
+	switch {
+	case !c.Active:
+		return ErrCouponNotFound
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return ErrCouponExpired
+	case c.AmountOff > 0 && !strings.EqualFold(c.Currency, currency):
+		return ErrCouponCurrency
+	case c.MaxRedemptions > 0 && redemptions >= c.MaxRedemptions:
+		return ErrCouponRedeemed
+	case c.MaxPerCustomer > 0 && customerRedemptions >= c.MaxPerCustomer:
+		return ErrCouponCustomerLimit
+	}
+
+	return nil
+}
+
+// spreads coupon discount over order lines in proportion to their totals,
+// the shares add up to the exact order discount
+func (o *Order) ApplyCoupon(c Coupon) error {
+	bases := make([]money.Money, len(o.Items))
+	ratios := make([]int64, len(o.Items))
+	for i, item := range o.Items {
+		var err error
+		if bases[i], err = item.Subtotal().Sub(item.Discount); err != nil {
+			return err
+		}
+		ratios[i] = bases[i].Amount()
+	}
+
+	base, err := money.Sum(bases...)
+	if err != nil {
+		return err
+	}
+
+	discount, err := c.Discount(base)
+	if err != nil || !discount.IsPositive() {
+		return err
+	}
+
+	shares, err := discount.Allocate(ratios...)
+	if err != nil {
+		return err
+	}
+
+	for i, item := range o.Items {
+		if item.Discount, err = item.Discount.Add(shares[i]); err != nil {
+			return err
+		}
+		if item.Amount, err = item.Total(); err != nil {
+			return err
+		}
+	}
+
+	return o.calculateTotals()
+}
+
+const couponColumns = `
+	c.id, c.code, c.description, c.percent_off, c.amount_off, c.currency, c.duration,
+	c.duration_in_months, c.trial_days, c.max_redemptions, c.max_per_customer, c.expires_at,
+	c.active, c.stripe_coupon_id,
+	(select count(r.id) from coupon_redemptions r where r.coupon_id = c.id),
+	c.created_at, c.updated_at
+`
+
+// scans coupon selected with couponColumns
+func scanCoupon(row interface{ Scan(...any) error }) (Coupon, error) {
+	var c Coupon
+	var expiresAt sql.NullTime
+
+	err := row.Scan(
+		&c.ID,
+		&c.Code,
+		&c.Description,
+		&c.PercentOff,
+		&c.AmountOff,
+		&c.Currency,
+		&c.Duration,
+		&c.DurationInMonths,
+		&c.TrialDays,
+		&c.MaxRedemptions,
+		&c.MaxPerCustomer,
+		&expiresAt,
+		&c.Active,
+		&c.StripeCouponID,
+		&c.Redemptions,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if expiresAt.Valid {
+		c.ExpiresAt = &expiresAt.Time
+	}
+
+	return c, err
+}
+
+// gets coupon by id
+func (m *DBModel) GetCoupon(id int) (Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+couponColumns+` from coupons c where c.id = ?`, id)
+
+	return scanCoupon(row)
+}
+
+// gets coupon by code entered at checkout
+func (m *DBModel) GetCouponByCode(code string) (Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+couponColumns+` from coupons c where c.code = ?`, NormalizeCouponCode(code))
+
+	c, err := scanCoupon(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, ErrCouponNotFound
+	}
+
+	return c, err
+}
+
+// gets coupon by code and checks customer may redeem it now
+func (m *DBModel) ValidateCoupon(code, email, currency string) (Coupon, error) {
+	c, err := m.GetCouponByCode(code)
+	if err != nil {
+		return c, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var customerRedemptions int
+	if c.MaxPerCustomer > 0 {
+		query := `select count(id) from coupon_redemptions where coupon_id = ? and email = ?`
+		err = m.DB.QueryRowContext(ctx, query, c.ID, NormalizeEmail(email)).Scan(&customerRedemptions)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	return c, c.redeemable(time.Now(), currency, c.Redemptions, customerRedemptions)
+}
+
+// prices widget quantities in currency with coupon validated when the payment was created and
+// taxes them for billing, empty code prices the order without discount
+func (m *DBModel) PriceOrderWithCoupon(quantities map[int]int, code, currency string, billing BillingDetails) (Order, Coupon, error) {
+	var c Coupon
+
+	order, err := m.PriceOrder(quantities, currency)
+	if err != nil {
+		return order, c, err
+	}
+
+	if code != "" {
+		if c, err = m.GetCouponByCode(code); err != nil {
+			return order, c, err
+		}
+
+		if err = order.ApplyCoupon(c); err != nil {
+			return order, c, err
+		}
+	}
+
+	return order, c, m.TaxOrder(&order, billing)
+}
+
+// records coupon use on order, recording the same order twice is a no-op
+func (m *DBModel) RedeemCoupon(couponID, orderID int, email string, discount money.Money) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		insert ignore into coupon_redemptions
+			(coupon_id, order_id, email, discount, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, couponID, orderID, NormalizeEmail(email), discount, time.Now(), time.Now())
+
+	return err
+}
+
+// returns page of coupons, newest first
+func (m *DBModel) GetAllCoupons(pageSize, page int) ([]*Coupon, int, int, error) {
+	if err := checkPage(pageSize, page); err != nil {
+		return nil, 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	var coupons []*Coupon
+
+	query := `
+		select ` + couponColumns + `
+		from
+			coupons c
+		order by
+			c.id desc
+		limit ? offset ?
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, pageSize, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		coupons = append(coupons, &c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var totalRecords int
+	if err = m.DB.QueryRowContext(ctx, `select count(id) from coupons`).Scan(&totalRecords); err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := pageCount(totalRecords, pageSize)
+
+	return coupons, lastPage, totalRecords, nil
+}
+
+// gets redemptions of coupon, newest first
+func (m *DBModel) GetCouponRedemptions(couponID int) ([]*CouponRedemption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var redemptions []*CouponRedemption
+
+	query := `
+		select
+			r.id, r.coupon_id, r.order_id, r.email, r.discount, coalesce(t.currency, ''), r.created_at, r.updated_at
+		from
+			coupon_redemptions r
+			left join orders o on (r.order_id = o.id)
+			left join transactions t on (o.transaction_id = t.id)
+		where
+			r.coupon_id = ?
+		order by
+			r.id desc
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r CouponRedemption
+		err = rows.Scan(
+			&r.ID,
+			&r.CouponID,
+			&r.OrderID,
+			&r.Email,
+			&r.Discount,
+			r.Discount.CurrencyColumn(),
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, &r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return redemptions, nil
+}
+
+// inserts coupon validated with Validate
+func (m *DBModel) InsertCoupon(c Coupon) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists int
+	err := m.DB.QueryRowContext(ctx, `select count(id) from coupons where code = ?`, c.Code).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists > 0 {
+		return 0, ErrCouponExists
+	}
+
+	query := `
+		insert into coupons
+			(code, description, percent_off, amount_off, currency, duration, duration_in_months,
+			trial_days, max_redemptions, max_per_customer, expires_at, active, stripe_coupon_id,
+			created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := m.DB.ExecContext(ctx, query,
+		c.Code,
+		c.Description,
+		c.PercentOff,
+		c.AmountOff,
+		c.Currency,
+		c.Duration,
+		c.DurationInMonths,
+		c.TrialDays,
+		c.MaxRedemptions,
+		c.MaxPerCustomer,
+		c.ExpiresAt,
+		c.Active,
+		c.StripeCouponID,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// updates coupon limits, the discount itself can't change once customers may have used it
+func (m *DBModel) UpdateCoupon(c Coupon) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update coupons set
+			description = ?, trial_days = ?, max_redemptions = ?, max_per_customer = ?,
+			expires_at = ?, active = ?, updated_at = ?
+		where
+			id = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, query,
+		c.Description,
+		c.TrialDays,
+		c.MaxRedemptions,
+		c.MaxPerCustomer,
+		c.ExpiresAt,
+		c.Active,
+		time.Now(),
+		c.ID,
+	)
+
+	return err
+}
+
+// deletes coupon that was never redeemed
+func (m *DBModel) DeleteCoupon(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var redemptions int
+	err := m.DB.QueryRowContext(ctx, `select count(id) from coupon_redemptions where coupon_id = ?`, id).Scan(&redemptions)
+	if err != nil {
+		return err
+	}
+	if redemptions > 0 {
+		return ErrCouponInUse
+	}
+
+	_, err = m.DB.ExecContext(ctx, `delete from coupons where id = ?`, id)
+
+	return err
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"go-stripe/internal/money"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CouponValidate(t *testing.T) {
+	c := Coupon{Code: " spring-10 ", PercentOff: 10}
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, "SPRING-10", c.Code)
+	assert.Equal(t, CouponDurationOnce, c.Duration)
+
+	assert.Error(t, (&Coupon{Code: "BOTH", PercentOff: 10, AmountOff: 500, Currency: "eur"}).Validate())
+	assert.Error(t, (&Coupon{Code: "NOTHING"}).Validate())
+	assert.Error(t, (&Coupon{Code: "FIVE", AmountOff: 500}).Validate())
+	assert.Error(t, (&Coupon{Code: "REPEAT", PercentOff: 10, Duration: CouponDurationRepeating}).Validate())
+	assert.Error(t, (&Coupon{Code: "no spaces", PercentOff: 10}).Validate())
+	assert.NoError(t, (&Coupon{Code: "TRIAL30", TrialDays: 30}).Validate())
+}
+
+func Test_CouponRedeemable(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+
+	c := Coupon{Active: true, AmountOff: 500, Currency: "eur", MaxRedemptions: 10, MaxPerCustomer: 1}
+	assert.NoError(t, c.redeemable(now, "EUR", 9, 0))
+	assert.ErrorIs(t, c.redeemable(now, "usd", 0, 0), ErrCouponCurrency)
+	assert.ErrorIs(t, c.redeemable(now, "eur", 10, 0), ErrCouponRedeemed)
+	assert.ErrorIs(t, c.redeemable(now, "eur", 1, 1), ErrCouponCustomerLimit)
+
+	c.ExpiresAt = &past
+	assert.ErrorIs(t, c.redeemable(now, "eur", 0, 0), ErrCouponExpired)
+
+	assert.ErrorIs(t, Coupon{}.redeemable(now, "eur", 0, 0), ErrCouponNotFound)
+}
+
+func Test_ApplyCoupon(t *testing.T) {
+	order := Order{Items: []*OrderItem{
+		{UnitPrice: eur(1000), Quantity: 1},
+		{UnitPrice: eur(500), Quantity: 1},
+		{UnitPrice: eur(500), Quantity: 1},
+	}}
+	for _, item := range order.Items {
+		item.Amount, _ = item.Total()
+	}
+
+	assert.NoError(t, order.ApplyCoupon(Coupon{AmountOff: 1001, Currency: "eur"}))
+
+	assert.Equal(t, eur(1001), order.Discount)
+	assert.Equal(t, eur(999), order.Amount)
+	assert.Equal(t, eur(501), order.Items[0].Discount)
+	assert.Equal(t, eur(250), order.Items[1].Discount)
+	assert.Equal(t, eur(250), order.Items[2].Discount)
+
+	order = Order{Items: []*OrderItem{{UnitPrice: eur(300), Quantity: 1}}}
+	assert.NoError(t, order.ApplyCoupon(Coupon{AmountOff: 500, Currency: "eur"}))
+	assert.True(t, order.Amount.IsZero())
+
+	order = Order{Items: []*OrderItem{{UnitPrice: eur(999), Quantity: 1}}}
+	assert.NoError(t, order.ApplyCoupon(Coupon{PercentOff: 10}))
+	assert.Equal(t, eur(99), order.Discount)
+	assert.Equal(t, eur(900), order.Amount)
+
+	order = Order{Items: []*OrderItem{{UnitPrice: eur(999), Quantity: 1}}}
+	assert.ErrorIs(t, order.ApplyCoupon(Coupon{AmountOff: 100, Currency: "usd"}), money.ErrCurrencyMismatch)
+}
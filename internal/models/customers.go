@@ -0,0 +1,703 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrCustomerExists     = errors.New("an account with this email already exists")
+	ErrMergeEmailMismatch = errors.New("only customers with the same email can be merged")
+)
+
+// signed token the front end gives the api for a logged in customer, e.g. to pay with a saved card,
+// valid for CustomerTokenExpiry minutes
+const (
+	CustomerTokenPath   = "/checkout/customer"
+	CustomerTokenExpiry = 60
+)
+
+// sources of customer merges
+const (
+	MergeSourceAdmin     = "admin"
+	MergeSourceCLI       = "cli"
+	MergeSourceMigration = "migration"
+)
+
+// customer with the details used to pick a survivor among duplicates
+type DuplicateCustomer struct {
+	Customer
+	Orders     int  `json:"orders"`
+	Registered bool `json:"registered"`
+}
+
+// customers sharing one normalized email, survivor is the suggested customer to keep
+type DuplicateGroup struct {
+	Email      string               `json:"email"`
+	SurvivorID int                  `json:"survivor_id"`
+	Customers  []*DuplicateCustomer `json:"customers"`
+}
+
+// audit record of a customer merged into a survivor
+type CustomerMerge struct {
+	ID               int       `json:"id"`
+	SurvivorID       int       `json:"survivor_id"`
+	MergedCustomerID int       `json:"merged_customer_id"`
+	MergedFirstName  string    `json:"merged_first_name"`
+	MergedLastName   string    `json:"merged_last_name"`
+	MergedEmail      string    `json:"merged_email"`
+	OrdersMoved      int       `json:"orders_moved"`
+	UserID           int       `json:"user_id"`
+	Source           string    `json:"source"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"-"`
+}
+
+// returns email in the form customers are matched by
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// orders of a customer, including ones placed as guest under another customer row with the same email
+const customerOrdersFilter = `
+	o.customer_id in (
+		select c2.id from customers c1 inner join customers c2 on (c2.email = c1.email)
+		where c1.id = ?
+	)
+`
+
+// inserts customer or updates the name and locale of the customer with the same normalized email, returns its id
+func (m *DBModel) UpsertCustomer(c Customer) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the unique index on the normalized email turns a concurrent insert of the same email into an update,
+	// last_insert_id(id) makes the existing id the one returned
+	result, err := m.DB.ExecContext(ctx, `
+		insert into customers (first_name, last_name, email, locale, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)
+		on duplicate key update
+			id = last_insert_id(id),
+			updated_at = if(values(first_name) = '' and values(last_name) = '' and values(locale) = '',
+				updated_at, values(updated_at)),
+			first_name = if(values(first_name) = '', first_name, values(first_name)),
+			last_name = if(values(last_name) = '', last_name, values(last_name)),
+			locale = if(values(locale) = '', locale, values(locale))
+	`, c.FirstName, c.LastName, NormalizeEmail(c.Email), c.Locale, time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// registers customer account, claims customer created by an earlier guest checkout
+// with the same email, returns customer id
+func (m *DBModel) RegisterCustomer(c Customer, hash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	email := NormalizeEmail(c.Email)
+
+	var id int
+	var password string
+
+	err = tx.QueryRowContext(ctx, `
+		select id, password from customers where email = ? order by id limit 1 for update
+	`, email).Scan(&id, &password)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		result, err := tx.ExecContext(ctx, `
+			insert into customers (first_name, last_name, email, password, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?)
+		`, c.FirstName, c.LastName, email, hash, time.Now(), time.Now())
+		if isDuplicateEntry(err) {
+			return 0, ErrCustomerExists
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		newID, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = int(newID)
+
+	case err != nil:
+		return 0, err
+
+	case password != "":
+		return 0, ErrCustomerExists
+
+	default:
+		_, err = tx.ExecContext(ctx, `
+			update customers set first_name = ?, last_name = ?, password = ?, updated_at = ? where id = ?
+		`, c.FirstName, c.LastName, hash, time.Now(), id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// checks customer credentials, returns customer id
+func (m *DBModel) AuthenticateCustomer(email, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var hashedPass string
+
+	row := m.DB.QueryRowContext(ctx, `
+		select id, password from customers where email = ? and password <> '' order by id limit 1
+	`, NormalizeEmail(email))
+
+	err := row.Scan(&id, &hashedPass)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPass), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, errors.New("incorrect username or password")
+	} else if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// gets customer by id
+func (m *DBModel) GetCustomerByID(id int) (Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Customer
+
+	row := m.DB.QueryRowContext(ctx, `
+		select id, first_name, last_name, email, locale, stripe_customer_id, created_at, updated_at
+		from customers
+		where id = ?
+	`, id)
+
+	err := row.Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.Locale,
+		&c.StripeCustomerID,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// gets customer with saved cards by email, sql.ErrNoRows when no customer with the email saved one
+func (m *DBModel) GetCustomerWithSavedCards(email string) (Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Customer
+
+	row := m.DB.QueryRowContext(ctx, `
+		select id, first_name, last_name, email, stripe_customer_id, created_at, updated_at
+		from customers
+		where email = ? and stripe_customer_id <> ''
+		order by id
+		limit 1
+	`, NormalizeEmail(email))
+
+	err := row.Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerID,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+
+	return c, err
+}
+
+// stores stripe customer cards of customer are saved for unless it already has one,
+// returns the stripe customer id kept
+func (m *DBModel) SetStripeCustomerID(id int, stripeCustomerID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		update customers set stripe_customer_id = ?, updated_at = ? where id = ? and stripe_customer_id = ''
+	`, stripeCustomerID, time.Now(), id)
+	if err != nil {
+		return "", err
+	}
+
+	// a concurrent request may have stored another one first
+	var stored string
+	err = m.DB.QueryRowContext(ctx, `select stripe_customer_id from customers where id = ?`, id).Scan(&stored)
+
+	return stored, err
+}
+
+// gets paginated orders of customer, newest first
+func (m *DBModel) GetOrdersForCustomer(customerID, pageSize, page int) ([]*Order, int, int, error) {
+	if err := checkPage(pageSize, page); err != nil {
+		return nil, 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	query := `
+		select
+			o.id, o.transaction_id, o.customer_id,
+			o.status_id, o.created_at, o.updated_at,
+			t.id, t.amount, t.currency, t.last_four,
+			t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code
+		from
+			orders o
+			left join transactions t on (o.transaction_id = t.id)
+		where
+			` + customerOrdersFilter + `
+		order by
+			o.created_at desc
+		limit ? offset ?
+	`
+
+	orders, err := m.queryCustomerOrders(ctx, query, customerID, pageSize, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var totalRecords int
+	err = m.DB.QueryRowContext(ctx, `select count(o.id) from orders o where `+customerOrdersFilter, customerID).Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := pageCount(totalRecords, pageSize)
+
+	return orders, lastPage, totalRecords, nil
+}
+
+// gets subscriptions of customer, newest first
+func (m *DBModel) GetSubscriptionsForCustomer(customerID int) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			o.id, o.transaction_id, o.customer_id,
+			o.status_id, o.created_at, o.updated_at,
+			t.id, t.amount, t.currency, t.last_four,
+			t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code
+		from
+			orders o
+			left join transactions t on (o.transaction_id = t.id)
+		where
+			` + customerOrdersFilter + `
+			and exists (
+				select oi.id from order_items oi inner join widgets w on (oi.widget_id = w.id)
+				where oi.order_id = o.id and w.is_recurring = 1
+			)
+		order by
+			o.created_at desc
+	`
+
+	return m.queryCustomerOrders(ctx, query, customerID)
+}
+
+// gets order by id, sql.ErrNoRows when it doesn't belong to customer
+func (m *DBModel) GetOrderForCustomer(customerID, orderID int) (Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, `select count(o.id) from orders o where o.id = ? and `+customerOrdersFilter,
+		orderID, customerID).Scan(&count)
+	if err != nil {
+		return Order{}, err
+	}
+
+	if count == 0 {
+		return Order{}, sql.ErrNoRows
+	}
+
+	return m.GetOrderByID(orderID)
+}
+
+// runs customer order query and loads order items and subscriptions
+func (m *DBModel) queryCustomerOrders(ctx context.Context, query string, args ...any) ([]*Order, error) {
+	var orders []*Order
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Order
+		err = rows.Scan(
+			&o.ID,
+			&o.TransactionID,
+			&o.CustomerID,
+			&o.StatusID,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+			&o.Transaction.ID,
+			&o.Transaction.Amount,
+			o.Transaction.Amount.CurrencyColumn(),
+			&o.Transaction.LastFour,
+			&o.Transaction.ExpiryMonth,
+			&o.Transaction.ExpiryYear,
+			&o.Transaction.PaymentIntent,
+			&o.Transaction.BankReturnCode,
+		)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, &o)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = m.loadOrderItems(ctx, orders...); err != nil {
+		return nil, err
+	}
+
+	if err = m.loadSubscriptions(ctx, orders...); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// finds customers sharing a normalized email, grouped by email with a suggested survivor
+func (m *DBModel) GetDuplicateCustomers() ([]*DuplicateGroup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			c.id, c.first_name, c.last_name, c.email, c.password <> '', c.created_at, c.updated_at,
+			(select count(o.id) from orders o where o.customer_id = c.id)
+		from
+			customers c
+		where
+			lower(trim(c.email)) in (
+				select lower(trim(email)) from customers group by lower(trim(email)) having count(id) > 1
+			)
+		order by
+			lower(trim(c.email)), c.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*DuplicateGroup
+	var group *DuplicateGroup
+
+	for rows.Next() {
+		var c DuplicateCustomer
+		err = rows.Scan(
+			&c.ID,
+			&c.FirstName,
+			&c.LastName,
+			&c.Email,
+			&c.Registered,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+			&c.Orders,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		email := NormalizeEmail(c.Email)
+		if group == nil || group.Email != email {
+			group = &DuplicateGroup{Email: email}
+			groups = append(groups, group)
+		}
+		group.Customers = append(group.Customers, &c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		g.SurvivorID = pickSurvivor(g.Customers)
+	}
+
+	return groups, nil
+}
+
+// prefers the registered customer, then the one with most orders, then the oldest
+func pickSurvivor(customers []*DuplicateCustomer) int {
+	var survivor *DuplicateCustomer
+
+	for _, c := range customers {
+		switch {
+		case survivor == nil:
+			survivor = c
+		case c.Registered != survivor.Registered:
+			if c.Registered {
+				survivor = c
+			}
+		case c.Orders != survivor.Orders:
+			if c.Orders > survivor.Orders {
+				survivor = c
+			}
+		case c.ID < survivor.ID:
+			survivor = c
+		}
+	}
+
+	if survivor == nil {
+		return 0
+	}
+
+	return survivor.ID
+}
+
+// moves orders of merged customers to survivor, deletes them and records each merge,
+// userID is the admin who merged, 0 when run from the command line
+func (m *DBModel) MergeCustomers(survivorID int, mergedIDs []int, userID int, source string) ([]*CustomerMerge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var survivorEmail, survivorPassword, survivorStripeID string
+	err = tx.QueryRowContext(ctx, `select email, password, stripe_customer_id from customers where id = ? for update`, survivorID).
+		Scan(&survivorEmail, &survivorPassword, &survivorStripeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var user sql.NullInt64
+	if userID > 0 {
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+
+	var merges []*CustomerMerge
+
+	for _, id := range mergedIDs {
+		if id == survivorID {
+			continue
+		}
+
+		merge := CustomerMerge{
+			SurvivorID:       survivorID,
+			MergedCustomerID: id,
+			UserID:           userID,
+			Source:           source,
+		}
+
+		var password, stripeID string
+		err = tx.QueryRowContext(ctx, `
+			select first_name, last_name, email, password, stripe_customer_id from customers where id = ? for update
+		`, id).Scan(&merge.MergedFirstName, &merge.MergedLastName, &merge.MergedEmail, &password, &stripeID)
+		if err != nil {
+			return nil, err
+		}
+
+		if NormalizeEmail(merge.MergedEmail) != NormalizeEmail(survivorEmail) {
+			return nil, ErrMergeEmailMismatch
+		}
+
+		// keep the customer able to log in when only a merged row was registered
+		if survivorPassword == "" && password != "" {
+			survivorPassword = password
+			_, err = tx.ExecContext(ctx, `update customers set password = ?, updated_at = ? where id = ?`,
+				password, time.Now(), survivorID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// keep the saved cards when only a merged row had them
+		if survivorStripeID == "" && stripeID != "" {
+			survivorStripeID = stripeID
+			_, err = tx.ExecContext(ctx, `update customers set stripe_customer_id = ?, updated_at = ? where id = ?`,
+				stripeID, time.Now(), survivorID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, `update orders set customer_id = ?, updated_at = ? where customer_id = ?`,
+			survivorID, time.Now(), id)
+		if err != nil {
+			return nil, err
+		}
+
+		moved, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		merge.OrdersMoved = int(moved)
+
+		// addresses of a kind the survivor has are kept, the merged customer's are deleted with it
+		_, err = tx.ExecContext(ctx, `update ignore addresses set customer_id = ?, updated_at = ? where customer_id = ?`,
+			survivorID, time.Now(), id)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err = tx.ExecContext(ctx, `
+			insert into customer_merges
+				(survivor_id, merged_customer_id, merged_first_name, merged_last_name, merged_email,
+				orders_moved, user_id, source, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			merge.SurvivorID,
+			merge.MergedCustomerID,
+			merge.MergedFirstName,
+			merge.MergedLastName,
+			merge.MergedEmail,
+			merge.OrdersMoved,
+			user,
+			merge.Source,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		mergeID, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		merge.ID = int(mergeID)
+
+		if _, err = tx.ExecContext(ctx, `delete from customers where id = ?`, id); err != nil {
+			return nil, err
+		}
+
+		merges = append(merges, &merge)
+	}
+
+	_, err = tx.ExecContext(ctx, `update customers set email = ?, updated_at = ? where id = ?`,
+		NormalizeEmail(survivorEmail), time.Now(), survivorID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return merges, nil
+}
+
+// gets paginated customer merge history, newest first
+func (m *DBModel) GetCustomerMerges(pageSize, page int) ([]*CustomerMerge, int, int, error) {
+	if err := checkPage(pageSize, page); err != nil {
+		return nil, 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	var merges []*CustomerMerge
+
+	query := `
+		select
+			id, survivor_id, merged_customer_id, merged_first_name, merged_last_name, merged_email,
+			orders_moved, coalesce(user_id, 0), source, created_at, updated_at
+		from
+			customer_merges
+		order by
+			id desc
+		limit ? offset ?
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, pageSize, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c CustomerMerge
+		err = rows.Scan(
+			&c.ID,
+			&c.SurvivorID,
+			&c.MergedCustomerID,
+			&c.MergedFirstName,
+			&c.MergedLastName,
+			&c.MergedEmail,
+			&c.OrdersMoved,
+			&c.UserID,
+			&c.Source,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+		)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		merges = append(merges, &c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var totalRecords int
+	if err = m.DB.QueryRowContext(ctx, `select count(id) from customer_merges`).Scan(&totalRecords); err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := pageCount(totalRecords, pageSize)
+
+	return merges, lastPage, totalRecords, nil
+}
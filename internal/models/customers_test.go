@@ -0,0 +1,25 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NormalizeEmail(t *testing.T) {
+	assert.Equal(t, "jane@example.com", NormalizeEmail("  Jane@Example.COM "))
+}
+
+func Test_PickSurvivor(t *testing.T) {
+	customers := []*DuplicateCustomer{
+		{Customer: Customer{ID: 1}, Orders: 1},
+		{Customer: Customer{ID: 2}, Orders: 3},
+		{Customer: Customer{ID: 3}, Orders: 3},
+	}
+	assert.Equal(t, 2, pickSurvivor(customers))
+
+	customers = append(customers, &DuplicateCustomer{Customer: Customer{ID: 4}, Registered: true})
+	assert.Equal(t, 4, pickSurvivor(customers))
+
+	assert.Equal(t, 0, pickSurvivor(nil))
+}
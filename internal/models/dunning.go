@@ -0,0 +1,354 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-stripe/internal/money"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dunning case statuses
+const (
+	DunningStatusOpen      = "open"
+	DunningStatusRecovered = "recovered"
+	DunningStatusCancelled = "cancelled"
+)
+
+// minutes a card update link sent with dunning emails stays valid
+const UpdateCardLinkExpiry = 7 * 24 * 60
+
+// default days between payment retries of a failed renewal
+const DefaultDunningSchedule = "3,5,7"
+
+var ErrInvalidDunningSchedule = errors.New("dunning schedule must be a comma separated list of days")
+
+// delays before each payment retry of a failed renewal, the subscription is cancelled when the last retry fails
+type DunningSchedule []time.Duration
+
+// parses comma separated days between retries, e.g. "3,5,7"
+func ParseDunningSchedule(s string) (DunningSchedule, error) {
+	if strings.TrimSpace(s) == "" {
+		s = DefaultDunningSchedule
+	}
+
+	var schedule DunningSchedule
+	for _, part := range strings.Split(s, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidDunningSchedule, s)
+		}
+		schedule = append(schedule, time.Duration(days)*24*time.Hour)
+	}
+
+	return schedule, nil
+}
+
+// returns time of the retry following attempts made so far, false when no retries are left
+func (s DunningSchedule) NextAttempt(attempts int, from time.Time) (time.Time, bool) {
+	if attempts < 0 || attempts >= len(s) {
+		return time.Time{}, false
+	}
+
+	return from.Add(s[attempts]), true
+}
+
+// type for failed renewal of subscription being retried
+type DunningCase struct {
+	ID                   int         `json:"id"`
+	SubscriptionID       int         `json:"subscription_id"`
+	Invoice              string      `json:"invoice"`
+	AmountDue            money.Money `json:"amount_due"`
+	Attempts             int         `json:"attempts"`
+	NextAttemptAt        *time.Time  `json:"next_attempt_at"`
+	Status               string      `json:"status"`
+	LastError            string      `json:"last_error"`
+	ResolvedAt           *time.Time  `json:"resolved_at"`
+	CreatedAt            time.Time   `json:"created_at"`
+	UpdatedAt            time.Time   `json:"-"`
+	OrderID              int         `json:"order_id"`
+	StripeSubscriptionID string      `json:"stripe_subscription_id"`
+	SubscriptionStatus   string      `json:"subscription_status"`
+	Customer             Customer    `json:"customer"`
+}
+
+const dunningColumns = `
+	d.id, d.subscription_id, d.invoice, d.amount_due, d.currency, d.attempts, d.next_attempt_at,
+	d.status, d.last_error, d.resolved_at, d.created_at, d.updated_at,
+	s.order_id, s.stripe_subscription_id, s.status,
+	c.id, c.first_name, c.last_name, c.email, c.locale
+`
+
+const dunningTables = `
+	dunning_cases d
+	inner join subscriptions s on (d.subscription_id = s.id)
+	inner join orders o on (s.order_id = o.id)
+	left join customers c on (o.customer_id = c.id)
+`
+
+// scans dunning case selected with dunningColumns
+func scanDunningCase(row interface{ Scan(...any) error }) (DunningCase, error) {
+	var d DunningCase
+	var nextAttempt, resolved sql.NullTime
+
+	err := row.Scan(
+		&d.ID,
+		&d.SubscriptionID,
+		&d.Invoice,
+		&d.AmountDue,
+		d.AmountDue.CurrencyColumn(),
+		&d.Attempts,
+		&nextAttempt,
+		&d.Status,
+		&d.LastError,
+		&resolved,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+		&d.OrderID,
+		&d.StripeSubscriptionID,
+		&d.SubscriptionStatus,
+		&d.Customer.ID,
+		&d.Customer.FirstName,
+		&d.Customer.LastName,
+		&d.Customer.Email,
+		&d.Customer.Locale,
+	)
+
+	if nextAttempt.Valid {
+		d.NextAttemptAt = &nextAttempt.Time
+	}
+	if resolved.Valid {
+		d.ResolvedAt = &resolved.Time
+	}
+
+	return d, err
+}
+
+// opens dunning case for failed renewal invoice and marks subscription past due, returns the open case
+// and whether it was created now, sql.ErrNoRows when the subscription is unknown
+func (m *DBModel) OpenDunningCase(stripeSubID, invoice string, amountDue money.Money, nextAttemptAt time.Time) (DunningCase, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return DunningCase{}, false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var subID int
+	err = tx.QueryRowContext(ctx, `select id from subscriptions where stripe_subscription_id = ? for update`, stripeSubID).Scan(&subID)
+	if err != nil {
+		return DunningCase{}, false, err
+	}
+
+	// failed retries of the same renewal are reported again, they belong to the open case
+	var existing int
+	err = tx.QueryRowContext(ctx, `select id from dunning_cases where subscription_id = ? and status = ?`,
+		subID, DunningStatusOpen).Scan(&existing)
+	if err == nil {
+		if err = tx.Commit(); err != nil {
+			return DunningCase{}, false, err
+		}
+		d, err := m.getDunningCase(existing)
+		return d, false, err
+	} else if err != sql.ErrNoRows {
+		return DunningCase{}, false, err
+	}
+
+	query := `
+		insert ignore into dunning_cases
+			(subscription_id, invoice, amount_due, currency, attempts, next_attempt_at, status, last_error, created_at, updated_at)
+		values (?, ?, ?, ?, 0, ?, ?, '', ?, ?)
+	`
+
+	result, err := tx.ExecContext(ctx, query, subID, invoice, amountDue, amountDue.Currency(), nextAttemptAt, DunningStatusOpen, time.Now(), time.Now())
+	if err != nil {
+		return DunningCase{}, false, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return DunningCase{}, false, err
+	}
+
+	// the invoice was already handled by a case that's now closed
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return DunningCase{}, false, tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx, `update subscriptions set status = ?, updated_at = ? where id = ? and status in (?, ?)`,
+		SubscriptionStatusPastDue, time.Now(), subID, SubscriptionStatusActive, SubscriptionStatusTrialing)
+	if err != nil {
+		return DunningCase{}, false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return DunningCase{}, false, err
+	}
+
+	d, err := m.getDunningCase(int(id))
+	return d, true, err
+}
+
+// gets dunning case by id
+func (m *DBModel) getDunningCase(id int) (DunningCase, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+dunningColumns+` from `+dunningTables+` where d.id = ?`, id)
+
+	return scanDunningCase(row)
+}
+
+// gets open dunning case of subscription, sql.ErrNoRows when its payments are fine
+func (m *DBModel) GetOpenDunningCase(stripeSubID string) (DunningCase, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + dunningColumns + ` from ` + dunningTables + `
+		where s.stripe_subscription_id = ? and d.status = ?`
+
+	row := m.DB.QueryRowContext(ctx, query, stripeSubID, DunningStatusOpen)
+
+	return scanDunningCase(row)
+}
+
+// gets open dunning cases whose next retry is due, oldest first
+func (m *DBModel) GetDueDunningCases(now time.Time, limit int) ([]*DunningCase, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + dunningColumns + ` from ` + dunningTables + `
+		where d.status = ? and d.next_attempt_at <= ?
+		order by d.next_attempt_at
+		limit ?`
+
+	rows, err := m.DB.QueryContext(ctx, query, DunningStatusOpen, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cases []*DunningCase
+	for rows.Next() {
+		d, err := scanDunningCase(rows)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, &d)
+	}
+
+	return cases, rows.Err()
+}
+
+// records failed retry of open dunning case and schedules the next one
+func (m *DBModel) RecordDunningAttempt(id int, lastError string, nextAttemptAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if len(lastError) > 255 {
+		lastError = lastError[:255]
+	}
+
+	query := `
+		update dunning_cases set
+			attempts = attempts + 1, last_error = ?, next_attempt_at = ?, updated_at = ?
+		where
+			id = ? and status = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, lastError, nextAttemptAt, time.Now(), id, DunningStatusOpen)
+
+	return err
+}
+
+// closes open dunning case of subscription as recovered or cancelled, a recovered subscription is active again
+func (m *DBModel) ResolveDunningCase(stripeSubID, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		update
+			dunning_cases d
+			inner join subscriptions s on (d.subscription_id = s.id)
+		set
+			d.status = ?, d.next_attempt_at = null, d.resolved_at = ?, d.updated_at = ?
+		where
+			s.stripe_subscription_id = ? and d.status = ?
+	`
+
+	result, err := tx.ExecContext(ctx, query, status, time.Now(), time.Now(), stripeSubID, DunningStatusOpen)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows > 0 && status == DunningStatusRecovered {
+		_, err = tx.ExecContext(ctx, `update subscriptions set status = ?, updated_at = ? where stripe_subscription_id = ? and status = ?`,
+			SubscriptionStatusActive, time.Now(), stripeSubID, SubscriptionStatusPastDue)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// gets page of open dunning cases, the subscriptions at risk of being cancelled, next retry first
+func (m *DBModel) GetAtRiskSubscriptions(pageSize, page int) ([]*DunningCase, int, int, error) {
+	if err := checkPage(pageSize, page); err != nil {
+		return nil, 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	query := `select ` + dunningColumns + ` from ` + dunningTables + `
+		where d.status = ?
+		order by d.next_attempt_at, d.id
+		limit ? offset ?`
+
+	rows, err := m.DB.QueryContext(ctx, query, DunningStatusOpen, pageSize, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	var cases []*DunningCase
+	for rows.Next() {
+		d, err := scanDunningCase(rows)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		cases = append(cases, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var totalRecords int
+	err = m.DB.QueryRowContext(ctx, `select count(id) from dunning_cases where status = ?`, DunningStatusOpen).Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := pageCount(totalRecords, pageSize)
+
+	return cases, lastPage, totalRecords, nil
+}
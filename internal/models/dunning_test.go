@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseDunningSchedule(t *testing.T) {
+	day := 24 * time.Hour
+
+	schedule, err := ParseDunningSchedule("1, 2,4")
+	assert.Nil(t, err)
+	assert.Equal(t, DunningSchedule{day, 2 * day, 4 * day}, schedule)
+
+	schedule, err = ParseDunningSchedule("")
+	assert.Nil(t, err)
+	assert.Len(t, schedule, 3)
+
+	for _, s := range []string{"3,x", "0", "3,,5", "-1"} {
+		_, err = ParseDunningSchedule(s)
+		assert.True(t, errors.Is(err, ErrInvalidDunningSchedule), s)
+	}
+}
+
+func Test_DunningScheduleNextAttempt(t *testing.T) {
+	day := 24 * time.Hour
+	schedule := DunningSchedule{day, 3 * day}
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	next, ok := schedule.NextAttempt(0, now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(day), next)
+
+	next, ok = schedule.NextAttempt(1, now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(3*day), next)
+
+	_, ok = schedule.NextAttempt(2, now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// runs update with the saved state of the fake payment gateway and saves the state it returns. The
+// row stays locked meanwhile, so the api and the website change the fake's objects one at a time
+func (m *DBModel) UpdateFakeGatewayState(update func(state []byte) ([]byte, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var state []byte
+	err = tx.QueryRowContext(ctx, `select state from fake_gateway_state where id = 1 for update`).Scan(&state)
+	if err != nil {
+		return err
+	}
+
+	updated, err := update(state)
+	if err != nil {
+		return err
+	}
+
+	// most calls only read
+	if !bytes.Equal(state, updated) {
+		_, err = tx.ExecContext(ctx, `
+			update fake_gateway_state set state = ?, updated_at = ? where id = 1
+		`, updated, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	// how long a stored response can be replayed
+	idempotencyKeyTTL = 24 * time.Hour
+	// after this a request that never finished is considered abandoned
+	idempotencyLockTimeout = time.Minute
+)
+
+var (
+	ErrIdempotencyInProgress = errors.New("a request with this idempotency key is in progress")
+	ErrIdempotencyMismatch   = errors.New("idempotency key was used with a different request")
+)
+
+// type for stored responses of idempotent requests
+type IdempotencyKey struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	Key          string    `json:"idempotency_key"`
+	Route        string    `json:"route"`
+	RequestHash  string    `json:"request_hash"`
+	Completed    bool      `json:"completed"`
+	StatusCode   int       `json:"status_code"`
+	ResponseBody string    `json:"response_body"`
+	LockedAt     time.Time `json:"locked_at"`
+	CreatedAt    time.Time `json:"-"`
+	UpdatedAt    time.Time `json:"-"`
+}
+
+// claims idempotency key for a request, returns stored key when its response can be replayed
+// and nil when the caller should handle the request
+func (m *DBModel) StartIdempotentRequest(userID int, key, route, requestHash string) (*IdempotencyKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		delete from idempotency_keys
+		where user_id = ? and idempotency_key = ? and route = ? and created_at < ?
+	`, userID, key, route, time.Now().Add(-idempotencyKeyTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.DB.ExecContext(ctx, `
+		insert ignore into idempotency_keys
+			(user_id, idempotency_key, route, request_hash, locked_at, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
+	`, userID, key, route, requestHash, time.Now(), time.Now(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows > 0 {
+		return nil, nil
+	}
+
+	var k IdempotencyKey
+	var body sql.NullString
+
+	err = m.DB.QueryRowContext(ctx, `
+		select
+			id, user_id, idempotency_key, route, request_hash, completed,
+			status_code, response_body, locked_at, created_at, updated_at
+		from
+			idempotency_keys
+		where
+			user_id = ? and idempotency_key = ? and route = ?
+	`, userID, key, route).Scan(
+		&k.ID,
+		&k.UserID,
+		&k.Key,
+		&k.Route,
+		&k.RequestHash,
+		&k.Completed,
+		&k.StatusCode,
+		&body,
+		&k.LockedAt,
+		&k.CreatedAt,
+		&k.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	k.ResponseBody = body.String
+
+	if k.RequestHash != requestHash {
+		return nil, ErrIdempotencyMismatch
+	}
+
+	if k.Completed {
+		return &k, nil
+	}
+
+	if time.Since(k.LockedAt) < idempotencyLockTimeout {
+		return nil, ErrIdempotencyInProgress
+	}
+
+	// take over abandoned request, only one of concurrent retries wins
+	result, err = m.DB.ExecContext(ctx, `
+		update idempotency_keys set locked_at = ?, updated_at = ?
+		where id = ? and completed = 0 and locked_at = ?
+	`, time.Now(), time.Now(), k.ID, k.LockedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, ErrIdempotencyInProgress
+	}
+
+	return nil, nil
+}
+
+// stores response of idempotent request for replays
+func (m *DBModel) CompleteIdempotentRequest(userID int, key, route string, statusCode int, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update idempotency_keys
+		set completed = 1, status_code = ?, response_body = ?, updated_at = ?
+		where user_id = ? and idempotency_key = ? and route = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, statusCode, string(body), time.Now(), userID, key, route)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// forgets idempotency key so the request can be retried
+func (m *DBModel) DeleteIdempotentRequest(userID int, key, route string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `delete from idempotency_keys where user_id = ? and idempotency_key = ? and route = ?`
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key, route)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,380 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ReservationPending   = "pending"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+const (
+	MovementSale = "sale"
+)
+
+var (
+	ErrOutOfStock = errors.New("not enough stock")
+	ErrNoItems    = errors.New("payment intent has no items")
+)
+
+// type for stock held for a payment that is not confirmed yet
+type InventoryReservation struct {
+	ID        int       `json:"id"`
+	WidgetID  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	Reference string    `json:"reference"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// type for ledger entries of stock changes
+type InventoryMovement struct {
+	ID        int       `json:"id"`
+	WidgetID  int       `json:"widget_id"`
+	Change    int       `json:"change"`
+	Balance   int       `json:"balance"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+	Widget    Widget    `json:"widget"`
+}
+
+// reserves quantities keyed by widget id for ttl, returns reservation reference
+func (m *DBModel) ReserveInventory(quantities map[int]int, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reference, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	reference = "res_" + reference
+
+	// lock widgets in a stable order so concurrent checkouts cannot deadlock
+	widgetIDs := make([]int, 0, len(quantities))
+	for id := range quantities {
+		widgetIDs = append(widgetIDs, id)
+	}
+	sort.Ints(widgetIDs)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, widgetID := range widgetIDs {
+		quantity := quantities[widgetID]
+		if quantity <= 0 {
+			continue
+		}
+
+		var level int
+		err = tx.QueryRowContext(ctx, `select inventory_level from widgets where id = ? for update`, widgetID).Scan(&level)
+		if err != nil {
+			return "", err
+		}
+
+		var reserved int
+		err = tx.QueryRowContext(ctx, `
+			select coalesce(sum(quantity), 0)
+			from inventory_reservations
+			where widget_id = ? and status = ? and expires_at > ?
+		`, widgetID, ReservationPending, time.Now()).Scan(&reserved)
+		if err != nil {
+			return "", err
+		}
+
+		if level-reserved < quantity {
+			return "", fmt.Errorf("%w for widget %d", ErrOutOfStock, widgetID)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into inventory_reservations
+				(widget_id, quantity, reference, status, expires_at, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?)
+		`,
+			widgetID,
+			quantity,
+			reference,
+			ReservationPending,
+			time.Now().Add(ttl),
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return reference, nil
+}
+
+// renames reservation, used once the payment intent or subscription id is known
+func (m *DBModel) UpdateReservationReference(reference, newReference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update inventory_reservations set reference = ?, updated_at = ? where reference = ?`
+
+	_, err := m.DB.ExecContext(ctx, query, newReference, time.Now(), reference)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// takes reserved stock out of inventory and records it in the ledger
+func (m *DBModel) CommitReservation(reference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// released and expired reservations are committed too, the payment went through after all
+	rows, err := tx.QueryContext(ctx, `
+		select id, widget_id, quantity
+		from inventory_reservations
+		where reference = ? and status <> ?
+		order by widget_id
+		for update
+	`, reference, ReservationCommitted)
+	if err != nil {
+		return err
+	}
+
+	var reservations []InventoryReservation
+	for rows.Next() {
+		var r InventoryReservation
+		if err = rows.Scan(&r.ID, &r.WidgetID, &r.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		reservations = append(reservations, r)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range reservations {
+		if err = insertMovement(ctx, tx, r.WidgetID, -r.Quantity, MovementSale, reference); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `update inventory_reservations set status = ?, updated_at = ? where id = ?`,
+			ReservationCommitted, time.Now(), r.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// changes widget stock and records ledger entry within an open db transaction
+func insertMovement(ctx context.Context, tx *sql.Tx, widgetID, change int, reason, reference string) error {
+	_, err := tx.ExecContext(ctx, `update widgets set inventory_level = inventory_level + ?, updated_at = ? where id = ?`,
+		change, time.Now(), widgetID)
+	if err != nil {
+		return err
+	}
+
+	var balance int
+	err = tx.QueryRowContext(ctx, `select inventory_level from widgets where id = ?`, widgetID).Scan(&balance)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into inventory_movements
+			(widget_id, quantity_change, balance, reason, reference, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
+	`,
+		widgetID,
+		change,
+		balance,
+		reason,
+		reference,
+		time.Now(),
+		time.Now(),
+	)
+
+	return err
+}
+
+// gives pending reserved stock back
+func (m *DBModel) ReleaseReservation(reference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update inventory_reservations set status = ?, updated_at = ? where reference = ? and status = ?`
+
+	_, err := m.DB.ExecContext(ctx, query, ReservationReleased, time.Now(), reference, ReservationPending)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// marks pending reservations past their ttl expired, returns number of expired rows
+func (m *DBModel) ExpireReservations() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update inventory_reservations set status = ?, updated_at = ? where status = ? and expires_at <= ?`
+
+	result, err := m.DB.ExecContext(ctx, query, ReservationExpired, time.Now(), ReservationPending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// gets page of inventory ledger, newest first
+func (m *DBModel) GetInventoryMovements(pageSize, page int) ([]*InventoryMovement, int, int, error) {
+	if err := checkPage(pageSize, page); err != nil {
+		return nil, 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	var movements []*InventoryMovement
+
+	query := `
+		select
+			im.id, im.widget_id, im.quantity_change, im.balance, im.reason, im.reference,
+			im.created_at, im.updated_at, w.id, w.name
+		from
+			inventory_movements im
+			left join widgets w on (im.widget_id = w.id)
+		order by
+			im.id desc
+		limit ? offset ?
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, pageSize, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var im InventoryMovement
+		err = rows.Scan(
+			&im.ID,
+			&im.WidgetID,
+			&im.Change,
+			&im.Balance,
+			&im.Reason,
+			&im.Reference,
+			&im.CreatedAt,
+			&im.UpdatedAt,
+			&im.Widget.ID,
+			&im.Widget.Name,
+		)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		movements = append(movements, &im)
+	}
+
+	var totalRecords int
+	countRow := m.DB.QueryRowContext(ctx, `select count(id) from inventory_movements`)
+	if err = countRow.Scan(&totalRecords); err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := pageCount(totalRecords, pageSize)
+
+	return movements, lastPage, totalRecords, nil
+}
+
+// encodes widget quantities for payment intent metadata, e.g. "1:2,3:1"
+func EncodeQuantities(quantities map[int]int) string {
+	widgetIDs := make([]int, 0, len(quantities))
+	for id := range quantities {
+		widgetIDs = append(widgetIDs, id)
+	}
+	sort.Ints(widgetIDs)
+
+	lines := make([]string, 0, len(widgetIDs))
+	for _, id := range widgetIDs {
+		lines = append(lines, fmt.Sprintf("%d:%d", id, quantities[id]))
+	}
+
+	return strings.Join(lines, ",")
+}
+
+// decodes widget quantities from payment intent metadata
+func DecodeQuantities(s string) (map[int]int, error) {
+	quantities := make(map[int]int)
+
+	for _, line := range strings.Split(s, ",") {
+		id, quantity, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid item %q", line)
+		}
+
+		widgetID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := strconv.Atoi(quantity)
+		if err != nil {
+			return nil, err
+		}
+
+		quantities[widgetID] += q
+	}
+
+	return quantities, nil
+}
+
+// reads widget quantities checkout recorded in payment intent metadata, ErrNoItems for
+// intents not created by checkout
+func QuantitiesFromMetadata(metadata map[string]string) (map[int]int, error) {
+	if items := metadata["items"]; items != "" {
+		return DecodeQuantities(items)
+	}
+
+	// intents created before items were recorded
+	if productID, err := strconv.Atoi(metadata["product_id"]); err == nil {
+		return map[int]int{productID: 1}, nil
+	}
+
+	return nil, ErrNoItems
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EncodeQuantities(t *testing.T) {
+	assert.Equal(t, "1:2,3:1,12:5", EncodeQuantities(map[int]int{12: 5, 3: 1, 1: 2}))
+	assert.Equal(t, "", EncodeQuantities(nil))
+}
+
+func Test_DecodeQuantities(t *testing.T) {
+	quantities, err := DecodeQuantities("1:2,3:1,1:1")
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]int{1: 3, 3: 1}, quantities)
+
+	quantities, err = DecodeQuantities(EncodeQuantities(map[int]int{4: 2, 2: 7}))
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]int{4: 2, 2: 7}, quantities)
+
+	for _, s := range []string{"", "1", "a:1", "1:b", "1:2,"} {
+		_, err = DecodeQuantities(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func Test_QuantitiesFromMetadata(t *testing.T) {
+	quantities, err := QuantitiesFromMetadata(map[string]string{"items": "2:3", "product_id": "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]int{2: 3}, quantities)
+
+	// intents created before items were recorded
+	quantities, err = QuantitiesFromMetadata(map[string]string{"product_id": "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]int{1: 1}, quantities)
+
+	_, err = QuantitiesFromMetadata(map[string]string{"cart": "abc"})
+	assert.ErrorIs(t, err, ErrNoItems)
+
+	_, err = QuantitiesFromMetadata(map[string]string{"items": "2"})
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, ErrNoItems)
+}
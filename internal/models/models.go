@@ -5,12 +5,42 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"go-stripe/internal/currency"
+	"go-stripe/internal/money"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrAmountMismatch = errors.New("payment amount does not match order")
+	// the stripe webhook and the browser both record a payment, the second one gets this
+	ErrPaymentRecorded = errors.New("payment intent is already recorded")
+	ErrInvalidPage     = errors.New("page and page size must be at least 1")
+)
+
+// checks page and page size of a paginated query
+func checkPage(pageSize, page int) error {
+	if pageSize < 1 || page < 1 {
+		return ErrInvalidPage
+	}
+	return nil
+}
+
+// returns number of pages of pageSize holding totalRecords, the last one may be partly filled
+func pageCount(totalRecords, pageSize int) int {
+	return (totalRecords + pageSize - 1) / pageSize
+}
+
+// reports whether err is mysql refusing a row that breaks a unique index
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
 // type for database connection values
 type DBModel struct {
 	DB *sql.DB
@@ -23,32 +53,117 @@ type Models struct {
 
 // type for all widgets
 type Widget struct {
-	ID             int       `json:"id"`
-	Name           string    `json:"name"`
-	Description    string    `json:"description"`
-	InventoryLevel int       `json:"inventory_level"`
-	Price          int       `json:"price"`
-	Image          string    `json:"image"`
-	IsRecurring    bool      `json:"is_recurring"`
-	PlanID         string    `json:"plan_id"`
-	CreatedAt      time.Time `json:"-"`
-	UpdatedAt      time.Time `json:"-"`
-}
-
-// type for all orders
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	InventoryLevel int    `json:"inventory_level"`
+	// price in the default currency
+	Price money.Money `json:"price"`
+	// price in each currency the widget is sold in keyed by currency code
+	Prices          map[string]money.Money `json:"prices"`
+	Image           string                 `json:"image"`
+	IsRecurring     bool                   `json:"is_recurring"`
+	PlanID          string                 `json:"plan_id"`
+	BillingInterval string                 `json:"billing_interval"`
+	IntervalCount   int                    `json:"interval_count"`
+	Tier            int                    `json:"tier"`
+	TrialDays       int                    `json:"trial_days"`
+	TaxCategory     string                 `json:"tax_category"`
+	CreatedAt       time.Time              `json:"-"`
+	UpdatedAt       time.Time              `json:"-"`
+}
+
+// type for all orders, totals are derived from order items
 type Order struct {
 	ID            int         `json:"id"`
-	WidgetID      int         `json:"widget_id"`
 	TransactionID int         `json:"transaction_id"`
 	CustomerID    int         `json:"customer_id"`
 	StatusID      int         `json:"status_id"`
 	Quantity      int         `json:"quantity"`
-	Amount        int         `json:"amount"`
-	CreatedAt     time.Time   `json:"-"`
-	UpdatedAt     time.Time   `json:"-"`
-	Widget        Widget      `json:"widget"`
-	Transaction   Transaction `json:"transaction"`
-	Customer      Customer    `json:"customer"`
+	Subtotal      money.Money `json:"subtotal"`
+	Discount      money.Money `json:"discount"`
+	Tax           money.Money `json:"tax"`
+	Amount        money.Money `json:"amount"`
+	Refunded      money.Money `json:"refunded"`
+	// billing details the order was taxed for
+	Billing       BillingDetails `json:"billing"`
+	ReverseCharge bool           `json:"reverse_charge"`
+	// copies of the addresses the order was placed with, nil when none was given
+	BillingAddress  *Address      `json:"billing_address,omitempty"`
+	ShippingAddress *Address      `json:"shipping_address,omitempty"`
+	CreatedAt       time.Time     `json:"-"`
+	UpdatedAt       time.Time     `json:"-"`
+	Items           []*OrderItem  `json:"items"`
+	Refunds         []*Refund     `json:"refunds"`
+	Transaction     Transaction   `json:"transaction"`
+	Customer        Customer      `json:"customer"`
+	Subscription    *Subscription `json:"subscription,omitempty"`
+}
+
+// type for order lines
+type OrderItem struct {
+	ID        int         `json:"id"`
+	OrderID   int         `json:"order_id"`
+	WidgetID  int         `json:"widget_id"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+	Discount  money.Money `json:"discount"`
+	Tax       money.Money `json:"tax"`
+	// tax rate in basis points, tax is a part of the price when it is included
+	TaxRate     int         `json:"tax_rate"`
+	TaxIncluded bool        `json:"tax_included"`
+	Amount      money.Money `json:"amount"`
+	Widget      Widget      `json:"widget"`
+	CreatedAt   time.Time   `json:"-"`
+	UpdatedAt   time.Time   `json:"-"`
+}
+
+// returns line total before discount and tax
+func (i *OrderItem) Subtotal() money.Money {
+	return i.UnitPrice.Mul(int64(i.Quantity))
+}
+
+// returns line total after discount and tax
+func (i *OrderItem) Total() (money.Money, error) {
+	if i.TaxIncluded {
+		return i.Subtotal().Sub(i.Discount)
+	}
+
+	return money.Sum(i.Subtotal(), i.Discount.Neg(), i.Tax)
+}
+
+// sets currency of line amounts read from order_items, they are in the currency of the order's transaction
+func (i *OrderItem) setCurrency(code string) {
+	i.UnitPrice = i.UnitPrice.In(code)
+	i.Discount = i.Discount.In(code)
+	i.Tax = i.Tax.In(code)
+	i.Amount = i.Amount.In(code)
+}
+
+// sums order lines into order totals
+func (o *Order) calculateTotals() error {
+	var totals Order
+
+	for _, item := range o.Items {
+		var err error
+		totals.Quantity += item.Quantity
+		if totals.Subtotal, err = totals.Subtotal.Add(item.Subtotal()); err != nil {
+			return err
+		}
+		if totals.Discount, err = totals.Discount.Add(item.Discount); err != nil {
+			return err
+		}
+		if totals.Tax, err = totals.Tax.Add(item.Tax); err != nil {
+			return err
+		}
+		if totals.Amount, err = totals.Amount.Add(item.Amount); err != nil {
+			return err
+		}
+	}
+
+	o.Quantity, o.Subtotal, o.Discount, o.Tax, o.Amount = totals.Quantity, totals.Subtotal, totals.Discount, totals.Tax, totals.Amount
+
+	return nil
 }
 
 // type for all order statuses
@@ -69,39 +184,50 @@ type TransactionStatus struct {
 
 // type for all transactions
 type Transaction struct {
-	ID                  int       `json:"id"`
-	Amount              int       `json:"amount"`
-	Currency            string    `json:"currency"`
-	LastFour            string    `json:"last_four"`
-	ExpiryMonth         int       `json:"expiry_month"`
-	ExpiryYear          int       `json:"expiry_year"`
-	BankReturnCode      string    `json:"bank_return_code"`
-	TransactionStatusID int       `json:"transaction_status_id"`
-	PaymentIntent       string    `json:"payment_intent"`
-	PaymentMethod       string    `json:"payment_method"`
-	CreatedAt           time.Time `json:"-"`
-	UpdatedAt           time.Time `json:"-"`
+	ID                  int         `json:"id"`
+	Amount              money.Money `json:"amount"`
+	LastFour            string      `json:"last_four"`
+	ExpiryMonth         int         `json:"expiry_month"`
+	ExpiryYear          int         `json:"expiry_year"`
+	BankReturnCode      string      `json:"bank_return_code"`
+	TransactionStatusID int         `json:"transaction_status_id"`
+	PaymentIntent       string      `json:"payment_intent"`
+	PaymentMethod       string      `json:"payment_method"`
+	CreatedAt           time.Time   `json:"-"`
+	UpdatedAt           time.Time   `json:"-"`
 }
 
 // type for all users
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	// ids of roles whose permissions the user has
+	Roles []int `json:"roles"`
+	// whether the user logs in with a code too, and whether one of their roles requires it
+	TwoFactorEnabled  bool `json:"two_factor_enabled"`
+	TwoFactorRequired bool `json:"two_factor_required"`
+	// set while too many failed logins keep the user out
+	LockedUntil *time.Time `json:"locked_until"`
+	CreatedAt   time.Time  `json:"-"`
+	UpdatedAt   time.Time  `json:"-"`
 }
 
-// type for all customers
+// type for all customers, password is only set once the customer registers
 type Customer struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Password  string `json:"-"`
+	// locale amounts are written in for the customer, e.g. "de-DE"
+	Locale string `json:"locale"`
+	// stripe customer the customer's cards are saved for, empty until they save one
+	StripeCustomerID string    `json:"-"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
 }
 
 // returns a model type with database connection pool
@@ -122,7 +248,8 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 
 	row := m.DB.QueryRowContext(ctx, `
 		SELECT
-			id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id, created_at, updated_at
+			id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
+			billing_interval, interval_count, tier, trial_days, tax_category, created_at, updated_at
 		FROM
 			widgets
 		WHERE id = ?
@@ -136,30 +263,49 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 		&widget.Image,
 		&widget.IsRecurring,
 		&widget.PlanID,
+		&widget.BillingInterval,
+		&widget.IntervalCount,
+		&widget.Tier,
+		&widget.TrialDays,
+		&widget.TaxCategory,
 		&widget.CreatedAt,
 		&widget.UpdatedAt,
 	); err != nil {
 		fmt.Println(err)
 		return widget, err
 	}
+	widget.Price = widget.Price.In(currency.Default)
+
+	prices, err := m.widgetPrices(ctx, widget.ID)
+	if err != nil {
+		return widget, err
+	}
+	widget.Prices = prices[widget.ID]
 
 	return widget, nil
 }
 
-// inserts a new tx and returns its id
+// inserts a new tx and returns its id, ErrPaymentRecorded when its payment intent is already recorded
 func (m *DBModel) InsertTransaction(tx Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertTransaction(ctx, m.DB, tx)
+}
+
+// inserts tx on db or within an open db transaction and returns its id
+func insertTransaction(ctx context.Context, db interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, tx Transaction) (int, error) {
 	query := `
 		INSERT INTO transactions
 			(amount, currency, last_four, expiry_month, expiry_year, bank_return_code, transaction_status_id, payment_intent, payment_method, created_at, updated_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, query,
+	result, err := db.ExecContext(ctx, query,
 		tx.Amount,
-		tx.Currency,
+		tx.Amount.Currency(),
 		tx.LastFour,
 		tx.ExpiryMonth,
 		tx.ExpiryYear,
@@ -170,85 +316,297 @@ func (m *DBModel) InsertTransaction(tx Transaction) (int, error) {
 		time.Now(),
 		time.Now(),
 	)
+	// payment intents are unique, see transactions.payment_intent_key
+	if isDuplicateEntry(err) {
+		return 0, ErrPaymentRecorded
+	}
 	if err != nil {
-		fmt.Println(err)
 		return 0, err
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		fmt.Println(err)
 		return 0, err
 	}
 
 	return int(id), nil
 }
 
-// inserts a new order and returns its id
+// inserts a new order with its items and returns its id
 func (m *DBModel) InsertOrder(order Order) (int, error) {
+	if len(order.Items) == 0 {
+		return 0, errors.New("order has no items")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	id, err := insertOrder(ctx, tx, order)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// inserts transaction and the order it pays together and returns the order id, ErrPaymentRecorded
+// when the payment intent of the transaction is already recorded
+func (m *DBModel) InsertOrderWithTransaction(txn Transaction, order Order) (int, error) {
+	if len(order.Items) == 0 {
+		return 0, errors.New("order has no items")
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	order.TransactionID, err = insertTransaction(ctx, tx, txn)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := insertOrder(ctx, tx, order)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// inserts order with its items and addresses within an open db transaction and returns its id
+func insertOrder(ctx context.Context, tx *sql.Tx, order Order) (int, error) {
 	query := `
 		INSERT INTO orders
-			(widget_id, transaction_id, status_id, quantity, customer_id, amount, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			(transaction_id, status_id, customer_id, billing_country, billing_region, vat_id, reverse_charge, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, query,
-		order.WidgetID,
+	result, err := tx.ExecContext(ctx, query,
 		order.TransactionID,
 		order.StatusID,
-		order.Quantity,
 		order.CustomerID,
-		order.Amount,
+		order.Billing.Country,
+		order.Billing.Region,
+		order.Billing.VATID,
+		order.ReverseCharge,
 		time.Now(),
 		time.Now(),
 	)
 	if err != nil {
-		fmt.Println(err)
 		return 0, err
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		fmt.Println(err)
+		return 0, err
+	}
+
+	if err = insertOrderItems(ctx, tx, int(id), order.Items); err != nil {
+		return 0, fmt.Errorf("insert order items: %w", err)
+	}
+
+	if err = insertOrderAddresses(ctx, tx, int(id), order); err != nil {
 		return 0, err
 	}
 
 	return int(id), nil
 }
 
-// inserts a new customer and returns its id
-func (m *DBModel) InsertCustomer(c Customer) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
+// inserts order lines within an open db transaction
+func insertOrderItems(ctx context.Context, tx *sql.Tx, orderID int, items []*OrderItem) error {
 	query := `
-		INSERT INTO customers
-			(first_name, last_name, email, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?)
+		insert into order_items
+			(order_id, widget_id, quantity, unit_price, discount, tax, tax_rate, tax_included, amount, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, query,
-		c.FirstName,
-		c.LastName,
-		c.Email,
-		time.Now(),
-		time.Now(),
-	)
-	if err != nil {
-		fmt.Println(err)
-		return 0, err
+	for _, item := range items {
+		total, err := item.Total()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, query,
+			orderID,
+			item.WidgetID,
+			item.Quantity,
+			item.UnitPrice,
+			item.Discount,
+			item.Tax,
+			item.TaxRate,
+			item.TaxIncluded,
+			total,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
 	}
 
-	id, err := result.LastInsertId()
+	return nil
+}
+
+// loads items for given orders and derives their totals
+func (m *DBModel) loadOrderItems(ctx context.Context, orders ...*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Order, len(orders))
+	args := make([]any, 0, len(orders))
+	for _, o := range orders {
+		byID[o.ID] = o
+		args = append(args, o.ID)
+	}
+
+	query := fmt.Sprintf(`
+		select
+			oi.id, oi.order_id, oi.widget_id, oi.quantity, oi.unit_price,
+			oi.discount, oi.tax, oi.tax_rate, oi.tax_included, oi.amount, oi.created_at, oi.updated_at,
+			w.id, w.name, w.description, w.price, w.is_recurring, w.plan_id,
+			w.billing_interval, w.interval_count, w.tier, w.tax_category
+		from
+			order_items oi
+			inner join widgets w on (oi.widget_id = w.id)
+		where
+			oi.order_id in (%s)
+		order by
+			oi.id
+	`, strings.TrimSuffix(strings.Repeat("?, ", len(orders)), ", "))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		fmt.Println(err)
-		return 0, err
+		return err
 	}
+	defer rows.Close()
 
-	return int(id), nil
+	for rows.Next() {
+		var i OrderItem
+		err = rows.Scan(
+			&i.ID,
+			&i.OrderID,
+			&i.WidgetID,
+			&i.Quantity,
+			&i.UnitPrice,
+			&i.Discount,
+			&i.Tax,
+			&i.TaxRate,
+			&i.TaxIncluded,
+			&i.Amount,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.ID,
+			&i.Widget.Name,
+			&i.Widget.Description,
+			&i.Widget.Price,
+			&i.Widget.IsRecurring,
+			&i.Widget.PlanID,
+			&i.Widget.BillingInterval,
+			&i.Widget.IntervalCount,
+			&i.Widget.Tier,
+			&i.Widget.TaxCategory,
+		)
+		if err != nil {
+			return err
+		}
+		i.Widget.Price = i.Widget.Price.In(currency.Default)
+
+		if o, ok := byID[i.OrderID]; ok {
+			i.setCurrency(o.Transaction.Amount.Currency())
+			o.Items = append(o.Items, &i)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		if err = o.calculateTotals(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prices widget quantities keyed by widget id from current widget prices in currency
+func (m *DBModel) PriceOrder(quantities map[int]int, code string) (Order, error) {
+	var order Order
+
+	if len(quantities) == 0 {
+		return order, errors.New("order has no items")
+	}
+
+	widgetIDs := make([]int, 0, len(quantities))
+	for id := range quantities {
+		widgetIDs = append(widgetIDs, id)
+	}
+	sort.Ints(widgetIDs)
+
+	for _, widgetID := range widgetIDs {
+		quantity := quantities[widgetID]
+		if quantity <= 0 {
+			return order, fmt.Errorf("invalid quantity %d for widget %d", quantity, widgetID)
+		}
+
+		widget, err := m.GetWidget(widgetID)
+		if err != nil {
+			return order, err
+		}
+
+		price, err := widget.PriceIn(code)
+		if err != nil {
+			return order, err
+		}
+
+		item := &OrderItem{
+			WidgetID:  widget.ID,
+			Quantity:  quantity,
+			UnitPrice: price,
+			Widget:    widget,
+		}
+		if item.Amount, err = item.Total(); err != nil {
+			return order, err
+		}
+
+		order.Items = append(order.Items, item)
+	}
+
+	return order, order.calculateTotals()
+}
+
+// checks that captured amount matches order total
+func (o *Order) CheckAmount(amount money.Money) error {
+	if !amount.Equal(o.Amount) {
+		return fmt.Errorf("%w: paid %s, expected %s", ErrAmountMismatch, amount, o.Amount)
+	}
+
+	return nil
 }
 
 // gets user by email
@@ -285,6 +643,15 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 
 }
 
+// bcrypt hash of a random password nobody knows, checked when no user has an email so logins
+// take as long whether there is a user or not
+const noUserPasswordHash = "$2a$12$vL7T6q8o5u4YuW.tOGa/yeUAcJESsImIBjWsNZR/dIMah/hKEHwL6"
+
+// takes the time checking password of a user would, for logins of emails without a user
+func SpendPasswordCheck(password string) {
+	_ = bcrypt.CompareHashAndPassword([]byte(noUserPasswordHash), []byte(password))
+}
+
 func (m *DBModel) Authenticate(email, password string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -296,6 +663,7 @@ func (m *DBModel) Authenticate(email, password string) (int, error) {
 
 	err := row.Scan(&id, &hashedPass)
 	if err != nil {
+		SpendPasswordCheck(password)
 		return id, err
 	}
 
@@ -332,18 +700,20 @@ func (m *DBModel) GetAllOrders(pageSize, page int) ([]*Order, int, int, error) {
 
 	query := `
 		select
-			o.id, o.widget_id, o.transaction_id, o.customer_id,
-			o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
-			w.id, w.name, t.id, t.amount, t.currency, t.last_four,
+			o.id, o.transaction_id, o.customer_id,
+			o.status_id, o.created_at, o.updated_at,
+			t.id, t.amount, t.currency, t.last_four,
 			t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
 			c.id, c.first_name, c.last_name, c.email
 		from
 			orders o
-			left join widgets w on (o.widget_id = w.id)
 			left join transactions t on (o.transaction_id = t.id)
 			left join customers c on (o.customer_id = c.id)
 		where
-			w.is_recurring = 0
+			exists (
+				select oi.id from order_items oi inner join widgets w on (oi.widget_id = w.id)
+				where oi.order_id = o.id and w.is_recurring = 0
+			)
 		order by
 			o.created_at desc
 		limit ? offset ?
@@ -359,19 +729,14 @@ func (m *DBModel) GetAllOrders(pageSize, page int) ([]*Order, int, int, error) {
 		var o Order
 		err = rows.Scan(
 			&o.ID,
-			&o.WidgetID,
 			&o.TransactionID,
 			&o.CustomerID,
 			&o.StatusID,
-			&o.Quantity,
-			&o.Amount,
 			&o.CreatedAt,
 			&o.UpdatedAt,
-			&o.Widget.ID,
-			&o.Widget.Name,
 			&o.Transaction.ID,
 			&o.Transaction.Amount,
-			&o.Transaction.Currency,
+			o.Transaction.Amount.CurrencyColumn(),
 			&o.Transaction.LastFour,
 			&o.Transaction.ExpiryMonth,
 			&o.Transaction.ExpiryYear,
@@ -389,12 +754,22 @@ func (m *DBModel) GetAllOrders(pageSize, page int) ([]*Order, int, int, error) {
 		orders = append(orders, &o)
 	}
 
+	if err = m.loadOrderItems(ctx, orders...); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err = m.loadSubscriptions(ctx, orders...); err != nil {
+		return nil, 0, 0, err
+	}
+
 	query = `
 		select count(o.id)
 		from orders o
-		left join widgets w on (o.widget_id = w.id)
 		where
-			w.is_recurring = 0
+			exists (
+				select oi.id from order_items oi inner join widgets w on (oi.widget_id = w.id)
+				where oi.order_id = o.id and w.is_recurring = 0
+			)
 	`
 
 	var totalRecords int
@@ -420,18 +795,20 @@ func (m *DBModel) GetAllSubscriptions(pageSize, page int) ([]*Order, int, int, e
 
 	query := `
 		select
-			o.id, o.widget_id, o.transaction_id, o.customer_id,
-			o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
-			w.id, w.name, t.id, t.amount, t.currency, t.last_four,
+			o.id, o.transaction_id, o.customer_id,
+			o.status_id, o.created_at, o.updated_at,
+			t.id, t.amount, t.currency, t.last_four,
 			t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
 			c.id, c.first_name, c.last_name, c.email
 		from
 			orders o
-			left join widgets w on (o.widget_id = w.id)
 			left join transactions t on (o.transaction_id = t.id)
 			left join customers c on (o.customer_id = c.id)
 		where
-			w.is_recurring = 1
+			exists (
+				select oi.id from order_items oi inner join widgets w on (oi.widget_id = w.id)
+				where oi.order_id = o.id and w.is_recurring = 1
+			)
 		order by
 			o.created_at desc
 		limit ? offset ?
@@ -447,19 +824,14 @@ func (m *DBModel) GetAllSubscriptions(pageSize, page int) ([]*Order, int, int, e
 		var o Order
 		err = rows.Scan(
 			&o.ID,
-			&o.WidgetID,
 			&o.TransactionID,
 			&o.CustomerID,
 			&o.StatusID,
-			&o.Quantity,
-			&o.Amount,
 			&o.CreatedAt,
 			&o.UpdatedAt,
-			&o.Widget.ID,
-			&o.Widget.Name,
 			&o.Transaction.ID,
 			&o.Transaction.Amount,
-			&o.Transaction.Currency,
+			o.Transaction.Amount.CurrencyColumn(),
 			&o.Transaction.LastFour,
 			&o.Transaction.ExpiryMonth,
 			&o.Transaction.ExpiryYear,
@@ -477,12 +849,22 @@ func (m *DBModel) GetAllSubscriptions(pageSize, page int) ([]*Order, int, int, e
 		orders = append(orders, &o)
 	}
 
+	if err = m.loadOrderItems(ctx, orders...); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err = m.loadSubscriptions(ctx, orders...); err != nil {
+		return nil, 0, 0, err
+	}
+
 	query = `
 		select count(o.id)
 		from orders o
-		left join widgets w on (o.widget_id = w.id)
 		where
-			w.is_recurring = 1
+			exists (
+				select oi.id from order_items oi inner join widgets w on (oi.widget_id = w.id)
+				where oi.order_id = o.id and w.is_recurring = 1
+			)
 	`
 
 	var totalRecords int
@@ -507,14 +889,14 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 
 	query := `
 		select
-			o.id, o.widget_id, o.transaction_id, o.customer_id,
-			o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
-			w.id, w.name, t.id, t.amount, t.currency, t.last_four,
+			o.id, o.transaction_id, o.customer_id,
+			o.status_id, o.billing_country, o.billing_region, o.vat_id, o.reverse_charge,
+			o.created_at, o.updated_at,
+			t.id, t.amount, t.currency, t.last_four,
 			t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
-			c.id, c.first_name, c.last_name, c.email
+			c.id, c.first_name, c.last_name, c.email, c.locale
 		from
 			orders o
-			left join widgets w on (o.widget_id = w.id)
 			left join transactions t on (o.transaction_id = t.id)
 			left join customers c on (o.customer_id = c.id)
 		where
@@ -525,19 +907,18 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 
 	err := row.Scan(
 		&o.ID,
-		&o.WidgetID,
 		&o.TransactionID,
 		&o.CustomerID,
 		&o.StatusID,
-		&o.Quantity,
-		&o.Amount,
+		&o.Billing.Country,
+		&o.Billing.Region,
+		&o.Billing.VATID,
+		&o.ReverseCharge,
 		&o.CreatedAt,
 		&o.UpdatedAt,
-		&o.Widget.ID,
-		&o.Widget.Name,
 		&o.Transaction.ID,
 		&o.Transaction.Amount,
-		&o.Transaction.Currency,
+		o.Transaction.Amount.CurrencyColumn(),
 		&o.Transaction.LastFour,
 		&o.Transaction.ExpiryMonth,
 		&o.Transaction.ExpiryYear,
@@ -547,12 +928,36 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 		&o.Customer.FirstName,
 		&o.Customer.LastName,
 		&o.Customer.Email,
+		&o.Customer.Locale,
 	)
 
 	if err != nil {
 		return o, err
 	}
 
+	if err = m.loadOrderItems(ctx, &o); err != nil {
+		return o, err
+	}
+
+	if err = m.loadOrderAddresses(ctx, &o); err != nil {
+		return o, err
+	}
+
+	if err = m.loadSubscriptions(ctx, &o); err != nil {
+		return o, err
+	}
+
+	o.Refunds, err = m.getRefundsForOrder(ctx, o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	for _, r := range o.Refunds {
+		if o.Refunded, err = o.Refunded.Add(r.Amount); err != nil {
+			return o, err
+		}
+	}
+
 	return o, nil
 }
 
@@ -570,6 +975,108 @@ func (m *DBModel) UpdateOrderStatus(orderID, statusID int) error {
 	return nil
 }
 
+// gets transaction by payment intent or subscription id
+func (m *DBModel) GetTransactionByPaymentIntent(pi string) (Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t Transaction
+
+	query := `
+		select
+			id, amount, currency, last_four, expiry_month, expiry_year,
+			bank_return_code, transaction_status_id, payment_intent, payment_method,
+			created_at, updated_at
+		from
+			transactions
+		where
+			payment_intent = ?
+		order by
+			id desc
+		limit 1
+	`
+
+	row := m.DB.QueryRowContext(ctx, query, pi)
+
+	err := row.Scan(
+		&t.ID,
+		&t.Amount,
+		t.Amount.CurrencyColumn(),
+		&t.LastFour,
+		&t.ExpiryMonth,
+		&t.ExpiryYear,
+		&t.BankReturnCode,
+		&t.TransactionStatusID,
+		&t.PaymentIntent,
+		&t.PaymentMethod,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+
+	if err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// updates status of transactions for payment intent or subscription id, returns number of updated rows
+func (m *DBModel) UpdateTransactionStatusByPaymentIntent(pi string, statusID int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update transactions set transaction_status_id = ?, updated_at = ? where payment_intent = ?`
+
+	result, err := m.DB.ExecContext(ctx, query, statusID, time.Now(), pi)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// updates card on transactions paid by payment intent or subscription id
+func (m *DBModel) UpdateTransactionPaymentMethod(pi string, t Transaction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update transactions
+		set payment_method = ?, last_four = ?, expiry_month = ?, expiry_year = ?, updated_at = ?
+		where payment_intent = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, t.PaymentMethod, t.LastFour, t.ExpiryMonth, t.ExpiryYear, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// updates status of orders paid by payment intent or subscription id
+func (m *DBModel) UpdateOrderStatusByPaymentIntent(pi string, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update
+			orders o
+			inner join transactions t on (o.transaction_id = t.id)
+		set
+			o.status_id = ?, o.updated_at = ?
+		where
+			t.payment_intent = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, statusID, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (m *DBModel) GetAllUsers() ([]*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -622,24 +1129,42 @@ func (m *DBModel) GetUserByID(id int) (User, error) {
 
 	query := `
 		select
-			id, last_name, first_name, email, created_at, updated_at
+			u.id, u.last_name, u.first_name, u.email, u.totp_enabled, ` + twoFactorRequiredSQL + `,
+			(
+				select max(t.locked_until) from auth_throttles t
+				where t.scope = ? and t.kind = ? and t.throttle_key = lower(u.email) and t.locked_until > ?
+			),
+			u.created_at, u.updated_at
 		from
-			users
+			users u
 		where
-			id = ?
+			u.id = ?
 	`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	var lockedUntil sql.NullTime
+	row := m.DB.QueryRowContext(ctx, query, ThrottleLogin, ThrottleAccount, time.Now(), id)
 
 	err := row.Scan(
 		&u.ID,
 		&u.LastName,
 		&u.FirstName,
 		&u.Email,
+		&u.TwoFactorEnabled,
+		&u.TwoFactorRequired,
+		&lockedUntil,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
 
+	if err != nil {
+		return u, err
+	}
+
+	if lockedUntil.Valid {
+		u.LockedUntil = &lockedUntil.Time
+	}
+
+	u.Roles, err = m.GetUserRoles(u.ID)
 	if err != nil {
 		return u, err
 	}
@@ -673,7 +1198,8 @@ func (m *DBModel) EditUser(u User) error {
 	return nil
 }
 
-func (m *DBModel) AddUser(u User, hash string) error {
+// inserts user, returns id of the new user
+func (m *DBModel) AddUser(u User, hash string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -681,7 +1207,7 @@ func (m *DBModel) AddUser(u User, hash string) error {
 		insert into users (first_name, last_name, email, password, created_at, updated_at)
 		values (?, ?, ?, ?, ?, ?)
 	`
-	_, err := m.DB.ExecContext(ctx, query,
+	result, err := m.DB.ExecContext(ctx, query,
 		u.FirstName,
 		u.LastName,
 		u.Email,
@@ -690,19 +1216,33 @@ func (m *DBModel) AddUser(u User, hash string) error {
 		time.Now(),
 	)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
 }
 
+// deletes user with their tokens and roles, ErrLastUserManager when nobody would be left to manage users
 func (m *DBModel) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
 	query := `
 		delete from users where id = ?
 	`
-	_, err := m.DB.ExecContext(ctx, query, id)
+	_, err = tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -710,10 +1250,14 @@ func (m *DBModel) DeleteUser(id int) error {
 	query = `
 		delete from tokens where user_id = ?
 	`
-	_, err = m.DB.ExecContext(ctx, query, id)
+	_, err = tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if err = checkUserManagers(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
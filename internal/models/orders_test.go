@@ -0,0 +1,77 @@
+package models
+
+import (
+	"fmt"
+	"go-stripe/internal/money"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+// returns amount in euro cents
+func eur(amount int64) money.Money {
+	m, _ := money.New(amount, "eur")
+	return m
+}
+
+func Test_OrderTotals(t *testing.T) {
+	items := []*OrderItem{
+		{Quantity: 2, UnitPrice: eur(1000), Discount: eur(200), Tax: eur(100)},
+		{Quantity: 1, UnitPrice: eur(1500)},
+	}
+	for _, item := range items {
+		item.Amount, _ = item.Total()
+	}
+
+	assert.Equal(t, eur(1900), items[0].Amount)
+	assert.Equal(t, eur(1500), items[1].Amount)
+
+	order := Order{Items: items}
+	assert.NoError(t, order.calculateTotals())
+
+	assert.Equal(t, 3, order.Quantity)
+	assert.Equal(t, eur(3500), order.Subtotal)
+	assert.Equal(t, eur(200), order.Discount)
+	assert.Equal(t, eur(100), order.Tax)
+	assert.Equal(t, eur(3400), order.Amount)
+
+	usd, _ := money.New(100, "usd")
+	order.Items = append(order.Items, &OrderItem{Quantity: 1, UnitPrice: usd, Amount: usd})
+	assert.ErrorIs(t, order.calculateTotals(), money.ErrCurrencyMismatch)
+}
+
+func Test_OrderCheckAmount(t *testing.T) {
+	order := Order{Amount: eur(2500)}
+
+	assert.NoError(t, order.CheckAmount(eur(2500)))
+	assert.ErrorIs(t, order.CheckAmount(eur(1)), ErrAmountMismatch)
+
+	// same amount in another currency doesn't pay for the order
+	usd, _ := money.New(2500, "usd")
+	assert.ErrorIs(t, order.CheckAmount(usd), ErrAmountMismatch)
+}
+
+func Test_IsDuplicateEntry(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'pi_1' for key 'transactions_payment_intent_key_idx'"}
+
+	assert.True(t, isDuplicateEntry(duplicate))
+	assert.True(t, isDuplicateEntry(fmt.Errorf("insert transaction: %w", duplicate)))
+	assert.False(t, isDuplicateEntry(&mysql.MySQLError{Number: 1452}))
+	assert.False(t, isDuplicateEntry(nil))
+}
+
+func Test_PageCount(t *testing.T) {
+	assert.Equal(t, 0, pageCount(0, 10))
+	assert.Equal(t, 1, pageCount(1, 10))
+	assert.Equal(t, 1, pageCount(10, 10))
+	assert.Equal(t, 2, pageCount(11, 10))
+	assert.Equal(t, 3, pageCount(21, 10))
+}
+
+func Test_CheckPage(t *testing.T) {
+	assert.Nil(t, checkPage(10, 1))
+	assert.ErrorIs(t, checkPage(0, 1), ErrInvalidPage)
+	assert.ErrorIs(t, checkPage(10, 0), ErrInvalidPage)
+	assert.ErrorIs(t, checkPage(-1, -1), ErrInvalidPage)
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-stripe/internal/currency"
+	"time"
+)
+
+// billing intervals of recurring widgets, same as stripe price intervals
+const (
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
+var ErrNotAPlan = errors.New("widget is not a subscription plan")
+
+// returns billing period for display, e.g. "month" or "3 months"
+func (w Widget) BillingPeriod() string {
+	interval := w.BillingInterval
+	if interval == "" {
+		interval = IntervalMonth
+	}
+
+	if w.IntervalCount <= 1 {
+		return interval
+	}
+
+	return fmt.Sprintf("%d %ss", w.IntervalCount, interval)
+}
+
+// returns plan price spread over a year, used to compare plans with different intervals
+func (w Widget) yearlyPrice() int64 {
+	count := w.IntervalCount
+	if count < 1 {
+		count = 1
+	}
+
+	var perYear int64
+	switch w.BillingInterval {
+	case IntervalDay:
+		perYear = 365
+	case IntervalWeek:
+		perYear = 52
+	case IntervalYear:
+		perYear = 1
+	default:
+		perYear = 12
+	}
+
+	return w.Price.Amount() * perYear / int64(count)
+}
+
+// reports whether switching from current plan to w is an upgrade,
+// higher tiers are upgrades, within a tier the more expensive plan is
+func (w Widget) IsUpgradeFrom(current Widget) bool {
+	if w.Tier != current.Tier {
+		return w.Tier > current.Tier
+	}
+
+	return w.yearlyPrice() > current.yearlyPrice()
+}
+
+// gets all subscription plans, cheapest tier first
+func (m *DBModel) GetPlans() ([]*Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var plans []*Widget
+
+	query := `
+		select
+			id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
+			billing_interval, interval_count, tier, trial_days, tax_category, created_at, updated_at
+		from
+			widgets
+		where
+			is_recurring = 1 and plan_id <> ''
+		order by
+			tier, price, id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var w Widget
+		err = rows.Scan(
+			&w.ID,
+			&w.Name,
+			&w.Description,
+			&w.InventoryLevel,
+			&w.Price,
+			&w.Image,
+			&w.IsRecurring,
+			&w.PlanID,
+			&w.BillingInterval,
+			&w.IntervalCount,
+			&w.Tier,
+			&w.TrialDays,
+			&w.TaxCategory,
+			&w.CreatedAt,
+			&w.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		w.Price = w.Price.In(currency.Default)
+		plans = append(plans, &w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(plans))
+	for i, p := range plans {
+		ids[i] = p.ID
+	}
+
+	prices, err := m.widgetPrices(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range plans {
+		p.Prices = prices[p.ID]
+	}
+
+	return plans, nil
+}
+
+// gets subscription plan by widget id
+func (m *DBModel) GetPlan(id int) (Widget, error) {
+	plan, err := m.GetWidget(id)
+	if err != nil {
+		return plan, err
+	}
+
+	if !plan.IsRecurring || plan.PlanID == "" {
+		return plan, ErrNotAPlan
+	}
+
+	return plan, nil
+}
+
+// moves subscription order to another plan, its line is repriced at the plan price in the order's currency
+// and taxed at the rate the order was taxed at
+func (m *DBModel) ChangeOrderPlan(orderID int, plan Widget, code string) error {
+	price, err := plan.PriceIn(code)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update order_items
+		set
+			widget_id = ?,
+			unit_price = ?,
+			tax = round((? * quantity - discount) * tax_rate / if(tax_included, 10000 + tax_rate, 10000)),
+			amount = ? * quantity - discount + if(tax_included, 0, tax),
+			updated_at = ?
+		where order_id = ?
+	`
+
+	// assignments are evaluated left to right, the amount adds the new tax
+	_, err = m.DB.ExecContext(ctx, query, plan.ID, price, price, price, time.Now(), orderID)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `update orders set updated_at = ? where id = ?`, time.Now(), orderID)
+
+	return err
+}
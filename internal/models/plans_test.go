@@ -0,0 +1,24 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BillingPeriod(t *testing.T) {
+	assert.Equal(t, "month", Widget{}.BillingPeriod())
+	assert.Equal(t, "year", Widget{BillingInterval: IntervalYear, IntervalCount: 1}.BillingPeriod())
+	assert.Equal(t, "3 months", Widget{BillingInterval: IntervalMonth, IntervalCount: 3}.BillingPeriod())
+}
+
+func Test_IsUpgradeFrom(t *testing.T) {
+	bronze := Widget{Tier: 1, Price: eur(2000), BillingInterval: IntervalMonth, IntervalCount: 1}
+	bronzeYearly := Widget{Tier: 1, Price: eur(20000), BillingInterval: IntervalYear, IntervalCount: 1}
+	silver := Widget{Tier: 2, Price: eur(1500), BillingInterval: IntervalMonth, IntervalCount: 1}
+
+	assert.True(t, silver.IsUpgradeFrom(bronze))
+	assert.False(t, bronze.IsUpgradeFrom(silver))
+	assert.False(t, bronzeYearly.IsUpgradeFrom(bronze))
+	assert.True(t, bronze.IsUpgradeFrom(bronzeYearly))
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-stripe/internal/currency"
+	"go-stripe/internal/money"
+	"strings"
+)
+
+var ErrNoPrice = errors.New("widget has no price in this currency")
+
+// returns price of widget in currency, widgets without a price list
+// are only sold at their price in the default currency
+func (w Widget) PriceIn(code string) (money.Money, error) {
+	code = strings.ToLower(code)
+
+	if price, ok := w.Prices[code]; ok {
+		return price, nil
+	}
+
+	if code == currency.Default && len(w.Prices) == 0 {
+		return w.Price, nil
+	}
+
+	return money.Money{}, fmt.Errorf("%w: %s is not sold in %s", ErrNoPrice, w.Name, strings.ToUpper(code))
+}
+
+// gets price lists of widgets keyed by widget id and currency
+func (m *DBModel) widgetPrices(ctx context.Context, widgetIDs ...int) (map[int]map[string]money.Money, error) {
+	prices := make(map[int]map[string]money.Money)
+	if len(widgetIDs) == 0 {
+		return prices, nil
+	}
+
+	args := make([]any, len(widgetIDs))
+	for i, id := range widgetIDs {
+		args[i] = id
+	}
+
+	query := `
+		select widget_id, currency, amount
+		from widget_prices
+		where widget_id in (?` + strings.Repeat(", ?", len(widgetIDs)-1) + `)
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var widgetID int
+		var price money.Money
+		if err = rows.Scan(&widgetID, price.CurrencyColumn(), &price); err != nil {
+			return nil, err
+		}
+
+		if prices[widgetID] == nil {
+			prices[widgetID] = make(map[string]money.Money)
+		}
+		prices[widgetID][price.Currency()] = price
+	}
+
+	return prices, rows.Err()
+}
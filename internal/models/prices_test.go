@@ -0,0 +1,28 @@
+package models
+
+import (
+	"go-stripe/internal/money"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WidgetPriceIn(t *testing.T) {
+	jpy := eur(1500).In("jpy")
+	w := Widget{Name: "Widget", Price: eur(1000), Prices: map[string]money.Money{"eur": eur(1000), "jpy": jpy}}
+
+	price, err := w.PriceIn("JPY")
+	assert.NoError(t, err)
+	assert.Equal(t, jpy, price)
+
+	_, err = w.PriceIn("usd")
+	assert.ErrorIs(t, err, ErrNoPrice)
+
+	// widgets without a price list are sold in the default currency only
+	price, err = Widget{Price: eur(2000)}.PriceIn("eur")
+	assert.NoError(t, err)
+	assert.Equal(t, eur(2000), price)
+
+	_, err = Widget{Price: eur(2000)}.PriceIn("gbp")
+	assert.ErrorIs(t, err, ErrNoPrice)
+}
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+)
+
+const (
+	// how long a login's access token lasts, it is refreshed before then
+	AccessTokenTTL = 15 * time.Minute
+	// how long a login lasts without being used, every refresh starts it again
+	RefreshTokenTTL = 7 * 24 * time.Hour
+	// how long after a refresh token is used it may be used again, by a tab that refreshed at the
+	// same moment, without the family being revoked
+	RefreshTokenReuseGrace = 10 * time.Second
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is not valid")
+	// a refresh token was used twice, it has probably been stolen
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// type for refresh tokens, each is used once for a new access token and refresh token of the same
+// family. A family is one login, all of it is revoked when a used token comes back
+type RefreshToken struct {
+	ID        int       `json:"-"`
+	PlainText string    `json:"token"`
+	UserID    int       `json:"-"`
+	Family    string    `json:"-"`
+	Hash      []byte    `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// returns random string of n bytes, base32 encoded
+func randomString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// generates refresh token of family, a new family when family is empty
+func GenerateRefreshToken(userID int, family string) (*RefreshToken, error) {
+	var err error
+	if family == "" {
+		family, err = randomString(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// longer than access tokens, so one is never mistaken for the other
+	plainText, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(plainText))
+
+	return &RefreshToken{
+		PlainText: plainText,
+		UserID:    userID,
+		Family:    family,
+		Hash:      hash[:],
+		Expiry:    time.Now().Add(RefreshTokenTTL),
+	}, nil
+}
+
+// saves access token t of a login with refresh token rt, which starts its family
+func (m *DBModel) InsertLoginTokens(t *Token, rt *RefreshToken, u User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	t.Family = rt.Family
+	if err = insertToken(ctx, tx, t, u); err != nil {
+		return err
+	}
+
+	if err = insertRefreshToken(ctx, tx, rt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// inserts refresh token within an open db transaction, clearing expired ones of the user
+func insertRefreshToken(ctx context.Context, tx *sql.Tx, rt *RefreshToken) error {
+	_, err := tx.ExecContext(ctx, `
+		delete from refresh_tokens where user_id = ? and expiry < ?
+	`, rt.UserID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		insert into refresh_tokens (user_id, family, token_hash, expiry, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)
+	`, rt.UserID, rt.Family, rt.Hash, rt.Expiry, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rt.ID = int(id)
+
+	return nil
+}
+
+// swaps refresh token for a new access token named name and a new refresh token of the same family,
+// the family's previous access token is revoked. A refresh token used before revokes the whole
+// family and fails with ErrRefreshTokenReused, unless it was used within RefreshTokenReuseGrace.
+// Unknown or expired ones fail with ErrRefreshTokenInvalid
+func (m *DBModel) RotateRefreshToken(plainText, name string) (*Token, *RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	hash := sha256.Sum256([]byte(plainText))
+
+	var old RefreshToken
+	var usedAt sql.NullTime
+	var u User
+	err = tx.QueryRowContext(ctx, `
+		select
+			rt.id, rt.user_id, rt.family, rt.expiry, rt.used_at, u.id, u.email
+		from
+			refresh_tokens rt
+			inner join users u on (rt.user_id = u.id)
+		where
+			rt.token_hash = ?
+		for update
+	`, hash[:]).Scan(&old.ID, &old.UserID, &old.Family, &old.Expiry, &usedAt, &u.ID, &u.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// used again within the grace it comes from a tab that refreshed at the same moment, the tab
+	// that refreshed first keeps the tokens it got
+	reused := usedAt.Valid
+	if reused && !withinReuseGrace(usedAt.Time, time.Now()) {
+		if err = revokeTokenFamily(ctx, tx, old.Family); err != nil {
+			return nil, nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	if old.Expiry.Before(time.Now()) {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+
+	if !reused {
+		// used tokens are kept until the family expires, to tell when one is used again
+		_, err = tx.ExecContext(ctx, `
+			update refresh_tokens set used_at = ?, updated_at = ? where id = ?
+		`, time.Now(), time.Now(), old.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from tokens where family = ?`, old.Family)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	t, err := GenerateToken(u.ID, AccessTokenTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.Name = name
+	t.Family = old.Family
+
+	if err = insertToken(ctx, tx, t, u); err != nil {
+		return nil, nil, err
+	}
+
+	rt, err := GenerateRefreshToken(u.ID, old.Family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = insertRefreshToken(ctx, tx, rt); err != nil {
+		return nil, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return t, rt, nil
+}
+
+// reports whether refresh token used at usedAt may still be used again at now
+func withinReuseGrace(usedAt, now time.Time) bool {
+	return now.Sub(usedAt) <= RefreshTokenReuseGrace
+}
+
+// deletes the access and refresh tokens of family, within an open db transaction
+func revokeTokenFamily(ctx context.Context, tx *sql.Tx, family string) error {
+	if _, err := tx.ExecContext(ctx, `delete from tokens where family = ?`, family); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `delete from refresh_tokens where family = ?`, family)
+
+	return err
+}
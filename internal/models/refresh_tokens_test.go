@@ -0,0 +1,40 @@
+package models
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GenerateRefreshToken(t *testing.T) {
+	rt, err := GenerateRefreshToken(1, "")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rt.Family)
+	assert.Len(t, rt.PlainText, 52)
+
+	hash := sha256.Sum256([]byte(rt.PlainText))
+	assert.Equal(t, hash[:], rt.Hash)
+
+	// rotated tokens stay in their family
+	next, err := GenerateRefreshToken(1, rt.Family)
+	assert.NoError(t, err)
+	assert.Equal(t, rt.Family, next.Family)
+	assert.NotEqual(t, rt.PlainText, next.PlainText)
+
+	other, err := GenerateRefreshToken(1, "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, rt.Family, other.Family)
+}
+
+func Test_WithinReuseGrace(t *testing.T) {
+	usedAt := time.Date(2022, 12, 11, 12, 0, 0, 0, time.UTC)
+
+	// a tab refreshing at the same moment gets tokens too
+	assert.True(t, withinReuseGrace(usedAt, usedAt))
+	assert.True(t, withinReuseGrace(usedAt, usedAt.Add(RefreshTokenReuseGrace)))
+
+	// later it is a stolen token
+	assert.False(t, withinReuseGrace(usedAt, usedAt.Add(RefreshTokenReuseGrace+time.Second)))
+}
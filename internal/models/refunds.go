@@ -0,0 +1,237 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"go-stripe/internal/money"
+	"time"
+)
+
+// order statuses, ids of the rows in statuses
+const (
+	OrderStatusCleared           = 1
+	OrderStatusRefunded          = 2
+	OrderStatusCancelled         = 3
+	OrderStatusPartiallyRefunded = 4
+)
+
+// transaction statuses
+const (
+	TransactionStatusPending           = 1
+	TransactionStatusCleared           = 2
+	TransactionStatusDeclined          = 3
+	TransactionStatusRefunded          = 4
+	TransactionStatusPartiallyRefunded = 5
+)
+
+// type for refunds issued against an order
+type Refund struct {
+	ID             int         `json:"id"`
+	OrderID        int         `json:"order_id"`
+	TransactionID  int         `json:"transaction_id"`
+	UserID         int         `json:"user_id"`
+	StripeRefundID string      `json:"stripe_refund_id"`
+	Amount         money.Money `json:"amount"`
+	Reason         string      `json:"reason"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"-"`
+	User           User        `json:"user"`
+}
+
+// records refund and moves order and transaction to partially refunded or refunded
+func (m *DBModel) InsertRefund(refund Refund) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var captured money.Money
+	err = tx.QueryRowContext(ctx, `select amount, currency from transactions where id = ? for update`, refund.TransactionID).
+		Scan(&captured, captured.CurrencyColumn())
+	if err != nil {
+		return err
+	}
+
+	// refunds made on the stripe dashboard only know their payment intent
+	if refund.OrderID == 0 {
+		err = tx.QueryRowContext(ctx, `select id from orders where transaction_id = ?`, refund.TransactionID).Scan(&refund.OrderID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var userID sql.NullInt64
+	if refund.UserID > 0 {
+		userID = sql.NullInt64{Int64: int64(refund.UserID), Valid: true}
+	}
+
+	// stripe webhooks may record the same refund, the admin who issued it wins
+	_, err = tx.ExecContext(ctx, `
+		insert into refunds
+			(order_id, transaction_id, user_id, stripe_refund_id, amount, reason, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)
+		on duplicate key update
+			user_id = coalesce(values(user_id), user_id),
+			reason = if(values(reason) = '', reason, values(reason)),
+			updated_at = values(updated_at)
+	`,
+		refund.OrderID,
+		refund.TransactionID,
+		userID,
+		refund.StripeRefundID,
+		refund.Amount,
+		refund.Reason,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	var refunded money.Money
+	err = tx.QueryRowContext(ctx, `select coalesce(sum(amount), 0) from refunds where transaction_id = ?`, refund.TransactionID).Scan(&refunded)
+	if err != nil {
+		return err
+	}
+	// refunds are in the currency of their transaction
+	refunded = refunded.In(captured.Currency())
+
+	if err = updateRefundStatuses(ctx, tx, refund.TransactionID, captured, refunded); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sets order and transaction statuses from refunded total
+func updateRefundStatuses(ctx context.Context, tx *sql.Tx, transactionID int, captured, refunded money.Money) error {
+	if !refunded.IsPositive() {
+		return nil
+	}
+
+	c, err := refunded.Cmp(captured)
+	if err != nil {
+		return err
+	}
+
+	txStatus, orderStatus := TransactionStatusPartiallyRefunded, OrderStatusPartiallyRefunded
+	if c >= 0 {
+		txStatus, orderStatus = TransactionStatusRefunded, OrderStatusRefunded
+	}
+
+	_, err = tx.ExecContext(ctx, `update transactions set transaction_status_id = ?, updated_at = ? where id = ?`,
+		txStatus, time.Now(), transactionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update orders set status_id = ?, updated_at = ? where transaction_id = ?`,
+		orderStatus, time.Now(), transactionID)
+
+	return err
+}
+
+// sets refund statuses for payment intent from total refunded as reported by stripe
+func (m *DBModel) UpdateRefundStatusByPaymentIntent(pi string, refunded money.Money) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	rows, err := tx.QueryContext(ctx, `select id, amount, currency from transactions where payment_intent = ? for update`, pi)
+	if err != nil {
+		return err
+	}
+
+	var transactions []Transaction
+	for rows.Next() {
+		var t Transaction
+		if err = rows.Scan(&t.ID, &t.Amount, t.Amount.CurrencyColumn()); err != nil {
+			rows.Close()
+			return err
+		}
+		transactions = append(transactions, t)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, t := range transactions {
+		if err = updateRefundStatuses(ctx, tx, t.ID, t.Amount, refunded); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// gets refunds for order, oldest first
+func (m *DBModel) getRefundsForOrder(ctx context.Context, orderID int) ([]*Refund, error) {
+	var refunds []*Refund
+
+	query := `
+		select
+			r.id, r.order_id, r.transaction_id, coalesce(r.user_id, 0), r.stripe_refund_id,
+			r.amount, t.currency, r.reason, r.created_at, r.updated_at,
+			coalesce(u.first_name, ''), coalesce(u.last_name, ''), coalesce(u.email, '')
+		from
+			refunds r
+			inner join transactions t on (r.transaction_id = t.id)
+			left join users u on (r.user_id = u.id)
+		where
+			r.order_id = ?
+		order by
+			r.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Refund
+		err = rows.Scan(
+			&r.ID,
+			&r.OrderID,
+			&r.TransactionID,
+			&r.UserID,
+			&r.StripeRefundID,
+			&r.Amount,
+			r.Amount.CurrencyColumn(),
+			&r.Reason,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+			&r.User.FirstName,
+			&r.User.LastName,
+			&r.User.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		r.User.ID = r.UserID
+		refunds = append(refunds, &r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return refunds, nil
+}
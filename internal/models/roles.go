@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// permissions admin users are granted through their roles, names are kept in the permissions table
+const (
+	PermViewSales           = "sales.view"
+	PermRefund              = "sales.refund"
+	PermManageSubscriptions = "subscriptions.manage"
+	PermVirtualTerminal     = "terminal.charge"
+	PermViewInventory       = "inventory.view"
+	PermManageCustomers     = "customers.manage"
+	PermManageCoupons       = "coupons.manage"
+	PermManageTaxRates      = "tax_rates.manage"
+	PermManageUsers         = "users.manage"
+)
+
+var ErrLastUserManager = errors.New("at least one user must keep a role that manages users")
+
+// type for permissions of a role or everything a user's roles grant
+type Permissions []string
+
+// reports whether permission is one of p
+func (p Permissions) Has(permission string) bool {
+	for _, name := range p {
+		if name == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// type for roles admin users are given, e.g. support or finance
+type Role struct {
+	ID          int         `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	// users with the role must log in with a code too
+	RequireTwoFactor bool      `json:"require_two_factor"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
+}
+
+// gets all roles with their permissions
+func (m *DBModel) GetRoles() ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select id, name, description, require_two_factor, created_at, updated_at
+		from roles
+		order by id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	byID := make(map[int]*Role)
+	for rows.Next() {
+		var r Role
+		if err = rows.Scan(&r.ID, &r.Name, &r.Description, &r.RequireTwoFactor, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		roles = append(roles, &r)
+		byID[r.ID] = &r
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+		select rp.role_id, p.name
+		from role_permissions rp
+			left join permissions p on (rp.permission_id = p.id)
+		order by p.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roleID int
+		var name string
+		if err = rows.Scan(&roleID, &name); err != nil {
+			return nil, err
+		}
+		if r, ok := byID[roleID]; ok {
+			r.Permissions = append(r.Permissions, name)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// gets ids of roles of user
+func (m *DBModel) GetUserRoles(userID int) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select role_id from user_roles where user_id = ? order by role_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		roles = append(roles, id)
+	}
+
+	return roles, rows.Err()
+}
+
+// gets everything the roles of user grant, none for users without a role
+func (m *DBModel) GetUserPermissions(userID int) (Permissions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select distinct p.name
+		from user_roles ur
+			left join role_permissions rp on (ur.role_id = rp.role_id)
+			left join permissions p on (rp.permission_id = p.id)
+		where ur.user_id = ? and p.name is not null
+		order by p.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, name)
+	}
+
+	return permissions, rows.Err()
+}
+
+// replaces roles of user, ErrLastUserManager when nobody would be left to manage users
+func (m *DBModel) SetUserRoles(userID int, roleIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.ExecContext(ctx, `delete from user_roles where user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	for _, roleID := range roleIDs {
+		_, err = tx.ExecContext(ctx, `
+			insert ignore into user_roles (user_id, role_id, created_at, updated_at)
+			values (?, ?, ?, ?)
+		`, userID, roleID, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = checkUserManagers(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// fails with ErrLastUserManager when no user is left who can manage users, so admins can't lock
+// everyone out, within an open db transaction
+func checkUserManagers(ctx context.Context, tx *sql.Tx) error {
+	var count int
+	err := tx.QueryRowContext(ctx, `
+		select count(distinct ur.user_id)
+		from user_roles ur
+			left join role_permissions rp on (ur.role_id = rp.role_id)
+			left join permissions p on (rp.permission_id = p.id)
+		where p.name = ?
+	`, PermManageUsers).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrLastUserManager
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PermissionsHas(t *testing.T) {
+	support := Permissions{PermViewSales, PermViewInventory, PermManageCustomers}
+
+	assert.True(t, support.Has(PermViewSales))
+	assert.False(t, support.Has(PermRefund))
+	assert.False(t, support.Has(""))
+
+	// users without a role can't do anything
+	var none Permissions
+	assert.False(t, none.Has(PermViewSales))
+}
@@ -0,0 +1,347 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// subscription statuses, same as stripe subscription statuses
+const (
+	SubscriptionStatusIncomplete        = "incomplete"
+	SubscriptionStatusIncompleteExpired = "incomplete_expired"
+	SubscriptionStatusTrialing          = "trialing"
+	SubscriptionStatusActive            = "active"
+	SubscriptionStatusPastDue           = "past_due"
+	SubscriptionStatusUnpaid            = "unpaid"
+	SubscriptionStatusCanceled          = "canceled"
+)
+
+// type for billing state of subscription order as last seen on stripe
+type Subscription struct {
+	ID                   int        `json:"id"`
+	OrderID              int        `json:"order_id"`
+	StripeSubscriptionID string     `json:"stripe_subscription_id"`
+	Status               string     `json:"status"`
+	CurrentPeriodStart   *time.Time `json:"current_period_start"`
+	CurrentPeriodEnd     *time.Time `json:"current_period_end"`
+	CancelAtPeriodEnd    bool       `json:"cancel_at_period_end"`
+	CancelAt             *time.Time `json:"cancel_at"`
+	CanceledAt           *time.Time `json:"canceled_at"`
+	LatestInvoice        string     `json:"latest_invoice"`
+	LatestInvoiceStatus  string     `json:"latest_invoice_status"`
+	SyncedAt             time.Time  `json:"synced_at"`
+	CreatedAt            time.Time  `json:"-"`
+	UpdatedAt            time.Time  `json:"-"`
+}
+
+// reports whether subscription has ended for good
+func (s Subscription) Ended() bool {
+	return s.Status == SubscriptionStatusCanceled || s.Status == SubscriptionStatusIncompleteExpired
+}
+
+// returns nullable time for unix timestamp, zero means not set
+func unixTime(ts int64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+
+	t := time.Unix(ts, 0)
+	return &t
+}
+
+// builds subscription from stripe unix timestamps
+func NewSubscription(stripeID, status string, periodStart, periodEnd int64, cancelAtPeriodEnd bool, cancelAt, canceledAt int64) Subscription {
+	return Subscription{
+		StripeSubscriptionID: stripeID,
+		Status:               status,
+		CurrentPeriodStart:   unixTime(periodStart),
+		CurrentPeriodEnd:     unixTime(periodEnd),
+		CancelAtPeriodEnd:    cancelAtPeriodEnd,
+		CancelAt:             unixTime(cancelAt),
+		CanceledAt:           unixTime(canceledAt),
+	}
+}
+
+const subscriptionColumns = `
+	s.id, s.order_id, s.stripe_subscription_id, s.status, s.current_period_start, s.current_period_end,
+	s.cancel_at_period_end, s.cancel_at, s.canceled_at, s.latest_invoice, s.latest_invoice_status,
+	s.synced_at, s.created_at, s.updated_at
+`
+
+// scans subscription selected with subscriptionColumns
+func scanSubscription(row interface{ Scan(...any) error }) (Subscription, error) {
+	var s Subscription
+	var periodStart, periodEnd, cancelAt, canceledAt sql.NullTime
+
+	err := row.Scan(
+		&s.ID,
+		&s.OrderID,
+		&s.StripeSubscriptionID,
+		&s.Status,
+		&periodStart,
+		&periodEnd,
+		&s.CancelAtPeriodEnd,
+		&cancelAt,
+		&canceledAt,
+		&s.LatestInvoice,
+		&s.LatestInvoiceStatus,
+		&s.SyncedAt,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+	)
+
+	for _, t := range []struct {
+		src sql.NullTime
+		dst **time.Time
+	}{
+		{periodStart, &s.CurrentPeriodStart},
+		{periodEnd, &s.CurrentPeriodEnd},
+		{cancelAt, &s.CancelAt},
+		{canceledAt, &s.CanceledAt},
+	} {
+		if t.src.Valid {
+			v := t.src.Time
+			*t.dst = &v
+		}
+	}
+
+	return s, err
+}
+
+// gets subscription by stripe subscription id
+func (m *DBModel) GetSubscriptionByStripeID(stripeID string) (Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+subscriptionColumns+` from subscriptions s where s.stripe_subscription_id = ?`, stripeID)
+
+	return scanSubscription(row)
+}
+
+// stores subscription state seen on stripe at syncedAt, older snapshots than the stored one are ignored,
+// a canceled subscription cancels its order
+func (m *DBModel) SyncSubscription(s Subscription, syncedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// subscription orders keep the subscription id in their transaction
+	query := `
+		select
+			o.id
+		from
+			orders o
+			inner join transactions t on (o.transaction_id = t.id)
+		where
+			t.payment_intent = ?
+		order by
+			o.id
+		limit 1
+	`
+
+	var orderID int
+	err = tx.QueryRowContext(ctx, query, s.StripeSubscriptionID).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		// order is recorded after stripe creates the subscription, it syncs once saved
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var id int
+	var lastSynced time.Time
+	err = tx.QueryRowContext(ctx, `
+		select id, synced_at from subscriptions where stripe_subscription_id = ? for update
+	`, s.StripeSubscriptionID).Scan(&id, &lastSynced)
+
+	switch {
+	case err == sql.ErrNoRows:
+		query = `
+			insert into subscriptions
+				(order_id, stripe_subscription_id, status, current_period_start, current_period_end,
+				cancel_at_period_end, cancel_at, canceled_at, latest_invoice, latest_invoice_status,
+				synced_at, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`
+		_, err = tx.ExecContext(ctx, query,
+			orderID,
+			s.StripeSubscriptionID,
+			s.Status,
+			s.CurrentPeriodStart,
+			s.CurrentPeriodEnd,
+			s.CancelAtPeriodEnd,
+			s.CancelAt,
+			s.CanceledAt,
+			s.LatestInvoice,
+			s.LatestInvoiceStatus,
+			syncedAt,
+			time.Now(),
+			time.Now(),
+		)
+	case err != nil:
+		return err
+	case syncedAt.Before(lastSynced):
+		// stripe delivers events out of order
+		return nil
+	default:
+		query = `
+			update subscriptions set
+				status = ?, current_period_start = ?, current_period_end = ?, cancel_at_period_end = ?,
+				cancel_at = ?, canceled_at = ?,
+				latest_invoice = if(? = '', latest_invoice, ?),
+				latest_invoice_status = if(? = '', latest_invoice_status, ?),
+				synced_at = ?, updated_at = ?
+			where
+				id = ?
+		`
+		_, err = tx.ExecContext(ctx, query,
+			s.Status,
+			s.CurrentPeriodStart,
+			s.CurrentPeriodEnd,
+			s.CancelAtPeriodEnd,
+			s.CancelAt,
+			s.CanceledAt,
+			s.LatestInvoice, s.LatestInvoice,
+			s.LatestInvoiceStatus, s.LatestInvoiceStatus,
+			syncedAt,
+			time.Now(),
+			id,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.Ended() {
+		_, err = tx.ExecContext(ctx, `update orders set status_id = ?, updated_at = ? where id = ?`,
+			OrderStatusCancelled, time.Now(), orderID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// records latest invoice of subscription and whether it was paid
+func (m *DBModel) UpdateSubscriptionInvoice(stripeID, invoiceID, invoiceStatus string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update subscriptions set
+			latest_invoice = ?, latest_invoice_status = ?, updated_at = ?
+		where
+			stripe_subscription_id = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, invoiceID, invoiceStatus, time.Now(), stripeID)
+
+	return err
+}
+
+// marks subscription as ending at the end of the current period, stripe confirms it with a webhook
+func (m *DBModel) MarkSubscriptionCancelling(stripeID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update subscriptions set
+			cancel_at_period_end = 1, cancel_at = current_period_end, updated_at = ?
+		where
+			stripe_subscription_id = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), stripeID)
+
+	return err
+}
+
+// gets ids of subscriptions not synced since before, including subscription orders never synced,
+// subscriptions that ended are left alone
+func (m *DBModel) GetSubscriptionsToReconcile(before time.Time, limit int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			t.payment_intent
+		from
+			orders o
+			inner join transactions t on (o.transaction_id = t.id)
+			left join subscriptions s on (s.order_id = o.id)
+		where
+			t.payment_intent like 'sub\_%'
+			and exists (
+				select oi.id from order_items oi inner join widgets w on (oi.widget_id = w.id)
+				where oi.order_id = o.id and w.is_recurring = 1
+			)
+			and (s.id is null or (s.status not in (?, ?) and s.synced_at < ?))
+		order by
+			s.synced_at, o.id
+		limit ?
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, SubscriptionStatusCanceled, SubscriptionStatusIncompleteExpired, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// attaches subscription state to subscription orders
+func (m *DBModel) loadSubscriptions(ctx context.Context, orders ...*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Order, len(orders))
+	args := make([]any, 0, len(orders))
+	for _, o := range orders {
+		byID[o.ID] = o
+		args = append(args, o.ID)
+	}
+
+	query := fmt.Sprintf(`select `+subscriptionColumns+` from subscriptions s where s.order_id in (%s)`,
+		strings.TrimSuffix(strings.Repeat("?, ", len(orders)), ", "))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return err
+		}
+
+		if o, ok := byID[s.OrderID]; ok {
+			o.Subscription = &s
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewSubscription(t *testing.T) {
+	start := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	s := NewSubscription("sub_1", SubscriptionStatusActive, start.Unix(), end.Unix(), true, end.Unix(), 0)
+
+	assert.Equal(t, "sub_1", s.StripeSubscriptionID)
+	assert.True(t, s.CurrentPeriodStart.Equal(start))
+	assert.True(t, s.CurrentPeriodEnd.Equal(end))
+	assert.True(t, s.CancelAt.Equal(end))
+	assert.Nil(t, s.CanceledAt)
+	assert.True(t, s.CancelAtPeriodEnd)
+}
+
+func Test_SubscriptionEnded(t *testing.T) {
+	for status, ended := range map[string]bool{
+		SubscriptionStatusActive:            false,
+		SubscriptionStatusTrialing:          false,
+		SubscriptionStatusPastDue:           false,
+		SubscriptionStatusUnpaid:            false,
+		SubscriptionStatusIncomplete:        false,
+		SubscriptionStatusIncompleteExpired: true,
+		SubscriptionStatusCanceled:          true,
+	} {
+		assert.Equal(t, ended, Subscription{Status: status}.Ended(), status)
+	}
+}
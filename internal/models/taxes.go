@@ -0,0 +1,551 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-stripe/internal/money"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBillingCountry = errors.New("we don't sell to this country")
+	ErrInvalidVATID   = errors.New("VAT ID is not valid for the billing country")
+)
+
+// product tax categories of widgets, categories without a rate of their own
+// in a country are taxed at its standard rate
+const (
+	TaxCategoryStandard = "standard"
+	TaxCategoryReduced  = "reduced"
+	TaxCategoryDigital  = "digital"
+	TaxCategoryExempt   = "exempt"
+)
+
+// country the shop is established in, business customers with a VAT ID
+// in other EU countries account for the VAT themselves
+const HomeCountry = "SK"
+
+// type for countries customers can be billed in
+type Country struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	EU   bool   `json:"eu"`
+}
+
+var countries = map[string]Country{
+	"AT": {Code: "AT", Name: "Austria", EU: true},
+	"AU": {Code: "AU", Name: "Australia"},
+	"BE": {Code: "BE", Name: "Belgium", EU: true},
+	"BG": {Code: "BG", Name: "Bulgaria", EU: true},
+	"CA": {Code: "CA", Name: "Canada"},
+	"CH": {Code: "CH", Name: "Switzerland"},
+	"CY": {Code: "CY", Name: "Cyprus", EU: true},
+	"CZ": {Code: "CZ", Name: "Czechia", EU: true},
+	"DE": {Code: "DE", Name: "Germany", EU: true},
+	"DK": {Code: "DK", Name: "Denmark", EU: true},
+	"EE": {Code: "EE", Name: "Estonia", EU: true},
+	"ES": {Code: "ES", Name: "Spain", EU: true},
+	"FI": {Code: "FI", Name: "Finland", EU: true},
+	"FR": {Code: "FR", Name: "France", EU: true},
+	"GB": {Code: "GB", Name: "United Kingdom"},
+	"GR": {Code: "GR", Name: "Greece", EU: true},
+	"HR": {Code: "HR", Name: "Croatia", EU: true},
+	"HU": {Code: "HU", Name: "Hungary", EU: true},
+	"IE": {Code: "IE", Name: "Ireland", EU: true},
+	"IT": {Code: "IT", Name: "Italy", EU: true},
+	"JP": {Code: "JP", Name: "Japan"},
+	"LT": {Code: "LT", Name: "Lithuania", EU: true},
+	"LU": {Code: "LU", Name: "Luxembourg", EU: true},
+	"LV": {Code: "LV", Name: "Latvia", EU: true},
+	"MT": {Code: "MT", Name: "Malta", EU: true},
+	"NL": {Code: "NL", Name: "Netherlands", EU: true},
+	"NO": {Code: "NO", Name: "Norway"},
+	"PL": {Code: "PL", Name: "Poland", EU: true},
+	"PT": {Code: "PT", Name: "Portugal", EU: true},
+	"RO": {Code: "RO", Name: "Romania", EU: true},
+	"SE": {Code: "SE", Name: "Sweden", EU: true},
+	"SI": {Code: "SI", Name: "Slovenia", EU: true},
+	"SK": {Code: "SK", Name: "Slovakia", EU: true},
+	"US": {Code: "US", Name: "United States"},
+}
+
+// formats of EU VAT IDs after the country prefix, Greece uses EL as its prefix
+var vatIDFormats = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^U\d{8}$`),
+	"BE": regexp.MustCompile(`^[01]\d{9}$`),
+	"BG": regexp.MustCompile(`^\d{9,10}$`),
+	"CY": regexp.MustCompile(`^\d{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^\d{8,10}$`),
+	"DE": regexp.MustCompile(`^\d{9}$`),
+	"DK": regexp.MustCompile(`^\d{8}$`),
+	"EE": regexp.MustCompile(`^\d{9}$`),
+	"ES": regexp.MustCompile(`^[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^\d{8}$`),
+	"FR": regexp.MustCompile(`^[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"GR": regexp.MustCompile(`^\d{9}$`),
+	"HR": regexp.MustCompile(`^\d{11}$`),
+	"HU": regexp.MustCompile(`^\d{8}$`),
+	"IE": regexp.MustCompile(`^(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^\d{11}$`),
+	"LT": regexp.MustCompile(`^(\d{9}|\d{12})$`),
+	"LU": regexp.MustCompile(`^\d{8}$`),
+	"LV": regexp.MustCompile(`^\d{11}$`),
+	"MT": regexp.MustCompile(`^\d{8}$`),
+	"NL": regexp.MustCompile(`^\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^\d{10}$`),
+	"PT": regexp.MustCompile(`^\d{9}$`),
+	"RO": regexp.MustCompile(`^\d{2,10}$`),
+	"SE": regexp.MustCompile(`^\d{12}$`),
+	"SI": regexp.MustCompile(`^\d{8}$`),
+	"SK": regexp.MustCompile(`^\d{10}$`),
+}
+
+// currencies prices are shown with tax included in, as customers paying in them expect.
+// Prices in other currencies have tax added at checkout
+var taxInclusiveCurrencies = map[string]bool{
+	"eur": true,
+	"gbp": true,
+	"jpy": true,
+}
+
+// returns countries customers can be billed in ordered by name
+func BillingCountries() []Country {
+	all := make([]Country, 0, len(countries))
+	for _, c := range countries {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	return all
+}
+
+// reports whether prices in currency include tax
+func PricesIncludeTax(code string) bool {
+	return taxInclusiveCurrencies[strings.ToLower(code)]
+}
+
+// formats rate in basis points as a percentage, e.g. "20%" or "5.5%"
+func TaxRatePercent(rate int) string {
+	return strconv.FormatFloat(float64(rate)/100, 'f', -1, 64) + "%"
+}
+
+// type for where an order is billed, it decides the tax
+type BillingDetails struct {
+	// ISO 3166-1 alpha-2 code
+	Country string `json:"country"`
+	// ISO 3166-2 subdivision code without the country, e.g. "CN" for the Canary Islands
+	Region string `json:"region"`
+	VATID  string `json:"vat_id"`
+}
+
+// normalizes billing details and checks the country is sold to and the VAT ID fits it
+func (b *BillingDetails) Validate() error {
+	b.Country = strings.ToUpper(strings.TrimSpace(b.Country))
+	b.Region = strings.ToUpper(strings.TrimSpace(b.Region))
+	b.VATID = NormalizeVATID(b.VATID)
+
+	country, ok := countries[b.Country]
+	if !ok {
+		return ErrBillingCountry
+	}
+
+	// VAT IDs outside the EU are printed on the invoice and don't change the tax
+	if b.VATID == "" || !country.EU {
+		return nil
+	}
+
+	prefix := country.Code
+	if prefix == "GR" {
+		prefix = "EL"
+	}
+
+	format := vatIDFormats[country.Code]
+	if !strings.HasPrefix(b.VATID, prefix) || !format.MatchString(b.VATID[len(prefix):]) {
+		return ErrInvalidVATID
+	}
+
+	return nil
+}
+
+// reports whether VAT is left to the customer, a business in another EU country than the shop.
+// The VAT ID format is checked, it is not looked up in VIES
+func (b BillingDetails) ReverseCharge() bool {
+	return b.VATID != "" && countries[b.Country].EU && b.Country != HomeCountry
+}
+
+// writes billing details to payment metadata, so orders recorded from the payment are taxed the same
+func (b BillingDetails) SetMetadata(metadata map[string]string) {
+	metadata["billing_country"] = b.Country
+	metadata["billing_region"] = b.Region
+	metadata["vat_id"] = b.VATID
+}
+
+// reads billing details written by SetMetadata
+func BillingDetailsFromMetadata(metadata map[string]string) BillingDetails {
+	return BillingDetails{
+		Country: metadata["billing_country"],
+		Region:  metadata["billing_region"],
+		VATID:   metadata["vat_id"],
+	}
+}
+
+// returns VAT ID in upper case without spaces, dots and dashes
+func NormalizeVATID(id string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '.', '-':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(id)))
+}
+
+// type for tax rates by country, region and product tax category
+type TaxRate struct {
+	ID       int    `json:"id"`
+	Country  string `json:"country"`
+	Region   string `json:"region"`
+	Category string `json:"category"`
+	Name     string `json:"name"`
+	// rate in basis points, 2000 is 20%
+	Rate int `json:"rate"`
+	// stripe tax rates applied to subscriptions, created when first needed
+	StripeTaxRateID          string    `json:"-"`
+	StripeInclusiveTaxRateID string    `json:"-"`
+	CreatedAt                time.Time `json:"-"`
+	UpdatedAt                time.Time `json:"-"`
+}
+
+// normalizes tax rate and checks it can be saved
+func (r *TaxRate) Validate() error {
+	r.Country = strings.ToUpper(strings.TrimSpace(r.Country))
+	r.Region = strings.ToUpper(strings.TrimSpace(r.Region))
+	r.Category = strings.ToLower(strings.TrimSpace(r.Category))
+	r.Name = strings.TrimSpace(r.Name)
+
+	if r.Category == "" {
+		r.Category = TaxCategoryStandard
+	}
+	if r.Name == "" {
+		r.Name = "VAT"
+	}
+
+	switch {
+	case countries[r.Country].Code == "":
+		return ErrBillingCountry
+	case len(r.Region) > 10:
+		return errors.New("region must be at most 10 characters")
+	case !validTaxCategory(r.Category) || r.Category == TaxCategoryExempt:
+		return errors.New("category must be standard, reduced or digital")
+	case r.Rate < 0 || r.Rate > 10000:
+		return errors.New("rate must be between 0 and 100%")
+	}
+
+	return nil
+}
+
+// reports whether category is a product tax category
+func validTaxCategory(category string) bool {
+	switch category {
+	case TaxCategoryStandard, TaxCategoryReduced, TaxCategoryDigital, TaxCategoryExempt:
+		return true
+	}
+
+	return false
+}
+
+// returns rate for widgets of category billed in country and region, rates of the region
+// win over the country's and categories without a rate of their own use the standard one.
+// Exempt widgets and countries without rates are not taxed
+func lookupTaxRate(rates []*TaxRate, country, region, category string) (*TaxRate, bool) {
+	if category == TaxCategoryExempt {
+		return nil, false
+	}
+	if category == "" {
+		category = TaxCategoryStandard
+	}
+
+	var best *TaxRate
+	score := 0
+	for _, r := range rates {
+		if r.Country != country || (r.Region != "" && r.Region != region) {
+			continue
+		}
+		if r.Category != category && r.Category != TaxCategoryStandard {
+			continue
+		}
+
+		s := 1
+		if r.Region != "" {
+			s += 2
+		}
+		if r.Category == category {
+			s++
+		}
+		if s > score {
+			best, score = r, s
+		}
+	}
+
+	return best, best != nil
+}
+
+// returns tax of line after discount at the line's rate
+func (i *OrderItem) calculateTax() (money.Money, error) {
+	net, err := i.Subtotal().Sub(i.Discount)
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	if i.TaxIncluded {
+		return net.Portion(int64(i.TaxRate), 10000+int64(i.TaxRate)), nil
+	}
+
+	return net.Portion(int64(i.TaxRate), 10000), nil
+}
+
+// taxes order lines after discounts at the rates for billing, so coupons are applied first.
+// Lines priced with tax included keep their amount and the tax is a part of it,
+// reverse charged orders are not taxed
+func (o *Order) ApplyTax(rates []*TaxRate, billing BillingDetails) error {
+	if err := billing.Validate(); err != nil {
+		return err
+	}
+	o.Billing = billing
+	o.ReverseCharge = billing.ReverseCharge()
+
+	for _, item := range o.Items {
+		item.TaxRate = 0
+		item.TaxIncluded = PricesIncludeTax(item.UnitPrice.Currency())
+		if rate, ok := lookupTaxRate(rates, billing.Country, billing.Region, item.Widget.TaxCategory); ok && !o.ReverseCharge {
+			item.TaxRate = rate.Rate
+		}
+
+		var err error
+		if item.Tax, err = item.calculateTax(); err != nil {
+			return err
+		}
+		if item.Amount, err = item.Total(); err != nil {
+			return err
+		}
+	}
+
+	return o.calculateTotals()
+}
+
+// type for tax of an order at one rate
+type TaxLine struct {
+	// rate in basis points
+	Rate int `json:"rate"`
+	// amount the tax is on, without the tax
+	Taxable money.Money `json:"taxable"`
+	Tax     money.Money `json:"tax"`
+}
+
+// sums taxed order lines by rate, highest rate first
+func (o *Order) TaxLines() ([]TaxLine, error) {
+	var lines []TaxLine
+	byRate := make(map[int]int)
+
+	for _, item := range o.Items {
+		if item.TaxRate == 0 {
+			continue
+		}
+
+		taxable, err := item.Subtotal().Sub(item.Discount)
+		if err == nil && item.TaxIncluded {
+			taxable, err = taxable.Sub(item.Tax)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		i, ok := byRate[item.TaxRate]
+		if !ok {
+			i = len(lines)
+			byRate[item.TaxRate] = i
+			lines = append(lines, TaxLine{Rate: item.TaxRate})
+		}
+
+		if lines[i].Taxable, err = lines[i].Taxable.Add(taxable); err != nil {
+			return nil, err
+		}
+		if lines[i].Tax, err = lines[i].Tax.Add(item.Tax); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Rate > lines[j].Rate })
+
+	return lines, nil
+}
+
+const taxRateColumns = `
+	id, country, region, category, name, rate, stripe_tax_rate_id, stripe_inclusive_tax_rate_id,
+	created_at, updated_at
+`
+
+// scans tax rate selected with taxRateColumns
+func scanTaxRate(row interface{ Scan(...any) error }) (TaxRate, error) {
+	var r TaxRate
+	err := row.Scan(
+		&r.ID,
+		&r.Country,
+		&r.Region,
+		&r.Category,
+		&r.Name,
+		&r.Rate,
+		&r.StripeTaxRateID,
+		&r.StripeInclusiveTaxRateID,
+		&r.CreatedAt,
+		&r.UpdatedAt,
+	)
+
+	return r, err
+}
+
+// gets all tax rates ordered by country, region and category
+func (m *DBModel) GetTaxRates() ([]*TaxRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select `+taxRateColumns+`
+		from tax_rates
+		order by country, region, category
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []*TaxRate
+	for rows.Next() {
+		r, err := scanTaxRate(rows)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, &r)
+	}
+
+	return rates, rows.Err()
+}
+
+// gets tax rate by id
+func (m *DBModel) GetTaxRate(id int) (TaxRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+taxRateColumns+` from tax_rates where id = ?`, id)
+
+	return scanTaxRate(row)
+}
+
+// inserts tax rate and returns its id
+func (m *DBModel) InsertTaxRate(r TaxRate) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		insert into tax_rates
+			(country, region, category, name, rate, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
+	`,
+		r.Country,
+		r.Region,
+		r.Category,
+		r.Name,
+		r.Rate,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// updates name and rate of tax rate, stripe tax rates can't change so new ones are created when needed
+func (m *DBModel) UpdateTaxRate(r TaxRate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		update tax_rates
+		set name = ?, rate = ?, stripe_tax_rate_id = '', stripe_inclusive_tax_rate_id = '', updated_at = ?
+		where id = ?
+	`,
+		r.Name,
+		r.Rate,
+		time.Now(),
+		r.ID,
+	)
+
+	return err
+}
+
+// deletes tax rate, orders keep the rate they were taxed at
+func (m *DBModel) DeleteTaxRate(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from tax_rates where id = ?`, id)
+	return err
+}
+
+// saves id of stripe tax rate created for tax rate, stripe keeps inclusive and exclusive rates apart
+func (m *DBModel) SetStripeTaxRateID(id int, inclusive bool, stripeID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	column := "stripe_tax_rate_id"
+	if inclusive {
+		column = "stripe_inclusive_tax_rate_id"
+	}
+
+	_, err := m.DB.ExecContext(ctx, fmt.Sprintf(`update tax_rates set %s = ?, updated_at = ? where id = ?`, column),
+		stripeID, time.Now(), id)
+
+	return err
+}
+
+// taxes priced order for billing at the current rates
+func (m *DBModel) TaxOrder(order *Order, billing BillingDetails) error {
+	rates, err := m.GetTaxRates()
+	if err != nil {
+		return err
+	}
+
+	return order.ApplyTax(rates, billing)
+}
+
+// returns rate order lines of a widget in category billed with billing are taxed at,
+// nothing for orders that are not taxed
+func (m *DBModel) TaxRateFor(category string, billing BillingDetails) (*TaxRate, error) {
+	if err := billing.Validate(); err != nil || billing.ReverseCharge() {
+		return nil, err
+	}
+
+	rates, err := m.GetTaxRates()
+	if err != nil {
+		return nil, err
+	}
+
+	rate, ok := lookupTaxRate(rates, billing.Country, billing.Region, category)
+	if !ok || rate.Rate == 0 {
+		return nil, nil
+	}
+
+	return rate, nil
+}
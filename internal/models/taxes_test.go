@@ -0,0 +1,141 @@
+package models
+
+import (
+	"go-stripe/internal/money"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTaxRates = []*TaxRate{
+	{ID: 1, Country: "SK", Category: TaxCategoryStandard, Rate: 2000},
+	{ID: 2, Country: "SK", Category: TaxCategoryReduced, Rate: 1000},
+	{ID: 3, Country: "DE", Category: TaxCategoryStandard, Rate: 1900},
+	{ID: 4, Country: "ES", Category: TaxCategoryStandard, Rate: 2100},
+	{ID: 5, Country: "ES", Region: "CN", Category: TaxCategoryStandard, Rate: 0},
+}
+
+func Test_BillingDetailsValidate(t *testing.T) {
+	b := BillingDetails{Country: " de ", VATID: "de 123.456-789"}
+	assert.NoError(t, b.Validate())
+	assert.Equal(t, BillingDetails{Country: "DE", VATID: "DE123456789"}, b)
+	assert.True(t, b.ReverseCharge())
+
+	// Greek VAT IDs start with EL
+	assert.NoError(t, (&BillingDetails{Country: "GR", VATID: "EL123456789"}).Validate())
+
+	assert.ErrorIs(t, (&BillingDetails{Country: "XX"}).Validate(), ErrBillingCountry)
+	assert.ErrorIs(t, (&BillingDetails{Country: "DE", VATID: "FR12345678901"}).Validate(), ErrInvalidVATID)
+	assert.ErrorIs(t, (&BillingDetails{Country: "SK", VATID: "SK123"}).Validate(), ErrInvalidVATID)
+
+	// VAT IDs outside the EU are kept, they don't reverse charge
+	us := BillingDetails{Country: "US", VATID: "anything"}
+	assert.NoError(t, us.Validate())
+	assert.False(t, us.ReverseCharge())
+
+	// businesses in the shop's country pay VAT
+	sk := BillingDetails{Country: HomeCountry, VATID: "SK2020123456"}
+	assert.NoError(t, sk.Validate())
+	assert.False(t, sk.ReverseCharge())
+}
+
+func Test_LookupTaxRate(t *testing.T) {
+	rate, ok := lookupTaxRate(testTaxRates, "SK", "", TaxCategoryReduced)
+	assert.True(t, ok)
+	assert.Equal(t, 2, rate.ID)
+
+	// categories without a rate of their own use the standard one
+	rate, ok = lookupTaxRate(testTaxRates, "SK", "", TaxCategoryDigital)
+	assert.True(t, ok)
+	assert.Equal(t, 1, rate.ID)
+
+	// rates of the region win over the country's
+	rate, ok = lookupTaxRate(testTaxRates, "ES", "CN", TaxCategoryReduced)
+	assert.True(t, ok)
+	assert.Equal(t, 5, rate.ID)
+
+	rate, ok = lookupTaxRate(testTaxRates, "ES", "MD", TaxCategoryStandard)
+	assert.True(t, ok)
+	assert.Equal(t, 4, rate.ID)
+
+	_, ok = lookupTaxRate(testTaxRates, "SK", "", TaxCategoryExempt)
+	assert.False(t, ok)
+	_, ok = lookupTaxRate(testTaxRates, "US", "CA", TaxCategoryStandard)
+	assert.False(t, ok)
+}
+
+func Test_ApplyTax(t *testing.T) {
+	usd := func(amount int64) money.Money {
+		m, _ := money.New(amount, "usd")
+		return m
+	}
+
+	newOrder := func(price money.Money) Order {
+		order := Order{Items: []*OrderItem{
+			{Quantity: 2, UnitPrice: price, Widget: Widget{TaxCategory: TaxCategoryStandard}},
+			{Quantity: 1, UnitPrice: price, Widget: Widget{TaxCategory: TaxCategoryReduced}},
+		}}
+		for _, item := range order.Items {
+			item.Amount, _ = item.Total()
+		}
+		_ = order.calculateTotals()
+		return order
+	}
+
+	// euro prices include tax, customers pay the price and the tax is a part of it
+	order := newOrder(eur(1200))
+	assert.NoError(t, order.ApplyTax(testTaxRates, BillingDetails{Country: "sk"}))
+	assert.Equal(t, "SK", order.Billing.Country)
+	assert.Equal(t, eur(400), order.Items[0].Tax)
+	assert.Equal(t, eur(109), order.Items[1].Tax)
+	assert.Equal(t, eur(509), order.Tax)
+	assert.Equal(t, eur(3600), order.Amount)
+
+	lines, err := order.TaxLines()
+	assert.NoError(t, err)
+	assert.Equal(t, []TaxLine{
+		{Rate: 2000, Taxable: eur(2000), Tax: eur(400)},
+		{Rate: 1000, Taxable: eur(1091), Tax: eur(109)},
+	}, lines)
+
+	// dollar prices have tax added
+	order = newOrder(usd(1000))
+	assert.NoError(t, order.ApplyTax(testTaxRates, BillingDetails{Country: "SK"}))
+	assert.Equal(t, usd(500), order.Tax)
+	assert.Equal(t, usd(3500), order.Amount)
+
+	// tax is on the discounted price
+	order = newOrder(usd(1000))
+	assert.NoError(t, order.ApplyCoupon(Coupon{PercentOff: 10}))
+	assert.NoError(t, order.ApplyTax(testTaxRates, BillingDetails{Country: "DE"}))
+	assert.Equal(t, usd(300), order.Discount)
+	assert.Equal(t, usd(513), order.Tax)
+	assert.Equal(t, usd(3213), order.Amount)
+
+	// EU businesses abroad are reverse charged
+	order = newOrder(usd(1000))
+	assert.NoError(t, order.ApplyTax(testTaxRates, BillingDetails{Country: "DE", VATID: "DE123456789"}))
+	assert.True(t, order.ReverseCharge)
+	assert.True(t, order.Tax.IsZero())
+	assert.Equal(t, usd(3000), order.Amount)
+
+	lines, err = order.TaxLines()
+	assert.NoError(t, err)
+	assert.Empty(t, lines)
+
+	order = newOrder(eur(100))
+	assert.ErrorIs(t, order.ApplyTax(testTaxRates, BillingDetails{}), ErrBillingCountry)
+}
+
+func Test_TaxRateValidate(t *testing.T) {
+	r := TaxRate{Country: "at", Rate: 2000}
+	assert.NoError(t, r.Validate())
+	assert.Equal(t, TaxRate{Country: "AT", Category: TaxCategoryStandard, Name: "VAT", Rate: 2000}, r)
+
+	assert.Error(t, (&TaxRate{Country: "AT", Rate: 10001}).Validate())
+	assert.Error(t, (&TaxRate{Country: "AT", Category: TaxCategoryExempt, Rate: 0}).Validate())
+	assert.ErrorIs(t, (&TaxRate{Country: "XX", Rate: 100}).Validate(), ErrBillingCountry)
+
+	assert.Equal(t, "20%", TaxRatePercent(2000))
+	assert.Equal(t, "5.5%", TaxRatePercent(550))
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// what attempts are counted for, each is throttled on its own
+const (
+	// passwords and two-factor codes of admin logins
+	ThrottleLogin = "login"
+	// password reset emails asked for
+	ThrottlePasswordReset = "password_reset"
+)
+
+// what attempts are counted by, an account is its email whether a user has it or not
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+// how long failures are remembered after the last one
+const ThrottleWindow = time.Hour
+
+// type for a key attempts are counted by
+type ThrottleKey struct {
+	Kind  string
+	Value string
+}
+
+// returns key of attempts for email
+func AccountKey(email string) ThrottleKey {
+	return ThrottleKey{Kind: ThrottleAccount, Value: strings.ToLower(strings.TrimSpace(email))}
+}
+
+// returns key of attempts from ip
+func IPKey(ip string) ThrottleKey {
+	return ThrottleKey{Kind: ThrottleIP, Value: ip}
+}
+
+// type for how attempts are slowed down: after free failures each one makes the next wait twice
+// as long up to maxDelay, and lockAfter failures lock the key out
+type throttlePolicy struct {
+	freeFailures int
+	lockAfter    int
+	maxDelay     time.Duration
+	lockout      time.Duration
+}
+
+// ips are shared by many users behind one network, so they get more tries than an account
+var throttlePolicies = map[string]map[string]throttlePolicy{
+	ThrottleLogin: {
+		ThrottleAccount: {freeFailures: 3, lockAfter: 10, maxDelay: time.Minute, lockout: 15 * time.Minute},
+		ThrottleIP:      {freeFailures: 20, lockAfter: 100, maxDelay: time.Minute, lockout: 15 * time.Minute},
+	},
+	ThrottlePasswordReset: {
+		ThrottleAccount: {freeFailures: 2, lockAfter: 5, maxDelay: 5 * time.Minute, lockout: time.Hour},
+		ThrottleIP:      {freeFailures: 10, lockAfter: 30, maxDelay: 5 * time.Minute, lockout: time.Hour},
+	},
+}
+
+// returns how long the next attempt has to wait after failures
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures >= p.lockAfter {
+		return p.lockout
+	}
+	if failures < p.freeFailures {
+		return 0
+	}
+
+	d := time.Second
+	for i := p.freeFailures; i < failures && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+
+	return d
+}
+
+// returns how long attempts of scope by any of keys have to wait, 0 when they may go ahead
+func (m *DBModel) ThrottleWait(scope string, keys ...ThrottleKey) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var wait time.Duration
+	for _, key := range keys {
+		var lockedUntil sql.NullTime
+		err := m.DB.QueryRowContext(ctx, `
+			select locked_until from auth_throttles
+			where scope = ? and kind = ? and throttle_key = ?
+		`, scope, key.Kind, key.Value).Scan(&lockedUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if lockedUntil.Valid {
+			if d := time.Until(lockedUntil.Time); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait, nil
+}
+
+// counts a failed attempt of scope against keys and makes the next one wait as their policies say
+func (m *DBModel) RecordFailure(scope string, keys ...ThrottleKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	now := time.Now()
+
+	// keys nobody has failed with for a while are forgotten
+	_, err = tx.ExecContext(ctx, `
+		delete from auth_throttles
+		where last_failure_at < ? and (locked_until is null or locked_until < ?)
+	`, now.Add(-ThrottleWindow), now)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		policy, ok := throttlePolicies[scope][key.Kind]
+		if !ok {
+			continue
+		}
+
+		// the row stays locked to this transaction, so instances count every failure
+		_, err = tx.ExecContext(ctx, `
+			insert into auth_throttles (scope, kind, throttle_key, failures, last_failure_at, created_at, updated_at)
+			values (?, ?, ?, 1, ?, ?, ?)
+			on duplicate key update failures = failures + 1, last_failure_at = ?, updated_at = ?
+		`, scope, key.Kind, key.Value, now, now, now, now, now)
+		if err != nil {
+			return err
+		}
+
+		var failures int
+		err = tx.QueryRowContext(ctx, `
+			select failures from auth_throttles
+			where scope = ? and kind = ? and throttle_key = ?
+		`, scope, key.Kind, key.Value).Scan(&failures)
+		if err != nil {
+			return err
+		}
+
+		if d := policy.delay(failures); d > 0 {
+			_, err = tx.ExecContext(ctx, `
+				update auth_throttles set locked_until = ?
+				where scope = ? and kind = ? and throttle_key = ?
+			`, now.Add(d), scope, key.Kind, key.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// forgets failed attempts of scope by key, after one succeeds
+func (m *DBModel) ClearFailures(scope string, key ThrottleKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		delete from auth_throttles where scope = ? and kind = ? and throttle_key = ?
+	`, scope, key.Kind, key.Value)
+
+	return err
+}
+
+// lifts lockouts and delays of the account with email, for admins to let a user back in
+func (m *DBModel) UnlockAccount(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	key := AccountKey(email)
+	_, err := m.DB.ExecContext(ctx, `
+		delete from auth_throttles where kind = ? and throttle_key = ?
+	`, key.Kind, key.Value)
+
+	return err
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ThrottlePolicyDelay(t *testing.T) {
+	policy := throttlePolicies[ThrottleLogin][ThrottleAccount]
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{9, time.Minute},
+		{10, 15 * time.Minute},
+		{50, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, policy.delay(tt.failures), "failures %d", tt.failures)
+	}
+}
+
+func Test_ThrottlePoliciesLockOut(t *testing.T) {
+	for scope, policies := range throttlePolicies {
+		for kind, policy := range policies {
+			assert.Less(t, policy.freeFailures, policy.lockAfter, "%s %s", scope, kind)
+			assert.GreaterOrEqual(t, policy.lockout, policy.maxDelay, "%s %s", scope, kind)
+		}
+	}
+}
+
+func Test_AccountKey(t *testing.T) {
+	// the same email typed differently is counted once
+	assert.Equal(t, AccountKey("admin@example.com"), AccountKey(" Admin@Example.com "))
+	assert.Equal(t, ThrottleAccount, AccountKey("admin@example.com").Kind)
+	assert.NotEqual(t, AccountKey("1.2.3.4"), IPKey("1.2.3.4"))
+}
@@ -2,63 +2,161 @@ package models
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base32"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
+// scopes limit what a token can be used for, the user's roles still decide what they may do
 const (
-	ScopeAuthentication = "authentication"
+	// tokens of logins, they can do everything the user may, including managing tokens
+	ScopeAuthentication      = "authentication"
+	ScopeReadSales           = "read-sales"
+	ScopeRefund              = "refund"
+	ScopeManageSubscriptions = "manage-subscriptions"
+	ScopeVirtualTerminal     = "virtual-terminal"
+	ScopeReadInventory       = "read-inventory"
+	ScopeManageCustomers     = "manage-customers"
+	ScopeManageCoupons       = "manage-coupons"
+	ScopeManageTaxRates      = "manage-tax-rates"
+	ScopeManageUsers         = "manage-users"
 )
 
+// longest a named api token lasts
+const MaxTokenTTL = 365 * 24 * time.Hour
+
+var (
+	ErrInvalidScope  = errors.New("token scope is not valid")
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+// type for scopes named tokens can be given
+type TokenScope struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+var tokenScopes = []TokenScope{
+	{Name: ScopeReadSales, Description: "View sales and subscriptions"},
+	{Name: ScopeRefund, Description: "Refund sales"},
+	{Name: ScopeManageSubscriptions, Description: "Cancel subscriptions and change their plan"},
+	{Name: ScopeVirtualTerminal, Description: "Charge cards with the virtual terminal"},
+	{Name: ScopeReadInventory, Description: "View stock movements"},
+	{Name: ScopeManageCustomers, Description: "Merge duplicate customers"},
+	{Name: ScopeManageCoupons, Description: "Create and edit coupons"},
+	{Name: ScopeManageTaxRates, Description: "Create and edit tax rates"},
+	{Name: ScopeManageUsers, Description: "Create and edit admin users"},
+}
+
+// returns scopes named tokens can be given, login tokens have ScopeAuthentication instead
+func TokenScopes() []TokenScope {
+	return tokenScopes
+}
+
+// checks scopes of a named token, they can't be empty or grant what only logins may
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: choose at least one", ErrInvalidScope)
+	}
+
+	for _, s := range scopes {
+		found := false
+		for _, ts := range tokenScopes {
+			if ts.Name == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %q", ErrInvalidScope, s)
+		}
+	}
+
+	return nil
+}
+
 // type for authentication tokens
 type Token struct {
-	PlainText string    `json:"token"`
-	UserID    int64     `json:"-"`
+	ID        int       `json:"id"`
+	PlainText string    `json:"token,omitempty"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
 	Hash      []byte    `json:"-"`
 	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Scopes    []string  `json:"scopes"`
+	// nil until the token is first used
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// email of the token's user, when tokens of all users are listed
+	Email string `json:"email,omitempty"`
+	// refresh token family of a login's access token, empty for named tokens
+	Family string `json:"-"`
+}
+
+// reports whether token may be used for scope, login tokens may be used for everything
+func (t *Token) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAuthentication {
+			return true
+		}
+	}
+
+	return false
 }
 
 // generates token that lasts for ttl, returns token and error
-func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
+func GenerateToken(userID int, ttl time.Duration, scopes ...string) (*Token, error) {
 	token := &Token{
 		UserID: int64(userID),
 		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		Scopes: scopes,
 	}
 
-	randomBytes := make([]byte, 16)
-
-	_, err := rand.Read(randomBytes)
+	var err error
+	token.PlainText, err = randomString(16)
 	if err != nil {
 		return nil, err
 	}
 
-	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 	hash := sha256.Sum256(([]byte(token.PlainText)))
 	token.Hash = hash[:]
 
 	return token, nil
 }
 
+// saves token next to the user's others, so logins on other devices stay logged in
 func (m *DBModel) InsertToken(t *Token, u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `delete from tokens where user_id = ?`
-	_, err := m.DB.ExecContext(ctx, query, u.ID)
+	return insertToken(ctx, m.DB, t, u)
+}
+
+// inserts token with db or an open transaction
+func insertToken(ctx context.Context, db interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, t *Token, u User) error {
+	// expired tokens are of no use, they are cleared when the user gets a new one
+	query := `delete from tokens where user_id = ? and expiry < ?`
+	_, err := db.ExecContext(ctx, query, u.ID, time.Now())
 	if err != nil {
 		return err
 	}
 
-	query = `insert into tokens (user_id, name, email, token_hash, expiry, created_at, updated_at) values (?, ?, ?, ?, ?, ?, ?)`
-	_, err = m.DB.ExecContext(ctx, query,
+	query = `
+		insert into tokens (user_id, name, email, token_hash, scopes, family, expiry, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := db.ExecContext(ctx, query,
 		u.ID,
-		u.LastName,
+		t.Name,
 		u.Email,
 		t.Hash,
+		strings.Join(t.Scopes, ","),
+		t.Family,
 		t.Expiry,
 		time.Now(),
 		time.Now(),
@@ -68,20 +166,32 @@ func (m *DBModel) InsertToken(t *Token, u User) error {
 		return err
 	}
 
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.ID = int(id)
+	t.CreatedAt = time.Now()
+
 	return nil
 }
 
-func (m *DBModel) GetUserForToken(token string) (*User, error) {
+// gets user of unexpired token with the token
+func (m *DBModel) GetUserForToken(token string) (*User, *Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	tokenHash := sha256.Sum256([]byte(token))
 
 	var user User
+	var t Token
+	var scopes string
+	var lastUsed sql.NullTime
 
 	query := `
 		select
-			u.id, u.first_name, u.last_name, u.email
+			u.id, u.first_name, u.last_name, u.email, u.totp_enabled, ` + twoFactorRequiredSQL + `,
+			t.id, t.name, t.scopes, t.expiry, t.last_used_at, t.created_at
 		from
 			users u
 			inner join tokens t on (u.id = t.user_id)
@@ -95,10 +205,177 @@ func (m *DBModel) GetUserForToken(token string) (*User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&user.TwoFactorEnabled,
+		&user.TwoFactorRequired,
+		&t.ID,
+		&t.Name,
+		&scopes,
+		&t.Expiry,
+		&lastUsed,
+		&t.CreatedAt,
 	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.UserID = int64(user.ID)
+	t.Scopes = splitScopes(scopes)
+	if lastUsed.Valid {
+		t.LastUsedAt = &lastUsed.Time
+	}
+
+	return &user, &t, nil
+}
+
+// returns scopes stored comma separated
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return nil
+	}
+
+	return strings.Split(scopes, ",")
+}
+
+// records token was used, at most once a minute so requests don't all write
+func (m *DBModel) TouchToken(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := m.DB.ExecContext(ctx, `
+		update tokens set last_used_at = ?
+		where id = ? and (last_used_at is null or last_used_at < ?)
+	`, now, id, now.Add(-time.Minute))
+
+	return err
+}
+
+// gets unexpired tokens of user, all users' when userID is 0
+func (m *DBModel) GetActiveTokens(userID int) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			t.id, t.user_id, t.name, u.email, t.scopes, t.expiry, t.last_used_at, t.created_at
+		from
+			tokens t
+			inner join users u on (t.user_id = u.id)
+		where
+			t.expiry > ?
+			and (? = 0 or t.user_id = ?)
+		order by
+			t.created_at desc
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now(), userID, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	var tokens []*Token
+	for rows.Next() {
+		var t Token
+		var scopes string
+		var lastUsed sql.NullTime
+
+		err = rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&t.Email,
+			&scopes,
+			&t.Expiry,
+			&lastUsed,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Scopes = splitScopes(scopes)
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+		tokens = append(tokens, &t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// deletes token, only one of user unless userID is 0, ErrTokenNotFound when there is none. A
+// login's refresh tokens go with it, so the login can't get a new token
+func (m *DBModel) RevokeToken(id, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var family string
+	err = tx.QueryRowContext(ctx, `
+		select family from tokens where id = ? and (? = 0 or user_id = ?)
+	`, id, userID, userID).Scan(&family)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `delete from tokens where id = ?`, id); err != nil {
+		return err
+	}
+
+	if family != "" {
+		if err = revokeTokenFamily(ctx, tx, family); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deletes all tokens of user but the one with id keepID, returns how many were revoked
+func (m *DBModel) RevokeAllTokens(userID, keepID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// the kept login goes on refreshing its token
+	_, err = tx.ExecContext(ctx, `
+		delete from refresh_tokens
+		where user_id = ?
+			and family not in (select family from tokens where id = ?)
+	`, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		delete from tokens where user_id = ? and id <> ?
+	`, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
 
-	return &user, nil
+	return int(n), tx.Commit()
 }
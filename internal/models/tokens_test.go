@@ -0,0 +1,36 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TokenAllows(t *testing.T) {
+	login, err := GenerateToken(1, time.Hour, ScopeAuthentication)
+	assert.NoError(t, err)
+	assert.Len(t, login.PlainText, 26)
+	assert.True(t, login.Allows(ScopeRefund))
+	assert.True(t, login.Allows(ScopeAuthentication))
+
+	script, err := GenerateToken(1, time.Hour, ScopeReadSales, ScopeReadInventory)
+	assert.NoError(t, err)
+	assert.True(t, script.Allows(ScopeReadSales))
+	assert.False(t, script.Allows(ScopeRefund))
+	// named tokens can't manage tokens
+	assert.False(t, script.Allows(ScopeAuthentication))
+}
+
+func Test_ValidateScopes(t *testing.T) {
+	assert.NoError(t, ValidateScopes([]string{ScopeReadSales, ScopeRefund}))
+
+	assert.ErrorIs(t, ValidateScopes(nil), ErrInvalidScope)
+	assert.ErrorIs(t, ValidateScopes([]string{ScopeAuthentication}), ErrInvalidScope)
+	assert.ErrorIs(t, ValidateScopes([]string{"everything"}), ErrInvalidScope)
+}
+
+func Test_SplitScopes(t *testing.T) {
+	assert.Nil(t, splitScopes(""))
+	assert.Equal(t, []string{ScopeReadSales, ScopeRefund}, splitScopes("read-sales,refund"))
+}
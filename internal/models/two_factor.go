@@ -0,0 +1,367 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"go-stripe/internal/totp"
+	"strings"
+	"time"
+)
+
+const (
+	// how many recovery codes a user gets, each works once
+	RecoveryCodeCount = 10
+	// how long the second step of a login may take
+	LoginChallengeTTL = 5 * time.Minute
+	// wrong codes a login challenge takes before it is thrown away
+	MaxChallengeAttempts = 5
+)
+
+var (
+	ErrTwoFactorRequired = errors.New("two-factor authentication is required by your role")
+	ErrChallengeInvalid  = errors.New("login challenge is not valid")
+)
+
+// type for a user's two-factor authentication, secret is encrypted by the caller
+type TwoFactor struct {
+	UserID  int
+	Secret  string
+	Enabled bool
+	// one of the user's roles requires two-factor authentication
+	Required          bool
+	LastStep          int64
+	RecoveryCodesLeft int
+}
+
+// reports whether user has to set up two-factor authentication before doing anything else
+func (tf TwoFactor) SetupRequired() bool {
+	return tf.Required && !tf.Enabled
+}
+
+// sql of whether one of the roles of the user u requires two-factor authentication
+const twoFactorRequiredSQL = `exists (
+	select 1
+	from user_roles ur
+		inner join roles r on (ur.role_id = r.id)
+	where ur.user_id = u.id and r.require_two_factor = 1
+)`
+
+// gets two-factor authentication of user
+func (m *DBModel) GetTwoFactor(userID int) (TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tf := TwoFactor{UserID: userID}
+
+	err := m.DB.QueryRowContext(ctx, `
+		select
+			u.totp_secret, u.totp_enabled, u.totp_last_step, `+twoFactorRequiredSQL+`,
+			(select count(id) from recovery_codes where user_id = u.id and used_at is null)
+		from
+			users u
+		where
+			u.id = ?
+	`, userID).Scan(&tf.Secret, &tf.Enabled, &tf.LastStep, &tf.Required, &tf.RecoveryCodesLeft)
+
+	return tf, err
+}
+
+// turns on two-factor authentication of user with encrypted secret, whose code for step was just
+// entered, and replaces the user's recovery codes
+func (m *DBModel) EnableTwoFactor(userID int, secret string, step int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, `
+		update users
+		set totp_secret = ?, totp_enabled = 1, totp_last_step = ?, updated_at = ?
+		where id = ?
+	`, secret, step, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// turns off two-factor authentication of user, ErrTwoFactorRequired when a role requires it
+func (m *DBModel) DisableTwoFactor(userID int) error {
+	tf, err := m.GetTwoFactor(userID)
+	if err != nil {
+		return err
+	}
+	if tf.Required {
+		return ErrTwoFactorRequired
+	}
+
+	return m.ResetTwoFactor(userID)
+}
+
+// turns off two-factor authentication of user who lost their codes, they set it up again when
+// their role requires it
+func (m *DBModel) ResetTwoFactor(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, `
+		update users
+		set totp_secret = '', totp_enabled = 0, totp_last_step = 0, updated_at = ?
+		where id = ?
+	`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaces recovery codes of user, the old ones stop working
+func (m *DBModel) ReplaceRecoveryCodes(userID int, codes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, codes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaces recovery codes of user within an open db transaction, only their hashes are kept
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codes []string) error {
+	if _, err := tx.ExecContext(ctx, `delete from recovery_codes where user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		_, err := tx.ExecContext(ctx, `
+			insert into recovery_codes (user_id, code_hash, created_at, updated_at)
+			values (?, ?, ?, ?)
+		`, userID, hashRecoveryCode(code), time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// records code of time step was used by user, false when it or a later one already was so a
+// code works once
+func (m *DBModel) UseTOTPStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		update users set totp_last_step = ? where id = ? and totp_last_step < ?
+	`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n == 1, err
+}
+
+// uses up recovery code of user, false when it isn't one of theirs or was used
+func (m *DBModel) UseRecoveryCode(userID int, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		update recovery_codes set used_at = ?, updated_at = ?
+		where user_id = ? and code_hash = ? and used_at is null
+	`, time.Now(), time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n == 1, err
+}
+
+// checks code of user with two-factor authentication turned on, either a code of their app for
+// the decrypted secret or one of their recovery codes. Either works once
+func (m *DBModel) CheckTwoFactorCode(userID int, secret, code string) (bool, error) {
+	if IsRecoveryCode(code) {
+		return m.UseRecoveryCode(userID, code)
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return m.UseTOTPStep(userID, step)
+}
+
+// returns new recovery codes, e.g. "k3m9q-2hx7d"
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		s, err := randomString(7)
+		if err != nil {
+			return nil, err
+		}
+		s = strings.ToLower(s[:10])
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+
+	return codes, nil
+}
+
+// reports whether code looks like a recovery code rather than a code of an app
+func IsRecoveryCode(code string) bool {
+	return len(normalizeRecoveryCode(code)) == 10
+}
+
+// returns code without what users add or change typing it
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hash[:]
+}
+
+// type for the second step of a login, between the password and a code
+type LoginChallenge struct {
+	ID       int
+	UserID   int
+	Attempts int
+}
+
+// starts second step of a login of user, returns the challenge the code is sent with
+func (m *DBModel) CreateLoginChallenge(userID int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	plainText, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(plainText))
+
+	_, err = m.DB.ExecContext(ctx, `delete from login_challenges where user_id = ? and expiry < ?`, userID, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `
+		insert into login_challenges (user_id, token_hash, expiry, created_at, updated_at)
+		values (?, ?, ?, ?, ?)
+	`, userID, hash[:], time.Now().Add(LoginChallengeTTL), time.Now(), time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+// gets unexpired login challenge that is still waiting for its code, ErrChallengeInvalid otherwise
+func (m *DBModel) GetLoginChallenge(plainText string) (LoginChallenge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(plainText))
+
+	var c LoginChallenge
+	err := m.DB.QueryRowContext(ctx, `
+		select id, user_id, attempts
+		from login_challenges
+		where token_hash = ? and expiry > ? and verified_at is null and attempts < ?
+	`, hash[:], time.Now(), MaxChallengeAttempts).Scan(&c.ID, &c.UserID, &c.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, ErrChallengeInvalid
+	}
+
+	return c, err
+}
+
+// counts a wrong code against login challenge
+func (m *DBModel) FailLoginChallenge(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		update login_challenges set attempts = attempts + 1, updated_at = ? where id = ?
+	`, time.Now(), id)
+
+	return err
+}
+
+// marks login challenge as passed, the website login finishes with it
+func (m *DBModel) VerifyLoginChallenge(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		update login_challenges set verified_at = ?, updated_at = ? where id = ?
+	`, time.Now(), time.Now(), id)
+
+	return err
+}
+
+// uses up passed login challenge of user, ErrChallengeInvalid when there is none
+func (m *DBModel) ConsumeLoginChallenge(userID int, plainText string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(plainText))
+
+	result, err := m.DB.ExecContext(ctx, `
+		delete from login_challenges
+		where user_id = ? and token_hash = ? and expiry > ? and verified_at is not null
+	`, userID, hash[:], time.Now())
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrChallengeInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes()
+	assert.NoError(t, err)
+	assert.Len(t, codes, RecoveryCodeCount)
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		assert.Regexp(t, regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`), code)
+		assert.True(t, IsRecoveryCode(code))
+		assert.False(t, seen[code])
+		seen[code] = true
+	}
+}
+
+func Test_RecoveryCodeTyping(t *testing.T) {
+	// codes typed in capitals, without the dash or with spaces are the same code
+	assert.Equal(t, hashRecoveryCode("k3m9q-2hx7d"), hashRecoveryCode("K3M9Q2HX7D"))
+	assert.Equal(t, hashRecoveryCode("k3m9q-2hx7d"), hashRecoveryCode(" k3m9q 2hx7d "))
+	assert.NotEqual(t, hashRecoveryCode("k3m9q-2hx7d"), hashRecoveryCode("k3m9q-2hx7e"))
+
+	// codes of apps are never taken for recovery codes
+	assert.False(t, IsRecoveryCode("123456"))
+	assert.False(t, IsRecoveryCode("123 456"))
+}
+
+func Test_TwoFactorSetupRequired(t *testing.T) {
+	assert.True(t, TwoFactor{Required: true}.SetupRequired())
+	assert.False(t, TwoFactor{Required: true, Enabled: true}.SetupRequired())
+	assert.False(t, TwoFactor{}.SetupRequired())
+}
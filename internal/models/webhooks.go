@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// how long a delivery has to process its event before a redelivery can take the event over
+const WebhookEventLease = 5 * time.Minute
+
+// states of a webhook event when a delivery tries to claim it
+const (
+	WebhookEventClaimed    = "claimed"
+	WebhookEventInProgress = "in_progress"
+	WebhookEventProcessed  = "processed"
+)
+
+// type for webhook events, in progress until ProcessedAt is set
+type WebhookEvent struct {
+	ID          int          `json:"id"`
+	EventID     string       `json:"event_id"`
+	EventType   string       `json:"event_type"`
+	LockedUntil sql.NullTime `json:"-"`
+	ProcessedAt sql.NullTime `json:"-"`
+	CreatedAt   time.Time    `json:"-"`
+	UpdatedAt   time.Time    `json:"-"`
+}
+
+// claims webhook event for WebhookEventLease, taking over an event whose earlier delivery didn't
+// finish in time, returns WebhookEventClaimed or the state that kept it from being claimed
+func (m *DBModel) ClaimWebhookEvent(eventID, eventType string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	// one row is affected by an insert, two by an update that took the event over, none otherwise
+	query := `
+		insert into webhook_events
+			(event_id, event_type, locked_until, created_at, updated_at)
+		values (?, ?, ?, ?, ?)
+		on duplicate key update
+			updated_at = if(processed_at is null and locked_until < ?, values(updated_at), updated_at),
+			locked_until = if(processed_at is null and locked_until < ?, values(locked_until), locked_until)
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, eventID, eventType, now.Add(WebhookEventLease), now, now, now, now)
+	if err != nil {
+		return "", err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rows > 0 {
+		return WebhookEventClaimed, nil
+	}
+
+	var processedAt sql.NullTime
+	err = m.DB.QueryRowContext(ctx, `select processed_at from webhook_events where event_id = ?`, eventID).Scan(&processedAt)
+	if err != nil {
+		return "", err
+	}
+	if processedAt.Valid {
+		return WebhookEventProcessed, nil
+	}
+
+	return WebhookEventInProgress, nil
+}
+
+// marks claimed webhook event processed, once its handler finished
+func (m *DBModel) MarkWebhookEventProcessed(eventID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update webhook_events set processed_at = ?, locked_until = null, updated_at = ? where event_id = ?`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), time.Now(), eventID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// removes webhook event so it can be processed again when redelivered
+func (m *DBModel) DeleteWebhookEvent(eventID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `delete from webhook_events where event_id = ? and processed_at is null`
+
+	_, err := m.DB.ExecContext(ctx, query, eventID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+package money
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-stripe/internal/currency"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+	ErrInvalidRatios    = errors.New("ratios must not be negative and must not all be zero")
+)
+
+// type for an amount in minor units of its currency, e.g. cents of EUR or yen of JPY.
+// The zero value is zero in no currency and can be added to amounts in any currency
+type Money struct {
+	amount   int64
+	currency string
+}
+
+// returns amount in minor units of a supported currency
+func New(amount int64, code string) (Money, error) {
+	c, err := currency.Get(code)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return Money{amount: amount, currency: c.Code}, nil
+}
+
+// returns amount in currency code as it was stored, e.g. read from an amount column
+// of a table that keeps the currency elsewhere. The code isn't checked and nothing is converted
+func (m Money) In(code string) Money {
+	return Money{amount: m.amount, currency: strings.ToLower(strings.TrimSpace(code))}
+}
+
+// returns amount in minor units
+func (m Money) Amount() int64 {
+	return m.amount
+}
+
+// returns lower case ISO code of the currency, empty for the zero value
+func (m Money) Currency() string {
+	return m.currency
+}
+
+func (m Money) IsZero() bool {
+	return m.amount == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.amount > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.amount < 0
+}
+
+// returns currency of an operation on m and o, amounts without a currency take the other's
+func (m Money) common(o Money) (string, error) {
+	switch {
+	case m.currency == o.currency || o.currency == "":
+		return m.currency, nil
+	case m.currency == "":
+		return o.currency, nil
+	}
+
+	return "", fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, strings.ToUpper(m.currency), strings.ToUpper(o.currency))
+}
+
+// returns m + o
+func (m Money) Add(o Money) (Money, error) {
+	code, err := m.common(o)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return Money{amount: m.amount + o.amount, currency: code}, nil
+}
+
+// returns m - o
+func (m Money) Sub(o Money) (Money, error) {
+	return m.Add(o.Neg())
+}
+
+// returns m times n, e.g. unit price times quantity
+func (m Money) Mul(n int64) Money {
+	return Money{amount: m.amount * n, currency: m.currency}
+}
+
+// returns -m
+func (m Money) Neg() Money {
+	return Money{amount: -m.amount, currency: m.currency}
+}
+
+// returns percent of m rounded toward zero, so it never exceeds the exact percentage
+func (m Money) Percent(percent int64) Money {
+	return Money{amount: m.amount * percent / 100, currency: m.currency}
+}
+
+// returns m times num divided by den rounded half away from zero, e.g. tax at a rate
+// in basis points. Den must be positive
+func (m Money) Portion(num, den int64) Money {
+	p := m.amount * num
+	q, r := p/den, p%den
+	if r < 0 {
+		r = -r
+	}
+	if 2*r >= den {
+		if p < 0 {
+			q--
+		} else {
+			q++
+		}
+	}
+
+	return Money{amount: q, currency: m.currency}
+}
+
+// compares m with o, returns -1 when m is less, 0 when equal and 1 when greater
+func (m Money) Cmp(o Money) (int, error) {
+	if _, err := m.common(o); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case m.amount < o.amount:
+		return -1, nil
+	case m.amount > o.amount:
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// reports whether m and o are the same amount in the same currency
+func (m Money) Equal(o Money) bool {
+	c, err := m.Cmp(o)
+	return err == nil && c == 0
+}
+
+// adds up amounts in the same currency
+func Sum(amounts ...Money) (Money, error) {
+	var total Money
+	for _, a := range amounts {
+		var err error
+		if total, err = total.Add(a); err != nil {
+			return Money{}, err
+		}
+	}
+
+	return total, nil
+}
+
+// splits m into parts in proportion to ratios, e.g. a discount or tax over order lines.
+// Parts add up to m exactly, minor units left over from rounding go one each
+// to the parts with the largest remainders, earlier parts first on a tie
+func (m Money) Allocate(ratios ...int64) ([]Money, error) {
+	var total int64
+	for _, r := range ratios {
+		if r < 0 {
+			return nil, ErrInvalidRatios
+		}
+		total += r
+	}
+	if total == 0 {
+		return nil, ErrInvalidRatios
+	}
+
+	amount := m.amount
+	if amount < 0 {
+		amount = -amount
+	}
+
+	parts := make([]Money, len(ratios))
+	remainders := make([]int64, len(ratios))
+	left := amount
+	for i, r := range ratios {
+		parts[i] = Money{amount: amount * r / total, currency: m.currency}
+		remainders[i] = amount * r % total
+		left -= parts[i].amount
+	}
+
+	order := make([]int, len(ratios))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+
+	for i := int64(0); i < left; i++ {
+		parts[order[i]].amount++
+	}
+
+	if m.amount < 0 {
+		for i := range parts {
+			parts[i] = parts[i].Neg()
+		}
+	}
+
+	return parts, nil
+}
+
+// splits m into n parts that differ by at most one minor unit
+func (m Money) Split(n int) ([]Money, error) {
+	if n <= 0 {
+		return nil, ErrInvalidRatios
+	}
+
+	ratios := make([]int64, n)
+	for i := range ratios {
+		ratios[i] = 1
+	}
+
+	return m.Allocate(ratios...)
+}
+
+// formats m the way locale writes amounts, e.g. "10,50 €" for sk-SK
+func (m Money) Format(locale string) string {
+	return currency.Format(int(m.amount), m.currency, locale)
+}
+
+// returns m for logs and error messages, e.g. "10.50 EUR" or "1500 JPY"
+func (m Money) String() string {
+	digits := 2
+	if c, err := currency.Get(m.currency); err == nil {
+		digits = c.Digits
+	}
+
+	sign, amount := "", m.amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	number := strconv.FormatInt(amount, 10)
+	if digits > 0 {
+		for len(number) <= digits {
+			number = "0" + number
+		}
+		number = number[:len(number)-digits] + "." + number[len(number)-digits:]
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%s%s %s", sign, number, strings.ToUpper(m.currency)))
+}
+
+// type for money in JSON and gob
+type jsonMoney struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// writes m as {"amount": 1050, "currency": "eur"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMoney{Amount: m.amount, Currency: m.currency})
+}
+
+// reads m from {"amount": 1050, "currency": "eur"}, the currency must be supported
+// unless the amount is zero
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var j jsonMoney
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	if j.Currency == "" && j.Amount == 0 {
+		*m = Money{}
+		return nil
+	}
+
+	parsed, err := New(j.Amount, j.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+
+	return nil
+}
+
+// writes m for gob, e.g. in session data
+func (m Money) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(jsonMoney{Amount: m.amount, Currency: m.currency}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// reads m written by GobEncode
+func (m *Money) GobDecode(data []byte) error {
+	var g jsonMoney
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	*m = Money{amount: g.Amount, currency: g.Currency}
+
+	return nil
+}
+
+// writes amount in minor units to an amount column, the currency is written separately
+func (m Money) Value() (driver.Value, error) {
+	return m.amount, nil
+}
+
+// reads amount in minor units from an amount column, the currency is kept,
+// read it with CurrencyColumn or set it with In
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		m.amount = 0
+	case int64:
+		m.amount = v
+	case []byte:
+		return m.Scan(string(v))
+	case string:
+		amount, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("money: cannot scan %q as amount: %w", v, err)
+		}
+		m.amount = amount
+	default:
+		return fmt.Errorf("money: cannot scan %T as amount", src)
+	}
+
+	return nil
+}
+
+// type for reading the currency column of money
+type currencyColumn struct {
+	m *Money
+}
+
+func (c currencyColumn) Scan(src any) error {
+	var code sql.NullString
+	if err := code.Scan(src); err != nil {
+		return err
+	}
+
+	*c.m = c.m.In(code.String)
+
+	return nil
+}
+
+// returns scan destination for the currency column kept next to the amount column of m
+func (m *Money) CurrencyColumn() sql.Scanner {
+	return currencyColumn{m: m}
+}
@@ -0,0 +1,137 @@
+package money
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"go-stripe/internal/currency"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func eur(amount int64) Money {
+	return Money{amount: amount, currency: "eur"}
+}
+
+func Test_New(t *testing.T) {
+	m, err := New(1500, " JPY ")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500), m.Amount())
+	assert.Equal(t, "jpy", m.Currency())
+
+	_, err = New(100, "xyz")
+	assert.ErrorIs(t, err, currency.ErrUnsupported)
+}
+
+func Test_Arithmetic(t *testing.T) {
+	sum, err := eur(1050).Add(eur(250))
+	assert.NoError(t, err)
+	assert.Equal(t, eur(1300), sum)
+
+	diff, err := eur(1050).Sub(eur(2000))
+	assert.NoError(t, err)
+	assert.True(t, diff.IsNegative())
+	assert.Equal(t, eur(-950), diff)
+
+	// the zero value takes the currency of what it is added to
+	sum, err = Money{}.Add(eur(5))
+	assert.NoError(t, err)
+	assert.Equal(t, eur(5), sum)
+
+	_, err = eur(100).Add(Money{amount: 100, currency: "usd"})
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+
+	assert.Equal(t, eur(3000), eur(1000).Mul(3))
+	assert.Equal(t, eur(99), eur(999).Percent(10))
+	assert.Equal(t, eur(200), eur(1000).Portion(2000, 10000))
+	assert.Equal(t, eur(167), eur(1000).Portion(2000, 12000))
+	assert.Equal(t, eur(-167), eur(-1000).Portion(2000, 12000))
+	assert.Equal(t, eur(1), eur(5).Portion(1, 10))
+
+	total, err := Sum(eur(1), eur(2), Money{}, eur(3))
+	assert.NoError(t, err)
+	assert.Equal(t, eur(6), total)
+
+	c, err := eur(1).Cmp(eur(2))
+	assert.NoError(t, err)
+	assert.Equal(t, -1, c)
+	assert.True(t, eur(2).Equal(eur(2)))
+	assert.False(t, eur(2).Equal(Money{amount: 2, currency: "gbp"}))
+}
+
+func Test_Allocate(t *testing.T) {
+	parts, err := eur(1001).Allocate(1000, 500, 500)
+	assert.NoError(t, err)
+	assert.Equal(t, []Money{eur(501), eur(250), eur(250)}, parts)
+
+	parts, err = eur(-100).Allocate(1, 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Money{eur(-34), eur(-33), eur(-33)}, parts)
+
+	parts, err = eur(10).Allocate(0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []Money{eur(0), eur(10)}, parts)
+
+	_, err = eur(10).Allocate(0, 0)
+	assert.ErrorIs(t, err, ErrInvalidRatios)
+	_, err = eur(10).Allocate(-1, 2)
+	assert.ErrorIs(t, err, ErrInvalidRatios)
+
+	parts, err = eur(5).Split(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []Money{eur(3), eur(2)}, parts)
+}
+
+func Test_Format(t *testing.T) {
+	assert.Equal(t, "10,50 €", eur(1050).Format("sk-SK"))
+	assert.Equal(t, "¥1,500", Money{amount: 1500, currency: "jpy"}.Format("ja-JP"))
+
+	assert.Equal(t, "10.50 EUR", eur(1050).String())
+	assert.Equal(t, "-0.05 EUR", eur(-5).String())
+	assert.Equal(t, "1500 JPY", Money{amount: 1500, currency: "jpy"}.String())
+}
+
+func Test_JSON(t *testing.T) {
+	out, err := json.Marshal(struct {
+		Amount Money `json:"amount"`
+	}{eur(1050)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount": {"amount": 1050, "currency": "eur"}}`, string(out))
+
+	var m Money
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 1500, "currency": "JPY"}`), &m))
+	assert.Equal(t, Money{amount: 1500, currency: "jpy"}, m)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 0}`), &m))
+	assert.Equal(t, Money{}, m)
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"amount": 100, "currency": "xyz"}`), &m), currency.ErrUnsupported)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"amount": 100}`), &m), currency.ErrUnsupported)
+}
+
+func Test_Gob(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&buf).Encode(struct{ Amount Money }{eur(1050)}))
+
+	var out struct{ Amount Money }
+	assert.NoError(t, gob.NewDecoder(&buf).Decode(&out))
+	assert.Equal(t, eur(1050), out.Amount)
+}
+
+func Test_SQL(t *testing.T) {
+	v, err := eur(1050).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1050), v)
+
+	var m Money
+	assert.NoError(t, m.Scan(int64(1050)))
+	assert.NoError(t, m.CurrencyColumn().Scan([]byte("EUR")))
+	assert.Equal(t, eur(1050), m)
+
+	// the currency is kept when only the amount is read
+	assert.NoError(t, m.Scan([]byte("20")))
+	assert.Equal(t, eur(20), m)
+
+	assert.Error(t, m.Scan(1.5))
+}